@@ -0,0 +1,295 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package budget bounds the number of llama invocations in flight
+// at once across every process on a machine.
+//
+// A Budget is a directory of lock files, shared by every process
+// that opens it. Each of Max slot files, slot-0, slot-1, and so on,
+// is held (with flock(2)) by the process running an invocation in
+// that slot. Processes waiting for a slot take a numbered ticket,
+// and hold a lock on a queue file named after it; only the holder
+// of the lowest live ticket may take a free slot, so that waiters
+// are served in the order they arrived. Locks are released when
+// their holder exits, so a process that dies holding a slot or a
+// place in the queue doesn't leak it.
+package budget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PollInterval is how often waiters check whether they've reached
+// the head of the queue, and the head whether a slot has freed up
+const PollInterval = 20 * time.Millisecond
+
+// DefaultTimeout is the Timeout of newly opened budgets
+const DefaultTimeout = 10 * time.Minute
+
+// ErrTimeout is matched, with errors.Is, by the errors Acquire
+// returns when it times out
+var ErrTimeout = errors.New("waited too long for an invocation slot")
+
+// TimeoutError reports that Acquire gave up waiting for a slot
+type TimeoutError struct {
+	Waited time.Duration
+	Max    int
+	// Queued is the number of processes that were waiting
+	// along with this one, including it
+	Queued int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s: all %d slots were busy for %s, with %d jobs queued",
+		ErrTimeout.Error(), e.Max, e.Waited.Round(time.Millisecond), e.Queued)
+}
+
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+type Budget struct {
+	dir string
+	// Max is the number of invocations allowed at once.
+	// Processes sharing a budget may disagree about it; each
+	// only uses the first Max slots.
+	Max int
+	// Timeout bounds how long Acquire waits for a slot. If it
+	// is zero, Acquire waits as long as its context allows.
+	Timeout time.Duration
+}
+
+// Open returns the budget whose lock files live in `dir`, allowing
+// `max` invocations at once, with a Timeout of DefaultTimeout
+func Open(dir string, max int) (*Budget, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("budget: max must be positive, not %d", max)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Budget{dir: dir, Max: max, Timeout: DefaultTimeout}, nil
+}
+
+// Dir returns the directory holding the budget's lock files
+func (b *Budget) Dir() string {
+	return b.dir
+}
+
+// A Slot is the right to run one invocation. It must be released
+// when the invocation finishes.
+type Slot struct {
+	f *os.File
+	// Index is the slot's number, from 0 to Max-1
+	Index int
+	// Waited is how long Acquire waited for the slot
+	Waited time.Duration
+}
+
+// Release frees the slot for the next waiter
+func (s *Slot) Release() error {
+	return s.f.Close()
+}
+
+// Acquire waits for a free slot, behind any processes that started
+// waiting first. It fails with a *TimeoutError if b.Timeout passes
+// first, or with ctx.Err() if `ctx` is done.
+func (b *Budget) Acquire(ctx context.Context) (*Slot, error) {
+	start := time.Now()
+	ticket, name, err := b.enqueue()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		os.Remove(path.Join(b.dir, name))
+		ticket.Close()
+	}()
+
+	var deadline <-chan time.Time
+	if b.Timeout > 0 {
+		timer := time.NewTimer(b.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	for {
+		queue, err := b.queue()
+		if err != nil {
+			return nil, err
+		}
+		if len(queue) > 0 && queue[0] == name {
+			if slot, err := b.trySlot(); err != nil || slot != nil {
+				if slot != nil {
+					slot.Waited = time.Since(start)
+				}
+				return slot, err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return nil, &TimeoutError{Waited: time.Since(start), Max: b.Max, Queued: len(queue)}
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// Status describes a budget's current use
+type Status struct {
+	Max    int `json:"max"`
+	InUse  int `json:"in_use"`
+	Queued int `json:"queued"`
+}
+
+// Status counts the slots in use and the processes waiting for one
+func (b *Budget) Status() (Status, error) {
+	st := Status{Max: b.Max}
+	for i := 0; i < b.Max; i++ {
+		f, ok, err := tryLock(b.slotPath(i), true)
+		if err != nil {
+			return st, err
+		}
+		if ok {
+			f.Close()
+		} else {
+			st.InUse++
+		}
+	}
+	queue, err := b.queue()
+	st.Queued = len(queue)
+	return st, err
+}
+
+func (b *Budget) slotPath(i int) string {
+	return path.Join(b.dir, "slot-"+strconv.Itoa(i))
+}
+
+// trySlot takes a free slot, if there is one
+func (b *Budget) trySlot() (*Slot, error) {
+	for i := 0; i < b.Max; i++ {
+		f, ok, err := tryLock(b.slotPath(i), true)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return &Slot{f: f, Index: i}, nil
+		}
+	}
+	return nil, nil
+}
+
+// enqueue takes the next ticket, returning its locked queue file
+// and the file's name
+func (b *Budget) enqueue() (*os.File, string, error) {
+	state, err := os.OpenFile(path.Join(b.dir, "next"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, "", err
+	}
+	defer state.Close()
+	if err := syscall.Flock(int(state.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, "", err
+	}
+	buf, err := ioutil.ReadAll(state)
+	if err != nil {
+		return nil, "", err
+	}
+	next, _ := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	name := fmt.Sprintf("q-%020d", next)
+
+	// The queue file is created and locked under a temporary
+	// name, so that no one sees it unlocked and takes it for the
+	// leftovers of a dead process.
+	tmp := path.Join(b.dir, "tmp-"+name)
+	f, ok, err := tryLock(tmp, true)
+	if err == nil && !ok {
+		err = fmt.Errorf("budget: %s is locked", tmp)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Rename(tmp, path.Join(b.dir, name)); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, "", err
+	}
+	if _, err := state.WriteAt([]byte(strconv.FormatUint(next+1, 10)+"\n"), 0); err != nil {
+		f.Close()
+		os.Remove(path.Join(b.dir, name))
+		return nil, "", err
+	}
+	return f, name, nil
+}
+
+// queue returns the names of the queue files of live waiters, in
+// the order they arrived, removing those left by dead ones
+func (b *Budget) queue() ([]string, error) {
+	ents, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	var live []string
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), "q-") {
+			continue
+		}
+		p := path.Join(b.dir, ent.Name())
+		f, unlocked, err := tryLock(p, false)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if unlocked {
+			os.Remove(p)
+			f.Close()
+			continue
+		}
+		live = append(live, ent.Name())
+	}
+	sort.Strings(live)
+	return live, nil
+}
+
+// tryLock opens `p` and takes an exclusive lock on it, reporting
+// whether it was able to. The caller holds the lock until it closes
+// the returned file.
+func tryLock(p string, create bool) (*os.File, bool, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(p, flags, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return f, true, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package budget
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	b, err := Open(t.TempDir(), 2)
+	require.NoError(t, err)
+
+	s0, err := b.Acquire(ctx)
+	require.NoError(t, err)
+	s1, err := b.Acquire(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, s0.Index, s1.Index)
+
+	st, err := b.Status()
+	require.NoError(t, err)
+	assert.Equal(t, Status{Max: 2, InUse: 2}, st)
+
+	b.Timeout = 50 * time.Millisecond
+	_, err = b.Acquire(ctx)
+	assert.True(t, errors.Is(err, ErrTimeout), "err=%v", err)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.Timeout = 0
+	_, err = b.Acquire(cctx)
+	assert.Equal(t, context.Canceled, err)
+
+	require.NoError(t, s0.Release())
+	s2, err := b.Acquire(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, s0.Index, s2.Index)
+	s1.Release()
+	s2.Release()
+}
+
+func TestAcquire_FIFO(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	b, err := Open(dir, 1)
+	require.NoError(t, err)
+
+	// The leftovers of a dead waiter shouldn't hold up the queue
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "q-00000000000000000000"), nil, 0644))
+
+	held, err := b.Acquire(ctx)
+	require.NoError(t, err)
+
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			slot, err := b.Acquire(ctx)
+			if err != nil {
+				order <- -1
+				return
+			}
+			order <- i
+			time.Sleep(5 * time.Millisecond)
+			slot.Release()
+		}(i)
+		// Wait for each waiter to join the queue before
+		// starting the next
+		require.Eventually(t, func() bool {
+			st, err := b.Status()
+			return err == nil && st.Queued == i+1
+		}, time.Second, time.Millisecond)
+	}
+	held.Release()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, i, <-order)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client runs commands on llama functions from Go programs.
+//
+// It packages up what the llama CLI does internally: a Client,
+// configured with a function and an object store, uploads a Job's
+// local input files, invokes the function, and writes the job's
+// outputs back to local files. The CLI is built on this package, so
+// a job run through a Client behaves as it would under `llama
+// invoke`.
+//
+// Lower-level control is available through the packages this one
+// wraps: llama.Invoke for invocations, and the files package for
+// moving files through the store.
+package client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/budget"
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/progress"
+	"github.com/nelhage/llama/protocol"
+	protocol_files "github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/storeurl"
+)
+
+// Config configures a Client
+type Config struct {
+	// Function names the Lambda function to invoke
+	Function string
+	// Router, if set, picks a function for each job instead;
+	// see llama.InvokeRouted. Function need not be set.
+	Router *llama.Router
+
+	// StoreURL names the object store, in any of the forms
+	// storeurl.Open accepts, e.g. s3://BUCKET/PATH. It is ignored
+	// if Store is set.
+	StoreURL string
+	// StoreReplicas are the URLs of replicas of the store, to
+	// read from if it is unavailable; see storeurl.OpenFailover
+	StoreReplicas []string
+	// Store, if set, is used instead of opening StoreURL
+	Store store.Store
+
+	// Session is used to talk to AWS. If it is nil, and one is
+	// needed, one is created from the environment, in Region if
+	// that is set.
+	Session *session.Session
+	Region  string
+	// Lambda, if set, is used to invoke the function instead of
+	// a client created from Session
+	Lambda *lambda.Lambda
+	// URL, if set, invokes the function through its function URL
+	// instead of the Lambda API; see llama.FunctionURL.
+	URL *llama.FunctionURL
+	// Budget, if set, is shared by the client's invocations; see
+	// llama.InvokeArgs.Budget.
+	Budget *budget.Budget
+	// Memoize reuses the results of identical Deterministic
+	// jobs; see llama.InvokeArgs.Memoize.
+	Memoize bool
+
+	// Upload and Fetch control how Run moves files through the
+	// store
+	Upload files.UploadOptions
+	Fetch  files.FetchOptions
+}
+
+// A Client invokes one function, or the functions of a Router. It
+// is safe for concurrent use.
+type Client struct {
+	cfg     Config
+	session *session.Session
+	lambda  *lambda.Lambda
+	store   store.Store
+}
+
+// New returns a Client for cfg.Function or cfg.Router
+func New(cfg Config) (*Client, error) {
+	if cfg.Function == "" && cfg.Router == nil {
+		return nil, errors.New("client: no function configured")
+	}
+	c := &Client{cfg: cfg, session: cfg.Session, lambda: cfg.Lambda, store: cfg.Store}
+	if c.session == nil && (c.lambda == nil || c.store == nil) {
+		awscfg := aws.NewConfig()
+		if cfg.Region != "" {
+			awscfg = awscfg.WithRegion(cfg.Region)
+		}
+		var err error
+		if c.session, err = session.NewSession(awscfg); err != nil {
+			return nil, err
+		}
+	}
+	if c.store == nil {
+		if cfg.StoreURL == "" {
+			return nil, errors.New("client: no object store configured")
+		}
+		var err error
+		if c.store, err = OpenStore(c.session, cfg.StoreURL, cfg.StoreReplicas...); err != nil {
+			return nil, err
+		}
+	}
+	if c.lambda == nil {
+		c.lambda = lambda.New(c.session)
+	}
+	return c, nil
+}
+
+// OpenStore opens the object store at `url` as the llama CLI does,
+// reading from `replicas` if it is unavailable. See storeurl.Open
+// for the URLs it accepts.
+func OpenStore(sess *session.Session, url string, replicas ...string) (store.Store, error) {
+	return storeurl.OpenFailover(context.Background(), append([]string{url}, replicas...), storeurl.Options{
+		Session:          sess,
+		DisableHeadCheck: true,
+	})
+}
+
+// Function returns the name of the function the client invokes
+func (c *Client) Function() string {
+	return c.cfg.Function
+}
+
+// Router returns the client's Router, or nil if it doesn't route
+// jobs
+func (c *Client) Router() *llama.Router {
+	return c.cfg.Router
+}
+
+// Store returns the client's object store
+func (c *Client) Store() store.Store {
+	return c.store
+}
+
+// Lambda returns the client the Client invokes the function with
+func (c *Client) Lambda() *lambda.Lambda {
+	return c.lambda
+}
+
+// Invoke runs `spec`, whose files must already be in the store, and
+// returns the function's response. A command that exits with a
+// non-zero status is not an error; a function that fails returns a
+// *llama.ErrorReturn.
+func (c *Client) Invoke(ctx context.Context, spec *protocol.InvocationSpec) (*protocol.InvocationResponse, error) {
+	res, err := c.InvokeWith(ctx, &llama.InvokeArgs{Spec: *spec})
+	if err != nil {
+		return nil, err
+	}
+	return &res.Response, nil
+}
+
+// InvokeWith calls llama.Invoke with the client's store and Lambda
+// client. If args.Function or args.URL are unset, the client's are
+// used; if the client has a Router and args.Function is unset, the
+// job is routed with llama.InvokeRouted instead. `args` itself is
+// left as it was.
+func (c *Client) InvokeWith(ctx context.Context, args *llama.InvokeArgs) (*llama.InvokeResult, error) {
+	copied := *args
+	args = &copied
+	args.Memoize = args.Memoize || c.cfg.Memoize
+	if args.Function == "" && c.cfg.Router != nil {
+		if args.Budget == nil {
+			args.Budget = c.cfg.Budget
+		}
+		return llama.InvokeRouted(ctx, c.lambda, c.store, c.cfg.Router, args)
+	}
+	if args.Function == "" {
+		args.Function = c.cfg.Function
+	}
+	if args.URL == nil && args.Function == c.cfg.Function {
+		args.URL = c.cfg.URL
+	}
+	if args.Budget == nil {
+		args.Budget = c.cfg.Budget
+	}
+	return llama.Invoke(ctx, c.lambda, c.store, args)
+}
+
+// ReadBlob returns the contents of `b`, fetching them from the
+// store if necessary
+func (c *Client) ReadBlob(ctx context.Context, b *protocol.Blob) ([]byte, error) {
+	return protocol_files.Read(ctx, c.store, b)
+}
+
+// FetchOutputs writes the outputs in `resp` to the local paths
+// `outputs` maps them to, as files.FetchOutputs does. Outputs that
+// don't correspond to any of `outputs` are returned, unfetched.
+func (c *Client) FetchOutputs(ctx context.Context, outputs files.List, resp *protocol.InvocationResponse) (extra protocol.FileList, err error) {
+	return c.fetchOutputs(ctx, outputs, resp, nil)
+}
+
+func (c *Client) fetchOutputs(ctx context.Context, outputs files.List, resp *protocol.InvocationResponse, report progress.Func) (extra protocol.FileList, err error) {
+	local, extra := outputs.TransformToLocal(ctx, resp.Outputs)
+	opts := c.cfg.Fetch
+	if report != nil {
+		opts.Progress = func(p files.FetchProgress) {
+			if c.cfg.Fetch.Progress != nil {
+				c.cfg.Fetch.Progress(p)
+			}
+			report(p.Event())
+		}
+	}
+	return extra, files.FetchOutputs(ctx, c.store, local, opts)
+}
+
+// ArchiveOutputs writes the outputs in `resp` into an archive at
+// `where`, in the format its extension names, as
+// files.WriteArchive does
+func (c *Client) ArchiveOutputs(ctx context.Context, resp *protocol.InvocationResponse, where string) (*files.ArchiveIndex, error) {
+	format, err := files.ArchiveFormat(where)
+	if err != nil {
+		return nil, err
+	}
+	return files.WriteArchive(ctx, c.store, resp.Outputs, where, format)
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/progress"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/runner/emulator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Run(t *testing.T) {
+	e := emulator.New(emulator.Options{})
+	defer e.Close()
+
+	c, err := New(Config{Function: e.Function(), Store: e.Store(), Lambda: e.Lambda()})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "llama-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b\n"), 0644))
+
+	j := NewJob("/bin/sh", "-c", "cat; cat in/a.txt in/sub/b.txt > out.txt; echo oops >&2; exit 2")
+	j.Stdin = []byte("stdin\n")
+	require.NoError(t, j.Input(src, "in"))
+	require.NoError(t, j.Output(filepath.Join(dir, "out.txt"), "out.txt"))
+	assert.Len(t, j.Inputs, 2)
+
+	res, err := c.Run(context.Background(), j)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Response.ExitStatus)
+	assert.Equal(t, "stdin\n", string(res.Stdout))
+	assert.Equal(t, "oops\n", string(res.Stderr))
+	assert.Empty(t, res.Extra)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", string(data))
+
+	j.Archive = filepath.Join(dir, "out.tar")
+	res, err = c.Run(context.Background(), j)
+	require.NoError(t, err)
+	require.NotNil(t, res.Archive)
+	if assert.Len(t, res.Archive.Entries, 1) {
+		assert.Equal(t, "out.txt", res.Archive.Entries[0].Path)
+		assert.Equal(t, int64(4), res.Archive.Entries[0].Size)
+	}
+	_, err = os.Stat(j.Archive)
+	assert.NoError(t, err)
+}
+
+func TestClient_InvokeWith(t *testing.T) {
+	e := emulator.New(emulator.Options{})
+	defer e.Close()
+
+	c, err := New(Config{Function: e.Function(), Store: e.Store(), Lambda: e.Lambda(), Memoize: true})
+	require.NoError(t, err)
+
+	args := llama.InvokeArgs{Spec: protocol.InvocationSpec{Args: []string{"/bin/true"}}}
+	res, err := c.InvokeWith(context.Background(), &args)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Response.ExitStatus)
+	// The client's defaults don't leak into the caller's args
+	assert.Empty(t, args.Function)
+	assert.False(t, args.Memoize)
+}
+
+func TestClient_RunProgress(t *testing.T) {
+	e := emulator.New(emulator.Options{})
+	defer e.Close()
+
+	c, err := New(Config{Function: e.Function(), Store: e.Store(), Lambda: e.Lambda()})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "llama-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j := NewJob("/bin/sh", "-c", "cp in.txt out.txt")
+	require.NoError(t, j.InputBytes([]byte("hello\n"), 0644, "in.txt"))
+	require.NoError(t, j.Output(filepath.Join(dir, "out.txt"), "out.txt"))
+	var stages []progress.Stage
+	last := make(map[progress.Stage]progress.Event)
+	j.Progress = func(e progress.Event) {
+		if len(stages) == 0 || stages[len(stages)-1] != e.Stage {
+			stages = append(stages, e.Stage)
+		}
+		last[e.Stage] = e
+	}
+
+	_, err = c.Run(context.Background(), j)
+	require.NoError(t, err)
+	assert.Equal(t, []progress.Stage{
+		progress.Hashing, progress.Uploading, progress.Invoking,
+		progress.Running, progress.Downloading, progress.Done,
+	}, stages)
+	assert.Equal(t, progress.Event{Stage: progress.Uploading, Files: 1, TotalFiles: 1, Bytes: 6, Elapsed: last[progress.Uploading].Elapsed}, last[progress.Uploading])
+	assert.Equal(t, 1, last[progress.Downloading].Files)
+	assert.Equal(t, int64(6), last[progress.Downloading].Bytes)
+}
+
+func TestClient_RunOutputFilter(t *testing.T) {
+	e := emulator.New(emulator.Options{})
+	defer e.Close()
+
+	c, err := New(Config{Function: e.Function(), Store: e.Store(), Lambda: e.Lambda()})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "llama-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j := NewJob("/bin/sh", "-c", "mkdir out; echo bin > out/prog; echo map > out/prog.map")
+	require.NoError(t, j.Output(filepath.Join(dir, "out"), "out"))
+	j.OutputFilter = &files.OutputFilter{Exclude: files.IgnoreRules{"*.map"}}
+
+	res, err := c.Run(context.Background(), j)
+	require.NoError(t, err)
+	assert.Len(t, res.Response.Outputs, 2)
+	if assert.Len(t, res.Skipped, 1) {
+		assert.Equal(t, "out/prog.map", res.Skipped[0].Path)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "out", "prog"))
+	require.NoError(t, err)
+	assert.Equal(t, "bin\n", string(data))
+	_, err = os.Stat(filepath.Join(dir, "out", "prog.map"))
+	assert.True(t, os.IsNotExist(err))
+
+	j.OutputFilter = &files.OutputFilter{Include: files.IgnoreRules{"nothing"}}
+	res, err = c.Run(context.Background(), j)
+	require.NoError(t, err, "skipping every output is not an error")
+	assert.Len(t, res.Skipped, 2)
+}
+
+func TestJob_Paths(t *testing.T) {
+	j := NewJob("true")
+	assert.Error(t, j.Input("/etc/hostname", "/abs"))
+	assert.Error(t, j.Output("out", "../escape"))
+	require.NoError(t, j.InputBytes([]byte("x"), 0644, "./dir/../x"))
+	assert.Equal(t, "x", j.Inputs[0].Remote)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/nelhage/llama/client"
+)
+
+func Example() {
+	c, err := client.New(client.Config{
+		Function: "gcc",
+		StoreURL: "s3://my-bucket/llama/",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	j := client.NewJob("gcc", "-c", "src/hello.c", "-o", "hello.o")
+	if err := j.Input("hello.c", "src/hello.c"); err != nil {
+		log.Fatal(err)
+	}
+	if err := j.Output("hello.o", "hello.o"); err != nil {
+		log.Fatal(err)
+	}
+
+	res, err := c.Run(context.Background(), j)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stderr.Write(res.Stderr)
+	if res.Response.ExitStatus != 0 {
+		log.Fatalf("gcc exited with status %d", res.Response.ExitStatus)
+	}
+}
+
+func ExampleClient_Invoke() {
+	c, err := client.New(client.Config{
+		Function: "my-function",
+		StoreURL: "s3://my-bucket/llama/",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+
+	j := client.NewJob("ls", "-R", "data")
+	if err := j.Input("testdata", "data"); err != nil {
+		log.Fatal(err)
+	}
+	spec, err := c.Prepare(ctx, j)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec.Sandbox = true
+
+	resp, err := c.Invoke(ctx, spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stdout, err := c.ReadBlob(ctx, resp.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s", stdout)
+}
@@ -0,0 +1,268 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/progress"
+	"github.com/nelhage/llama/protocol"
+	protocol_files "github.com/nelhage/llama/protocol/files"
+)
+
+// A Job is a command to run, along with the local files it reads
+// and writes
+type Job struct {
+	Args  []string
+	Stdin []byte
+	// Inputs are uploaded and placed in the job's workspace, and
+	// Outputs are fetched from it once the command finishes.
+	Inputs  files.List
+	Outputs files.List
+	// Archive, if set, is the path of a tar or zip archive to
+	// write the outputs into, under their paths in the job's
+	// workspace, instead of writing them to their local paths;
+	// see files.WriteArchive.
+	Archive string
+	// OutputFilter, if set, chooses which outputs Run fetches or
+	// archives. The rest are left in the store, and listed in the
+	// Result's Skipped.
+	OutputFilter *files.OutputFilter
+	// Spec holds any other settings for the invocation. Its Args,
+	// Stdin, Files, and Outputs are filled in by Prepare.
+	Spec protocol.InvocationSpec
+	// Progress, if set, is told how the job is getting along as
+	// Prepare and Run upload its inputs, invoke it, and fetch its
+	// outputs
+	Progress progress.Func
+}
+
+// NewJob returns a Job that runs `args`
+func NewJob(args ...string) *Job {
+	return &Job{Args: args}
+}
+
+// checkRemote checks that `remote` names a path inside the job's
+// workspace
+func checkRemote(remote string) (string, error) {
+	clean := protocol.NormalizePath(remote)
+	if protocol.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%q: must be a relative path inside the job's workspace", remote)
+	}
+	return clean, nil
+}
+
+// Input adds the local file or directory `local` to the job, at
+// the relative path `remote` in its workspace. Directories are
+// added recursively, skipping anything that isn't a regular file.
+func (j *Job) Input(local, remote string) error {
+	remote, err := checkRemote(remote)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(local)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		j.Inputs = j.Inputs.Append(files.Mapped{Local: files.LocalFile{Path: abs}, Remote: remote})
+		return nil
+	}
+	return filepath.Walk(abs, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil {
+				return nil
+			}
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(abs, p)
+		if err != nil {
+			return err
+		}
+		j.Inputs = j.Inputs.Append(files.Mapped{
+			Local:  files.LocalFile{Path: p},
+			Remote: path.Join(remote, filepath.ToSlash(rel)),
+		})
+		return nil
+	})
+}
+
+// InputBytes adds a file holding `data` to the job, at `remote` in
+// its workspace
+func (j *Job) InputBytes(data []byte, mode os.FileMode, remote string) error {
+	remote, err := checkRemote(remote)
+	if err != nil {
+		return err
+	}
+	j.Inputs = j.Inputs.Append(files.Mapped{Local: files.LocalFile{Bytes: data, Mode: mode}, Remote: remote})
+	return nil
+}
+
+// Output asks for the file or directory at `remote` in the job's
+// workspace to be written to `local` when the job finishes
+func (j *Job) Output(local, remote string) error {
+	remote, err := checkRemote(remote)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(local)
+	if err != nil {
+		return err
+	}
+	j.Outputs = j.Outputs.Append(files.Mapped{Local: files.LocalFile{Path: abs}, Remote: remote})
+	return nil
+}
+
+// Prepare uploads the job's inputs and stdin, and returns the spec
+// to invoke it with. If the client routes jobs, and the spec
+// doesn't declare its InputBytes, they are filled in.
+func (c *Client) Prepare(ctx context.Context, j *Job) (*protocol.InvocationSpec, error) {
+	spec := j.Spec
+	spec.Args = j.Args
+	opts := c.cfg.Upload
+	if j.Progress != nil {
+		j.Progress.Report(progress.Event{Stage: progress.Hashing, TotalFiles: len(j.Inputs)})
+		opts.Progress = func(p files.UploadProgress) {
+			if c.cfg.Upload.Progress != nil {
+				c.cfg.Upload.Progress(p)
+			}
+			j.Progress(p.Event())
+		}
+	}
+	var err error
+	if spec.Files, err = j.Inputs.UploadWith(ctx, c.store, nil, opts); err != nil {
+		return nil, err
+	}
+	spec.Stdin = nil
+	if j.Stdin != nil {
+		if spec.Stdin, err = protocol_files.NewBlob(ctx, c.store, j.Stdin); err != nil {
+			return nil, err
+		}
+	}
+	spec.Outputs = nil
+	for _, out := range j.Outputs {
+		spec.Outputs = append(spec.Outputs, out.Remote)
+	}
+	if c.cfg.Router != nil && spec.InputBytes == 0 {
+		spec.InputBytes = j.Inputs.Size() + int64(len(j.Stdin))
+	}
+	return &spec, nil
+}
+
+// Result is the outcome of a job that ran
+type Result struct {
+	Response protocol.InvocationResponse
+	// Stdout and Stderr hold the command's output
+	Stdout, Stderr []byte
+	// Extra lists outputs the function returned that the job
+	// didn't ask for, which weren't fetched
+	Extra protocol.FileList
+	// Skipped lists the outputs the job's OutputFilter skipped,
+	// which weren't fetched
+	Skipped protocol.FileList
+	// Archive lists the contents of the job's archive, if it
+	// has one
+	Archive *files.ArchiveIndex
+	// Retries counts the invocations that failed transiently
+	// before the one that ran the job
+	Retries int
+	// Function is the function that ran the job
+	Function string
+}
+
+// Run prepares and invokes the job, and fetches its outputs. If the
+// function reports that objects the job references are missing from
+// the store, they are uploaded again from the job's inputs, and the
+// job is resubmitted. A command that exits with a non-zero status
+// is not an error.
+func (c *Client) Run(ctx context.Context, j *Job) (*Result, error) {
+	defer j.Progress.Report(progress.Event{Stage: progress.Done})
+	spec, err := c.Prepare(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+	args := llama.InvokeArgs{
+		Spec:     *spec,
+		Reupload: c.reuploader(j),
+		Progress: j.Progress,
+	}
+	res, err := c.InvokeWith(ctx, &args)
+	if err != nil {
+		return nil, err
+	}
+	out := &Result{Response: res.Response, Retries: res.Retries, Function: res.Function}
+	fetch := res.Response
+	fetch.Outputs, out.Skipped = j.OutputFilter.Filter(res.Response.Outputs)
+	if j.Archive != "" {
+		if out.Archive, err = c.ArchiveOutputs(ctx, &fetch, j.Archive); err != nil {
+			return out, err
+		}
+	} else if out.Extra, err = c.fetchOutputs(ctx, j.Outputs, &fetch, j.Progress); err != nil {
+		return out, err
+	}
+	if res.Response.Stdout != nil {
+		if out.Stdout, err = c.ReadBlob(ctx, res.Response.Stdout); err != nil {
+			return out, fmt.Errorf("reading stdout: %w", err)
+		}
+	}
+	if res.Response.Stderr != nil {
+		if out.Stderr, err = c.ReadBlob(ctx, res.Response.Stderr); err != nil {
+			return out, fmt.Errorf("reading stderr: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// reuploader returns an InvokeArgs.Reupload function that restores
+// objects from the job's inputs and stdin
+func (c *Client) reuploader(j *Job) func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error) {
+	return func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error) {
+		missing, err := j.Inputs.Reupload(ctx, c.store, spec.Files, missing, c.cfg.Upload)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Stdin == nil || spec.Stdin.Ref == "" {
+			return missing, nil
+		}
+		var unresolved []string
+		for _, id := range missing {
+			if id != spec.Stdin.Ref {
+				unresolved = append(unresolved, id)
+			}
+		}
+		if len(unresolved) < len(missing) {
+			if spec.Stdin, err = protocol_files.NewBlob(ctx, c.store, j.Stdin); err != nil {
+				return nil, err
+			}
+		}
+		return unresolved, nil
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+
+	"github.com/nelhage/llama/llama"
 )
 
 type Config struct {
@@ -33,6 +35,30 @@ type Config struct {
 		APIKey  string `json:"api_key,omitempty"`
 		Dataset string `json:"dataset,omitempty"`
 	} `json:"honeycomb,omitempty"`
+
+	// StoreReplicas are the URLs of replicas of the object store,
+	// such as copies of its bucket in other regions, to read from
+	// if it is unavailable; see store.Failover.
+	StoreReplicas []string `json:"object_store_replicas,omitempty"`
+
+	// FunctionURLs maps function names to Lambda function URLs
+	// to invoke them through, instead of the Lambda API; see
+	// llama.FunctionURL. Requests carry URLToken, or
+	// $LLAMA_URL_TOKEN, if either is set, and are otherwise
+	// signed with AWS credentials.
+	FunctionURLs map[string]string `json:"function_urls,omitempty"`
+	URLToken     string            `json:"url_token,omitempty"`
+
+	// MaxInvocations, if non-zero, bounds the invocations in
+	// flight at once across every llama process on the machine;
+	// see package budget. SlotTimeout, a duration like "5m",
+	// bounds how long each waits for its turn.
+	MaxInvocations int    `json:"max_invocations,omitempty"`
+	SlotTimeout    string `json:"slot_timeout,omitempty"`
+
+	// Routers maps names, used in place of a function name, to
+	// sets of functions to route jobs among; see llama.Router.
+	Routers map[string]*llama.Router `json:"routers,omitempty"`
 }
 
 func WriteConfig(cfg *Config, configPath string) error {
@@ -0,0 +1,88 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/daemon/server"
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/protocol"
+)
+
+// LoadState returns the global state described by the config file
+// and the environment, for programs, like llamacc, that have no
+// flags of their own to override them.
+func LoadState() (*GlobalState, error) {
+	cfg, err := ReadConfig(ConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	if env := os.Getenv("LLAMA_OBJECT_STORE"); env != "" {
+		cfg.Store = env
+	}
+	if env := os.Getenv(protocol.StoreReplicasEnv); env != "" {
+		cfg.StoreReplicas = strings.Fields(env)
+	}
+	if env := os.Getenv("LLAMA_MAX_INVOCATIONS"); env != "" {
+		if cfg.MaxInvocations, err = strconv.Atoi(env); err != nil {
+			return nil, fmt.Errorf("LLAMA_MAX_INVOCATIONS: %w", err)
+		}
+	}
+	if env := os.Getenv("LLAMA_SLOT_TIMEOUT"); env != "" {
+		cfg.SlotTimeout = env
+	}
+	return &GlobalState{Config: cfg}, nil
+}
+
+// Connect returns a client for the llama daemon, starting one if
+// necessary. If no daemon can be started, as when `llama` isn't on
+// $PATH, it runs one in this process instead, using `g`'s session
+// and store and the default stat cache, so that callers needn't
+// care which they got.
+func (g *GlobalState) Connect(ctx context.Context, urlPath string) (*daemon.Client, error) {
+	return server.Connect(ctx, SocketPath(), urlPath, func() (*server.StartArgs, error) {
+		sess, err := g.Session()
+		if err != nil {
+			return nil, err
+		}
+		st, err := g.Store()
+		if err != nil {
+			return nil, err
+		}
+		urls, err := g.FunctionURLs()
+		if err != nil {
+			return nil, err
+		}
+		b, err := g.Budget()
+		if err != nil {
+			return nil, err
+		}
+		args := &server.StartArgs{Session: sess, Store: st, FunctionURLs: urls, Budget: b}
+		if path, err := files.DefaultStatCachePath(g.Config.Store); err == nil {
+			if args.StatCache, err = files.OpenStatCache(path); err != nil {
+				log.Printf("llama: stat cache: %s", err.Error())
+				args.StatCache = nil
+			}
+		}
+		return args, nil
+	})
+}
@@ -15,16 +15,21 @@
 package cli
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/mitchellh/go-homedir"
+	"github.com/nelhage/llama/budget"
+	"github.com/nelhage/llama/client"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/store"
-	"github.com/nelhage/llama/store/s3store"
 )
 
 var initEnv sync.Once
@@ -35,7 +40,8 @@ type GlobalState struct {
 
 	Config *Config
 
-	store store.Store
+	store  store.Store
+	budget *budget.Budget
 }
 
 func (g *GlobalState) Session() (*session.Session, error) {
@@ -111,14 +117,8 @@ func (g *GlobalState) Store() (store.Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	opts := s3store.Options{
-		DisableHeadCheck: true,
-	}
-	g.store, err = s3store.FromSessionAndOptions(sess, g.Config.Store, opts)
-	if err != nil {
-		return nil, err
-	}
-	return g.store, nil
+	g.store, err = client.OpenStore(sess, g.Config.Store, g.Config.StoreReplicas...)
+	return g.store, err
 }
 
 func (g *GlobalState) MustStore() store.Store {
@@ -128,3 +128,130 @@ func (g *GlobalState) MustStore() store.Store {
 	}
 	return st
 }
+
+// Client returns a client for `function`, sharing the global
+// session and store. If `function` names a router, the client
+// routes jobs among its functions.
+func (g *GlobalState) Client(function string) (*client.Client, error) {
+	sess, err := g.Session()
+	if err != nil {
+		return nil, err
+	}
+	st, err := g.Store()
+	if err != nil {
+		return nil, err
+	}
+	b, err := g.Budget()
+	if err != nil {
+		return nil, err
+	}
+	router, err := g.Router(function)
+	if err != nil {
+		return nil, err
+	}
+	if router != nil {
+		return client.New(client.Config{
+			Router:  router,
+			Session: sess,
+			Store:   st,
+			Budget:  b,
+		})
+	}
+	url, err := g.FunctionURL(function)
+	if err != nil {
+		return nil, err
+	}
+	return client.New(client.Config{
+		Function: function,
+		Session:  sess,
+		Store:    st,
+		URL:      url,
+		Budget:   b,
+	})
+}
+
+// Router returns a copy of the router configured as `name`, with
+// the function URLs of its routes filled in, or nil if there isn't
+// one
+func (g *GlobalState) Router(name string) (*llama.Router, error) {
+	cfg, ok := g.Config.Routers[name]
+	if !ok || cfg == nil {
+		return nil, nil
+	}
+	router := *cfg
+	router.Routes = append([]llama.Route(nil), cfg.Routes...)
+	for i := range router.Routes {
+		url, err := g.FunctionURL(router.Routes[i].Function)
+		if err != nil {
+			return nil, err
+		}
+		router.Routes[i].URL = url
+	}
+	return &router, nil
+}
+
+// BudgetPath returns the directory holding the machine-wide
+// invocation budget's lock files
+func BudgetPath() string {
+	return path.Join(ConfigDir(), "budget")
+}
+
+// Budget returns the machine-wide invocation budget, or nil if
+// Config.MaxInvocations is unset
+func (g *GlobalState) Budget() (*budget.Budget, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.budget != nil || g.Config.MaxInvocations == 0 {
+		return g.budget, nil
+	}
+	b, err := budget.Open(BudgetPath(), g.Config.MaxInvocations)
+	if err != nil {
+		return nil, err
+	}
+	if g.Config.SlotTimeout != "" {
+		if b.Timeout, err = time.ParseDuration(g.Config.SlotTimeout); err != nil {
+			return nil, fmt.Errorf("slot timeout: %w", err)
+		}
+	}
+	g.budget = b
+	return b, nil
+}
+
+// FunctionURL returns the function URL to invoke `function`
+// through, or nil if it should be invoked through the Lambda API.
+func (g *GlobalState) FunctionURL(function string) (*llama.FunctionURL, error) {
+	url, ok := g.Config.FunctionURLs[function]
+	if !ok {
+		return nil, nil
+	}
+	token := g.Config.URLToken
+	if env := os.Getenv(protocol.URLTokenEnv); env != "" {
+		token = env
+	}
+	if token != "" {
+		return &llama.FunctionURL{URL: url, Token: token}, nil
+	}
+	sess, err := g.Session()
+	if err != nil {
+		return nil, err
+	}
+	return &llama.FunctionURL{
+		URL:         url,
+		Credentials: sess.Config.Credentials,
+		Region:      aws.StringValue(sess.Config.Region),
+	}, nil
+}
+
+// FunctionURLs returns the function URLs for every function
+// configured to be invoked through one
+func (g *GlobalState) FunctionURLs() (map[string]*llama.FunctionURL, error) {
+	urls := make(map[string]*llama.FunctionURL, len(g.Config.FunctionURLs))
+	for function := range g.Config.FunctionURLs {
+		url, err := g.FunctionURL(function)
+		if err != nil {
+			return nil, err
+		}
+		urls[function] = url
+	}
+	return urls, nil
+}
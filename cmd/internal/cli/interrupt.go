@@ -0,0 +1,66 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nelhage/llama/protocol/files"
+)
+
+// ExitInterrupted is the exit status of a command cut short by an
+// interrupt, as shells report for processes killed by SIGINT
+const ExitInterrupted = 130
+
+// WithInterrupt returns a context that is canceled the first time
+// the process receives SIGINT or SIGTERM, so that commands can stop
+// starting new work and wind down what is in flight. A second
+// signal deletes any partially written output files and exits
+// immediately. The returned function stops handling signals.
+func WithInterrupt(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-sigs:
+		case <-stopped:
+			return
+		}
+		log.Printf("interrupted: canceling; interrupt again to exit immediately")
+		cancel()
+		select {
+		case <-sigs:
+		case <-stopped:
+			return
+		}
+		if n := files.RemovePartial(); n > 0 {
+			log.Printf("interrupted again: removed %d partially written files; exiting", n)
+		} else {
+			log.Printf("interrupted again: exiting")
+		}
+		os.Exit(ExitInterrupted)
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(stopped)
+		cancel()
+	}
+}
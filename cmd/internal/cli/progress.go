@@ -0,0 +1,88 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nelhage/llama/progress"
+)
+
+// PlainInterval bounds how often a StatusLine that isn't drawing on
+// a terminal logs progress within one stage
+const PlainInterval = 10 * time.Second
+
+// A StatusLine shows an invocation's progress to the person running
+// llama. On a terminal, it redraws a single status line in place;
+// otherwise, it logs a line when the invocation moves to a new
+// stage, and occasionally in between. It is safe for concurrent
+// use.
+type StatusLine struct {
+	mu      sync.Mutex
+	f       *os.File
+	tty     bool
+	stage   progress.Stage
+	logged  time.Time
+	drawn   bool
+	started time.Time
+}
+
+// NewStatusLine returns a StatusLine drawing on `f`
+func NewStatusLine(f *os.File) *StatusLine {
+	s := &StatusLine{f: f, started: time.Now()}
+	if fi, err := f.Stat(); err == nil {
+		s.tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	return s
+}
+
+// Update shows `e`
+func (s *StatusLine) Update(e progress.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.Stage == progress.Done {
+		s.clear()
+		return
+	}
+	line := fmt.Sprintf("llama: %s [%s]", e.String(), time.Since(s.started).Round(time.Second))
+	if s.tty {
+		fmt.Fprintf(s.f, "\r\033[K%s", line)
+		s.drawn = true
+		return
+	}
+	if e.Stage == s.stage && time.Since(s.logged) < PlainInterval {
+		return
+	}
+	s.stage, s.logged = e.Stage, time.Now()
+	log.Print(line)
+}
+
+// Close erases the status line, if it was drawn
+func (s *StatusLine) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clear()
+}
+
+func (s *StatusLine) clear() {
+	if s.drawn {
+		fmt.Fprint(s.f, "\r\033[K")
+		s.drawn = false
+	}
+}
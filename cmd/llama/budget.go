@@ -0,0 +1,75 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+)
+
+type BudgetCommand struct {
+	json bool
+}
+
+func (*BudgetCommand) Name() string     { return "budget" }
+func (*BudgetCommand) Synopsis() string { return "Show the machine-wide invocation budget's use" }
+func (*BudgetCommand) Usage() string {
+	return `budget [flags]
+
+Print the number of invocations allowed at once across this
+machine's llama processes (see -max-invocations), how many are in
+flight, and how many are waiting for a slot.
+`
+}
+
+func (c *BudgetCommand) SetFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&c.json, "json", false, "Print the status as JSON")
+}
+
+func (c *BudgetCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	b, err := global.Budget()
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return subcommands.ExitFailure
+	}
+	if b == nil {
+		log.Printf("no invocation budget is configured; pass -max-invocations or set $LLAMA_MAX_INVOCATIONS")
+		return subcommands.ExitFailure
+	}
+	st, err := b.Status()
+	if err != nil {
+		log.Printf("reading budget: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(&st)
+		return subcommands.ExitSuccess
+	}
+	fmt.Fprintf(os.Stdout, "max=%d\n", st.Max)
+	fmt.Fprintf(os.Stdout, "in_use=%d\n", st.InUse)
+	fmt.Fprintf(os.Stdout, "queued=%d\n", st.Queued)
+	fmt.Fprintf(os.Stdout, "timeout=%s\n", b.Timeout)
+	return subcommands.ExitSuccess
+}
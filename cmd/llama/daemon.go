@@ -16,6 +16,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -23,11 +24,11 @@ import (
 	"os/exec"
 	"os/signal"
 	"syscall"
-	"text/tabwriter"
 	"time"
 
 	"github.com/google/subcommands"
 	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/cost"
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/daemon/server"
 	"golang.org/x/sys/unix"
@@ -42,6 +43,11 @@ type DaemonCommand struct {
 	detach           bool
 	idleTimeout      time.Duration
 	ccConcurrency    int64
+
+	pricing   string
+	top       int
+	json      bool
+	statCache statCacheFlags
 }
 
 func (*DaemonCommand) Name() string     { return "daemon" }
@@ -61,6 +67,10 @@ func (c *DaemonCommand) SetFlags(flags *flag.FlagSet) {
 	flags.StringVar(&c.path, "path", cli.SocketPath(), "Path to daemon socket")
 	flags.DurationVar(&c.idleTimeout, "idle-timeout", 10*time.Minute, "Idle timeout")
 	flags.Int64Var(&c.ccConcurrency, "cc-concurrency", 0, "Configure llamacc concurrency limit")
+	flags.StringVar(&c.pricing, "pricing", "", "With -stats, estimate costs with the price overrides in this JSON `file` (default $"+cost.PricingEnv+")")
+	flags.IntVar(&c.top, "top", daemon.DefaultTopJobs, "With -stats, list this many of the most expensive jobs")
+	flags.BoolVar(&c.json, "json", false, "With -stats, print the statistics and cost report as JSON")
+	c.statCache.register(flags)
 }
 
 func raiseRlimits() {
@@ -99,70 +109,45 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 			}
 			log.Printf("The daemon is exiting.")
 		} else if c.stats {
-			stats, err := client.GetDaemonStats(&daemon.StatsArgs{})
+			pricing, err := cost.LoadPricing(c.pricing)
+			if err != nil {
+				log.Fatalf("%s", err.Error())
+			}
+			stats, err := client.GetDaemonStats(&daemon.StatsArgs{
+				Pricing: pricing,
+				TopJobs: c.top,
+			})
 			if err != nil {
 				log.Fatalf("Getting stats: %s", err.Error())
 			}
+			if c.json {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(stats)
+				return subcommands.ExitSuccess
+			}
 			fmt.Fprintf(os.Stdout, "in_flight=%d\n", stats.Stats.InFlight)
 			fmt.Fprintf(os.Stdout, "max_in_flight=%d\n", stats.Stats.MaxInFlight)
 			fmt.Fprintf(os.Stdout, "invocations=%d\n", stats.Stats.Invocations)
 			fmt.Fprintf(os.Stdout, "func_errors=%d\n", stats.Stats.FunctionErrors)
 			fmt.Fprintf(os.Stdout, "other_errors=%d\n", stats.Stats.OtherErrors)
-			fmt.Fprintf(os.Stdout, "AWS Usage:\n")
-			cost := 0.0
-			tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
-			fmt.Fprintf(tw, "  Lambda runtime\tms\t%d\n", stats.Stats.Usage.Lambda.Millis)
-			fmt.Fprintf(tw, "  Lambda runtime\tMB-ms\t%d\t$%.2f\n",
-				stats.Stats.Usage.Lambda.MB_Millis,
-				float64(stats.Stats.Usage.Lambda.MB_Millis)*0.0000166667/1000000,
-			)
-			cost += float64(stats.Stats.Usage.Lambda.MB_Millis) * 0.0000166667 / 1000000
-			fmt.Fprintf(tw, "  Lambda requests\t\t%d\t$%.2f\n",
-				stats.Stats.Usage.Lambda.Requests,
-				float64(stats.Stats.Usage.Lambda.Requests)*0.20/1000000,
-			)
-			cost += float64(stats.Stats.Usage.Lambda.Requests) * 0.20 / 1000000
-			fmt.Fprintf(tw, "  S3 Write requests[client]\t\t%d\t$%.2f\n",
-				stats.Stats.Usage.LocalS3.Write_Requests,
-				0.005/1000*float64(stats.Stats.Usage.LocalS3.Write_Requests),
-			)
-			cost += 0.005 / 1000 * float64(stats.Stats.Usage.LocalS3.Write_Requests)
-			fmt.Fprintf(tw, "  S3 Read requests[client]\t\t%d\t$%.2f\n",
-				stats.Stats.Usage.LocalS3.Read_Requests,
-				0.0004/1000*float64(stats.Stats.Usage.LocalS3.Read_Requests),
-			)
-			cost += 0.0004 / 1000 * float64(stats.Stats.Usage.LocalS3.Read_Requests)
-			fmt.Fprintf(tw, "  S3 Xfer in[client]\tMB\t%d\t$%.2f\n",
-				stats.Stats.Usage.LocalS3.Xfer_In/(1024*1024),
-				0.0,
-			)
-			fmt.Fprintf(tw, "  S3 Xfer out[client]\tMB\t%d\t$%.2f\n",
-				stats.Stats.Usage.LocalS3.Xfer_Out/(1024*1024),
-				float64(stats.Stats.Usage.LocalS3.Xfer_Out)*0.09/(1024*1024*1024),
-			)
-			cost += float64(stats.Stats.Usage.LocalS3.Xfer_Out) * 0.09 / (1024 * 1024 * 1024)
-			fmt.Fprintf(tw, "  S3 Write requests[remote]\t\t%d\t$%.2f\n",
-				stats.Stats.Usage.RemoteS3.Write_Requests,
-				0.005/1000*float64(stats.Stats.Usage.RemoteS3.Write_Requests),
-			)
-			cost += 0.005 / 1000 * float64(stats.Stats.Usage.RemoteS3.Write_Requests)
-			fmt.Fprintf(tw, "  S3 Read requests[remote]\t\t%d\t$%.2f\n",
-				stats.Stats.Usage.RemoteS3.Read_Requests,
-				0.0004/1000*float64(stats.Stats.Usage.RemoteS3.Read_Requests),
-			)
-			cost += 0.0004 / 1000 * float64(stats.Stats.Usage.RemoteS3.Read_Requests)
-			fmt.Fprintf(tw, "  S3 Xfer in[remote]\tMB\t%d\t$%.2f\n",
-				stats.Stats.Usage.RemoteS3.Xfer_In/(1024*1024),
-				0.0,
-			)
-			fmt.Fprintf(tw, "  S3 Xfer out[remote]\tMB\t%d\t$%.2f\n",
-				stats.Stats.Usage.RemoteS3.Xfer_Out/(1024*1024),
-				0.0,
-			)
-			fmt.Fprintf(tw, "  Total\t$\t\t$%.2f\n",
-				cost,
-			)
-			tw.Flush()
+			fmt.Fprintf(os.Stdout, "retries=%d\n", stats.Stats.Retries)
+			fmt.Fprintf(os.Stdout, "local=%d\n", stats.Stats.Local)
+			fmt.Fprintf(os.Stdout, "memoized=%d\n", stats.Stats.Memoized)
+			fmt.Fprintf(os.Stdout, "uptime=%s\n", stats.Uptime.Round(time.Second))
+			fmt.Fprintf(os.Stdout, "uploaded_bytes=%d\n", stats.Stats.Usage.LocalS3.Xfer_In)
+			if sc := stats.StatCache; sc != nil {
+				fmt.Fprintf(os.Stdout, "stat_cache_hits=%d\n", sc.Hits)
+				fmt.Fprintf(os.Stdout, "stat_cache_misses=%d\n", sc.Misses)
+				fmt.Fprintf(os.Stdout, "stat_cache_hit_rate=%s\n", hitRate(uint64(sc.Hits), uint64(sc.Misses)))
+				fmt.Fprintf(os.Stdout, "stat_cache_verified=%d\n", sc.Verified)
+				fmt.Fprintf(os.Stdout, "stat_cache_stale=%d\n", sc.Stale)
+			}
+			if sc := stats.StoreCache; sc != nil {
+				fmt.Fprintf(os.Stdout, "seen_cache_hit_rate=%s\n", hitRate(sc.SeenHits, sc.SeenMisses))
+				fmt.Fprintf(os.Stdout, "disk_cache_hit_rate=%s\n", hitRate(sc.DiskHits, sc.DiskMisses))
+			}
+			stats.Cost.WriteText(os.Stdout)
 		}
 		return subcommands.ExitSuccess
 	} else if c.start || c.autostart {
@@ -171,6 +156,8 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 			cmd := exec.Command("/proc/self/exe", "daemon", "-start",
 				"-idle-timeout", c.idleTimeout.String(),
 				"-path", c.path,
+				fmt.Sprintf("-no-stat-cache=%t", c.statCache.disable),
+				fmt.Sprintf("-verify-stat-cache=%g", c.statCache.verify),
 			)
 			cmd.SysProcAttr = &syscall.SysProcAttr{
 				Setsid: true,
@@ -181,12 +168,23 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 			}
 		} else {
 			global := cli.MustState(ctx)
+			urls, err := global.FunctionURLs()
+			if err != nil {
+				log.Fatalf("function URLs: %s", err.Error())
+			}
+			b, err := global.Budget()
+			if err != nil {
+				log.Fatalf("invocation budget: %s", err.Error())
+			}
 			if err := server.Start(ctx, &server.StartArgs{
 				Path:               c.path,
 				Session:            global.MustSession(),
 				Store:              global.MustStore(),
 				IdleTimeout:        c.idleTimeout,
 				LlamaCCConcurrency: c.ccConcurrency,
+				StatCache:          c.statCache.open(global),
+				FunctionURLs:       urls,
+				Budget:             b,
 			}); err != nil {
 				if c.autostart && err == server.ErrAlreadyRunning {
 					return subcommands.ExitSuccess
@@ -200,3 +198,11 @@ func (c *DaemonCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 
 	return subcommands.ExitSuccess
 }
+
+// hitRate formats the fraction of lookups that hit a cache
+func hitRate(hits, misses uint64) string {
+	if hits+misses == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(hits)/float64(hits+misses))
+}
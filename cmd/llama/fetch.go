@@ -0,0 +1,75 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/files"
+)
+
+type FetchCommand struct {
+	dir string
+}
+
+func (*FetchCommand) Name() string     { return "fetch" }
+func (*FetchCommand) Synopsis() string { return "Fetch outputs described by a manifest" }
+func (*FetchCommand) Usage() string {
+	return `fetch [-dir DIR] MANIFEST [PATH...]
+
+Fetch the outputs described by MANIFEST, as written by
+` + "`llama invoke -manifest`" + `, or only those named by PATH, each of
+which may be an output's remote or local path. Outputs are written
+to their local paths, or under DIR.
+`
+}
+
+func (c *FetchCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.dir, "dir", "", "Write outputs to their remote paths under `DIR`, instead of to their local paths")
+}
+
+func (c *FetchCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() < 1 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	m, err := files.ReadManifest(flag.Arg(0))
+	if err != nil {
+		log.Printf("reading manifest: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	if m.Store != "" && m.Store != global.Config.Store {
+		log.Printf("warning: the manifest's outputs are in %s, but the configured store is %s", m.Store, global.Config.Store)
+	}
+
+	err = files.FetchManifest(ctx, global.MustStore(), m, flag.Args()[1:], c.dir, files.FetchOptions{})
+	var missing *files.MissingObjectsError
+	if errors.As(err, &missing) {
+		log.Printf("%s", missing.Error())
+		log.Printf("they may have been garbage-collected; rerun the job to recreate them")
+		return subcommands.ExitFailure
+	} else if err != nil {
+		log.Printf("fetching outputs: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -18,12 +18,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/protocol"
 )
 
 const (
@@ -35,16 +37,24 @@ const (
 	defaultTimeout = 60 * time.Second
 )
 
+// functionEnv returns the environment llama functions are created
+// with
+func functionEnv(g *cli.GlobalState) map[string]*string {
+	env := map[string]*string{
+		"LLAMA_OBJECT_STORE": aws.String(g.Config.Store),
+	}
+	if len(g.Config.StoreReplicas) > 0 {
+		env[protocol.StoreReplicasEnv] = aws.String(strings.Join(g.Config.StoreReplicas, " "))
+	}
+	return env
+}
+
 func createOrUpdateFunction(ctx context.Context, g *cli.GlobalState, cfg *functionConfig) error {
 	client := lambda.New(g.MustSession())
 	args := &lambda.CreateFunctionInput{
 		FunctionName: aws.String(cfg.name),
 		Role:         aws.String(g.Config.IAMRole),
-		Environment: &lambda.Environment{
-			Variables: map[string]*string{
-				"LLAMA_OBJECT_STORE": aws.String(g.Config.Store),
-			},
-		},
+		Environment:  &lambda.Environment{Variables: functionEnv(g)},
 		Tags: map[string]*string{
 			"LlamaFunction": aws.String("true"),
 		},
@@ -79,11 +89,7 @@ func updateFunction(ctx context.Context, g *cli.GlobalState, cfg *functionConfig
 	args := &lambda.UpdateFunctionConfigurationInput{
 		FunctionName: aws.String(cfg.name),
 		Role:         aws.String(g.Config.IAMRole),
-		Environment: &lambda.Environment{
-			Variables: map[string]*string{
-				"LLAMA_OBJECT_STORE": aws.String(g.Config.Store),
-			},
-		},
+		Environment:  &lambda.Environment{Variables: functionEnv(g)},
 	}
 	if cfg.memory != 0 {
 		args.MemorySize = &cfg.memory
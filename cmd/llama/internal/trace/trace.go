@@ -240,6 +240,16 @@ func (c *TraceCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 		if c.trace != "" && span.TraceId != c.trace {
 			continue
 		}
+		// The output formats don't distinguish metrics
+		// from other fields.
+		if len(span.Metrics) > 0 {
+			if span.Fields == nil {
+				span.Fields = make(map[string]interface{})
+			}
+			for k, v := range span.Metrics {
+				span.Fields[k] = v
+			}
+		}
 		if extraFields != nil {
 			if span.Fields == nil {
 				span.Fields = make(map[string]interface{})
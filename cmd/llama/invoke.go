@@ -17,27 +17,67 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/rpc"
 	"os"
+	"path"
+	"strings"
 	"text/template"
 
 	"github.com/google/subcommands"
 	"github.com/nelhage/llama/cmd/internal/cli"
 	"github.com/nelhage/llama/daemon"
-	"github.com/nelhage/llama/daemon/server"
 	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/protocol"
 )
 
+// envList collects repeated KEY=VALUE flags
+type envList []string
+
+func (e *envList) String() string { return strings.Join(*e, " ") }
+
+func (e *envList) Set(v string) error {
+	if strings.IndexByte(v, '=') <= 0 {
+		return fmt.Errorf("%q: expected KEY=VALUE", v)
+	}
+	*e = append(*e, v)
+	return nil
+}
+
 type InvokeCommand struct {
-	stdin  bool
-	logs   bool
-	time   bool
-	files  files.List
-	output files.List
+	stdin    bool
+	logs     bool
+	time     bool
+	compress string
+	stream   bool
+	repro    bool
+	noInputs bool
+	async    bool
+	persist  bool
+	nested   bool
+	memoize  bool
+	refresh  bool
+	progress bool
+	result   string
+	local    bool
+	fallback bool
+	dryRun   bool
+	json     bool
+	record   string
+	noCache  bool
+	manifest string
+	archive  string
+	diff     bool
+	env      envList
+	expand   bool
+	files    files.List
+	output   files.List
+	filter   files.OutputFilter
 }
 
 func (*InvokeCommand) Name() string     { return "invoke" }
@@ -55,6 +95,30 @@ func (c *InvokeCommand) SetFlags(flags *flag.FlagSet) {
 	flags.Var(&c.files, "file", "Pass a file through to the invocation")
 	flags.Var(&c.output, "o", "Fetch additional output files")
 	flags.Var(&c.output, "output", "Fetch additional output files")
+	flags.Var(&c.filter.Include, "include-output", "Only fetch outputs whose paths match this `pattern`; may be repeated")
+	flags.Var(&c.filter.Exclude, "exclude-output", "Don't fetch outputs whose paths match this `pattern`; may be repeated")
+	flags.BoolVar(&c.stream, "stream", false, "Stream stdout as it is produced (requires a function with the RESPONSE_STREAM invoke mode)")
+	flags.BoolVar(&c.repro, "repro", false, "If the command fails, save its workspace as a reproduction bundle (see `llama repro`)")
+	flags.BoolVar(&c.noInputs, "repro-exclude-inputs", false, "Leave input files out of the reproduction bundle")
+	flags.Var(&c.env, "env", "Set KEY=VALUE in the command's environment")
+	flags.BoolVar(&c.expand, "expand", false, "Expand $VAR references, such as $LLAMA_ROOT, in arguments and -env values")
+	flags.BoolVar(&c.async, "async-upload", false, "Let the function upload large outputs after it responds")
+	flags.BoolVar(&c.persist, "persist-trace", false, "Save the invocation's trace in the object store (see `llama show-trace`)")
+	flags.BoolVar(&c.nested, "nested", false, "Let the command invoke llama functions itself, with the function's credentials")
+	flags.StringVar(&c.result, "result", "", "Write a JSON description of the invocation to `file`, or to stdout if \"-\" (see the README)")
+	flags.BoolVar(&c.progress, "progress", false, "Show the invocation's progress on stderr")
+	flags.BoolVar(&c.memoize, "memoize", false, "Declare the command deterministic, and reuse the stored result of an identical earlier invocation")
+	flags.BoolVar(&c.refresh, "refresh-memo", false, "With -memoize, run the command even if a result is stored, and replace it")
+	flags.BoolVar(&c.local, "local", false, "Run the command locally, in the daemon, instead of on Lambda (Linux only)")
+	flags.BoolVar(&c.fallback, "local-fallback", false, "Run the command locally if the function can't be invoked (Linux only)")
+	flags.BoolVar(&c.dryRun, "dry-run", false, "Print what would be uploaded and run, without invoking anything")
+	flags.BoolVar(&c.json, "json", false, "With -dry-run, print the plan as JSON")
+	flags.StringVar(&c.record, "record", "", "Record the invocation's spec and response in `DIR` (see `llama replay`)")
+	flags.StringVar(&c.compress, "compress", "", "Compress large input and output files using the named algorithm (zstd)")
+	flags.StringVar(&c.manifest, "manifest", "", "Don't fetch the outputs; describe them in a manifest `file` instead (see `llama fetch`)")
+	flags.StringVar(&c.archive, "archive", "", "Write the outputs into a .tar, .tar.gz, or .zip `file`, with an index of its contents in FILE.index.json, instead of into the working directory")
+	flags.BoolVar(&c.diff, "diff", false, "Report which input files changed since the last invocation of the same job")
+	flags.BoolVar(&c.noCache, "no-stat-cache", false, "Read and hash every input file, instead of trusting the daemon's stat cache for unchanged ones")
 }
 
 func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -82,12 +146,47 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 		return subcommands.ExitFailure
 	}
 
-	cl, err := server.DialWithAutostart(ctx, cli.SocketPath(), rpc.DefaultRPCPath)
+	if c.archive != "" {
+		if c.manifest != "" {
+			log.Printf("-archive and -manifest are mutually exclusive")
+			return subcommands.ExitUsageError
+		}
+		if _, err := files.ArchiveFormat(c.archive); err != nil {
+			log.Printf("%s", err.Error())
+			return subcommands.ExitUsageError
+		}
+	}
+
+	cl, err := global.Connect(ctx, rpc.DefaultRPCPath)
 	if err != nil {
 		log.Fatalf("connecting to daemon: %s", err.Error())
 	}
 	args.Function = flag.Arg(0)
 	args.ReturnLogs = c.logs
+	args.Compression = c.compress
+	args.AsyncUploads = c.async
+	args.PersistTrace = c.persist
+	args.Nested = c.nested
+	args.Memoize = c.memoize
+	args.RefreshMemo = c.refresh
+	if b, err := global.Budget(); err != nil {
+		log.Fatalf("%s", err.Error())
+	} else if b != nil {
+		args.Budget = &daemon.BudgetArgs{Dir: b.Dir(), Max: b.Max, Timeout: b.Timeout}
+	}
+	args.Local = c.local
+	args.LocalFallback = c.fallback
+	args.DryRun = c.dryRun
+	args.NoStatCache = c.noCache
+	args.DeferOutputs = c.manifest != ""
+	if !c.filter.Empty() {
+		args.OutputFilter = &c.filter
+	}
+	args.Env = c.env
+	args.ExpandVars = c.expand
+	if c.repro {
+		args.Repro = &protocol.ReproSpec{ExcludeInputs: c.noInputs}
+	}
 
 	wd, err := files.WorkingDir()
 	if err != nil {
@@ -95,21 +194,131 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 	}
 	args.Files = args.Files.MakeAbsolute(wd)
 	args.Outputs = args.Outputs.MakeAbsolute(wd)
+	args.Record = c.record
+	if args.Record != "" && !path.IsAbs(args.Record) {
+		args.Record = path.Join(wd, args.Record)
+	}
+	args.Archive = c.archive
+	if args.Archive != "" && !path.IsAbs(args.Archive) {
+		args.Archive = path.Join(wd, args.Archive)
+	}
+
+	var streamed chan struct{}
+	if c.stream && !c.dryRun {
+		args.Stream = newID()
+		streamed = make(chan struct{})
+		go func() {
+			defer close(streamed)
+			for {
+				chunk, err := cl.ReadStream(&daemon.ReadStreamArgs{Stream: args.Stream})
+				if err != nil {
+					log.Printf("reading stream: %s", err.Error())
+					return
+				}
+				os.Stdout.Write(chunk.Data)
+				if chunk.EOF {
+					return
+				}
+			}
+		}()
+	}
 
-	response, err := cl.InvokeWithFiles(&args)
+	var results *resultWriter
+	if c.result != "" && !c.dryRun {
+		if c.result == "-" && c.stream {
+			log.Printf("-stream can't be used with -result -: both write to stdout")
+			return subcommands.ExitFailure
+		}
+		if results, err = openResults(c.result); err != nil {
+			log.Printf("opening -result: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		defer results.Close()
+	}
+
+	var followed chan struct{}
+	if c.progress && !c.dryRun {
+		args.Progress = newID()
+		followed = make(chan struct{})
+		go func() {
+			defer close(followed)
+			followProgress(cl, args.Progress, cli.NewStatusLine(os.Stderr))
+		}()
+	}
+
+	response, err := invokeInterruptibly(ctx, cl, &args)
+	if err == context.Canceled {
+		log.Printf("interrupted: the job was already handed to the daemon, which can't stop it; it may still run and write its outputs")
+		return cli.ExitInterrupted
+	}
 	if err != nil {
+		if results != nil {
+			results.Write(&jobResult{Function: args.Function, Args: args.Args, Error: err.Error(), Outputs: []outputResult{}})
+		}
 		log.Fatalf("invoke: %s", err.Error())
 	}
+	if streamed != nil {
+		<-streamed
+	}
+	if followed != nil {
+		<-followed
+	}
+	if response.Plan != nil {
+		if err := writePlan(os.Stdout, response.Plan, c.json); err != nil {
+			log.Fatalf("writing plan: %s", err.Error())
+		}
+		return subcommands.ExitSuccess
+	}
 	if response.Logs != nil {
 		fmt.Fprintf(os.Stderr, "==== invocation logs ====\n%s\n==== end logs ====\n", response.Logs)
 	}
 
-	if response.Stdout != nil {
+	if response.Stdout != nil && (results == nil || !results.Stdout) {
 		os.Stdout.Write(response.Stdout)
 	}
 	if response.Stderr != nil {
 		os.Stderr.Write(response.Stderr)
 	}
+	if c.diff && response.Diff != nil {
+		log.Printf("inputs: %s", response.Diff.String())
+		if detail := response.Diff.Detail(); detail != "" {
+			fmt.Fprintln(os.Stderr, detail)
+		}
+	}
+	for _, w := range response.Warnings {
+		log.Printf("warning: %s", w)
+	}
+	if response.Skipped.Count > 0 {
+		log.Printf("skipped %s not matching the output filter", response.Skipped.String())
+	}
+	if d := response.Diagnostics; d != nil && d.Repro != nil {
+		if d.Repro.Err != "" {
+			log.Printf("creating reproduction bundle: %s", d.Repro.Err)
+		} else {
+			log.Printf("reproduction bundle saved; run `llama repro %s` to unpack it", d.Repro.Ref)
+		}
+	}
+
+	if response.Manifest != nil {
+		response.Manifest.Store = global.Config.Store
+		if err := response.Manifest.Write(c.manifest); err != nil {
+			log.Fatalf("writing manifest: %s", err.Error())
+		}
+	}
+
+	if response.ArchiveIndex != nil {
+		if err := response.ArchiveIndex.Write(args.Archive + ".index.json"); err != nil {
+			log.Fatalf("writing archive index: %s", err.Error())
+		}
+	}
+
+	if response.Recording != "" {
+		log.Printf("invocation recorded; run `llama replay %s` to replay it", response.Recording)
+	}
+
+	if c.persist && response.JobID != "" {
+		log.Printf("trace saved; run `llama show-trace %s` to view it", response.JobID)
+	}
 
 	if c.time {
 		log.Printf("Invoke timing:")
@@ -123,6 +332,26 @@ func (c *InvokeCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...in
 		log.Printf("  exec:    %s", response.Timing.Remote.Exec)
 		log.Printf("  upload:  %s", response.Timing.Remote.Upload)
 		log.Printf("  network: %s", response.Timing.Invoke-response.Timing.Remote.E2E)
+		if response.Retries > 0 {
+			log.Printf("retries: %d", response.Retries)
+		}
+		if response.Local {
+			log.Printf("ran locally")
+		}
+		if response.Memoized {
+			log.Printf("memoized: reused an earlier result")
+		}
+		if n := response.Nested; n != nil {
+			log.Printf("nested:  %d invocations (%d failed), %d lambda ms, %d bytes fetched",
+				n.Invocations, n.Failed, n.Usage.Lambda.Millis, n.FetchBytes)
+		}
+	}
+
+	if results != nil {
+		if err := results.Write(invokeResult(&args, response, results.Stdout)); err != nil {
+			log.Printf("writing -result: %s", err.Error())
+			return subcommands.ExitFailure
+		}
 	}
 
 	if response.InvokeErr != "" {
@@ -159,3 +388,47 @@ func prepareArgs(ctx context.Context, global *cli.GlobalState, args []string) ([
 
 	return outArgs, ioctx, nil
 }
+
+// invokeInterruptibly calls the daemon's InvokeWithFiles, returning
+// early with context.Canceled if `ctx` is canceled first
+func invokeInterruptibly(ctx context.Context, cl *daemon.Client, args *daemon.InvokeWithFilesArgs) (*daemon.InvokeWithFilesReply, error) {
+	type result struct {
+		reply *daemon.InvokeWithFilesReply
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := cl.InvokeWithFiles(args)
+		done <- result{reply, err}
+	}()
+	select {
+	case r := <-done:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return nil, context.Canceled
+	}
+}
+
+// newID returns a random ID for a stream or progress watch
+func newID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		log.Fatalf("gen ID: %s", err.Error())
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// followProgress shows the progress of the invocation with the
+// Progress ID `id` on `line` until it is done
+func followProgress(cl *daemon.Client, id string, line *cli.StatusLine) {
+	defer line.Close()
+	var seq uint64
+	for {
+		repl, err := cl.ReadProgress(&daemon.ReadProgressArgs{Progress: id, Seq: seq})
+		if err != nil || repl.Done {
+			return
+		}
+		seq = repl.Seq
+		line.Update(repl.Event)
+	}
+}
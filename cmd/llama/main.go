@@ -17,6 +17,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -24,6 +25,7 @@ import (
 	"runtime/pprof"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/service/xray"
 	"github.com/google/subcommands"
 	"github.com/klauspost/compress/zstd"
 	"github.com/nelhage/llama/cmd/internal/cli"
@@ -44,11 +46,18 @@ func main() {
 	subcommands.Register(&InvokeCommand{}, "")
 	subcommands.Register(&XargsCommand{}, "")
 	subcommands.Register(&DaemonCommand{}, "")
+	subcommands.Register(&BudgetCommand{}, "")
+	subcommands.Register(&ReproCommand{}, "")
+	subcommands.Register(&ReplayCommand{}, "")
+	subcommands.Register(&FetchCommand{}, "")
+	subcommands.Register(&SeedCommand{}, "")
 
 	subcommands.Register(&StoreCommand{}, "internals")
 	subcommands.Register(&GetCommand{}, "internals")
 	subcommands.Register(&trace.TraceCommand{}, "tracing")
+	subcommands.Register(&ShowTraceCommand{}, "tracing")
 	subcommands.Register(&MultigetCommand{}, "internals")
+	subcommands.Register(&StoreBenchCommand{}, "internals")
 
 	subcommands.ImportantFlag("region")
 
@@ -65,12 +74,26 @@ func runLlama(ctx context.Context) int {
 	debugAWS := false
 	var storeConcurrency int
 	var trace string
+	var otlpEndpoint string
+	var xrayTrace bool
+	var traceSample string
+	var chromeTrace string
+	var summary bool
 	var cpuProfile, memProfile string
+	var maxInvocations int
+	var slotTimeout string
 	flag.StringVar(&regionOverride, "region", "", "AWS region")
 	flag.StringVar(&storeOverride, "store", "", "Path to the llama object store. s3://BUCKET/PATH")
 	flag.BoolVar(&debugAWS, "debug-aws", false, "Log all AWS requests/responses")
 	flag.IntVar(&storeConcurrency, "s3-concurrency", defaultStoreConcurrency, "Maximum concurrent S3 uploads/downloads")
 	flag.StringVar(&trace, "trace", "", "Write tracing data to file")
+	flag.StringVar(&chromeTrace, "chrome-trace", os.Getenv("LLAMA_CHROME_TRACE"), "Write tracing data to file in Chrome's trace-event format, for chrome://tracing or Perfetto")
+	flag.BoolVar(&summary, "summary", false, "Print a summary of traced operations and their metrics on exit")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", otlpEndpointFromEnv(), "Export tracing data to an OpenTelemetry collector at this URL, using OTLP/HTTP")
+	flag.StringVar(&traceSample, "trace-sample", os.Getenv("LLAMA_TRACE_SAMPLE"), "Trace only a sample of operations: RATE[,ALWAYS...], as 0.1, 10%, or 1/10, optionally followed by span names to always trace")
+	flag.BoolVar(&xrayTrace, "xray", os.Getenv("LLAMA_XRAY") != "", "Export tracing data to AWS X-Ray")
+	flag.IntVar(&maxInvocations, "max-invocations", 0, "Allow at most N invocations in flight at once across all llama processes on this machine (default $LLAMA_MAX_INVOCATIONS)")
+	flag.StringVar(&slotTimeout, "slot-timeout", "", "With -max-invocations, give up on jobs that wait longer than this `duration` for their turn (default 10m)")
 	flag.StringVar(&cpuProfile, "cpu-profile", "", "Write CPU profile to file")
 	flag.StringVar(&memProfile, "mem-profile", "", "Write memory profile to file")
 
@@ -101,6 +124,14 @@ func runLlama(ctx context.Context) int {
 		}()
 	}
 
+	if traceSample != "" {
+		sampler, err := tracing.ParseSampler(traceSample)
+		if err != nil {
+			log.Fatalf("trace-sample: %s", err.Error())
+		}
+		ctx = tracing.WithSampler(ctx, sampler)
+	}
+
 	if trace != "" {
 		fh, err := os.Create(trace)
 		if err != nil {
@@ -121,15 +152,48 @@ func runLlama(ctx context.Context) int {
 		ctx, wt = tracing.WithWriterTracer(ctx, w)
 		defer wt.Close()
 	}
+	if otlpEndpoint != "" {
+		ot := tracing.NewOTLPTracer(tracing.OTLPOptions{
+			Endpoint: otlpEndpoint,
+			Headers:  otlpHeadersFromEnv(),
+		})
+		defer func() {
+			if err := ot.Close(); err != nil {
+				log.Printf("exporting traces: %s", err.Error())
+			}
+		}()
+		ctx = tracing.AddTracer(ctx, ot)
+	}
+	if summary {
+		agg := tracing.NewAggregator()
+		defer func() {
+			if snap := agg.Snapshot(); len(snap) > 0 {
+				fmt.Fprintln(os.Stderr, "llama: trace summary:")
+				tracing.WriteSummary(os.Stderr, snap)
+			}
+		}()
+		ctx = tracing.AddTracer(ctx, agg)
+	}
+	if chromeTrace != "" {
+		fh, err := os.Create(chromeTrace)
+		if err != nil {
+			log.Fatalf("chrome-trace: %s", err.Error())
+		}
+		ct := tracing.NewChromeTracer(fh)
+		defer func() {
+			if err := ct.Close(); err != nil {
+				log.Printf("writing chrome trace: %s", err.Error())
+			}
+		}()
+		ctx = tracing.AddTracer(ctx, ct)
+	}
 
-	cfg, err := cli.ReadConfig(cli.ConfigPath())
+	state, err := cli.LoadState()
 	if err != nil {
 		log.Fatalf("reading config file: %s", err.Error())
 	}
+	cfg := state.Config
 
-	if storeOverride == "" {
-		storeOverride = os.Getenv("LLAMA_OBJECT_STORE")
-	}
 	if storeOverride != "" {
 		cfg.Store = storeOverride
 	}
@@ -139,16 +203,62 @@ func runLlama(ctx context.Context) int {
 	if regionOverride != "" {
 		cfg.Region = regionOverride
 	}
+	if maxInvocations != 0 {
+		cfg.MaxInvocations = maxInvocations
+	}
+	if slotTimeout != "" {
+		cfg.SlotTimeout = slotTimeout
+	}
 	cfg.DebugAWS = debugAWS
 
-	var state cli.GlobalState
-	state.Config = cfg
+	ctx = cli.WithState(ctx, state)
 
-	ctx = cli.WithState(ctx, &state)
+	if xrayTrace {
+		sess, err := state.Session()
+		if err != nil {
+			log.Fatalf("xray: %s", err.Error())
+		}
+		xt := tracing.NewXRayTracer(tracing.XRayOptions{
+			Sender: tracing.NewXRayAPISender(xray.New(sess)),
+		})
+		defer func() {
+			if err := xt.Close(); err != nil {
+				log.Printf("exporting traces: %s", err.Error())
+			}
+		}()
+		ctx = tracing.AddTracer(ctx, xt)
+	}
 
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	ctx, stop := cli.WithInterrupt(ctx)
+	defer stop()
 	return int(subcommands.Execute(ctx))
 }
+
+// otlpEndpointFromEnv honors the standard OpenTelemetry exporter
+// variables. Only the HTTP transport is supported.
+func otlpEndpointFromEnv() string {
+	if ep := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); ep != "" {
+		return ep
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+}
+
+func otlpHeadersFromEnv() map[string]string {
+	env := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+	if env == "" {
+		return nil
+	}
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(env, ",") {
+		eq := strings.IndexByte(kv, '=')
+		if eq < 0 {
+			continue
+		}
+		headers[strings.TrimSpace(kv[:eq])] = strings.TrimSpace(kv[eq+1:])
+	}
+	return headers
+}
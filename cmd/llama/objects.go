@@ -16,7 +16,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -32,7 +34,11 @@ type StoreCommand struct {
 func (*StoreCommand) Name() string     { return "store" }
 func (*StoreCommand) Synopsis() string { return "Store an object to the llama object store" }
 func (*StoreCommand) Usage() string {
-	return `store PATH
+	return `store PATH...
+
+Store each PATH, or stdin for "-", in the configured object store
+(see -store), and print the ID it was stored under. Given more than
+one PATH, print each ID followed by its PATH.
 `
 }
 
@@ -41,9 +47,19 @@ func (c *StoreCommand) SetFlags(flags *flag.FlagSet) {
 
 func (c *StoreCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	global := cli.MustState(ctx)
+	if flag.NArg() == 0 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
 
 	for _, arg := range flag.Args() {
-		bytes, err := ioutil.ReadFile(arg)
+		var bytes []byte
+		var err error
+		if arg == "-" {
+			bytes, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			bytes, err = ioutil.ReadFile(arg)
+		}
 		if err != nil {
 			log.Printf("read %q: %v\n", arg, err)
 			return subcommands.ExitFailure
@@ -54,34 +70,59 @@ func (c *StoreCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 			log.Printf("storing %q: %v\n", arg, err)
 			return subcommands.ExitFailure
 		}
-		log.Printf("object %q stored id=%s", arg, id)
+		if flag.NArg() == 1 {
+			fmt.Println(id)
+		} else {
+			fmt.Printf("%s  %s\n", id, arg)
+		}
 	}
 
 	return subcommands.ExitSuccess
 }
 
 type GetCommand struct {
+	output string
 }
 
 func (*GetCommand) Name() string     { return "get" }
 func (*GetCommand) Synopsis() string { return "Get an object from the llama object store" }
 func (*GetCommand) Usage() string {
-	return `get ID
+	return `get [-o FILE] ID
+
+Fetch the object ID from the configured object store (see -store),
+check its contents against its ID, and write it to stdout or FILE.
 `
 }
 
 func (c *GetCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.output, "o", "", "Write the object to `FILE` instead of stdout")
 }
 
 func (c *GetCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	global := cli.MustState(ctx)
+	if flag.NArg() != 1 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	id := flag.Arg(0)
 
-	obj, err := store.Get(ctx, global.MustStore(), flag.Arg(0))
-	if err != nil {
-		log.Printf("read %q: %v\n", flag.Arg(0), err)
+	obj, verified, err := store.GetVerified(ctx, global.MustStore(), id)
+	if errors.Is(err, store.ErrNotExists) {
+		log.Printf("object %s not found in %s", id, global.Config.Store)
+		return subcommands.ExitFailure
+	} else if err != nil {
+		log.Printf("read %q: %v\n", id, err)
+		return subcommands.ExitFailure
+	}
+	if !verified {
+		log.Printf("warning: the store can't compute object IDs; %s was not verified", id)
+	}
+	if c.output == "" {
+		os.Stdout.Write(obj)
+	} else if err := ioutil.WriteFile(c.output, obj, 0644); err != nil {
+		log.Printf("writing %s: %v", c.output, err)
 		return subcommands.ExitFailure
 	}
-	os.Stdout.Write(obj)
 
 	return subcommands.ExitSuccess
 }
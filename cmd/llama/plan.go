@@ -0,0 +1,57 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nelhage/llama/daemon"
+)
+
+// writePlan prints a dry run's plan, as JSON if `asJSON` is set
+func writePlan(w io.Writer, plan *daemon.Plan, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	words := make([]string, len(plan.Cmdline))
+	for i, arg := range plan.Cmdline {
+		words[i] = shellquote(arg)
+	}
+	fmt.Fprintf(w, "function: %s\n", plan.Function)
+	fmt.Fprintf(w, "command:  %s\n", strings.Join(words, " "))
+	if plan.CmdlineNote != "" {
+		fmt.Fprintf(w, "          (%s)\n", plan.CmdlineNote)
+	}
+	fmt.Fprintf(w, "files:\n")
+	for _, f := range plan.Files {
+		fmt.Fprintf(w, "  %s %s\n", f.Mode, f.Path)
+	}
+	if plan.StdinBytes > 0 {
+		fmt.Fprintf(w, "stdin:    %d bytes\n", plan.StdinBytes)
+	}
+	fmt.Fprintf(w, "outputs:\n")
+	for _, out := range plan.Outputs {
+		fmt.Fprintf(w, "  %s\n", out)
+	}
+	fmt.Fprintf(w, "uploads:  %d objects, %d bytes (%d of %d objects already stored)\n",
+		plan.UploadObjects, plan.UploadBytes,
+		len(plan.Uploads)-plan.UploadObjects, len(plan.Uploads))
+	return nil
+}
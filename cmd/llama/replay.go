@@ -0,0 +1,113 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/llama"
+)
+
+type ReplayCommand struct {
+	function string
+	local    bool
+}
+
+func (*ReplayCommand) Name() string { return "replay" }
+func (*ReplayCommand) Synopsis() string {
+	return "Re-run a recorded invocation and compare the results"
+}
+func (*ReplayCommand) Usage() string {
+	return `replay [flags] RECORDING
+
+Re-submit the spec recorded by "llama invoke -record" in RECORDING,
+unchanged except for its idempotency token, and compare the
+response with the recorded one. Exits 1 if they differ.
+`
+}
+
+func (c *ReplayCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.function, "function", "", "Invoke this function instead of the recorded one")
+	flags.BoolVar(&c.local, "local", false, "Run the spec locally instead of on Lambda (Linux only)")
+}
+
+func (c *ReplayCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() != 1 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	rec, err := llama.ReadRecording(flag.Arg(0))
+	if err != nil {
+		log.Printf("reading recording: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	args := llama.InvokeArgs{
+		Function: rec.Function,
+		Spec:     rec.Spec,
+	}
+	if c.function != "" {
+		args.Function = c.function
+	}
+	// A runtime that remembers the recorded token would return
+	// its earlier response instead of running the job again.
+	args.Spec.IdempotencyToken = ""
+	args.Spec.Trace = nil
+	if c.local {
+		if args.Local, err = llama.NewLocal(global.MustStore()); err != nil {
+			log.Printf("local execution: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	client, err := global.Client(args.Function)
+	if err != nil {
+		log.Printf("initializing client: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	res, err := client.InvokeWith(ctx, &args)
+	if err != nil {
+		if rec.Error != "" {
+			fmt.Printf("recorded error: %s\n", rec.Error)
+		}
+		fmt.Printf("replay error:   %s\n", err.Error())
+		if rec.Error == err.Error() {
+			return subcommands.ExitSuccess
+		}
+		return subcommands.ExitFailure
+	}
+	if rec.Response == nil {
+		fmt.Printf("recorded error: %s\n", rec.Error)
+		fmt.Printf("replay succeeded with exit status %d\n", res.Response.ExitStatus)
+		return subcommands.ExitFailure
+	}
+
+	diffs := llama.DiffResponses(rec.Response, &res.Response)
+	if len(diffs) == 0 {
+		fmt.Println("no differences")
+		return subcommands.ExitSuccess
+	}
+	for _, d := range diffs {
+		fmt.Println(d)
+	}
+	return subcommands.ExitFailure
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+type ReproCommand struct {
+	dir string
+}
+
+func (*ReproCommand) Name() string     { return "repro" }
+func (*ReproCommand) Synopsis() string { return "Unpack a failed invocation's reproduction bundle" }
+func (*ReproCommand) Usage() string {
+	return `repro [flags] ID
+
+Unpack the reproduction bundle ID, saved by "llama invoke -repro",
+and print the command line to re-run the failed command locally.
+`
+}
+
+func (c *ReproCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.dir, "o", "", "Directory to unpack into (default llama-repro-ID)")
+}
+
+func (c *ReproCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() != 1 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	id := flag.Arg(0)
+
+	dir := c.dir
+	if dir == "" {
+		short := strings.SplitN(id, ":", 2)[0]
+		if len(short) > 12 {
+			short = short[:12]
+		}
+		dir = "llama-repro-" + short
+	}
+
+	data, err := store.Get(ctx, global.MustStore(), id)
+	if err != nil {
+		log.Printf("fetching bundle %q: %v", id, err)
+		return subcommands.ExitFailure
+	}
+	manifest, err := unpackRepro(bytes.NewReader(data), dir)
+	if err != nil {
+		log.Printf("unpacking bundle: %v", err)
+		return subcommands.ExitFailure
+	}
+
+	fmt.Printf("Unpacked reproduction bundle into %s\n", dir)
+	if len(manifest.Excluded) > 0 {
+		fmt.Printf("\nThese inputs were left out; copy them in before re-running:\n")
+		for _, f := range manifest.Excluded {
+			fmt.Printf("  %s\n", f)
+		}
+	}
+	if len(manifest.Omitted) > 0 {
+		fmt.Printf("\nThese files were omitted because the bundle reached its size limit:\n")
+		for _, f := range manifest.Omitted {
+			fmt.Printf("  %s\n", f)
+		}
+	}
+	fmt.Printf("\nThe command exited with status %d. To re-run it:\n\n", manifest.ExitStatus)
+	fmt.Printf("  %s\n", reproCommandLine(dir, manifest))
+	return subcommands.ExitSuccess
+}
+
+func reproCommandLine(dir string, manifest *protocol.ReproManifest) string {
+	words := []string{"cd", shellquote(dir), "&&"}
+	for _, kv := range manifest.Env {
+		kv := strings.SplitN(kv, "=", 2)
+		if len(kv) == 2 {
+			words = append(words, kv[0]+"="+shellquote(kv[1]))
+		}
+	}
+	for _, arg := range manifest.Args {
+		words = append(words, shellquote(arg))
+	}
+	if manifest.Stdin {
+		words = append(words, "<", protocol.ReproStdinPath)
+	}
+	return strings.Join(words, " ")
+}
+
+// unpackRepro extracts a reproduction bundle into `dir`, which must
+// not already exist, and returns its manifest.
+func unpackRepro(r io.Reader, dir string) (*protocol.ReproManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	var manifest *protocol.ReproManifest
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rel, err := protocol.CleanPath(hdr.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", hdr.Name, err)
+		}
+		where := filepath.Join(dir, filepath.FromSlash(rel))
+		// Don't let an earlier symlink redirect a later entry
+		// outside of `dir`.
+		if err := checkNoSymlinks(dir, filepath.Dir(where)); err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(where, 0755)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, where)
+		case tar.TypeReg:
+			if rel == protocol.ReproManifestPath {
+				manifest = &protocol.ReproManifest{}
+				if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+					return nil, fmt.Errorf("reading manifest: %w", err)
+				}
+				continue
+			}
+			err = writeTarFile(tr, where, os.FileMode(hdr.Mode).Perm())
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("bundle has no manifest")
+	}
+	return manifest, nil
+}
+
+func checkNoSymlinks(root, dir string) error {
+	for dir != root && strings.HasPrefix(dir, root) {
+		fi, err := os.Lstat(dir)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: refusing to write through a symlink", dir)
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+func writeTarFile(r io.Reader, where string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(where), 0755); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(where, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fh, r); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+func makeBundle(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.body))
+		require.NoError(t, tw.WriteHeader(&e.hdr))
+		_, err := tw.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestUnpackRepro(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "llama-repro")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	manifest, _ := json.Marshal(&protocol.ReproManifest{
+		Args:  []string{"cc", "-c", "it's.c"},
+		Env:   []string{"NPROC=2"},
+		Stdin: true,
+	})
+	bundle := makeBundle(t, []tarEntry{
+		{hdr: tar.Header{Name: "src/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "src/it's.c", Typeflag: tar.TypeReg, Mode: 0644}, body: "int x;\n"},
+		{hdr: tar.Header{Name: protocol.ReproManifestPath, Typeflag: tar.TypeReg, Mode: 0644}, body: string(manifest)},
+	})
+	dir := path.Join(tmp, "ok")
+	got, err := unpackRepro(bytes.NewReader(bundle), dir)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(path.Join(dir, "src/it's.c"))
+	require.NoError(t, err)
+	assert.Equal(t, "int x;\n", string(data))
+	assert.Equal(t,
+		`cd '`+dir+`' && NPROC='2' 'cc' '-c' 'it'"'"'s.c' < `+protocol.ReproStdinPath,
+		reproCommandLine(dir, got))
+
+	for name, entries := range map[string][]tarEntry{
+		"dotdot": {
+			{hdr: tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}, body: "x"},
+		},
+		"symlink": {
+			{hdr: tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: tmp}},
+			{hdr: tar.Header{Name: "link/escape", Typeflag: tar.TypeReg, Mode: 0644}, body: "x"},
+		},
+	} {
+		_, err := unpackRepro(bytes.NewReader(makeBundle(t, entries)), path.Join(tmp, name))
+		assert.Error(t, err, name)
+		_, err = os.Stat(path.Join(tmp, "escape"))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
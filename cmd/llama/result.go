@@ -0,0 +1,316 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/protocol"
+)
+
+// resultVersion is the version of the -result schema. It changes
+// only if fields are removed or change meaning; new fields may be
+// added without changing it.
+const resultVersion = 1
+
+// A jobResult describes one invocation, for -result. See "Scripting
+// with -result" in the README for the schema.
+type jobResult struct {
+	Version    int            `json:"version"`
+	JobID      string         `json:"job_id,omitempty"`
+	Function   string         `json:"function"`
+	Args       []string       `json:"args"`
+	ExitStatus int            `json:"exit_status"`
+	Signal     string         `json:"signal,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Outputs    []outputResult `json:"outputs"`
+	// Skipped summarizes the outputs the output filter skipped
+	Skipped  *files.SkippedOutputs `json:"skipped_outputs,omitempty"`
+	Stdout   *blobResult           `json:"stdout,omitempty"`
+	Stderr   *blobResult           `json:"stderr,omitempty"`
+	Timing   timingResult          `json:"timing"`
+	Transfer transferResult        `json:"transfer"`
+	Retries  int                   `json:"retries,omitempty"`
+	Local    bool                  `json:"local,omitempty"`
+	Memoized bool                  `json:"memoized,omitempty"`
+	Warnings []string              `json:"warnings,omitempty"`
+}
+
+type outputResult struct {
+	// Path is the output's path in the job's workspace, and
+	// Local where it was written, if it was
+	Path  string `json:"path"`
+	Local string `json:"local,omitempty"`
+	// ID is the object holding the file, unless it was returned
+	// inline or is sparse
+	ID   string `json:"id,omitempty"`
+	Size int64  `json:"size"`
+	// Skipped is set if the output filter skipped the output, in
+	// which case Data holds its contents, base64-encoded, if they
+	// were returned inline, since they aren't in the store
+	Skipped bool   `json:"skipped,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+type blobResult struct {
+	ID string `json:"id,omitempty"`
+	// Size is the size of the contents, if it is known
+	Size int64 `json:"size,omitempty"`
+	// Data holds the contents, base64-encoded, if llama has them
+	// and didn't write them to its own stdout or stderr
+	Data []byte `json:"data,omitempty"`
+}
+
+type timingResult struct {
+	E2E    int64 `json:"e2e_ms"`
+	Upload int64 `json:"upload_ms"`
+	Invoke int64 `json:"invoke_ms"`
+	Fetch  int64 `json:"fetch_ms"`
+	Remote struct {
+		E2E    int64 `json:"e2e_ms"`
+		Fetch  int64 `json:"fetch_ms"`
+		Exec   int64 `json:"exec_ms"`
+		Upload int64 `json:"upload_ms"`
+		Cold   bool  `json:"cold,omitempty"`
+	} `json:"remote"`
+}
+
+type transferResult struct {
+	// The objects the function fetched to run the job, and how
+	// many of them came from its local cache
+	FetchedObjects int   `json:"fetched_objects"`
+	FetchedBytes   int64 `json:"fetched_bytes"`
+	CachedObjects  int   `json:"cached_objects"`
+	// Sources counts the objects fetched from each replica of
+	// the store, the primary included, if the function has any
+	Sources map[string]int `json:"sources,omitempty"`
+}
+
+// invokeResult describes the daemon's reply to `args`. The
+// command's stdout is included if `stdout` is set.
+func invokeResult(args *daemon.InvokeWithFilesArgs, reply *daemon.InvokeWithFilesReply, stdout bool) *jobResult {
+	var skipped protocol.FileList
+	if !args.DeferOutputs {
+		_, skipped = args.OutputFilter.Filter(reply.Outputs)
+	}
+	r := &jobResult{
+		JobID:      reply.JobID,
+		Function:   args.Function,
+		Args:       args.Args,
+		ExitStatus: reply.ExitStatus,
+		Signal:     reply.Signal,
+		Error:      reply.InvokeErr,
+		Outputs:    outputResults(args.Outputs, reply.Outputs, skipped),
+		Skipped:    skippedOf(skipped),
+		Stdout:     blobOf(reply.StdoutID, reply.Stdout, stdout),
+		Stderr:     blobOf(reply.StderrID, reply.Stderr, false),
+		Transfer:   transferOf(&reply.Transfer),
+		Retries:    reply.Retries,
+		Local:      reply.Local,
+		Memoized:   reply.Memoized,
+		Warnings:   reply.Warnings,
+	}
+	r.Timing.E2E = reply.Timing.E2E.Milliseconds()
+	r.Timing.Upload = reply.Timing.Upload.Milliseconds()
+	r.Timing.Invoke = reply.Timing.Invoke.Milliseconds()
+	r.Timing.Fetch = reply.Timing.Fetch.Milliseconds()
+	r.Timing.setRemote(&reply.Timing.Remote)
+	return r
+}
+
+// xargsResult describes a job `llama xargs` ran on `function`.
+// Its stdout and stderr are only referenced, since xargs doesn't
+// fetch them unless the job fails.
+func xargsResult(function string, job *Invocation) *jobResult {
+	r := &jobResult{
+		Function: function,
+		Args:     job.FormattedArgs,
+		Outputs:  []outputResult{},
+	}
+	r.Timing.Upload = job.Upload.Milliseconds()
+	r.Timing.Invoke = job.Invoke.Milliseconds()
+	r.Timing.Fetch = job.Fetch.Milliseconds()
+	r.Timing.E2E = (job.Upload + job.Invoke + job.Fetch).Milliseconds()
+	if job.Err != nil {
+		r.Error = job.Err.Error()
+	}
+	if job.Result == nil {
+		return r
+	}
+	resp := &job.Result.Response
+	if job.Result.Function != "" {
+		r.Function = job.Result.Function
+	}
+	r.JobID = resp.JobID
+	r.ExitStatus = resp.ExitStatus
+	r.Signal = resp.Signal
+	r.Outputs = outputResults(job.TemplateContext.Outputs, resp.Outputs, job.Skipped)
+	r.Skipped = skippedOf(job.Skipped)
+	r.Stdout = blobRef(resp.Stdout)
+	r.Stderr = blobRef(resp.Stderr)
+	r.Transfer = transferOf(&resp.Transfer)
+	r.Retries = job.Result.Retries
+	r.Local = resp.Local
+	r.Memoized = resp.Memoized
+	r.Warnings = resp.Warnings
+	r.Timing.setRemote(&resp.Times)
+	return r
+}
+
+// blobRef describes `b` without fetching it. Inline contents are
+// included.
+func blobRef(b *protocol.Blob) *blobResult {
+	if b == nil {
+		return nil
+	}
+	if b.Ref != "" {
+		return &blobResult{ID: b.Ref}
+	}
+	data := b.Bytes
+	if data == nil {
+		data = []byte(b.String)
+	}
+	return &blobResult{Size: int64(len(data)), Data: data}
+}
+
+func (t *timingResult) setRemote(remote *protocol.Timing) {
+	t.Remote.E2E = remote.E2E.Milliseconds()
+	t.Remote.Fetch = remote.Fetch.Milliseconds()
+	t.Remote.Exec = remote.Exec.Milliseconds()
+	t.Remote.Upload = remote.Upload.Milliseconds()
+	t.Remote.Cold = remote.ColdStart
+}
+
+func transferOf(t *protocol.Transfer) transferResult {
+	var out transferResult
+	for _, f := range t.Fetched {
+		out.FetchedObjects++
+		out.FetchedBytes += f.Bytes
+		if f.Cached {
+			out.CachedObjects++
+		}
+		if f.Source != "" {
+			if out.Sources == nil {
+				out.Sources = make(map[string]int)
+			}
+			out.Sources[f.Source]++
+		}
+	}
+	return out
+}
+
+// outputResults describes `returned`, the outputs a job returned,
+// which were written to the local paths `outputs` maps them to,
+// unless they are among those `skipped`
+func outputResults(outputs files.List, returned, skipped protocol.FileList) []outputResult {
+	skip := make(map[string]bool, len(skipped))
+	for _, f := range skipped {
+		skip[f.Path] = true
+	}
+	results := []outputResult{}
+	for _, f := range returned {
+		r := outputResult{Path: f.Path, ID: f.Ref, Size: f.Size, Skipped: skip[f.Path]}
+		if r.Skipped {
+			if f.Ref == "" && len(f.Extents) == 0 && f.Compression == "" {
+				r.Data = f.Bytes
+				if r.Data == nil {
+					r.Data = []byte(f.String)
+				}
+			}
+		} else if local, ok := outputs.LocalPath(f.Path); ok {
+			r.Local = local
+		}
+		switch {
+		case r.Size != 0:
+		case f.Ref == "" && len(f.Extents) == 0:
+			r.Size = int64(len(f.Bytes) + len(f.String))
+		case r.Local != "":
+			if fi, err := os.Stat(r.Local); err == nil {
+				r.Size = fi.Size()
+			}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// skippedOf summarizes `skipped`, if there are any
+func skippedOf(skipped protocol.FileList) *files.SkippedOutputs {
+	if len(skipped) == 0 {
+		return nil
+	}
+	s := files.Skipped(skipped)
+	return &s
+}
+
+// blobOf describes a blob with the object ID `id` and contents
+// `data`, including them if `include` is set
+func blobOf(id string, data []byte, include bool) *blobResult {
+	if id == "" && data == nil {
+		return nil
+	}
+	b := &blobResult{ID: id, Size: int64(len(data))}
+	if include {
+		b.Data = data
+	}
+	return b
+}
+
+// A resultWriter writes jobResults, one JSON document per line, to
+// a file or to stdout. It is safe for concurrent use.
+type resultWriter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	// Stdout is set if results go to stdout, which must then
+	// carry nothing else
+	Stdout bool
+}
+
+// openResults opens `path` to write results to, or stdout if it is
+// "-"
+func openResults(path string) (*resultWriter, error) {
+	if path == "-" {
+		return &resultWriter{w: os.Stdout, Stdout: true}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{w: f}, nil
+}
+
+func (w *resultWriter) Write(r *jobResult) error {
+	r.Version = resultVersion
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.w.Write(append(data, '\n'))
+	return err
+}
+
+func (w *resultWriter) Close() error {
+	if w.Stdout {
+		return nil
+	}
+	return w.w.Close()
+}
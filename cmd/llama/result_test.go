@@ -0,0 +1,111 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXargsResult(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "a.o")
+	require.NoError(t, ioutil.WriteFile(local, []byte("object"), 0644))
+
+	job := &Invocation{FormattedArgs: []string{"cc", "-c", "a.c"}}
+	job.TemplateContext.Outputs = files.List{{Local: files.LocalFile{Path: local}, Remote: "a.o"}}
+	job.Result = &llama.InvokeResult{
+		Function: "gcc-big",
+		Response: protocol.InvocationResponse{
+			JobID:      "job",
+			ExitStatus: -1,
+			Signal:     "SIGSEGV",
+			Stdout:     &protocol.Blob{Bytes: []byte("hi\n")},
+			Stderr:     &protocol.Blob{Ref: "sha256:err"},
+			Outputs: protocol.FileList{
+				{Path: "a.o", File: protocol.File{Blob: protocol.Blob{Ref: "sha256:obj"}}},
+				{Path: "extra", File: protocol.File{Blob: protocol.Blob{String: "xy"}}},
+			},
+			Transfer: protocol.Transfer{Fetched: []protocol.Fetch{{ID: "a", Bytes: 10}, {ID: "b", Bytes: 5, Cached: true, Source: "s3://replica"}}},
+			Warnings: []string{"careful"},
+		},
+	}
+
+	r := xargsResult("gcc", job)
+	assert.Equal(t, "gcc-big", r.Function)
+	assert.Equal(t, "SIGSEGV", r.Signal)
+	assert.Equal(t, []outputResult{
+		{Path: "a.o", Local: local, ID: "sha256:obj", Size: 6},
+		{Path: "extra", Size: 2},
+	}, r.Outputs)
+	assert.Nil(t, r.Skipped)
+
+	job.Skipped = job.Result.Response.Outputs[:1]
+	r = xargsResult("gcc", job)
+	assert.Equal(t, outputResult{Path: "a.o", ID: "sha256:obj", Skipped: true}, r.Outputs[0])
+	assert.Equal(t, &files.SkippedOutputs{Count: 1, Unsized: 1}, r.Skipped)
+	job.Skipped = job.Result.Response.Outputs[1:]
+	r = xargsResult("gcc", job)
+	assert.Equal(t, outputResult{Path: "extra", Size: 2, Skipped: true, Data: []byte("xy")}, r.Outputs[1])
+	job.Skipped = nil
+	assert.Equal(t, &blobResult{Size: 3, Data: []byte("hi\n")}, r.Stdout)
+	assert.Equal(t, &blobResult{ID: "sha256:err"}, r.Stderr)
+	assert.Equal(t, transferResult{FetchedObjects: 2, FetchedBytes: 15, CachedObjects: 1, Sources: map[string]int{"s3://replica": 1}}, r.Transfer)
+
+	job.Result = nil
+	job.Err = errors.New("upload failed")
+	r = xargsResult("gcc", job)
+	assert.Equal(t, "upload failed", r.Error)
+	assert.Equal(t, []outputResult{}, r.Outputs)
+}
+
+func TestResultWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	w, err := openResults(path)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(&jobResult{Function: "gcc", Args: []string{"true"}, Outputs: []outputResult{}}))
+	require.NoError(t, w.Write(&jobResult{Function: "gcc", Args: []string{"false"}, ExitStatus: 1, Outputs: []outputResult{}}))
+	require.NoError(t, w.Close())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var m map[string]interface{}
+		require.NoError(t, dec.Decode(&m))
+		lines = append(lines, m)
+	}
+	require.Len(t, lines, 2)
+	assert.Equal(t, float64(resultVersion), lines[0]["version"])
+	assert.Equal(t, float64(1), lines[1]["exit_status"])
+	assert.Equal(t, []interface{}{}, lines[0]["outputs"])
+
+	stdout, err := openResults("-")
+	require.NoError(t, err)
+	assert.True(t, stdout.Stdout)
+	assert.Equal(t, os.Stdout, stdout.w)
+}
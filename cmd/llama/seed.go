@@ -0,0 +1,116 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/files"
+)
+
+type SeedCommand struct {
+	ignore      files.IgnoreRules
+	ignoreFile  string
+	manifest    string
+	concurrency int
+	compress    string
+	progress    bool
+	statCache   statCacheFlags
+}
+
+func (*SeedCommand) Name() string     { return "seed" }
+func (*SeedCommand) Synopsis() string { return "Upload directories to the object store ahead of time" }
+func (*SeedCommand) Usage() string {
+	return `seed [flags] DIR...
+
+Upload every file under each DIR, such as a toolchain or a tree of
+headers, to the object store, so that the first jobs to use them
+don't pay for the upload. Objects already in the store aren't
+uploaded again. With -manifest, also write a manifest of the files
+and the objects they were stored as, which ` + "`llama xargs -seed`" + `
+can use to skip hashing them again.
+
+Ignore patterns are globs, as accepted by Go's path.Match. Patterns
+without a slash match the name of any file or directory; patterns
+with one match paths relative to DIR. A trailing slash makes a
+pattern match only directories.
+`
+}
+
+func (c *SeedCommand) SetFlags(flags *flag.FlagSet) {
+	flags.Var(&c.ignore, "ignore", "Skip files and directories matching this `pattern`; may be repeated")
+	flags.StringVar(&c.ignoreFile, "ignore-file", "", "Read ignore patterns from `file`, one per line")
+	flags.StringVar(&c.manifest, "manifest", "", "Write a manifest of the seeded files to `file`")
+	flags.IntVar(&c.concurrency, "j", 2*files.DefaultUploadConcurrency, "Number of files to hash and upload concurrently")
+	flags.StringVar(&c.compress, "compress", "", "Compress large files using the named algorithm (zstd); jobs must use the same setting to reuse them")
+	flags.BoolVar(&c.progress, "progress", false, "Report upload progress")
+	c.statCache.register(flags)
+}
+
+func (c *SeedCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() < 1 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	opts := files.SeedOptions{
+		UploadOptions: files.UploadOptions{
+			Compression: c.compress,
+			Concurrency: c.concurrency,
+			StatCache:   c.statCache.open(global),
+		},
+		Ignore: c.ignore,
+	}
+	defer saveStatCache(opts.StatCache)
+	if c.ignoreFile != "" {
+		rules, err := files.ReadIgnoreFile(c.ignoreFile)
+		if err != nil {
+			log.Printf("reading ignore file: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+		opts.Ignore = append(opts.Ignore, rules...)
+	}
+	if c.progress {
+		opts.Progress = func(p files.UploadProgress) {
+			fmt.Fprintf(os.Stderr, "\rllama: seeding: %s", p.String())
+			if p.Files == p.TotalFiles {
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+
+	res, err := files.Seed(ctx, global.MustStore(), flag.Args(), opts)
+	if err != nil {
+		log.Printf("seeding: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	log.Printf("seeded %s", res.String())
+
+	if c.manifest != "" {
+		res.Manifest.Store = global.Config.Store
+		if err := res.Manifest.Write(c.manifest); err != nil {
+			log.Printf("writing manifest: %s", err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
+)
+
+type ShowTraceCommand struct {
+	chrome string
+	raw    string
+}
+
+func (*ShowTraceCommand) Name() string     { return "show-trace" }
+func (*ShowTraceCommand) Synopsis() string { return "Fetch and display a trace saved by an invocation" }
+func (*ShowTraceCommand) Usage() string {
+	return `show-trace [flags] JOB-ID
+
+Fetch the trace saved by "llama invoke -persist-trace" for JOB-ID
+and print a summary of its spans.
+`
+}
+
+func (c *ShowTraceCommand) SetFlags(flags *flag.FlagSet) {
+	flags.StringVar(&c.chrome, "chrome-trace", "", "Write the trace to a file in Chrome's trace-event format")
+	flags.StringVar(&c.raw, "o", "", "Write the trace's spans to a file, for use with `llama trace`")
+}
+
+func (c *ShowTraceCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+	if flag.NArg() != 1 {
+		log.Printf("usage: %s", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	id := flag.Arg(0)
+
+	spans, err := store.GetTrace(ctx, global.MustStore(), id)
+	if err != nil {
+		log.Printf("fetching trace for %q: %v", id, err)
+		return subcommands.ExitFailure
+	}
+
+	if c.chrome != "" {
+		if err := writeFile(c.chrome, func(fh *os.File) error {
+			return tracing.WriteChromeTrace(fh, spans)
+		}); err != nil {
+			log.Printf("chrome-trace: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+	if c.raw != "" {
+		if err := writeFile(c.raw, func(fh *os.File) error {
+			enc := json.NewEncoder(fh)
+			for i := range spans {
+				if err := enc.Encode(&spans[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			log.Printf("writing spans: %v", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	agg := tracing.NewAggregator()
+	for i := range spans {
+		agg.Submit(&spans[i])
+	}
+	fmt.Printf("%d spans in trace for job %s\n", len(spans), id)
+	tracing.WriteSummary(os.Stdout, agg.Snapshot())
+	return subcommands.ExitSuccess
+}
+
+func writeFile(path string, write func(fh *os.File) error) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(fh); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
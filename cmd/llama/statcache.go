@@ -0,0 +1,69 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/files"
+)
+
+// statCacheFlags configures the stat cache consulted when uploading
+// local files; see files.StatCache
+type statCacheFlags struct {
+	disable bool
+	verify  float64
+}
+
+func (f *statCacheFlags) register(flags *flag.FlagSet) {
+	flags.BoolVar(&f.disable, "no-stat-cache", false, "Read and hash every input file, instead of trusting the stat cache for unchanged ones")
+	flags.Float64Var(&f.verify, "verify-stat-cache", 0, "Rehash this `fraction` of the input files the stat cache claims are unchanged, and check them")
+}
+
+// open opens the stat cache for the configured store. It returns nil
+// if the cache is disabled or can't be opened.
+func (f *statCacheFlags) open(global *cli.GlobalState) *files.StatCache {
+	if f.disable {
+		return nil
+	}
+	path, err := files.DefaultStatCachePath(global.Config.Store)
+	if err != nil {
+		log.Printf("llama: stat cache: %s", err.Error())
+		return nil
+	}
+	cache, err := files.OpenStatCache(path)
+	if err != nil {
+		log.Printf("llama: stat cache: %s", err.Error())
+		return nil
+	}
+	cache.Verify = f.verify
+	return cache
+}
+
+// saveStatCache saves `cache`, if there is one, warning about any
+// stale entries verification turned up.
+func saveStatCache(cache *files.StatCache) {
+	if cache == nil {
+		return
+	}
+	if stats := cache.Stats(); stats.Stale > 0 {
+		log.Printf("llama: stat cache: %d of %d verified files had changed without changing their mtime", stats.Stale, stats.Verified)
+	}
+	if err := cache.Save(); err != nil {
+		log.Printf("llama: saving stat cache: %s", err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/store/storebench"
+)
+
+type StoreBenchCommand struct {
+	backends string
+	workload storebench.Workload
+	opts     storebench.Options
+	count    int
+	json     bool
+}
+
+func (*StoreBenchCommand) Name() string     { return "store-bench" }
+func (*StoreBenchCommand) Synopsis() string { return "Benchmark object store backends" }
+func (*StoreBenchCommand) Usage() string {
+	return `store-bench [flags]
+
+Store and fetch a synthetic workload of objects through each
+backend, and print the throughput, request counts, and latencies
+of each phase in the Go benchmark format, for benchstat.
+
+Backends are mem, disk, disk:DIR, fake-s3 (an in-process fake
+bucket), s3 (the configured store), or s3://BUCKET/PATH. Real
+buckets accumulate the workload's objects.
+`
+}
+
+func (c *StoreBenchCommand) SetFlags(flags *flag.FlagSet) {
+	c.workload = storebench.DefaultWorkload
+	flags.StringVar(&c.backends, "backend", "mem", "Comma-separated backends to benchmark")
+	flags.IntVar(&c.workload.Objects, "objects", c.workload.Objects, "Number of objects")
+	flags.IntVar(&c.workload.MinSize, "min-size", c.workload.MinSize, "Smallest object size, in bytes")
+	flags.IntVar(&c.workload.MaxSize, "max-size", c.workload.MaxSize, "Largest object size, in bytes")
+	flags.Float64Var(&c.workload.Dedup, "dedup", c.workload.Dedup, "Fraction of objects that repeat an earlier one")
+	flags.Float64Var(&c.workload.Compressible, "compressible", c.workload.Compressible, "Fraction of each object that is zeros")
+	flags.IntVar(&c.workload.Concurrency, "concurrency", c.workload.Concurrency, "Store or GetObjects calls in flight at once")
+	flags.IntVar(&c.workload.Batch, "batch", c.workload.Batch, "Objects per GetObjects call")
+	flags.Int64Var(&c.workload.Seed, "seed", c.workload.Seed, "Random seed for the workload")
+	flags.IntVar(&c.opts.S3Concurrency, "fetch-concurrency", 0, "Objects an S3 backend fetches at once per GetObjects call")
+	flags.Uint64Var(&c.opts.DiskCacheBytes, "disk-cache", 0, "Put a disk cache of this many bytes in front of S3 backends")
+	flags.BoolVar(&c.opts.HeadCheck, "head-check", false, "Check for objects before uploading them to S3 backends")
+	flags.DurationVar(&c.opts.Latency, "latency", 0, "Latency to add to each fake S3 request")
+	flags.IntVar(&c.count, "count", 1, "Run each benchmark this many times")
+	flags.BoolVar(&c.json, "json", false, "Print results as JSON lines")
+}
+
+func (c *StoreBenchCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global := cli.MustState(ctx)
+
+	var results []*storebench.Result
+	for _, backend := range strings.Split(c.backends, ",") {
+		name := backend
+		if backend == "s3" {
+			backend = global.Config.Store
+		}
+		opts := c.opts
+		if strings.HasPrefix(backend, "s3://") {
+			opts.Session = global.MustSession()
+			// Keep result names stable across buckets
+			name = "s3"
+		}
+		for i := 0; i < c.count; i++ {
+			st, done, err := storebench.Open(ctx, backend, opts)
+			if err != nil {
+				log.Printf("store-bench: %s", err.Error())
+				return subcommands.ExitFailure
+			}
+			workload := c.workload
+			if strings.HasPrefix(backend, "s3://") {
+				// Don't let a real bucket dedup earlier
+				// runs' objects
+				workload.Seed += time.Now().UnixNano()
+			}
+			res, err := storebench.Run(ctx, name, st, workload)
+			done()
+			if err != nil {
+				log.Printf("store-bench: %s: %s", name, err.Error())
+				return subcommands.ExitFailure
+			}
+			res.Workload.Seed = c.workload.Seed
+			results = append(results, res)
+		}
+	}
+
+	write := storebench.WriteText
+	if c.json {
+		write = storebench.WriteJSON
+	}
+	if err := write(os.Stdout, results); err != nil {
+		log.Printf("store-bench: %s", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -18,18 +18,23 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/google/subcommands"
+	"github.com/nelhage/llama/client"
 	"github.com/nelhage/llama/cmd/internal/cli"
+	"github.com/nelhage/llama/cost"
 	"github.com/nelhage/llama/files"
 	"github.com/nelhage/llama/llama"
 	"github.com/nelhage/llama/protocol"
@@ -41,10 +46,34 @@ type XargsCommand struct {
 	logs        bool
 	files       files.List
 	concurrency int
+	progress    bool
+	local       bool
+	fallback    bool
+	record      string
+	costReport  bool
+	costJSON    string
+	pricing     string
+	statCache   statCacheFlags
+	seed        string
+	nested      bool
+	escalate    bool
+	memoize     bool
+	refresh     bool
+	result      string
+	filter      files.OutputFilter
 
-	lambda   *lambda.Lambda
+	client   *client.Client
+	runner   llama.LocalRunner
 	function string
 	fileMap  protocol.FileList
+	// fileBytes is the size of the -file inputs, if jobs are
+	// routed
+	fileBytes int64
+	// claims catches jobs whose outputs overlap
+	claims files.Claims
+	cost   cost.Tracker
+	// uploadOpts is used for every file the run uploads
+	uploadOpts files.UploadOptions
 }
 
 func (*XargsCommand) Name() string     { return "xargs" }
@@ -59,6 +88,22 @@ func (c *XargsCommand) SetFlags(flags *flag.FlagSet) {
 	flags.Var(&c.files, "f", "Pass a file through to the invocation")
 	flags.Var(&c.files, "file", "Pass a file through to the invocation")
 	flags.IntVar(&c.concurrency, "j", 100, "Number of concurrent lambdas to execute")
+	flags.BoolVar(&c.progress, "progress", false, "Show progress while uploading -file inputs")
+	flags.BoolVar(&c.local, "local", false, "Run the commands locally instead of on Lambda (Linux only)")
+	flags.StringVar(&c.record, "record", "", "Record each invocation's spec and response in `DIR` (see `llama replay`)")
+	flags.BoolVar(&c.fallback, "local-fallback", false, "Run commands locally if the function can't be invoked (Linux only)")
+	flags.BoolVar(&c.costReport, "cost", false, "Print an estimate of the run's AWS cost when it finishes")
+	flags.StringVar(&c.costJSON, "cost-json", "", "Write the run's cost estimate as JSON to `file`")
+	flags.StringVar(&c.pricing, "pricing", "", "Estimate costs with the price overrides in this JSON `file` (default $"+cost.PricingEnv+")")
+	flags.StringVar(&c.seed, "seed", "", "Reuse the uploads recorded in this `manifest` from `llama seed` for files that haven't changed")
+	flags.BoolVar(&c.nested, "nested", false, "Let the commands invoke llama functions themselves, with the function's credentials")
+	flags.StringVar(&c.result, "result", "", "Write a JSON description of each invocation, one per line, to `file`, or to stdout if \"-\" (see the README)")
+	flags.BoolVar(&c.memoize, "memoize", false, "Declare the commands deterministic, and reuse the stored results of identical earlier invocations")
+	flags.BoolVar(&c.refresh, "refresh-memo", false, "With -memoize, run every command even if a result is stored, and replace it")
+	flags.Var(&c.filter.Include, "include-output", "Only fetch outputs whose paths match this `pattern`; may be repeated")
+	flags.Var(&c.filter.Exclude, "exclude-output", "Don't fetch outputs whose paths match this `pattern`; may be repeated")
+	flags.BoolVar(&c.escalate, "escalate", false, "If FUNCTION-NAME is a router, retry jobs that run out of memory on its next larger function")
+	c.statCache.register(flags)
 }
 
 type Invocation struct {
@@ -69,54 +114,136 @@ type Invocation struct {
 	OutputPaths     map[string]string
 	Result          *llama.InvokeResult
 	Err             error
+	// Started is set once the job has been submitted to the
+	// function
+	Started bool
+	// Skipped lists the outputs the output filter skipped
+	Skipped protocol.FileList
+	// How long the job spent uploading its inputs, being
+	// invoked, and fetching its outputs
+	Upload, Invoke, Fetch time.Duration
 }
 
 func (c *XargsCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	global := cli.MustState(ctx)
 
 	var err error
+	c.uploadOpts.StatCache = c.statCache.open(global)
+	defer saveStatCache(c.uploadOpts.StatCache)
+	if c.seed != "" {
+		if c.uploadOpts.Seed, err = files.ReadSeedManifest(c.seed); err != nil {
+			log.Fatalf("reading seed manifest: %s", err.Error())
+		}
+		if s := c.uploadOpts.Seed.Store; s != "" && s != global.Config.Store {
+			log.Printf("warning: the seed manifest's files are in %s, but the configured store is %s", s, global.Config.Store)
+		}
+	}
 	if len(c.files) > 0 {
-		c.fileMap, err = c.files.Upload(ctx, global.MustStore(), c.fileMap)
+		opts := c.uploadOpts
+		if c.progress {
+			opts.Progress = func(p files.UploadProgress) {
+				fmt.Fprintf(os.Stderr, "\rllama: uploading: %s", p.String())
+				if p.Files == p.TotalFiles {
+					fmt.Fprintln(os.Stderr)
+				}
+			}
+		}
+		c.fileMap, err = c.files.UploadWith(ctx, global.MustStore(), c.fileMap, opts)
 		if err != nil {
 			log.Fatalf("files: %s", err.Error())
 		}
 	}
-	c.lambda = lambda.New(global.MustSession())
+	if c.local || c.fallback {
+		if c.runner, err = llama.NewLocal(global.MustStore()); err != nil {
+			log.Fatalf("local execution: %s", err.Error())
+		}
+	}
 	c.function = flag.Arg(0)
+	if c.client, err = global.Client(c.function); err != nil {
+		log.Fatalf("initializing client: %s", err.Error())
+	}
+	if router := c.client.Router(); router != nil {
+		router.Escalate = router.Escalate || c.escalate
+		c.fileBytes = c.files.Size()
+	}
+	var pricing *cost.Pricing
+	if c.costReport || c.costJSON != "" {
+		if pricing, err = cost.LoadPricing(c.pricing); err != nil {
+			log.Fatalf("%s", err.Error())
+		}
+	}
+
+	var results *resultWriter
+	if c.result != "" {
+		if results, err = openResults(c.result); err != nil {
+			log.Fatalf("opening -result: %s", err.Error())
+		}
+		defer results.Close()
+	}
 
 	submit := make(chan *Invocation)
 	go generateJobs(ctx, os.Stdin, flag.Args()[1:], submit)
-	results := make(chan *Invocation)
+	finished := make(chan *Invocation)
 
 	var wg sync.WaitGroup
 	wg.Add(c.concurrency)
 	go func() {
 		wg.Wait()
-		close(results)
+		close(finished)
 	}()
 	for i := 0; i < c.concurrency; i++ {
 		go func() {
 			defer wg.Done()
-			c.worker(ctx, submit, results)
+			c.worker(ctx, submit, finished)
 		}()
 	}
 
 	code := subcommands.ExitSuccess
-	for done := range results {
+	var completed, failed int
+	var abandoned [][]string
+	var skipped files.SkippedOutputs
+	for done := range finished {
+		if len(done.Skipped) > 0 {
+			s := files.Skipped(done.Skipped)
+			skipped.Count += s.Count
+			skipped.Bytes += s.Bytes
+			skipped.Unsized += s.Unsized
+		}
 		if done.Err != nil || done.Result.Response.ExitStatus != 0 {
 			code = subcommands.ExitFailure
 		}
+		if results != nil && (done.Started || ctx.Err() == nil) {
+			if err := results.Write(xargsResult(c.function, done)); err != nil {
+				log.Printf("writing -result: %s", err.Error())
+				code = subcommands.ExitFailure
+			}
+		}
 		displayCmd := append([]string{c.function}, done.FormattedArgs...)
 		if done.Err == nil && done.Result.Response.ExitStatus == 0 {
-			log.Printf("Done: %v", displayCmd)
+			completed++
+			if done.Result.Response.Memoized {
+				log.Printf("Done: %v (memoized)", displayCmd)
+			} else if c.client.Router() != nil {
+				log.Printf("Done: %v (on %s)", displayCmd, done.Result.Function)
+			} else {
+				log.Printf("Done: %v", displayCmd)
+			}
 			continue
 		}
+		if done.Err != nil && ctx.Err() != nil {
+			if done.Started {
+				abandoned = append(abandoned, displayCmd)
+			}
+			continue
+		}
+		failed++
 
 		if done.Err == nil {
 			log.Printf("Command exited with status: %v: %d", displayCmd, done.Result.Response.ExitStatus)
 		} else if done.Err != nil {
 			log.Printf("Invocation failed: %v: %s", displayCmd, done.Err.Error())
-			if ret, ok := done.Err.(*llama.ErrorReturn); ok {
+			var ret *llama.ErrorReturn
+			if errors.As(done.Err, &ret) {
 				if ret.Logs != nil {
 					log.Printf("==== logs ====\n%s\n==== end logs ====\n", ret.Logs)
 				}
@@ -142,9 +269,50 @@ func (c *XargsCommand) Execute(ctx context.Context, flag *flag.FlagSet, _ ...int
 		}
 	}
 
+	if skipped.Count > 0 {
+		log.Printf("skipped %s not matching the output filter", skipped.String())
+	}
+
+	if ctx.Err() != nil {
+		reportInterrupted(completed, failed, abandoned)
+		code = cli.ExitInterrupted
+	}
+
+	if pricing != nil {
+		var client protocol.StoreUsage
+		global.MustStore().FetchAWSUsage(&client)
+		report := c.cost.Report(pricing, client, 10)
+		if c.costReport {
+			report.WriteText(os.Stderr)
+		}
+		if c.costJSON != "" {
+			data, _ := json.MarshalIndent(report, "", "  ")
+			if err := ioutil.WriteFile(c.costJSON, append(data, '\n'), 0644); err != nil {
+				log.Printf("writing cost report: %s", err.Error())
+				code = subcommands.ExitFailure
+			}
+		}
+	}
+
 	return code
 }
 
+// reportInterrupted summarizes a run cut short by an interrupt.
+// Jobs that had already been submitted can't be recalled, so they
+// may still run to completion on Lambda, but their outputs are not
+// fetched.
+func reportInterrupted(completed, failed int, abandoned [][]string) {
+	log.Printf("interrupted: %d jobs completed, %d failed, %d abandoned in flight; no further jobs were started",
+		completed, failed, len(abandoned))
+	if len(abandoned) == 0 {
+		return
+	}
+	log.Printf("these jobs had been submitted; any still running remotely can't be stopped, and their outputs won't be fetched:")
+	for _, cmd := range abandoned {
+		log.Printf("  %v", cmd)
+	}
+}
+
 func prepareTemplates(args []string) ([]*template.Template, error) {
 	var argTemplates []*template.Template
 	for i, arg := range args {
@@ -170,7 +338,7 @@ func generateJobs(ctx context.Context, lines io.Reader, args []string, out chan<
 	for {
 		i += 1
 		line, err := read.ReadString('\n')
-		if err == io.EOF {
+		if err == io.EOF || ctx.Err() != nil {
 			return
 		}
 		if err != nil {
@@ -184,13 +352,26 @@ func generateJobs(ctx context.Context, lines io.Reader, args []string, out chan<
 			},
 			Templates: argTemplates,
 		}
-		out <- &job
+		select {
+		case out <- &job:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 func (c *XargsCommand) worker(ctx context.Context, jobs <-chan *Invocation, out chan<- *Invocation) {
 	global := cli.MustState(ctx)
-	for job := range jobs {
+	for {
+		var job *Invocation
+		select {
+		case job = <-jobs:
+		case <-ctx.Done():
+			return
+		}
+		if job == nil {
+			return
+		}
 		c.run(ctx, global, job)
 		out <- job
 	}
@@ -221,6 +402,7 @@ func (j *jobContext) AsFile(data string) string {
 func prepareInvocation(ctx context.Context,
 	store store.Store,
 	globalFiles protocol.FileList,
+	opts files.UploadOptions,
 	job *Invocation) (*protocol.InvocationSpec, error) {
 	for _, tpl := range job.Templates {
 		var w bytes.Buffer
@@ -232,7 +414,7 @@ func prepareInvocation(ctx context.Context,
 	}
 
 	var allFiles protocol.FileList
-	allFiles, err := job.TemplateContext.Inputs.Upload(ctx, store, globalFiles)
+	allFiles, err := job.TemplateContext.Inputs.UploadWith(ctx, store, globalFiles, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -250,39 +432,61 @@ func prepareInvocation(ctx context.Context,
 }
 
 func (c *XargsCommand) run(ctx context.Context, global *cli.GlobalState, job *Invocation) {
-	st := global.MustStore()
-	spec, err := prepareInvocation(ctx, st, c.fileMap, job)
+	st := c.client.Store()
+	start := time.Now()
+	spec, err := prepareInvocation(ctx, st, c.fileMap, c.uploadOpts, job)
+	job.Upload = time.Since(start)
 	if err != nil {
 		job.Err = err
 		return
 	}
+	spec.Nested = c.nested
+	spec.Deterministic = c.memoize
+	function := c.function
+	if c.client.Router() != nil {
+		// Leave the function for the router to pick
+		function = ""
+		spec.InputBytes = c.fileBytes + job.TemplateContext.Inputs.Size()
+	}
 	job.Args = &llama.InvokeArgs{
-		Function:   c.function,
+		Function:   function,
 		ReturnLogs: c.logs,
 		Spec:       *spec,
+		Reupload: func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error) {
+			local := append(c.files[:len(c.files):len(c.files)], job.TemplateContext.Inputs...)
+			return local.Reupload(ctx, st, spec.Files, missing, c.uploadOpts)
+		},
+		Local:         c.runner,
+		LocalFallback: !c.local,
+		Record:        c.record,
+		Memoize:       c.memoize,
+		RefreshMemo:   c.refresh,
 	}
 
-	if job.Err != nil {
+	if job.Err = ctx.Err(); job.Err != nil {
 		return
 	}
-	job.Result, job.Err = llama.Invoke(ctx, c.lambda, st, job.Args)
+	job.Started = true
+	start = time.Now()
+	job.Result, job.Err = c.client.InvokeWith(ctx, job.Args)
+	job.Invoke = time.Since(start)
+	if job.Result != nil {
+		c.cost.AddJob(job.Result.Function, cost.Name(append([]string{c.function}, job.FormattedArgs...)),
+			job.Result.Response.JobID, cost.JobUsage(&job.Result.Response))
+	}
 
 	if job.Err == nil {
-		fetchList, extra := job.TemplateContext.Outputs.TransformToLocal(ctx, job.Result.Response.Outputs)
+		var wanted protocol.FileList
+		wanted, job.Skipped = c.filter.Filter(job.Result.Response.Outputs)
+		fetchList, extra := job.TemplateContext.Outputs.TransformToLocal(ctx, wanted)
 		for _, out := range extra {
 			log.Printf("Remote returned unexpected output: %s", out.Path)
 		}
-		var gets []store.GetRequest
-		for _, file := range fetchList {
-			gets = protocol_files.AppendGet(gets, &file.Blob)
-		}
-		st.GetObjects(ctx, gets)
-		for _, file := range fetchList {
-			err, gets = protocol_files.FetchFile(&file.File, file.Path, gets)
-			if err != nil {
-				job.Err = err
-				break
-			}
-		}
+		start = time.Now()
+		job.Err = files.FetchOutputs(ctx, st, fetchList, files.FetchOptions{
+			Claims: &c.claims,
+			Owner:  fmt.Sprintf("input line %d", job.TemplateContext.Idx+1),
+		})
+		job.Fetch = time.Since(start)
 	}
 }
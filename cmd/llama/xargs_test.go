@@ -70,7 +70,7 @@ func generateAndPrepare(
 	go generateJobs(context.Background(), read, args, jobs)
 	var specs []*protocol.InvocationSpec
 	for job := range jobs {
-		spec, err := prepareInvocation(ctx, st, files, job)
+		spec, err := prepareInvocation(ctx, st, files, fs.UploadOptions{}, job)
 		if err != nil {
 			t.Fatalf("prepare: %s", err.Error())
 		}
@@ -206,3 +206,13 @@ func TestPrepareInvocation_Files(t *testing.T) {
 	gotFiles = readFiles(t, ctx, st, specs[0].Files)
 	assert.Equal(t, wantFiles, gotFiles, ".I and .AsFile")
 }
+
+func TestGenerateJobs_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jobs := make(chan *Invocation)
+	go generateJobs(ctx, strings.NewReader("a\nb\n"), []string{"echo", "{{.Line}}"}, jobs)
+	for job := range jobs {
+		t.Errorf("job generated after cancellation: %q", job.TemplateContext.Line)
+	}
+}
@@ -17,109 +17,113 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws/session"
-
+	"github.com/nelhage/llama/internal/bufpool"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/runner"
 	"github.com/nelhage/llama/store"
-	"github.com/nelhage/llama/store/s3store"
+	"github.com/nelhage/llama/store/storeurl"
+	"github.com/nelhage/llama/tracing"
 )
 
 const DiskCacheLimit = 100 * 1024 * 1024
 
-func initStore() (store.Store, error) {
-	session, err := session.NewSession()
-	if err != nil {
-		return nil, err
-	}
+func initStore(concurrency int, replicas []string) (store.Store, string, error) {
 	url := os.Getenv("LLAMA_OBJECT_STORE")
 	if url == "" {
-		return nil, errors.New("Could not read llama s3 bucket from LLAMA_OBJECT_STORE")
+		return nil, "", errors.New("Could not read llama s3 bucket from LLAMA_OBJECT_STORE")
 	}
 	cacheDir, err := ioutil.TempDir("", "llama.cache.*")
 	if err != nil {
-		return nil, err
-	}
-	opts := s3store.Options{
-		DiskCachePath:  cacheDir,
-		DiskCacheBytes: DiskCacheLimit,
+		return nil, "", err
 	}
-	s3, err := s3store.FromSessionAndOptions(session, url, opts)
+	urls := append([]string{url}, replicas...)
+	st, err := storeurl.OpenFailover(context.Background(), urls, storeurl.Options{
+		CacheDir:    cacheDir,
+		CacheBytes:  DiskCacheLimit,
+		Concurrency: concurrency,
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-
-	return s3, nil
+	return st, cacheDir, nil
 }
 
 func main() {
+	t_start := time.Now()
+	runner.SandboxHelper()
+
+	runner.SetLogOutput(os.Stderr, os.Getenv("LLAMA_LOG_FORMAT") == "text")
+
 	runtimeURI := os.Getenv("AWS_LAMBDA_RUNTIME_API")
 	if runtimeURI == "" {
 		log.Fatalf("could not read runtime API endpoint")
 	}
 
-	client := http.Client{}
 	ctx := context.Background()
 
-	store, err := initStore()
+	concurrency, retain := runner.StoreTuning()
+	bufpool.SetMaxRetained(retain)
+
+	replicas := strings.Fields(os.Getenv(protocol.StoreReplicasEnv))
+	t_store := time.Now()
+	store, cacheDir, err := initStore(concurrency, replicas)
+	storeTime := time.Since(t_store)
 	if err != nil {
-		log.Printf("initialization error: %s", err.Error())
-		payload, _ := json.Marshal(struct {
-			Error string `json:"error"`
-		}{fmt.Sprintf("Unable to initialize store: %s", err.Error())})
-		req, _ := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/2018-06-01/runtime/init/error", runtimeURI), bytes.NewReader(payload))
-		client.Do(req)
+		runner.InitError(ctx, runtimeURI, fmt.Errorf("Unable to initialize store: %w", err))
 		os.Exit(1)
 	}
 
-	cmdline := computeCmdline(os.Args[1:])
-
-	var workerId [8]byte
-	if _, err := rand.Reader.Read(workerId[:]); err != nil {
-		log.Fatalf("gen ID: %s", err.Error())
+	maxWorkers, _ := strconv.Atoi(os.Getenv("LLAMA_MAX_WORKERS"))
+	cmdline, tool := computeCmdline(os.Args[1:])
+	opts := runner.Options{
+		Store:         store,
+		Cmdline:       cmdline,
+		Tool:          tool,
+		CacheDir:      cacheDir,
+		Fsync:         os.Getenv("LLAMA_FSYNC") != "",
+		URLToken:      os.Getenv(protocol.URLTokenEnv),
+		MaxWorkers:    maxWorkers,
+		Concurrency:   concurrency,
+		Started:       t_start,
+		InitStore:     storeTime,
+		StoreURL:      os.Getenv("LLAMA_OBJECT_STORE"),
+		StoreReplicas: replicas,
+		Function:      os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
 	}
-
-	runtime := Runtime{
-		store:    store,
-		cmdline:  cmdline,
-		workerId: hex.EncodeToString(workerId[:]),
+	if os.Getenv("LLAMA_XRAY") != "" {
+		opts.XRay = tracing.NewXRayTracer(tracing.XRayOptions{
+			Name:   os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+			Sender: tracing.NewXRayDaemonSender(""),
+		})
 	}
-
-	lambda.StartWithContext(ctx, runtime.RunOne)
-}
-
-func computeCmdline(argv []string) []string {
-	if handler := os.Getenv("_HANDLER"); handler != "" {
-		// Running in packaged mode, pull our exe from the
-		// environment
-		return []string{handler}
+	runtime := runner.New(opts)
+
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		runtime.Shutdown()
+	}()
+
+	err = runtime.Serve(ctx, runtimeURI)
+	if errors.Is(err, runner.ErrShutdown) {
+		os.Exit(0)
 	}
+	log.Fatal(err)
+}
 
-	// We're running in a container. We'll have been
-	// passed our command as our own ARGV
-	if len(argv) == 3 && argv[0] == "/bin/sh" && argv[1] == "-c" {
-		// The Dockerfile used the [CMD "STRING"]
-		// version of CMD, so it is being evaluated by
-		// /bin/sh -c. In order to be able to append
-		// arguments, we need to munge it a bit.
-		return []string{
-			"/bin/sh",
-			"-c",
-			fmt.Sprintf(`%s "$@"`, argv[2]),
-			strings.SplitN(argv[2], " ", 2)[0],
-		}
-	}
-	return argv
+func computeCmdline(argv []string) ([]string, string) {
+	return protocol.Cmdline(os.Getenv("_HANDLER"), argv)
 }
@@ -27,6 +27,9 @@ type Config struct {
 	Function        string
 	LocalPreprocess bool
 	BuildID         string
+	// TraceSample configures trace sampling, in the format of
+	// tracing.ParseSampler
+	TraceSample string
 
 	// FilteredWarnings is a list of warnings that we should always filter
 	// out of the compilation
@@ -98,6 +101,8 @@ func ParseConfig(env []string) Config {
 			out.LocalPreprocess = BoolConfigTrue(val)
 		case "BUILD_ID":
 			out.BuildID = val
+		case "TRACE_SAMPLE":
+			out.TraceSample = val
 		case "LOCAL_CC":
 			out.LocalCC = val
 		case "LOCAL_CXX":
@@ -39,12 +39,23 @@ func runLlamaCC(cfg *Config, comp *Compilation) error {
 	ctx := context.Background()
 	mt := tracing.NewMemoryTracer(ctx)
 	ctx = tracing.WithTracer(ctx, mt)
+	if cfg.TraceSample != "" {
+		if sampler, err := tracing.ParseSampler(cfg.TraceSample); err != nil {
+			log.Printf("llamacc: LLAMACC_TRACE_SAMPLE: %s", err.Error())
+		} else {
+			ctx = tracing.WithSampler(ctx, sampler)
+		}
+	}
 	ctx, span := tracing.StartSpan(ctx, "llamacc")
 	if cfg.BuildID != "" {
 		span.AddField("global.build_id", cfg.BuildID)
 	}
 
-	client, err := server.DialWithAutostart(ctx, cli.SocketPath(), server.LlamaCCPath)
+	global, err := cli.LoadState()
+	if err != nil {
+		return err
+	}
+	client, err := global.Connect(ctx, server.LlamaCCPath)
 	if err != nil {
 		return err
 	}
@@ -92,6 +103,9 @@ func buildRemotePreprocess(ctx context.Context, client *daemon.Client, cfg *Conf
 	if err != nil {
 		return err
 	}
+	if cfg.Verbose && out.Diff != nil {
+		log.Printf("[llamacc] inputs: %s", out.Diff.String())
+	}
 	os.Stdout.Write(out.Stdout)
 	os.Stderr.Write(out.Stderr)
 	if out.InvokeErr != "" {
@@ -257,6 +271,9 @@ func buildLocalPreprocess(ctx context.Context, client *daemon.Client, cfg *Confi
 	if err != nil {
 		return err
 	}
+	if cfg.Verbose && out.Diff != nil {
+		log.Printf("[llamacc] inputs: %s", out.Diff.String())
+	}
 	os.Stdout.Write(out.Stdout)
 	os.Stderr.Write(out.Stderr)
 	if out.InvokeErr != "" {
@@ -0,0 +1,113 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cost
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimate(t *testing.T) {
+	p := Pricing{
+		LambdaGBSecond:   1,
+		LambdaRequest:    0.5,
+		S3Put:            0.25,
+		S3Get:            0.125,
+		S3StorageGBMonth: 2,
+		TransferOutGB:    4,
+	}
+	u := Usage{
+		Invocations: 2,
+		// 2GB for 3s
+		Lambda:  protocol.LambdaUsage{Millis: 3000, MB_Millis: 2048 * 3000},
+		Client:  protocol.StoreUsage{Write_Requests: 1, Read_Requests: 2, Xfer_In: gb / 2, Xfer_Out: gb},
+		Runtime: protocol.StoreUsage{Write_Requests: 3, Read_Requests: 6, Xfer_In: gb / 2, Xfer_Out: 5 * gb},
+	}
+	e := p.Estimate(&u)
+	var costs []float64
+	for _, l := range e.Lines {
+		costs = append(costs, l.Cost)
+	}
+	assert.Equal(t, []float64{6, 1, 1, 1, 2, 4}, costs)
+	assert.Equal(t, 15.0, e.Total)
+}
+
+func TestLoadPricing(t *testing.T) {
+	p, err := LoadPricing("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultPricing, *p)
+
+	f, err := ioutil.TempFile("", "pricing")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"lambda_gb_second": 0.5}`)
+	f.Close()
+
+	p, err = LoadPricing(f.Name())
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, p.LambdaGBSecond)
+	assert.Equal(t, DefaultPricing.S3Put, p.S3Put)
+
+	ioutil.WriteFile(f.Name(), []byte(`{"lambda_gb_sec": 0.5}`), 0644)
+	_, err = LoadPricing(f.Name())
+	assert.Error(t, err)
+}
+
+func TestTracker(t *testing.T) {
+	var tr Tracker
+	for i, ms := range []uint64{1000, 5000, 3000} {
+		resp := protocol.InvocationResponse{
+			JobID: string(rune('a' + i)),
+			Usage: protocol.UsageMetrics{Lambda: protocol.LambdaUsage{Millis: ms, MB_Millis: ms * 1024}},
+		}
+		tr.AddJob("fn", Name([]string{"cc", "-c", resp.JobID}), resp.JobID, JobUsage(&resp))
+	}
+	tr.AddJob("fn", "local", "d", JobUsage(&protocol.InvocationResponse{Local: true}))
+
+	r := tr.Report(&DefaultPricing, protocol.StoreUsage{Read_Requests: 10}, 2)
+	assert.Equal(t, 4, r.Jobs)
+	assert.Equal(t, uint64(3), r.Usage.Invocations)
+	assert.Equal(t, 9.0, r.Usage.GBSeconds())
+	assert.Equal(t, uint64(10), r.Usage.Client.Read_Requests)
+	require.Len(t, r.Top, 2)
+	assert.Equal(t, "b", r.Top[0].JobID)
+	assert.Equal(t, "cc -c b", r.Top[0].Name)
+	assert.Equal(t, "fn", r.Top[0].Function)
+	assert.Equal(t, "c", r.Top[1].JobID)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	assert.Contains(t, buf.String(), "9.000 GB-s")
+	assert.Contains(t, buf.String(), "Most expensive of 4 jobs:")
+
+	tr.Reset()
+	r = tr.Report(&DefaultPricing, protocol.StoreUsage{}, 10)
+	assert.Equal(t, 0, r.Jobs)
+	assert.Equal(t, 0.0, r.Estimate.Total)
+}
+
+func TestName(t *testing.T) {
+	assert.Equal(t, "cc -c a.c", Name([]string{"cc", "-c", "a.c"}))
+	long := Name([]string{"cc", strings.Repeat("x", 100)})
+	assert.Len(t, long, 80)
+	assert.True(t, strings.HasSuffix(long, "..."))
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cost estimates what running jobs on llama costs in AWS
+// charges, from the usage the client and runtime report.
+package cost
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Pricing holds the AWS prices estimates are computed with, in
+// USD. The defaults are us-east-1 list prices for x86 Lambda and S3
+// Standard; other regions, architectures, and negotiated discounts
+// can be described by overriding them.
+type Pricing struct {
+	LambdaGBSecond float64 `json:"lambda_gb_second"`
+	LambdaRequest  float64 `json:"lambda_request"`
+	// S3Put and S3Get are per request
+	S3Put float64 `json:"s3_put"`
+	S3Get float64 `json:"s3_get"`
+	// S3StorageGBMonth prices the objects a run added to the
+	// store, as if kept for a month
+	S3StorageGBMonth float64 `json:"s3_storage_gb_month"`
+	// TransferOutGB prices the bytes the client fetched from
+	// S3. Clients inside the store's region pay nothing.
+	TransferOutGB float64 `json:"transfer_out_gb"`
+}
+
+var DefaultPricing = Pricing{
+	LambdaGBSecond:   0.0000166667,
+	LambdaRequest:    0.20 / 1e6,
+	S3Put:            0.005 / 1000,
+	S3Get:            0.0004 / 1000,
+	S3StorageGBMonth: 0.023,
+	TransferOutGB:    0.09,
+}
+
+// PricingEnv names a file of pricing overrides, used if no other
+// file is given
+const PricingEnv = "LLAMA_PRICING"
+
+// LoadPricing reads a JSON object of overrides to DefaultPricing,
+// such as {"lambda_gb_second": 0.0000133334}, from `file`. If
+// `file` is empty, it is taken from $LLAMA_PRICING; if that is also
+// empty, DefaultPricing is returned.
+func LoadPricing(file string) (*Pricing, error) {
+	p := DefaultPricing
+	if file == "" {
+		file = os.Getenv(PricingEnv)
+	}
+	if file == "" {
+		return &p, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading pricing: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("reading pricing: %s: %w", file, err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cost
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// Usage is the AWS usage of a job, or of a whole run
+type Usage struct {
+	// Invocations counts Lambda requests. Jobs run locally
+	// make none.
+	Invocations uint64               `json:"invocations"`
+	Lambda      protocol.LambdaUsage `json:"lambda"`
+	// Client and Runtime are the S3 usage of the client and of
+	// the runtimes that ran its jobs
+	Client  protocol.StoreUsage `json:"client_s3"`
+	Runtime protocol.StoreUsage `json:"runtime_s3"`
+}
+
+// JobUsage returns the usage the runtime reported for a job
+func JobUsage(resp *protocol.InvocationResponse) Usage {
+	u := Usage{
+		Lambda:  resp.Usage.Lambda,
+		Runtime: resp.Usage.S3,
+	}
+	if !resp.Local {
+		u.Invocations = 1
+	}
+	return u
+}
+
+func addStore(u *protocol.StoreUsage, o *protocol.StoreUsage) {
+	u.Read_Requests += o.Read_Requests
+	u.Write_Requests += o.Write_Requests
+	u.Xfer_In += o.Xfer_In
+	u.Xfer_Out += o.Xfer_Out
+}
+
+func (u *Usage) Add(o *Usage) {
+	u.Invocations += o.Invocations
+	u.Lambda.Millis += o.Lambda.Millis
+	u.Lambda.MB_Millis += o.Lambda.MB_Millis
+	u.Lambda.Requests += o.Lambda.Requests
+	addStore(&u.Client, &o.Client)
+	addStore(&u.Runtime, &o.Runtime)
+}
+
+// GBSeconds is the Lambda compute the usage was billed for
+func (u *Usage) GBSeconds() float64 {
+	return float64(u.Lambda.MB_Millis) / 1024 / 1000
+}
+
+const gb = 1 << 30
+
+// Line is one item of an Estimate
+type Line struct {
+	Item     string  `json:"item"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit,omitempty"`
+	Cost     float64 `json:"cost"`
+}
+
+type Estimate struct {
+	Lines []Line  `json:"lines"`
+	Total float64 `json:"total"`
+}
+
+// Estimate prices `u`. Objects are counted at their uncompressed
+// size, so storage and transfer are overestimated for compressible
+// data.
+func (p *Pricing) Estimate(u *Usage) Estimate {
+	puts := u.Client.Write_Requests + u.Runtime.Write_Requests
+	gets := u.Client.Read_Requests + u.Runtime.Read_Requests
+	stored := float64(u.Client.Xfer_In+u.Runtime.Xfer_In) / gb
+	out := float64(u.Client.Xfer_Out) / gb
+	e := Estimate{Lines: []Line{
+		{"Lambda compute", u.GBSeconds(), "GB-s", u.GBSeconds() * p.LambdaGBSecond},
+		{"Lambda requests", float64(u.Invocations), "", float64(u.Invocations) * p.LambdaRequest},
+		{"S3 PUT requests", float64(puts), "", float64(puts) * p.S3Put},
+		{"S3 GET requests", float64(gets), "", float64(gets) * p.S3Get},
+		{"S3 storage added", stored, "GB-month", stored * p.S3StorageGBMonth},
+		{"S3 transfer out", out, "GB", out * p.TransferOutGB},
+	}}
+	for _, l := range e.Lines {
+		e.Total += l.Cost
+	}
+	return e
+}
+
+// Job is a job's usage and estimated cost
+type Job struct {
+	Name  string `json:"name"`
+	JobID string `json:"job_id,omitempty"`
+	// Function is the function that ran the job
+	Function string  `json:"function,omitempty"`
+	Usage    Usage   `json:"usage"`
+	Cost     float64 `json:"cost"`
+}
+
+// MaxJobs bounds the jobs a Tracker attributes costs to. Jobs past
+// it still count towards the totals.
+const MaxJobs = 100000
+
+// A Tracker accumulates usage over a run. It is safe for concurrent
+// use.
+type Tracker struct {
+	mu    sync.Mutex
+	total Usage
+	jobs  []Job
+}
+
+// AddJob records the usage of a job `function` ran under `name`, a
+// description of the job for reports
+func (t *Tracker) AddJob(function, name, jobID string, u Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total.Add(&u)
+	if len(t.jobs) < MaxJobs {
+		t.jobs = append(t.jobs, Job{Name: name, JobID: jobID, Function: function, Usage: u})
+	}
+}
+
+// Reset forgets all recorded usage
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total = Usage{}
+	t.jobs = nil
+}
+
+// Report summarizes a run in which the client's own store usage
+// was `client`
+type Report struct {
+	Pricing  Pricing  `json:"pricing"`
+	Usage    Usage    `json:"usage"`
+	Estimate Estimate `json:"estimate"`
+	Jobs     int      `json:"jobs"`
+	// Top lists the most expensive jobs, most expensive first
+	Top []Job `json:"top,omitempty"`
+}
+
+// Report prices the run so far with `p`, listing its `top` most
+// expensive jobs
+func (t *Tracker) Report(p *Pricing, client protocol.StoreUsage, top int) *Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := &Report{Pricing: *p, Usage: t.total, Jobs: len(t.jobs)}
+	addStore(&r.Usage.Client, &client)
+	r.Estimate = p.Estimate(&r.Usage)
+
+	jobs := make([]Job, len(t.jobs))
+	for i, j := range t.jobs {
+		j.Cost = p.Estimate(&j.Usage).Total
+		jobs[i] = j
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].Cost > jobs[j].Cost })
+	if len(jobs) > top {
+		jobs = jobs[:top]
+	}
+	r.Top = jobs
+	return r
+}
+
+func formatQuantity(l *Line) string {
+	if l.Unit == "" {
+		return fmt.Sprintf("%.0f", l.Quantity)
+	}
+	return fmt.Sprintf("%.3f %s", l.Quantity, l.Unit)
+}
+
+// WriteText writes the report as a table
+func (r *Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "Estimated AWS cost:\t\t\t\n")
+	for i := range r.Estimate.Lines {
+		l := &r.Estimate.Lines[i]
+		fmt.Fprintf(tw, "  %s\t%s\t$%.4f\t\n", l.Item, formatQuantity(l), l.Cost)
+	}
+	fmt.Fprintf(tw, "  Total\t\t$%.4f\t\n", r.Estimate.Total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(r.Top) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "Most expensive of %d jobs:\n", r.Jobs)
+	tw = tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	for _, j := range r.Top {
+		fmt.Fprintf(tw, "  $%.6f\t%.3f GB-s\t%s\t%s\t%s\n", j.Cost, j.Usage.GBSeconds(), j.JobID, j.Function, j.Name)
+	}
+	return tw.Flush()
+}
+
+// Name describes a job by its command line, shortened to fit on a
+// line of a report
+func Name(args []string) string {
+	const max = 80
+	var name []rune
+	for i, a := range args {
+		if i > 0 {
+			name = append(name, ' ')
+		}
+		name = append(name, []rune(a)...)
+	}
+	if len(name) > max {
+		return string(name[:max-3]) + "..."
+	}
+	return string(name)
+}
@@ -14,14 +14,30 @@
 
 package daemon
 
-import "net/rpc"
+import (
+	"io"
+	"net/rpc"
+)
 
 type Client struct {
 	conn *rpc.Client
+	// done, if set, is called after the connection is closed
+	done func()
+}
+
+// NewClient returns a Client speaking to a daemon over `conn`, for
+// callers that serve one themselves. `done`, if non-nil, is called
+// by Close once the connection is closed.
+func NewClient(conn io.ReadWriteCloser, done func()) *Client {
+	return &Client{conn: rpc.NewClient(conn), done: done}
 }
 
 func (c *Client) Close() error {
-	return c.conn.Close()
+	err := c.conn.Close()
+	if c.done != nil {
+		c.done()
+	}
+	return err
 }
 
 func (c *Client) Ping(in *PingArgs) (*PingReply, error) {
@@ -42,6 +58,18 @@ func (c *Client) InvokeWithFiles(in *InvokeWithFilesArgs) (*InvokeWithFilesReply
 	return &out, err
 }
 
+func (c *Client) ReadStream(in *ReadStreamArgs) (*ReadStreamReply, error) {
+	var out ReadStreamReply
+	err := c.conn.Call("Daemon.ReadStream", in, &out)
+	return &out, err
+}
+
+func (c *Client) ReadProgress(in *ReadProgressArgs) (*ReadProgressReply, error) {
+	var out ReadProgressReply
+	err := c.conn.Call("Daemon.ReadProgress", in, &out)
+	return &out, err
+}
+
 func (c *Client) GetDaemonStats(in *StatsArgs) (*StatsReply, error) {
 	var out StatsReply
 	err := c.conn.Call("Daemon.GetDaemonStats", in, &out)
@@ -24,7 +24,7 @@ func Dial(_ context.Context, sockPath string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
+	return &Client{conn: conn}, nil
 }
 
 func DialPath(_ context.Context, sockPath string, urlPath string) (*Client, error) {
@@ -32,5 +32,5 @@ func DialPath(_ context.Context, sockPath string, urlPath string) (*Client, erro
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
+	return &Client{conn: conn}, nil
 }
@@ -16,6 +16,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -26,8 +27,12 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/nelhage/llama/budget"
+	"github.com/nelhage/llama/cost"
 	"github.com/nelhage/llama/daemon"
+	llama_files "github.com/nelhage/llama/files"
 	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/progress"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/protocol/files"
 	"github.com/nelhage/llama/store"
@@ -97,23 +102,113 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 		Function:   in.Function,
 		ReturnLogs: in.ReturnLogs,
 		Spec: protocol.InvocationSpec{
-			Args: in.Args,
+			Args:            in.Args,
+			CompressOutputs: in.Compression,
+			Repro:           in.Repro,
+			AsyncUploads:    in.AsyncUploads,
+			Env:             in.Env,
+			ExpandVars:      in.ExpandVars,
+			PersistTrace:    in.PersistTrace,
+			Nested:          in.Nested,
+			Deterministic:   in.Memoize,
 		},
+		Record:      in.Record,
+		URL:         d.urls[in.Function],
+		Budget:      d.budget,
+		Memoize:     in.Memoize,
+		RefreshMemo: in.RefreshMemo,
+	}
+	if in.Budget != nil {
+		b, err := budget.Open(in.Budget.Dir, in.Budget.Max)
+		if err != nil {
+			return err
+		}
+		b.Timeout = in.Budget.Timeout
+		args.Budget = b
+	}
+
+	if in.Local || in.LocalFallback {
+		local, err := d.localRunner()
+		if err != nil {
+			return err
+		}
+		args.Local = local
+		args.LocalFallback = !in.Local
+	}
+
+	uploadOpts := llama_files.UploadOptions{Compression: in.Compression}
+	if !in.NoStatCache && !in.DryRun {
+		// A dry run needs to see every object it would store
+		uploadOpts.StatCache = d.statCache
+	}
+	key := diffKey(in)
+	args.Reupload = func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error) {
+		// The job's remembered files referenced missing objects
+		d.differ.Forget(key)
+		missing, err := in.Files.Reupload(ctx, d.store, spec.Files, missing, uploadOpts)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Stdin == nil || spec.Stdin.Ref == "" {
+			return missing, nil
+		}
+		var unresolved []string
+		for _, id := range missing {
+			if id != spec.Stdin.Ref {
+				unresolved = append(unresolved, id)
+			}
+		}
+		if len(unresolved) < len(missing) {
+			if spec.Stdin, err = files.NewBlob(ctx, d.store, in.Stdin); err != nil {
+				return nil, err
+			}
+		}
+		return unresolved, nil
+	}
+
+	if in.Stream != "" {
+		stream := d.stream(in.Stream)
+		defer stream.Close()
+		args.Stdout = stream
+	}
+	var report progress.Func
+	if in.Progress != "" {
+		watch := d.progress(in.Progress)
+		defer watch.Close()
+		report = watch.report
+		args.Progress = report
+		uploadOpts.Progress = func(p llama_files.UploadProgress) { report(p.Event()) }
 	}
 
 	t_start := time.Now()
 
+	st := d.store
+	var dry *store.DryRun
+	if in.DryRun {
+		var err error
+		if dry, err = store.NewDryRun(d.store); err != nil {
+			return err
+		}
+		st = dry
+	}
+
+	var diff *llama_files.FileDiff
 	{
 		ctx, sb := tracing.StartSpan(ctx, "upload")
 		sb.AddField("files", len(in.Files))
+		report.Report(progress.Event{Stage: progress.Hashing, TotalFiles: len(in.Files)})
 		var err error
-		args.Spec.Files, err = in.Files.Upload(ctx, d.store, nil)
+		if dry != nil {
+			args.Spec.Files, err = in.Files.UploadWith(ctx, st, nil, uploadOpts)
+		} else {
+			args.Spec.Files, diff, err = d.differ.Upload(ctx, st, key, in.Files, nil, uploadOpts)
+		}
 		if err != nil {
 			sb.AddField("error", fmt.Sprintf("upload: %s", err.Error()))
 			return err
 		}
 		if in.Stdin != nil {
-			args.Spec.Stdin, err = files.NewBlob(ctx, d.store, in.Stdin)
+			args.Spec.Stdin, err = files.NewBlob(ctx, st, in.Stdin)
 			if err != nil {
 				sb.AddField("error", fmt.Sprintf("stdin: %s", err.Error()))
 				return err
@@ -125,6 +220,11 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 		sb.End()
 	}
 
+	if dry != nil {
+		out.Plan = d.plan(ctx, in, &args, dry)
+		return nil
+	}
+
 	t_invoke := time.Now()
 
 	atomic.AddUint64(&d.stats.Usage.Lambda.Requests, 1)
@@ -144,6 +244,16 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 
 	t_fetch := time.Now()
 
+	if repl.Retries > 0 {
+		atomic.AddUint64(&d.stats.Retries, uint64(repl.Retries))
+	}
+	if repl.Response.Local {
+		atomic.AddUint64(&d.stats.Local, 1)
+	}
+	if repl.Response.Memoized {
+		atomic.AddUint64(&d.stats.Memoized, 1)
+	}
+
 	atomic.AddUint64(&d.stats.ExitStatuses[repl.Response.ExitStatus&0xff], 1)
 	atomic.AddUint64(&d.stats.Usage.Lambda.MB_Millis, repl.Response.Usage.Lambda.MB_Millis)
 	atomic.AddUint64(&d.stats.Usage.Lambda.Millis, repl.Response.Usage.Lambda.Millis)
@@ -151,29 +261,53 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	atomic.AddUint64(&d.stats.Usage.RemoteS3.Write_Requests, repl.Response.Usage.S3.Write_Requests)
 	atomic.AddUint64(&d.stats.Usage.RemoteS3.Xfer_In, repl.Response.Usage.S3.Xfer_In)
 	atomic.AddUint64(&d.stats.Usage.RemoteS3.Xfer_Out, repl.Response.Usage.S3.Xfer_Out)
+	d.cost.AddJob(repl.Function, cost.Name(in.Args), repl.Response.JobID, cost.JobUsage(&repl.Response))
 
 	var gets []store.GetRequest
 
 	var fetchList, extra protocol.FileList
-	if repl.Response.Outputs != nil {
-		fetchList, extra = in.Outputs.TransformToLocal(ctx, repl.Response.Outputs)
+	var manifest *llama_files.Manifest
+	wanted, skipped := in.OutputFilter.Filter(repl.Response.Outputs)
+	if in.DeferOutputs {
+		// The manifest lists every output, to be fetched later
+		manifest = llama_files.NewManifest(repl.Response.JobID, in.Outputs, repl.Response.Outputs)
+		skipped = nil
+	} else if wanted != nil && in.Archive == "" {
+		fetchList, extra = in.Outputs.TransformToLocal(ctx, wanted)
 		for _, out := range extra {
 			log.Printf("Remote returned unexpected output: %s", out.Path)
 		}
-		for _, f := range fetchList {
-			gets = files.AppendGet(gets, &f.Blob)
-		}
 	}
 
 	*out = daemon.InvokeWithFilesReply{
-		Logs:       repl.Logs,
-		ExitStatus: repl.Response.ExitStatus,
+		JobID:       repl.Response.JobID,
+		Logs:        repl.Logs,
+		ExitStatus:  repl.Response.ExitStatus,
+		Signal:      repl.Response.Signal,
+		Outputs:     repl.Response.Outputs,
+		Skipped:     llama_files.Skipped(skipped),
+		Warnings:    repl.Response.Warnings,
+		Diagnostics: repl.Response.Diagnostics,
+		Transfer:    repl.Response.Transfer,
+		Retries:     repl.Retries,
+		Local:       repl.Response.Local,
+		Memoized:    repl.Response.Memoized,
+		Recording:   repl.Recording,
+		Manifest:    manifest,
+		Diff:        diff,
+		Nested:      repl.Response.Nested,
 	}
 	if invokeErr != nil {
 		out.InvokeErr = invokeErr.Error()
 	}
+	if b := repl.Response.Stdout; b != nil {
+		out.StdoutID = b.Ref
+	}
+	if b := repl.Response.Stderr; b != nil {
+		out.StderrID = b.Ref
+	}
 
-	if repl.Response.Stdout != nil {
+	if repl.Response.Stdout != nil && in.Stream == "" {
 		gets = files.AppendGet(gets, repl.Response.Stdout)
 	}
 
@@ -181,23 +315,32 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 		gets = files.AppendGet(gets, repl.Response.Stderr)
 	}
 
-	d.store.GetObjects(ctx, gets)
-
-	for _, f := range fetchList {
-		var err error
-		err, gets = files.FetchFile(&f.File, f.Path, gets)
-		if err != nil && out.InvokeErr == "" {
-			out.InvokeErr = err.Error()
+	fetchCtx, fetchSpan := tracing.StartSpan(ctx, "download")
+	fetchSpan.AddField("files", len(fetchList))
+	if len(gets) > 0 {
+		d.store.GetObjects(fetchCtx, gets)
+	}
+	fetchOpts := llama_files.FetchOptions{}
+	if report != nil {
+		fetchOpts.Progress = func(p llama_files.FetchProgress) { report(p.Event()) }
+	}
+	if err := llama_files.FetchOutputs(fetchCtx, d.store, fetchList, fetchOpts); err != nil && out.InvokeErr == "" {
+		out.InvokeErr = err.Error()
+	}
+	if in.Archive != "" {
+		if err := d.archiveOutputs(fetchCtx, in.Archive, wanted, out); err != nil && out.InvokeErr == "" {
+			out.InvokeErr = fmt.Sprintf("archiving outputs: %s", err.Error())
 		}
 	}
 
-	if repl.Response.Stdout != nil {
+	if repl.Response.Stdout != nil && in.Stream == "" {
 		out.Stdout, _, gets = files.ReadBlob(repl.Response.Stdout, gets)
 	}
 
 	if repl.Response.Stderr != nil {
 		out.Stderr, _, gets = files.ReadBlob(repl.Response.Stderr, gets)
 	}
+	fetchSpan.End()
 
 	t_end := time.Now()
 
@@ -215,6 +358,34 @@ func (d *Daemon) InvokeWithFiles(in *daemon.InvokeWithFilesArgs, out *daemon.Inv
 	return nil
 }
 
+// diffKey returns the key under which the daemon's Differ
+// remembers the files of `in`; see InvokeWithFilesArgs.DiffKey.
+func diffKey(in *daemon.InvokeWithFilesArgs) string {
+	if in.DiffKey != "" {
+		return in.DiffKey
+	}
+	parts := []string{in.Function}
+	if len(in.Outputs) > 0 {
+		for _, out := range in.Outputs {
+			parts = append(parts, out.Local.Path)
+		}
+	} else {
+		parts = append(parts, in.Args...)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// archiveOutputs writes `outputs` into the archive at `where`,
+// recording its index in `out`
+func (d *Daemon) archiveOutputs(ctx context.Context, where string, outputs protocol.FileList, out *daemon.InvokeWithFilesReply) error {
+	format, err := llama_files.ArchiveFormat(where)
+	if err != nil {
+		return err
+	}
+	out.ArchiveIndex, err = llama_files.WriteArchive(ctx, d.store, outputs, where, format)
+	return err
+}
+
 func (d *Daemon) GetDaemonStats(in *daemon.StatsArgs, out *daemon.StatsReply) error {
 	d.store.FetchAWSUsage(&d.stats.Usage.LocalS3)
 
@@ -226,11 +397,30 @@ func (d *Daemon) GetDaemonStats(in *daemon.StatsArgs, out *daemon.StatsReply) er
 	// use a mutex, I guess.
 	stats := d.stats
 
+	pricing := in.Pricing
+	if pricing == nil {
+		pricing = &cost.DefaultPricing
+	}
+	top := in.TopJobs
+	if top == 0 {
+		top = daemon.DefaultTopJobs
+	}
+
 	*out = daemon.StatsReply{
 		Stats: stats,
+		Cost:  d.cost.Report(pricing, stats.Usage.LocalS3, top),
+	}
+	if d.statCache != nil {
+		cacheStats := d.statCache.Stats()
+		out.StatCache = &cacheStats
+	}
+	if cacheStats, ok := store.GetCacheStats(d.store); ok {
+		out.StoreCache = &cacheStats
 	}
+	out.Uptime = time.Since(d.started)
 	if in.Reset {
 		d.stats = daemon.Stats{}
+		d.cost.Reset()
 	}
 	return nil
 }
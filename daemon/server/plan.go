@@ -0,0 +1,58 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/store"
+)
+
+// plan describes the invocation `args` would make
+func (d *Daemon) plan(ctx context.Context, in *daemon.InvokeWithFilesArgs, args *llama.InvokeArgs, dry *store.DryRun) *daemon.Plan {
+	plan := daemon.Plan{
+		Function:   in.Function,
+		StdinBytes: len(in.Stdin),
+		Outputs:    args.Spec.Outputs,
+		Uploads:    dry.Objects(),
+		Spec:       args.Spec,
+	}
+	plan.UploadObjects, plan.UploadBytes = dry.Missing()
+
+	var cmdline []string
+	if in.Local {
+		plan.CmdlineNote = "the job would run locally, with no function command"
+	} else {
+		var ok bool
+		var err error
+		cmdline, ok, err = llama.FunctionCmdline(ctx, d.lambda, in.Function)
+		if err != nil {
+			plan.CmdlineNote = fmt.Sprintf("looking up the function's command: %s", err.Error())
+		} else if !ok {
+			plan.CmdlineNote = "the function's command is set by its image's CMD"
+		}
+	}
+	plan.Cmdline = append(cmdline, args.Spec.Args...)
+
+	for _, f := range args.Spec.Files {
+		plan.Files = append(plan.Files, daemon.PlannedFile{Path: f.Path, Mode: f.Mode})
+	}
+	sort.Slice(plan.Files, func(i, j int) bool { return plan.Files[i].Path < plan.Files[j].Path })
+	return &plan
+}
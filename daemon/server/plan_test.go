@@ -0,0 +1,93 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvokeWithFiles_DryRun(t *testing.T) {
+	ctx := context.Background()
+	invoked := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			invoked = true
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte(`{"FunctionName":"fn","ImageConfigResponse":{"ImageConfig":{"Command":["/bin/sh","-c","cc -O2"]}}}`))
+	}))
+	defer srv.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+
+	st := store.InMemory()
+	old := bytes.Repeat([]byte("o"), 2*protocol.MaxInlineBlob)
+	_, err := st.Store(ctx, old)
+	require.NoError(t, err)
+	d := Daemon{ctx: ctx, store: st, lambda: lambda.New(sess)}
+
+	var out daemon.InvokeWithFilesReply
+	err = d.InvokeWithFiles(&daemon.InvokeWithFilesArgs{
+		Function: "fn",
+		Args:     []string{"-c", "b.c"},
+		Files: files.List{
+			{Local: files.LocalFile{Bytes: bytes.Repeat([]byte("b"), 2*protocol.MaxInlineBlob), Mode: 0644}, Remote: "b.c"},
+			{Local: files.LocalFile{Bytes: old, Mode: 0644}, Remote: "a.h"},
+		},
+		Outputs: files.List{{Local: files.LocalFile{Path: "/tmp/b.o"}, Remote: "b.o"}},
+		DryRun:  true,
+	}, &out)
+	require.NoError(t, err)
+	assert.False(t, invoked)
+
+	plan := out.Plan
+	require.NotNil(t, plan)
+	assert.Equal(t, []string{"/bin/sh", "-c", `cc -O2 "$@"`, "cc", "-c", "b.c"}, plan.Cmdline)
+	assert.Empty(t, plan.CmdlineNote)
+	assert.Equal(t, []daemon.PlannedFile{{Path: "a.h", Mode: 0644}, {Path: "b.c", Mode: 0644}}, plan.Files)
+	assert.Equal(t, []string{"b.o"}, plan.Outputs)
+	assert.Len(t, plan.Uploads, 2)
+	assert.Equal(t, 1, plan.UploadObjects)
+	assert.Equal(t, int64(2*protocol.MaxInlineBlob), plan.UploadBytes)
+
+	// Nothing new was stored.
+	for _, obj := range plan.Uploads {
+		_, err = store.Get(ctx, st, obj.ID)
+		if obj.Exists {
+			assert.NoError(t, err)
+		} else {
+			assert.Equal(t, &store.NotFoundError{ID: obj.ID}, err)
+		}
+	}
+}
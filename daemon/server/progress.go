@@ -0,0 +1,89 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/nelhage/llama/daemon"
+	"github.com/nelhage/llama/progress"
+)
+
+// progressWatch holds the latest progress of an invocation until a
+// client collects it with ReadProgress. Like stdoutStream, it never
+// blocks the invocation; a slow client just misses intermediate
+// events.
+type progressWatch struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	event  progress.Event
+	seq    uint64
+	closed bool
+}
+
+func (d *Daemon) progress(id string) *progressWatch {
+	d.progressWatches.Lock()
+	defer d.progressWatches.Unlock()
+	w, ok := d.progressWatches.byID[id]
+	if !ok {
+		w = &progressWatch{}
+		w.cond.L = &w.mu
+		d.progressWatches.byID[id] = w
+	}
+	return w
+}
+
+func (w *progressWatch) report(e progress.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.event = e
+	w.seq++
+	w.cond.Broadcast()
+}
+
+// Close reports the invocation done
+func (w *progressWatch) Close() error {
+	w.report(progress.Event{Stage: progress.Done})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+// read waits for an event after the `after`th, returning it and its
+// sequence number, or reports that the invocation is over and the
+// client has seen its last event.
+func (w *progressWatch) read(after uint64) (progress.Event, uint64, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.seq <= after && !w.closed {
+		w.cond.Wait()
+	}
+	if w.seq <= after {
+		return progress.Event{}, w.seq, true
+	}
+	return w.event, w.seq, false
+}
+
+func (d *Daemon) ReadProgress(in *daemon.ReadProgressArgs, out *daemon.ReadProgressReply) error {
+	event, seq, done := d.progress(in.Progress).read(in.Seq)
+	if done {
+		d.progressWatches.Lock()
+		delete(d.progressWatches.byID, in.Progress)
+		d.progressWatches.Unlock()
+	}
+	*out = daemon.ReadProgressReply{Event: event, Seq: seq, Done: done}
+	return nil
+}
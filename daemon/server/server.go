@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"net/rpc"
@@ -26,13 +27,18 @@ import (
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/gofrs/flock"
+	"github.com/nelhage/llama/budget"
+	"github.com/nelhage/llama/cost"
 	"github.com/nelhage/llama/daemon"
+	llama_files "github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/llama"
 	"github.com/nelhage/llama/store"
 	"golang.org/x/sync/semaphore"
 )
@@ -46,6 +52,17 @@ type Daemon struct {
 	lambda   *lambda.Lambda
 
 	stats daemon.Stats
+	// cost attributes the AWS usage in stats to jobs
+	cost cost.Tracker
+	// statCache, if non-nil, is used to upload the files jobs
+	// pass, and saved periodically
+	statCache *llama_files.StatCache
+	// urls holds StartArgs.FunctionURLs
+	urls map[string]*llama.FunctionURL
+	// differ remembers the files of recent jobs; see diffKey
+	differ *llama_files.Differ
+	// budget holds StartArgs.Budget
+	budget *budget.Budget
 
 	llamaccSem *semaphore.Weighted
 
@@ -53,6 +70,27 @@ type Daemon struct {
 		sync.RWMutex
 		paths map[compilerAndLanguage][]string
 	}
+
+	streams struct {
+		sync.Mutex
+		byID map[string]*stdoutStream
+	}
+
+	progressWatches struct {
+		sync.Mutex
+		byID map[string]*progressWatch
+	}
+
+	local struct {
+		sync.Once
+		runner llama.LocalRunner
+		err    error
+	}
+
+	// started is when the daemon started, and active counts the
+	// requests it is serving, which keep it from going idle
+	started time.Time
+	active  int64
 }
 
 type compilerAndLanguage struct {
@@ -68,8 +106,21 @@ type StartArgs struct {
 	Session            *session.Session
 	IdleTimeout        time.Duration
 	LlamaCCConcurrency int64
+	// StatCache, if non-nil, lets the daemon skip reading input
+	// files that haven't changed; see files.StatCache. It is
+	// saved every StatCacheSaveInterval and when the daemon
+	// exits.
+	StatCache *llama_files.StatCache
+	// FunctionURLs maps the names of functions to invoke through
+	// function URLs, instead of the Lambda API, to their URLs
+	FunctionURLs map[string]*llama.FunctionURL
+	// Budget, if set, bounds the invocations in flight across
+	// the machine, including the daemon's own
+	Budget *budget.Budget
 }
 
+const StatCacheSaveInterval = time.Minute
+
 const (
 	LlamaCCPath = "/llamacc"
 )
@@ -101,48 +152,132 @@ func Start(ctx context.Context, args *StartArgs) error {
 	srvCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	concurrency := args.LlamaCCConcurrency
-	if concurrency == 0 {
-		concurrency = 2 * int64(runtime.NumCPU())
-	}
-
-	daemon := Daemon{
-		ctx:      srvCtx,
-		shutdown: cancel,
-		store:    args.Store,
-		session:  args.Session,
-		lambda:   lambda.New(args.Session),
-
-		llamaccSem: semaphore.NewWeighted(concurrency),
-	}
-	daemon.includePathCache.paths = make(map[compilerAndLanguage][]string)
+	daemon := newDaemon(srvCtx, cancel, args)
 
 	extend := make(chan struct{})
 	go func() {
-		waitForIdle(srvCtx, extend, args.IdleTimeout)
+		waitForIdle(srvCtx, extend, args.IdleTimeout, daemon.busy)
 		cancel()
 	}()
 
 	var httpSrv http.Server
 	var rpcSrv rpc.Server
-	rpcSrv.Register(&daemon)
+	rpcSrv.Register(daemon)
 	httpSrv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == LlamaCCPath {
 			daemon.acquireSem(srvCtx)
 			defer daemon.releaseSem()
 		}
+		atomic.AddInt64(&daemon.active, 1)
+		defer atomic.AddInt64(&daemon.active, -1)
 		extend <- struct{}{}
 		rpcSrv.ServeHTTP(w, r)
 	})
 	go func() {
 		httpSrv.Serve(listener)
 	}()
+	if daemon.statCache != nil {
+		go daemon.saveStatCache(srvCtx)
+	}
 	<-srvCtx.Done()
 
 	httpSrv.Shutdown(ctx)
+	daemon.finish()
 	return nil
 }
 
+func newDaemon(ctx context.Context, cancel context.CancelFunc, args *StartArgs) *Daemon {
+	concurrency := args.LlamaCCConcurrency
+	if concurrency == 0 {
+		concurrency = 2 * int64(runtime.NumCPU())
+	}
+
+	d := &Daemon{
+		ctx:      ctx,
+		shutdown: cancel,
+		store:    args.Store,
+		session:  args.Session,
+		lambda:   lambda.New(args.Session),
+
+		statCache: args.StatCache,
+		urls:      args.FunctionURLs,
+		differ:    llama_files.NewDiffer(),
+		budget:    args.Budget,
+
+		llamaccSem: semaphore.NewWeighted(concurrency),
+		started:    time.Now(),
+	}
+	d.includePathCache.paths = make(map[compilerAndLanguage][]string)
+	d.streams.byID = make(map[string]*stdoutStream)
+	d.progressWatches.byID = make(map[string]*progressWatch)
+	return d
+}
+
+// finish saves the daemon's state when it exits
+func (d *Daemon) finish() {
+	if d.statCache != nil {
+		if err := d.statCache.Save(); err != nil {
+			log.Printf("saving stat cache: %s", err.Error())
+		}
+	}
+}
+
+// busy reports whether the daemon is serving any requests
+func (d *Daemon) busy() bool {
+	return atomic.LoadInt64(&d.active) > 0
+}
+
+// InProcess returns a client for a daemon running in this process,
+// for use when no daemon can be reached over its socket. The daemon
+// exits, saving its stat cache, when the client is closed; it has
+// no socket, and no idle timeout.
+func InProcess(ctx context.Context, args *StartArgs) *daemon.Client {
+	srvCtx, cancel := context.WithCancel(ctx)
+	d := newDaemon(srvCtx, cancel, args)
+	var rpcSrv rpc.Server
+	rpcSrv.Register(d)
+	conn, srvConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rpcSrv.ServeConn(srvConn)
+		cancel()
+		d.finish()
+	}()
+	return daemon.NewClient(conn, func() { <-done })
+}
+
+// Connect connects to the daemon at `sockPath`, starting it if
+// necessary, like DialWithAutostart. If that fails and `fallback` is
+// non-nil, it instead runs a daemon in this process, configured by
+// `fallback`, so that callers work the same way without one.
+func Connect(ctx context.Context, sockPath string, urlPath string, fallback func() (*StartArgs, error)) (*daemon.Client, error) {
+	cl, err := DialWithAutostart(ctx, sockPath, urlPath)
+	if err == nil || fallback == nil {
+		return cl, err
+	}
+	args, ferr := fallback()
+	if ferr != nil {
+		return nil, fmt.Errorf("%s; running without a daemon: %w", err.Error(), ferr)
+	}
+	return InProcess(ctx, args), nil
+}
+
+func (d *Daemon) saveStatCache(ctx context.Context) {
+	t := time.NewTicker(StatCacheSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := d.statCache.Save(); err != nil {
+				log.Printf("saving stat cache: %s", err.Error())
+			}
+		}
+	}
+}
+
 func DialWithAutostart(ctx context.Context, sockPath string, urlPath string) (*daemon.Client, error) {
 	cl, err := daemon.DialPath(ctx, sockPath, urlPath)
 	if err == nil {
@@ -196,7 +331,10 @@ func DialWithAutostart(ctx context.Context, sockPath string, urlPath string) (*d
 	}
 }
 
-func waitForIdle(srvCtx context.Context, extend chan struct{}, timeout time.Duration) {
+// waitForIdle returns once `timeout` passes without a message on
+// `extend` and without `busy` reporting that there's work under way,
+// or when `srvCtx` is done.
+func waitForIdle(srvCtx context.Context, extend chan struct{}, timeout time.Duration, busy func() bool) {
 	var timer *time.Timer
 	var expire <-chan time.Time
 	if timeout != 0 {
@@ -209,7 +347,10 @@ loop:
 		case <-srvCtx.Done():
 			break loop
 		case <-expire:
-			break loop
+			if !busy() {
+				break loop
+			}
+			timer.Reset(timeout)
 		case <-extend:
 			if timer != nil {
 				if !timer.Stop() {
@@ -232,3 +373,12 @@ func (d *Daemon) acquireSem(ctx context.Context) {
 func (d *Daemon) releaseSem() {
 	d.llamaccSem.Release(1)
 }
+
+// localRunner returns the runner for jobs run in the daemon,
+// creating it on first use
+func (d *Daemon) localRunner() (llama.LocalRunner, error) {
+	d.local.Do(func() {
+		d.local.runner, d.local.err = llama.NewLocal(d.store)
+	})
+	return d.local.runner, d.local.err
+}
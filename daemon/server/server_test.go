@@ -16,6 +16,7 @@ package server_test
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/exec"
@@ -24,8 +25,11 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/nelhage/llama/daemon"
 	"github.com/nelhage/llama/daemon/server"
+	"github.com/nelhage/llama/store"
 )
 
 func TestDialWithAutostart(t *testing.T) {
@@ -107,3 +111,44 @@ func TestDialWithAutostart(t *testing.T) {
 	}
 
 }
+
+func TestConnect_Fallback(t *testing.T) {
+	ctx := context.Background()
+	// With no llama binary to autostart, Connect should fall
+	// back to a daemon in this process.
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	sock := path.Join(t.TempDir(), "llama.sock")
+
+	_, err := server.Connect(ctx, sock, server.LlamaCCPath, func() (*server.StartArgs, error) {
+		return nil, errors.New("no config")
+	})
+	if err == nil {
+		t.Fatalf("expected an error when the fallback fails")
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	cl, err := server.Connect(ctx, sock, server.LlamaCCPath, func() (*server.StartArgs, error) {
+		return &server.StartArgs{Session: sess, Store: store.InMemory()}, nil
+	})
+	if err != nil {
+		t.Fatalf("Connect: %s", err.Error())
+	}
+	pong, err := cl.Ping(&daemon.PingArgs{})
+	if err != nil {
+		t.Fatalf("Ping: %s", err.Error())
+	}
+	if pong.ServerPid != os.Getpid() {
+		t.Errorf("daemon pid=%d, expected ours (%d)", pong.ServerPid, os.Getpid())
+	}
+	stats, err := cl.GetDaemonStats(&daemon.StatsArgs{})
+	if err != nil {
+		t.Fatalf("GetDaemonStats: %s", err.Error())
+	}
+	if stats.Uptime <= 0 || stats.StoreCache != nil {
+		t.Errorf("stats: uptime=%s store_cache=%v", stats.Uptime, stats.StoreCache)
+	}
+	if err := cl.Close(); err != nil {
+		t.Errorf("Close: %s", err.Error())
+	}
+}
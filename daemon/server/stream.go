@@ -0,0 +1,87 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/nelhage/llama/daemon"
+)
+
+// stdoutStream buffers streamed stdout from an invocation until a
+// client collects it with ReadStream. Writes never block, so a slow
+// client can't hold up the invocation.
+type stdoutStream struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (d *Daemon) stream(id string) *stdoutStream {
+	d.streams.Lock()
+	defer d.streams.Unlock()
+	s, ok := d.streams.byID[id]
+	if !ok {
+		s = &stdoutStream{}
+		s.cond.L = &s.mu
+		d.streams.byID[id] = s
+	}
+	return s
+}
+
+func (s *stdoutStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buf.Write(p)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+func (s *stdoutStream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+	return nil
+}
+
+// read waits for data, returning it, or reports EOF once the stream
+// has been closed and drained.
+func (s *stdoutStream) read() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.buf.Len() == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		return nil, true
+	}
+	data := append([]byte(nil), s.buf.Bytes()...)
+	s.buf.Reset()
+	return data, false
+}
+
+func (d *Daemon) ReadStream(in *daemon.ReadStreamArgs, out *daemon.ReadStreamReply) error {
+	data, eof := d.stream(in.Stream).read()
+	if eof {
+		d.streams.Lock()
+		delete(d.streams.byID, in.Stream)
+		d.streams.Unlock()
+	}
+	*out = daemon.ReadStreamReply{Data: data, EOF: eof}
+	return nil
+}
@@ -15,10 +15,14 @@
 package daemon
 
 import (
+	"os"
 	"time"
 
+	"github.com/nelhage/llama/cost"
 	"github.com/nelhage/llama/files"
+	"github.com/nelhage/llama/progress"
 	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
 	"github.com/nelhage/llama/tracing"
 )
 
@@ -39,19 +43,216 @@ type InvokeWithFilesArgs struct {
 	Files      files.List
 	Outputs    files.List
 
+	// If set, compress large input and output files using the
+	// named algorithm (see protocol.File.Compression)
+	Compression string
+
 	// If true, release the llamacc semaphore to allow other
 	// llamacc processes to use CPU while we talk to AWS
 	DropSemaphore bool
+
+	// If non-empty, invoke using response streaming. The
+	// command's stdout can be read as it is produced by calling
+	// ReadStream with the same ID while the invocation runs,
+	// and is omitted from the reply.
+	Stream string
+
+	// If non-empty, the invocation's progress can be followed by
+	// calling ReadProgress with the same ID while it runs.
+	Progress string
+
+	// If non-nil, request a reproduction bundle if the command
+	// fails. It is referenced from the reply's Diagnostics.
+	Repro *protocol.ReproSpec
+
+	// KEY=VALUE settings for the command's environment, and
+	// whether to expand variables in them and in Args; see
+	// protocol.InvocationSpec.ExpandVars.
+	Env        []string
+	ExpandVars bool
+
+	// If true, let the runtime upload large outputs after it
+	// responds; see protocol.InvocationSpec.AsyncUploads.
+	AsyncUploads bool
+
+	// If true, have the runtime save the job's trace in the
+	// object store; see protocol.InvocationSpec.PersistTrace.
+	PersistTrace bool
+
+	// If true, let the command invoke llama itself; see
+	// protocol.InvocationSpec.Nested.
+	Nested bool
+
+	// Budget, if set, replaces the daemon's own invocation
+	// budget for this job
+	Budget *BudgetArgs
+
+	// If true, declare the job deterministic, and reuse the
+	// result of an identical earlier job if one is stored; see
+	// llama.InvokeArgs.Memoize. RefreshMemo reruns the job
+	// anyway, replacing the stored result.
+	Memoize     bool
+	RefreshMemo bool
+
+	// If true, run the job in the daemon, instead of on Lambda.
+	// If LocalFallback is true, only do so if the function
+	// can't be invoked; see llama.InvokeArgs.LocalFallback.
+	Local         bool
+	LocalFallback bool
+
+	// If true, don't invoke the function or store anything; the
+	// reply's Plan describes what would have been done.
+	DryRun bool
+
+	// If non-empty, the absolute path of a directory in which to
+	// record the invocation; see llama.InvokeArgs.Record.
+	Record string
+
+	// If true, read every input file, ignoring the daemon's stat
+	// cache; see files.StatCache.
+	NoStatCache bool
+
+	// If true, don't fetch the outputs; instead, describe them
+	// in the reply's Manifest, so that they can be fetched later
+	// with files.FetchManifest.
+	DeferOutputs bool
+
+	// If non-empty, the absolute path of a tar or zip archive to
+	// write the outputs into, instead of writing them to their
+	// local paths; see files.WriteArchive. The format is chosen
+	// by the extension, as by files.ArchiveFormat.
+	Archive string
+
+	// OutputFilter, if set, chooses which outputs are fetched or
+	// archived. The rest are left in the store; the reply's
+	// Outputs still lists them.
+	OutputFilter *files.OutputFilter
+
+	// DiffKey identifies the logical job this is an invocation
+	// of, so that files unchanged since its last invocation needn't
+	// be uploaded again; see files.Differ. It defaults to the
+	// function and the job's local output paths, or its arguments
+	// if it has no outputs.
+	DiffKey string
 }
 
 type InvokeWithFilesReply struct {
+	JobID      string
 	InvokeErr  string
 	ExitStatus int
-	Stdout     []byte
-	Stderr     []byte
-	Logs       []byte
+	// Signal names the signal that killed the command, if one
+	// did
+	Signal   string
+	Stdout   []byte
+	Stderr   []byte
+	Logs     []byte
+	Warnings []string
+	// StdoutID and StderrID are the IDs of the objects holding
+	// the command's stdout and stderr, if they weren't returned
+	// inline
+	StdoutID string
+	StderrID string
+	// Outputs lists the output files the function returned,
+	// under their remote paths
+	Outputs protocol.FileList
+	// Skipped summarizes the outputs the OutputFilter skipped
+	Skipped files.SkippedOutputs
 
-	Timing Timing
+	Diagnostics *protocol.Diagnostics
+	Transfer    protocol.Transfer
+	Timing      Timing
+	// Retries counts the attempts to invoke the function that
+	// failed transiently before the one that produced this reply
+	Retries int
+	// Local is set if the job ran in the daemon, instead of on
+	// Lambda
+	Local bool
+	// Memoized is set if the job didn't run, and its result is
+	// that of an identical earlier job
+	Memoized bool
+	// Manifest describes the outputs, if they weren't fetched;
+	// see InvokeWithFilesArgs.DeferOutputs
+	Manifest *files.Manifest
+	// ArchiveIndex lists the archive's contents, if the outputs
+	// were archived; see InvokeWithFilesArgs.Archive
+	ArchiveIndex *files.ArchiveIndex
+	// Diff describes how the job's files differ from those of the
+	// last invocation with the same DiffKey
+	Diff *files.FileDiff
+	// Nested totals the invocations the job made itself, if
+	// it was Nested
+	Nested *protocol.NestedUsage
+
+	// Plan is set if the invocation was a dry run
+	Plan *Plan
+	// Recording is the path of the invocation's recording, if
+	// one was requested
+	Recording string
+}
+
+// Plan describes what an invocation would do; see
+// InvokeWithFilesArgs.DryRun.
+type Plan struct {
+	Function string `json:"function"`
+	// Cmdline is the command line the runtime would run, before
+	// expanding variables or moving arguments into a response
+	// file. If the function's own command couldn't be
+	// determined, Cmdline only holds the job's arguments, and
+	// CmdlineNote says why.
+	Cmdline     []string `json:"cmdline"`
+	CmdlineNote string   `json:"cmdline_note,omitempty"`
+	// Files lists the files that would be materialized in the
+	// job's workspace, and Outputs the paths that would be
+	// collected from it.
+	Files      []PlannedFile `json:"files"`
+	StdinBytes int           `json:"stdin_bytes,omitempty"`
+	Outputs    []string      `json:"outputs"`
+	// Uploads lists the objects the invocation would store.
+	// UploadObjects and UploadBytes count those the store
+	// doesn't already have.
+	Uploads       []store.PlannedObject `json:"uploads"`
+	UploadObjects int                   `json:"upload_objects"`
+	UploadBytes   int64                 `json:"upload_bytes"`
+	// Spec is what would be sent to the function
+	Spec protocol.InvocationSpec `json:"spec"`
+}
+
+type PlannedFile struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// BudgetArgs describes a budget.Budget
+type BudgetArgs struct {
+	Dir     string
+	Max     int
+	Timeout time.Duration
+}
+
+type ReadStreamArgs struct {
+	Stream string
+}
+
+type ReadStreamReply struct {
+	Data []byte
+	EOF  bool
+}
+
+// ReadProgressArgs asks for the first progress event of the
+// invocation with the given Progress ID after the Seq'th
+type ReadProgressArgs struct {
+	Progress string
+	Seq      uint64
+}
+
+// ReadProgressReply carries the invocation's latest progress event,
+// and its sequence number. Events between the requested one and it
+// are skipped. Done is set, without an event, once the invocation
+// is over and its last event has been read.
+type ReadProgressReply struct {
+	Event progress.Event
+	Seq   uint64
+	Done  bool
 }
 
 type Timing struct {
@@ -69,7 +270,14 @@ type Stats struct {
 	Invocations    uint64
 	FunctionErrors uint64
 	OtherErrors    uint64
-	ExitStatuses   [256]uint64
+	// Retries counts invocations that were retried after
+	// failing transiently
+	Retries uint64
+	// Local counts jobs run in the daemon instead of on Lambda
+	Local uint64
+	// Memoized counts jobs whose stored results were reused
+	Memoized     uint64
+	ExitStatuses [256]uint64
 
 	Usage AWSUsage
 }
@@ -82,9 +290,29 @@ type AWSUsage struct {
 
 type StatsArgs struct {
 	Reset bool
+	// Pricing, if set, replaces cost.DefaultPricing in the cost
+	// report
+	Pricing *cost.Pricing
+	// TopJobs is the number of the most expensive jobs to list,
+	// by default DefaultTopJobs
+	TopJobs int
 }
+
+const DefaultTopJobs = 10
+
 type StatsReply struct {
 	Stats Stats
+	// Cost estimates the AWS cost of the jobs run since the
+	// daemon started, or its stats were last reset
+	Cost *cost.Report
+	// StatCache counts the daemon's stat cache lookups since it
+	// started. It is nil if the daemon has no stat cache.
+	StatCache *files.StatCacheStats
+	// StoreCache counts the hits and misses in the object
+	// store's caches since the daemon started, if it has any.
+	StoreCache *store.CacheStats
+	// Uptime is how long the daemon has been running
+	Uptime time.Duration
 }
 
 type TraceSpansArgs struct {
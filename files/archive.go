@@ -0,0 +1,263 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+)
+
+// Archive formats understood by WriteArchive
+const (
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+	ArchiveZip   = "zip"
+)
+
+// ArchiveFormat returns the archive format named by the extension
+// of `path`
+func ArchiveFormat(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		return ArchiveTar, nil
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return ArchiveTarGz, nil
+	case strings.HasSuffix(path, ".zip"):
+		return ArchiveZip, nil
+	}
+	return "", fmt.Errorf("%s: unknown archive format (expected .tar, .tar.gz, .tgz, or .zip)", path)
+}
+
+// ArchiveIndex lists the contents of an archive written by
+// WriteArchive
+type ArchiveIndex struct {
+	Format  string         `json:"format"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+// ArchiveEntry describes one file in an archive
+type ArchiveEntry struct {
+	Path  string      `json:"path"`
+	Size  int64       `json:"size"`
+	Mode  os.FileMode `json:"mode"`
+	MTime time.Time   `json:"mtime"`
+}
+
+// Write writes the index to `where`, as JSON
+func (idx *ArchiveIndex) Write(where string) error {
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return files.WriteFile(where, append(data, '\n'), 0644, files.WriteOptions{})
+}
+
+// archiveWriter adds files to an archive
+type archiveWriter interface {
+	create(e *ArchiveEntry) (io.Writer, error)
+	Close() error
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (w *tarWriter) create(e *ArchiveEntry) (io.Writer, error) {
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     e.Path,
+		Size:     e.Size,
+		Mode:     int64(e.Mode.Perm()),
+		ModTime:  e.MTime,
+		Format:   tar.FormatPAX,
+	})
+	return w.tw, err
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) create(e *ArchiveEntry) (io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name:     e.Path,
+		Method:   zip.Deflate,
+		Modified: e.MTime,
+	}
+	hdr.SetMode(e.Mode.Perm())
+	return w.zw.CreateHeader(hdr)
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+func newArchiveWriter(format string, out io.Writer) (archiveWriter, error) {
+	switch format {
+	case ArchiveTar:
+		return &tarWriter{tw: tar.NewWriter(out)}, nil
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(out)
+		return &tarWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case ArchiveZip:
+		return &zipWriter{zw: zip.NewWriter(out)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format: %q", format)
+}
+
+// WriteArchive writes the files in `list` into an archive at
+// `where`, instead of materializing them as separate files. Each is
+// stored under its Path, which must be relative, and with its mode
+// and modification time. Files are fetched from `st` one at a time,
+// and sparse files one extent at a time, and written straight into
+// the archive, so no more than one object is held in memory at
+// once. The archive is written to a temporary file and renamed into
+// place, so a failure never leaves a partial archive at `where`.
+func WriteArchive(ctx context.Context, st store.Store, list protocol.FileList, where, format string) (*ArchiveIndex, error) {
+	sorted := make(protocol.FileList, len(list))
+	for i, f := range list {
+		clean, err := protocol.CleanPath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		f.Path = clean
+		sorted[i] = f
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Path == sorted[i-1].Path {
+			return nil, fmt.Errorf("%s: output returned more than once", sorted[i].Path)
+		}
+	}
+
+	idx := &ArchiveIndex{Format: format, Entries: make([]ArchiveEntry, 0, len(sorted))}
+	now := time.Now()
+	err := files.WriteStream(where, 0644, files.WriteOptions{}, func(out io.Writer) error {
+		buf := bufio.NewWriter(out)
+		aw, err := newArchiveWriter(format, buf)
+		if err != nil {
+			return err
+		}
+		for i := range sorted {
+			e, err := archiveFile(ctx, st, aw, &sorted[i], now)
+			if err != nil {
+				return fmt.Errorf("%s: %w", sorted[i].Path, err)
+			}
+			idx.Entries = append(idx.Entries, e)
+		}
+		if err := aw.Close(); err != nil {
+			return err
+		}
+		return buf.Flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// archiveFile adds `f` to `aw`. Files that don't record a
+// modification time are given `now`.
+func archiveFile(ctx context.Context, st store.Store, aw archiveWriter, f *protocol.FileAndPath, now time.Time) (ArchiveEntry, error) {
+	e := ArchiveEntry{Path: f.Path, Mode: f.Mode, MTime: now}
+	if e.Mode == 0 {
+		e.Mode = 0644
+	}
+	if f.MTime != 0 {
+		e.MTime = time.Unix(0, f.MTime)
+	}
+	if len(f.Extents) > 0 {
+		return e, archiveSparse(ctx, st, aw, &e, &f.File)
+	}
+	data, err := files.Read(ctx, st, &f.Blob)
+	if err != nil {
+		return e, err
+	}
+	if data, err = files.Decompress(&f.File, data); err != nil {
+		return e, err
+	}
+	e.Size = int64(len(data))
+	w, err := aw.create(&e)
+	if err != nil {
+		return e, err
+	}
+	_, err = w.Write(data)
+	return e, err
+}
+
+// archiveSparse adds the sparse file `f` to `aw`, filling in the
+// holes between its extents with zeros
+func archiveSparse(ctx context.Context, st store.Store, aw archiveWriter, e *ArchiveEntry, f *protocol.File) error {
+	e.Size = f.Size
+	w, err := aw.create(e)
+	if err != nil {
+		return err
+	}
+	var off int64
+	for i := range f.Extents {
+		ext := &f.Extents[i]
+		data, err := files.Read(ctx, st, &ext.Blob)
+		if err != nil {
+			return err
+		}
+		if ext.Offset < off || ext.Offset+int64(len(data)) > f.Size {
+			return fmt.Errorf("extent at %d (%d bytes) is out of order or outside of a %d-byte file", ext.Offset, len(data), f.Size)
+		}
+		if _, err := io.CopyN(w, zeros{}, ext.Offset-off); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		off = ext.Offset + int64(len(data))
+	}
+	_, err = io.CopyN(w, zeros{}, f.Size-off)
+	return err
+}
+
+// zeros is an io.Reader of an endless stream of zeros
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
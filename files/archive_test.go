@@ -0,0 +1,145 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteArchive(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-archive")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := store.InMemory()
+	big := bytes.Repeat([]byte("y"), 2*protocol.MaxInlineBlob)
+	exe, err := files.NewFile(ctx, st, big, 0755, "")
+	require.NoError(t, err)
+	mtime := time.Unix(1600000000, 123456789)
+	exe.MTime = mtime.UnixNano()
+	small, err := files.NewFile(ctx, st, []byte("hi"), 0, "")
+	require.NoError(t, err)
+	ext, err := files.NewBlob(ctx, st, []byte("data"))
+	require.NoError(t, err)
+	sparse := protocol.File{
+		Size:    10,
+		Mode:    0600,
+		Extents: []protocol.Extent{{Blob: *ext, Offset: 3}},
+	}
+
+	list := protocol.FileList{
+		{File: *small, Path: "out.txt"},
+		{File: *exe, Path: "bin/tool"},
+		{File: sparse, Path: "sparse"},
+	}
+	want := map[string][]byte{
+		"bin/tool": big,
+		"out.txt":  []byte("hi"),
+		"sparse":   []byte("\x00\x00\x00data\x00\x00\x00"),
+	}
+
+	tarPath := filepath.Join(dir, "out.tar")
+	idx, err := WriteArchive(ctx, st, list, tarPath, ArchiveTar)
+	require.NoError(t, err)
+	require.Len(t, idx.Entries, 3)
+	assert.Equal(t, "bin/tool", idx.Entries[0].Path)
+	assert.Equal(t, int64(len(big)), idx.Entries[0].Size)
+	assert.Equal(t, os.FileMode(0755), idx.Entries[0].Mode)
+	assert.True(t, idx.Entries[0].MTime.Equal(mtime))
+
+	fh, err := os.Open(tarPath)
+	require.NoError(t, err)
+	defer fh.Close()
+	tr := tar.NewReader(fh)
+	got := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		got[hdr.Name] = data
+		if hdr.Name == "bin/tool" {
+			assert.Equal(t, int64(0755), hdr.Mode)
+			assert.True(t, hdr.ModTime.Equal(mtime), "mtime=%s", hdr.ModTime)
+		}
+	}
+	assert.Equal(t, want, got)
+
+	zipPath := filepath.Join(dir, "out.zip")
+	_, err = WriteArchive(ctx, st, list, zipPath, ArchiveZip)
+	require.NoError(t, err)
+	zr, err := zip.OpenReader(zipPath)
+	require.NoError(t, err)
+	defer zr.Close()
+	got = map[string][]byte{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		r.Close()
+		got[f.Name] = data
+		if f.Name == "sparse" {
+			assert.Equal(t, os.FileMode(0600), f.Mode())
+		}
+	}
+	assert.Equal(t, want, got)
+
+	// A failure leaves the existing archive alone, and no
+	// temporary files behind
+	bad := append(list, protocol.FileAndPath{File: protocol.File{Blob: protocol.Blob{Err: "boom"}}, Path: "bad"})
+	_, err = WriteArchive(ctx, st, bad, tarPath, ArchiveTar)
+	assert.Error(t, err)
+	ents, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, ents, 2)
+	fi, err := os.Stat(tarPath)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Size())
+
+	_, err = WriteArchive(ctx, st, protocol.FileList{{File: *small, Path: "../escape"}}, tarPath, ArchiveTar)
+	assert.Error(t, err)
+}
+
+func TestArchiveFormat(t *testing.T) {
+	for path, want := range map[string]string{
+		"a.tar": ArchiveTar, "a.tar.gz": ArchiveTarGz, "a.tgz": ArchiveTarGz, "a.zip": ArchiveZip,
+	} {
+		got, err := ArchiveFormat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, path)
+	}
+	_, err := ArchiveFormat("a.rar")
+	assert.Error(t, err)
+}
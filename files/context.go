@@ -19,6 +19,8 @@ import (
 	"os"
 	"path"
 	"strings"
+
+	"github.com/nelhage/llama/protocol"
 )
 
 type IOContext struct {
@@ -27,14 +29,17 @@ type IOContext struct {
 }
 
 func (io *IOContext) cleanPath(file string) (Mapped, error) {
-	if path.IsAbs(file) {
+	// The remote side always uses `/`-separated paths, even if
+	// we were handed a Windows-style local path.
+	remote := protocol.NormalizePath(file)
+	if path.IsAbs(file) || protocol.IsAbs(remote) {
 		return Mapped{}, fmt.Errorf("Cannot pass absolute path: %q", file)
 	}
 	file = path.Clean(file)
-	if strings.HasPrefix(file, "../") {
+	if remote == ".." || strings.HasPrefix(remote, "../") {
 		return Mapped{}, fmt.Errorf("Cannot pass path outside working directory: %q", file)
 	}
-	return Mapped{Local: LocalFile{Path: file}, Remote: file}, nil
+	return Mapped{Local: LocalFile{Path: file}, Remote: remote}, nil
 }
 
 func (io *IOContext) Input(file string) (string, error) {
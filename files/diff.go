@@ -0,0 +1,205 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nelhage/llama/internal/humanize"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// MaxDifferJobs bounds the number of jobs a Differ remembers
+const MaxDifferJobs = 4096
+
+// A Differ remembers the files each job, identified by a key of the
+// caller's choosing, was last uploaded with, and compares the files
+// of the next job with the same key against them. Local files whose
+// size, modification time, and inode haven't changed since aren't
+// read or uploaded again, which makes rerunning a job after editing
+// one or two of its inputs cheap. Past MaxDifferJobs, an arbitrary
+// job is forgotten to make room for each new one. A Differ is safe
+// for concurrent use.
+type Differ struct {
+	mu   sync.Mutex
+	jobs map[string]map[string]*diffEntry
+}
+
+type diffEntry struct {
+	local       string
+	size, mtime int64
+	inode       uint64
+	compression string
+	file        protocol.File
+}
+
+func NewDiffer() *Differ {
+	return &Differ{jobs: make(map[string]map[string]*diffEntry)}
+}
+
+// FileDiff describes how a job's files differ from those of the last
+// job with the same key. Added, Modified, and Removed list remote
+// paths.
+type FileDiff struct {
+	Added     []string `json:"added,omitempty"`
+	Modified  []string `json:"modified,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	Unchanged int      `json:"unchanged"`
+	// Bytes is the total size of the added and modified files
+	Bytes int64 `json:"bytes"`
+}
+
+// Changed returns the number of files that aren't unchanged
+func (d *FileDiff) Changed() int {
+	return len(d.Added) + len(d.Modified) + len(d.Removed)
+}
+
+func (d *FileDiff) String() string {
+	return fmt.Sprintf("%d files changed, %d unchanged, %s to upload",
+		d.Changed(), d.Unchanged, humanize.Bytes(float64(d.Bytes)))
+}
+
+// Detail lists the changed files, one per line, marked with +, ~, or
+// - for added, modified, and removed files
+func (d *FileDiff) Detail() string {
+	var lines []string
+	for _, p := range d.Added {
+		lines = append(lines, "+ "+p)
+	}
+	for _, p := range d.Modified {
+		lines = append(lines, "~ "+p)
+	}
+	for _, p := range d.Removed {
+		lines = append(lines, "- "+p)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Forget forgets the files of the job `key`, so that the next job
+// with that key is uploaded in full
+func (d *Differ) Forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.jobs, key)
+}
+
+// Upload behaves like f.UploadWith, except that files unchanged
+// since the last job with the same `key` are reused without being
+// read, and it also describes how the job's files differ from that
+// job's. Every file still appears in the returned list, so the spec
+// built from it is complete.
+func (d *Differ) Upload(ctx context.Context, st store.Store, key string, f List, files protocol.FileList, opts UploadOptions) (protocol.FileList, *FileDiff, error) {
+	d.mu.Lock()
+	prev := d.jobs[key]
+	d.mu.Unlock()
+
+	out := make([]*protocol.File, len(f))
+	keys := make([]*statKey, len(f))
+	var changed List
+	var changedIdx []int
+	for i := range f {
+		m := &f[i]
+		if m.Local.Path != "" {
+			sk, err := statFile(m.Local.Path)
+			if err != nil {
+				return files, nil, fmt.Errorf("reading file %q: %w", m.Local.Path, err)
+			}
+			keys[i] = sk
+			if e := prev[m.Remote]; e != nil && e.matches(sk, opts.Compression) {
+				pf := e.file
+				out[i] = &pf
+				continue
+			}
+		}
+		changed = append(changed, *m)
+		changedIdx = append(changedIdx, i)
+	}
+
+	uploaded, err := changed.UploadWith(ctx, st, nil, opts)
+	if err != nil {
+		return files, nil, err
+	}
+	for j, i := range changedIdx {
+		pf := uploaded[j].File
+		out[i] = &pf
+	}
+
+	diff := &FileDiff{}
+	next := make(map[string]*diffEntry, len(f))
+	for i := range f {
+		m := &f[i]
+		e := prev[m.Remote]
+		switch {
+		case e != nil && protocol.SameFile(&e.file, out[i]):
+			diff.Unchanged++
+		case e != nil:
+			diff.Modified = append(diff.Modified, m.Remote)
+			diff.Bytes += localSize(m, keys[i])
+		default:
+			diff.Added = append(diff.Added, m.Remote)
+			diff.Bytes += localSize(m, keys[i])
+		}
+		ent := &diffEntry{compression: opts.Compression, file: *out[i]}
+		// Files modified too recently to trust their mtime are
+		// only remembered for comparison's sake; see
+		// statRacyWindow.
+		if sk := keys[i]; sk != nil && sk.stat.Sub(sk.fi.ModTime()) >= statRacyWindow {
+			ent.local = sk.path
+			ent.size = sk.fi.Size()
+			ent.mtime = sk.fi.ModTime().UnixNano()
+			ent.inode = sk.inode
+		}
+		next[m.Remote] = ent
+		files = append(files, protocol.FileAndPath{File: *out[i], Path: m.Remote})
+	}
+	for remote := range prev {
+		if _, ok := next[remote]; !ok {
+			diff.Removed = append(diff.Removed, remote)
+		}
+	}
+	sort.Strings(diff.Removed)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.jobs[key]; !ok && len(d.jobs) >= MaxDifferJobs {
+		for k := range d.jobs {
+			delete(d.jobs, k)
+			break
+		}
+	}
+	d.jobs[key] = next
+	return files, diff, nil
+}
+
+func (e *diffEntry) matches(key *statKey, compression string) bool {
+	return e.local != "" && e.local == key.path &&
+		e.size == key.fi.Size() &&
+		e.mtime == key.fi.ModTime().UnixNano() &&
+		e.inode == key.inode &&
+		e.compression == compression &&
+		e.file.Mode == key.fi.Mode()
+}
+
+func localSize(m *Mapped, key *statKey) int64 {
+	if key != nil {
+		return key.fi.Size()
+	}
+	return int64(len(m.Local.Bytes))
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffer(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-diff")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("x"), 2*protocol.MaxInlineBlob)
+	var list List
+	for _, name := range []string{"a.h", "b.h", "c.h"} {
+		p := filepath.Join(dir, name)
+		writeOld(t, p, append([]byte(name), data...))
+		list = list.Append(Mapped{Local: LocalFile{Path: p}, Remote: name})
+	}
+	list = list.Append(Mapped{Local: LocalFile{Bytes: []byte("args")}, Remote: "args"})
+
+	st := &countingStore{inner: store.InMemory()}
+	d := NewDiffer()
+	first, diff, err := d.Upload(ctx, st, "job", list, nil, UploadOptions{})
+	require.NoError(t, err)
+	assert.Len(t, first, 4)
+	assert.Equal(t, []string{"a.h", "b.h", "c.h", "args"}, diff.Added)
+	assert.Equal(t, 3, st.stores)
+
+	// Edit one file, drop another, and add a new one
+	st.stores = 0
+	writeOld(t, filepath.Join(dir, "a.h"), append([]byte("edited"), data...))
+	writeOld(t, filepath.Join(dir, "d.h"), []byte("new"))
+	next := List{list[0], list[1], list[3]}.Append(
+		Mapped{Local: LocalFile{Path: filepath.Join(dir, "d.h")}, Remote: "d.h"})
+	second, diff, err := d.Upload(ctx, st, "job", next, nil, UploadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d.h"}, diff.Added)
+	assert.Equal(t, []string{"a.h"}, diff.Modified)
+	assert.Equal(t, []string{"c.h"}, diff.Removed)
+	assert.Equal(t, 2, diff.Unchanged)
+	assert.Equal(t, int64(len("edited")+len(data)+len("new")), diff.Bytes)
+	assert.Equal(t, "3 files changed, 2 unchanged, 209B to upload", diff.String())
+	assert.Equal(t, 1, st.stores, "only the edited file is stored")
+	require.Len(t, second, 4)
+	assert.Equal(t, first[1], second[1])
+	assert.NotEqual(t, first[0].File, second[0].File)
+
+	// Other keys, and forgotten ones, start from scratch
+	_, diff, err = d.Upload(ctx, st, "other", next, nil, UploadOptions{})
+	require.NoError(t, err)
+	assert.Len(t, diff.Added, 4)
+	d.Forget("job")
+	_, diff, err = d.Upload(ctx, st, "job", next, nil, UploadOptions{})
+	require.NoError(t, err)
+	assert.Len(t, diff.Added, 4)
+}
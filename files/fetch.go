@@ -0,0 +1,205 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nelhage/llama/progress"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+)
+
+// DefaultFetchConcurrency is the default for
+// FetchOptions.Concurrency
+const DefaultFetchConcurrency = 32
+
+// FetchOptions controls how FetchOutputs writes files
+type FetchOptions struct {
+	files.WriteOptions
+
+	// Concurrency bounds the number of files fetched and written
+	// at once. It defaults to DefaultFetchConcurrency, and is
+	// further capped by the store's own limit, if it has one.
+	Concurrency int
+
+	// If Claims is non-nil, each file's local path is claimed in
+	// it on behalf of Owner before the file is written, and a
+	// path already claimed by another owner is reported as a
+	// conflict instead of being overwritten.
+	Claims *Claims
+	Owner  string
+
+	// Progress, if non-nil, is called after each file is
+	// written. Calls are not concurrent.
+	Progress func(FetchProgress)
+}
+
+// FetchProgress reports the progress of a fetch
+type FetchProgress struct {
+	Files      int
+	TotalFiles int
+	// Bytes counts the contents of the files written so far
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Event returns the progress as a progress.Downloading event
+func (p FetchProgress) Event() progress.Event {
+	return progress.Event{Stage: progress.Downloading, Files: p.Files, TotalFiles: p.TotalFiles, Bytes: p.Bytes, Elapsed: p.Elapsed}
+}
+
+// Claims records which owner wrote each local path across a batch
+// of FetchOutputs calls, so that jobs whose outputs overlap are
+// detected rather than silently racing. The zero value is ready to
+// use, and it is safe for concurrent use.
+type Claims struct {
+	mu     sync.Mutex
+	owners map[string]string
+}
+
+// claim claims `path` for `owner`, returning the path's previous
+// owner if it belongs to someone else.
+func (c *Claims) claim(path, owner string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.owners == nil {
+		c.owners = make(map[string]string)
+	}
+	if prev, ok := c.owners[path]; ok && prev != owner {
+		return prev, false
+	}
+	c.owners[path] = owner
+	return "", true
+}
+
+// FetchError reports every file that failed to be fetched
+type FetchError struct {
+	Failed []FileError
+}
+
+func (e *FetchError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d files failed to download:", len(e.Failed))
+	for _, f := range e.Failed {
+		fmt.Fprintf(&b, "\n  %s: %s", f.Path, f.Err.Error())
+	}
+	return b.String()
+}
+
+// FetchOutputs fetches each file in `list` from `st` and writes it
+// to its Path, which should be local, creating parent directories
+// as needed. Files are fetched and written in parallel; each is
+// written to a temporary file and renamed into place, with its
+// mode and modification time. If any fail, FetchOutputs writes the
+// others and returns a *FetchError naming all of the failures.
+func FetchOutputs(ctx context.Context, st store.Store, list protocol.FileList, opts FetchOptions) error {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultFetchConcurrency
+	}
+	if limit := store.Concurrency(st); limit > 0 && limit < concurrency {
+		concurrency = limit
+	}
+
+	var mu sync.Mutex
+	var failed []FileError
+	fail := func(path string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, FileError{Path: path, Err: err})
+	}
+
+	jobs := make(chan *protocol.FileAndPath)
+	go func() {
+		defer close(jobs)
+		seen := make(map[string]bool, len(list))
+		for i := range list {
+			f := &list[i]
+			if seen[f.Path] {
+				fail(f.Path, fmt.Errorf("output returned more than once"))
+				continue
+			}
+			seen[f.Path] = true
+			if opts.Claims != nil {
+				if prev, ok := opts.Claims.claim(f.Path, opts.Owner); !ok {
+					fail(f.Path, fmt.Errorf("conflicts with an output of %s", prev))
+					continue
+				}
+			}
+			jobs <- f
+		}
+	}()
+
+	start := time.Now()
+	progress := FetchProgress{TotalFiles: len(list)}
+	done := func(f *protocol.FileAndPath) {
+		if opts.Progress == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		progress.Files++
+		if fi, err := os.Stat(f.Path); err == nil {
+			progress.Bytes += fi.Size()
+		}
+		progress.Elapsed = time.Since(start)
+		opts.Progress(progress)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				if err := fetchOne(ctx, st, f, opts.WriteOptions); err != nil {
+					fail(f.Path, err)
+				} else {
+					done(f)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != nil {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+		return &FetchError{Failed: failed}
+	}
+	return nil
+}
+
+func fetchOne(ctx context.Context, st store.Store, f *protocol.FileAndPath, opts files.WriteOptions) error {
+	gets := files.AppendGetFile(nil, &f.File)
+	if len(gets) > 0 {
+		st.GetObjects(ctx, gets)
+	}
+	// Outputs inside a directory output may need their parent
+	// directories created.
+	if err := os.MkdirAll(path.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	err, _ := files.FetchFileWith(&f.File, f.Path, gets, opts)
+	return err
+}
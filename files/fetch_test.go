@@ -0,0 +1,82 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchOutputs(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-fetch")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	st := store.InMemory()
+	data := bytes.Repeat([]byte("y"), 2*protocol.MaxInlineBlob)
+	exe, err := files.NewFile(ctx, st, data, 0755, "")
+	require.NoError(t, err)
+	mtime := time.Unix(1600000000, 123456789)
+	exe.MTime = mtime.UnixNano()
+	small, err := files.NewFile(ctx, st, []byte("hi"), 0, "")
+	require.NoError(t, err)
+
+	list := protocol.FileList{
+		{File: *exe, Path: filepath.Join(dir, "bin", "tool")},
+		{File: *small, Path: filepath.Join(dir, "out.txt")},
+		{File: protocol.File{Blob: protocol.Blob{Err: "boom"}}, Path: filepath.Join(dir, "bad")},
+	}
+	var claims Claims
+	err = FetchOutputs(ctx, st, list, FetchOptions{Claims: &claims, Owner: "job 1"})
+	var fetchErr *FetchError
+	require.True(t, errors.As(err, &fetchErr), "err=%v", err)
+	if assert.Len(t, fetchErr.Failed, 1) {
+		assert.Equal(t, filepath.Join(dir, "bad"), fetchErr.Failed[0].Path)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "bin", "tool"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(mtime), "mtime=%s", fi.ModTime())
+	got, err := ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(got))
+
+	// A second job writing the same path is a conflict, and
+	// leaves the first job's output alone
+	other, err := files.NewFile(ctx, st, []byte("other"), 0, "")
+	require.NoError(t, err)
+	err = FetchOutputs(ctx, st, protocol.FileList{
+		{File: *other, Path: filepath.Join(dir, "out.txt")},
+	}, FetchOptions{Claims: &claims, Owner: "job 2"})
+	require.True(t, errors.As(err, &fetchErr), "err=%v", err)
+	assert.Contains(t, err.Error(), "conflicts with an output of job 1")
+	got, err = ioutil.ReadFile(filepath.Join(dir, "out.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(got))
+}
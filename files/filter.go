@@ -0,0 +1,100 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"fmt"
+
+	"github.com/nelhage/llama/internal/humanize"
+	"github.com/nelhage/llama/protocol"
+)
+
+// An OutputFilter chooses which of the outputs a job returned are
+// fetched. Its rules are path.Match patterns matched against the
+// outputs' paths in the job's workspace, as IgnoreRules are matched
+// against seeded paths. An output is fetched if it matches an
+// Include rule, or there are none, and matches no Exclude rule. The
+// outputs it skips are left in the store.
+type OutputFilter struct {
+	Include IgnoreRules
+	Exclude IgnoreRules
+}
+
+// Empty reports whether the filter has no rules, and so fetches
+// every output. A nil filter is empty.
+func (f *OutputFilter) Empty() bool {
+	return f == nil || (len(f.Include) == 0 && len(f.Exclude) == 0)
+}
+
+// Match reports whether the output at `remote` is fetched
+func (f *OutputFilter) Match(remote string) bool {
+	if f.Empty() {
+		return true
+	}
+	if len(f.Include) > 0 && !f.Include.Match(remote, false) {
+		return false
+	}
+	return !f.Exclude.Match(remote, false)
+}
+
+// Filter splits `outputs` into those the filter fetches and those
+// it skips
+func (f *OutputFilter) Filter(outputs protocol.FileList) (keep, skip protocol.FileList) {
+	if f.Empty() {
+		return outputs, nil
+	}
+	for _, out := range outputs {
+		if f.Match(out.Path) {
+			keep = append(keep, out)
+		} else {
+			skip = append(skip, out)
+		}
+	}
+	return keep, skip
+}
+
+// SkippedOutputs summarizes the outputs a filter skipped
+type SkippedOutputs struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+	// Unsized counts the skipped outputs whose sizes aren't known
+	// without fetching them, and so aren't included in Bytes
+	Unsized int `json:"unsized,omitempty"`
+}
+
+// Skipped summarizes `skip`, as returned by OutputFilter.Filter
+func Skipped(skip protocol.FileList) SkippedOutputs {
+	s := SkippedOutputs{Count: len(skip)}
+	for i := range skip {
+		if size, ok := fileSize(&skip[i].File); ok {
+			s.Bytes += size
+		} else {
+			s.Unsized++
+		}
+	}
+	return s
+}
+
+func (s SkippedOutputs) String() string {
+	size := humanize.Bytes(float64(s.Bytes))
+	if s.Unsized > 0 {
+		size = fmt.Sprintf("%s and %d of unknown size", size, s.Unsized)
+	}
+	noun := "outputs"
+	if s.Count == 1 {
+		noun = "output"
+	}
+	return fmt.Sprintf("%d %s (%s)", s.Count, noun, size)
+}
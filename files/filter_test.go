@@ -0,0 +1,59 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFilter(t *testing.T) {
+	outputs := protocol.FileList{
+		{Path: "out/prog", File: protocol.File{Blob: protocol.Blob{String: "binary"}}},
+		{Path: "out/prog.map", File: protocol.File{Blob: protocol.Blob{Ref: "sha256:abc"}}},
+		{Path: "debug/prog.dwo", File: protocol.File{Blob: protocol.Blob{Bytes: []byte("dwarf")}}},
+	}
+	paths := func(l protocol.FileList) []string {
+		var out []string
+		for _, f := range l {
+			out = append(out, f.Path)
+		}
+		return out
+	}
+
+	var nilFilter *OutputFilter
+	keep, skip := nilFilter.Filter(outputs)
+	assert.Equal(t, outputs, keep)
+	assert.Empty(t, skip)
+
+	f := &OutputFilter{Exclude: IgnoreRules{"*.map", "debug/*"}}
+	keep, skip = f.Filter(outputs)
+	assert.Equal(t, []string{"out/prog"}, paths(keep))
+	assert.Equal(t, []string{"out/prog.map", "debug/prog.dwo"}, paths(skip))
+	s := Skipped(skip)
+	assert.Equal(t, SkippedOutputs{Count: 2, Bytes: 5, Unsized: 1}, s)
+	assert.Equal(t, "2 outputs (5B and 1 of unknown size)", s.String())
+
+	f = &OutputFilter{Include: IgnoreRules{"prog*"}, Exclude: IgnoreRules{"*.dwo"}}
+	keep, _ = f.Filter(outputs)
+	assert.Equal(t, []string{"out/prog", "out/prog.map"}, paths(keep))
+
+	f = &OutputFilter{Include: IgnoreRules{"none"}}
+	keep, skip = f.Filter(outputs)
+	assert.Empty(t, keep)
+	assert.Equal(t, "3 outputs (11B and 1 of unknown size)", Skipped(skip).String())
+}
@@ -17,12 +17,15 @@ package files
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/nelhage/llama/internal/humanize"
+	"github.com/nelhage/llama/progress"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/protocol/files"
 	"github.com/nelhage/llama/store"
@@ -63,7 +66,8 @@ func (f *List) Set(v string) error {
 		source = v
 		dest = v
 	}
-	if path.IsAbs(dest) {
+	dest = protocol.NormalizePath(dest)
+	if protocol.IsAbs(dest) {
 		return fmt.Errorf("-file: cannot expose file at absolute path: %q", dest)
 	}
 	*f = f.Append(Mapped{Local: LocalFile{Path: source}, Remote: dest})
@@ -74,78 +78,298 @@ func (f List) Append(mapped ...Mapped) List {
 	return append(f, mapped...)
 }
 
-func uploadWorker(ctx context.Context, store store.Store, jobs <-chan Mapped, out chan<- *protocol.FileAndPath) {
-	for file := range jobs {
-		data, mode, err := func() ([]byte, os.FileMode, error) {
-			if file.Local.Bytes != nil {
-				if file.Local.Path != "" {
-					panic("MappedFile: got both Path and Bytes")
-				}
-				return file.Local.Bytes, file.Local.Mode, nil
-			} else {
-				data, err := ioutil.ReadFile(file.Local.Path)
-				if err != nil {
-					return nil, 0, fmt.Errorf("reading file %q: %w", file.Local.Path, err)
-				}
-				st, err := os.Stat(file.Local.Path)
-				if err != nil {
-					return nil, 0, fmt.Errorf("stat %q: %w", file.Local.Path, err)
-				}
-				return data, st.Mode(), nil
-			}
-		}()
-		var blob *protocol.Blob
-		if err == nil {
-			blob, err = files.NewBlob(ctx, store, data)
+// Size returns the total size of the files in the list. Files that
+// can't be stat'd count for nothing.
+func (f List) Size() int64 {
+	var size int64
+	for _, m := range f {
+		if m.Local.Bytes != nil {
+			size += int64(len(m.Local.Bytes))
+		} else if fi, err := os.Stat(m.Local.Path); err == nil {
+			size += fi.Size()
 		}
-		if err != nil {
-			blob = &protocol.Blob{Err: err.Error()}
+	}
+	return size
+}
+
+// UploadOptions controls how files are uploaded
+type UploadOptions struct {
+	// Compression, if set, names an algorithm (see
+	// protocol.File.Compression) used to compress large files
+	// before uploading them.
+	Compression string
+
+	// Concurrency bounds the number of files read, hashed, and
+	// stored at once. It defaults to DefaultUploadConcurrency,
+	// and is further capped by the store's own limit, if it has
+	// one (see store.Limiter).
+	Concurrency int
+
+	// Progress, if non-nil, is called after each file is
+	// uploaded. Calls are not concurrent.
+	Progress func(UploadProgress)
+
+	// StatCache, if non-nil, is consulted before local files are
+	// read, and updated after they are uploaded. Callers must
+	// Save it themselves.
+	StatCache *StatCache
+
+	// Seed, if non-nil, supplies the objects files were stored as
+	// when they were seeded, for files that haven't changed since;
+	// see Seed.
+	Seed *SeedManifest
+}
+
+// UploadProgress reports the progress of an upload
+type UploadProgress struct {
+	Files      int
+	TotalFiles int
+	// Bytes counts the contents of the files uploaded so far,
+	// before compression.
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Rate returns the average upload rate so far, in bytes per second
+func (p UploadProgress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// Event returns the progress as a progress.Uploading event
+func (p UploadProgress) Event() progress.Event {
+	return progress.Event{Stage: progress.Uploading, Files: p.Files, TotalFiles: p.TotalFiles, Bytes: p.Bytes, Elapsed: p.Elapsed}
+}
+
+func (p UploadProgress) String() string {
+	return fmt.Sprintf("%d/%d files, %s, %s/s",
+		p.Files, p.TotalFiles, humanize.Bytes(float64(p.Bytes)), humanize.Bytes(p.Rate()))
+}
+
+// FileError records a file that failed to upload
+type FileError struct {
+	// Path is the local path of the file, or its remote path if
+	// it came from memory
+	Path string
+	Err  error
+}
+
+// UploadError reports every file that failed to upload
+type UploadError struct {
+	Failed []FileError
+}
+
+func (e *UploadError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d files failed to upload:", len(e.Failed))
+	for _, f := range e.Failed {
+		fmt.Fprintf(&b, "\n  %s: %s", f.Path, f.Err.Error())
+	}
+	return b.String()
+}
+
+// DefaultUploadConcurrency is the default for
+// UploadOptions.Concurrency
+const DefaultUploadConcurrency = 32
+
+// uploadOne uploads `file`. If `lookup` is set, and opts has a
+// StatCache, unchanged files aren't read again.
+func uploadOne(ctx context.Context, store store.Store, opts UploadOptions, file *Mapped, lookup bool) (*protocol.File, int64, error) {
+	if file.Local.Bytes != nil {
+		if file.Local.Path != "" {
+			panic("MappedFile: got both Path and Bytes")
+		}
+		pf, err := files.NewFile(ctx, store, file.Local.Bytes, file.Local.Mode, opts.Compression)
+		return pf, int64(len(file.Local.Bytes)), err
+	}
+	if opts.Seed != nil && lookup {
+		if pf, size := opts.Seed.lookup(file.Local.Path, opts.Compression); pf != nil {
+			return pf, size, nil
 		}
-		out <- &protocol.FileAndPath{
-			File: protocol.File{Blob: *blob, Mode: mode},
-			Path: file.Remote,
+	}
+	var key *statKey
+	var cached *protocol.File
+	if cache := opts.StatCache; cache != nil {
+		var err error
+		if key, err = cache.stat(file.Local.Path); err != nil {
+			return nil, 0, fmt.Errorf("reading file %q: %w", file.Local.Path, err)
 		}
+		if lookup {
+			var verify bool
+			cached, verify = cache.lookup(key, opts.Compression)
+			if cached != nil && !verify {
+				return cached, key.fi.Size(), nil
+			}
+		}
+	}
+	pf, err := files.ReadFileCompressed(ctx, store, file.Local.Path, opts.Compression)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading file %q: %w", file.Local.Path, err)
 	}
+	if key != nil {
+		opts.StatCache.record(key, opts.Compression, pf, cached)
+		return pf, key.fi.Size(), nil
+	}
+	var size int64
+	if fi, err := os.Stat(file.Local.Path); err == nil {
+		size = fi.Size()
+	}
+	return pf, size, nil
 }
 
-const uploadConcurrency = 32
-
 func (f List) Upload(ctx context.Context, store store.Store, files protocol.FileList) (protocol.FileList, error) {
+	return f.UploadWith(ctx, store, files, UploadOptions{})
+}
+
+// UploadWith behaves like Upload, using the provided UploadOptions.
+// Each worker reads, hashes, and stores one file at a time, so
+// hashing some files overlaps with uploading others. Files are
+// appended to `files` in the order they appear in `f`. If any fail, UploadWith returns the
+// others along with an *UploadError naming all of the failures.
+func (f List) UploadWith(ctx context.Context, st store.Store, files protocol.FileList, opts UploadOptions) (protocol.FileList, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultUploadConcurrency
+	}
+	if limit := store.Concurrency(st); limit > 0 && limit < concurrency {
+		concurrency = limit
+	}
+
+	type result struct {
+		idx  int
+		file *protocol.File
+		size int64
+		err  error
+	}
 	var wg sync.WaitGroup
-	jobs := make(chan Mapped)
-	out := make(chan *protocol.FileAndPath)
+	jobs := make(chan int)
+	out := make(chan result)
 
 	go func() {
 		defer close(jobs)
-		for _, file := range f {
-			jobs <- file
+		for i := range f {
+			jobs <- i
 		}
 	}()
-	for i := 0; i < uploadConcurrency; i++ {
+	for i := 0; i < concurrency; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			uploadWorker(ctx, store, jobs, out)
+			for idx := range jobs {
+				pf, size, err := uploadOne(ctx, st, opts, &f[idx], true)
+				out <- result{idx, pf, size, err}
+			}
 		}()
 	}
 	go func() {
 		wg.Wait()
 		close(out)
 	}()
-	for file := range out {
-		files = append(files, *file)
+
+	start := time.Now()
+	progress := UploadProgress{TotalFiles: len(f)}
+	uploaded := make([]*protocol.File, len(f))
+	var failed []FileError
+	for res := range out {
+		if res.err != nil {
+			path := f[res.idx].Local.Path
+			if path == "" {
+				path = f[res.idx].Remote
+			}
+			failed = append(failed, FileError{Path: path, Err: res.err})
+		} else {
+			uploaded[res.idx] = res.file
+		}
+		progress.Files++
+		progress.Bytes += res.size
+		progress.Elapsed = time.Since(start)
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
 	}
 
+	for i, pf := range uploaded {
+		if pf != nil {
+			files = append(files, protocol.FileAndPath{File: *pf, Path: f[i].Remote})
+		}
+	}
+	if failed != nil {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+		return files, &UploadError{Failed: failed}
+	}
 	return files, nil
 }
 
+// Reupload stores again each file in `f` whose uploaded form, in
+// `uploaded`, references any of the objects `missing`, replacing
+// its entry in `uploaded`. It returns the IDs in `missing` that no
+// file in `f` accounts for. Files are always read again, even if
+// opts has a StatCache, since their cached uploads evidently
+// referenced missing objects.
+func (f List) Reupload(ctx context.Context, st store.Store, uploaded protocol.FileList, missing []string, opts UploadOptions) ([]string, error) {
+	unresolved := make(map[string]bool, len(missing))
+	for _, id := range missing {
+		unresolved[id] = true
+	}
+	byRemote := make(map[string]*Mapped, len(f))
+	for i := range f {
+		byRemote[f[i].Remote] = &f[i]
+	}
+	for i := range uploaded {
+		refs := fileRefs(&uploaded[i].File)
+		hit := false
+		for _, ref := range refs {
+			hit = hit || unresolved[ref]
+		}
+		local, ok := byRemote[uploaded[i].Path]
+		if !hit || !ok {
+			continue
+		}
+		pf, _, err := uploadOne(ctx, st, opts, local, false)
+		if err != nil {
+			return nil, err
+		}
+		uploaded[i].File = *pf
+		for _, ref := range refs {
+			delete(unresolved, ref)
+		}
+	}
+	var out []string
+	for _, id := range missing {
+		if unresolved[id] {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+// fileRefs returns the IDs of the objects `file` references
+func fileRefs(file *protocol.File) []string {
+	var refs []string
+	if file.Ref != "" {
+		refs = append(refs, file.Ref)
+	}
+	for _, ext := range file.Extents {
+		if ext.Ref != "" {
+			refs = append(refs, ext.Ref)
+		}
+	}
+	return refs
+}
+
+// TransformToLocal maps remote output paths back to the local paths
+// they should be written to. A remote path that isn't itself a
+// declared output may lie inside one, if that output was a
+// directory.
 func (f List) TransformToLocal(ctx context.Context, files protocol.FileList) (ok protocol.FileList, bad protocol.FileList) {
 	byPath := make(map[string]string)
 	for _, out := range f {
 		byPath[out.Remote] = out.Local.Path
 	}
 	for _, out := range files {
-		if local, found := byPath[out.Path]; found {
+		if local, found := lookupOutput(byPath, out.Path); found {
 			out.Path = local
 			ok = append(ok, out)
 		} else {
@@ -155,6 +379,28 @@ func (f List) TransformToLocal(ctx context.Context, files protocol.FileList) (ok
 	return
 }
 
+// LocalPath returns the local path the output at `remote` is
+// written to, as TransformToLocal would map it
+func (f List) LocalPath(remote string) (string, bool) {
+	byPath := make(map[string]string, len(f))
+	for _, out := range f {
+		byPath[out.Remote] = out.Local.Path
+	}
+	return lookupOutput(byPath, remote)
+}
+
+func lookupOutput(byPath map[string]string, remote string) (string, bool) {
+	if local, found := byPath[remote]; found {
+		return local, true
+	}
+	for dir := path.Dir(remote); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if local, found := byPath[dir]; found {
+			return path.Join(local, strings.TrimPrefix(remote, dir+"/")), true
+		}
+	}
+	return "", false
+}
+
 func (f List) MakeAbsolute(base string) List {
 	out := make(List, 0, len(f))
 	for _, e := range f {
@@ -0,0 +1,206 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindowsPathsRoundTrip(t *testing.T) {
+	var ioctx IOContext
+	in, err := ioctx.Input(`src\lib/util.c`)
+	require.NoError(t, err)
+	assert.Equal(t, "src/lib/util.c", in)
+
+	out, err := ioctx.Output(`build\util.o`)
+	require.NoError(t, err)
+	assert.Equal(t, "build/util.o", out)
+
+	_, err = ioctx.Input(`..\secret`)
+	assert.Error(t, err)
+	_, err = ioctx.Input(`C:\src\main.c`)
+	assert.Error(t, err)
+	_, err = ioctx.Input(`c:main.c`)
+	assert.Error(t, err)
+
+	var list List
+	require.NoError(t, list.Set(`data.txt:data\in.txt`))
+	assert.Equal(t, "data/in.txt", list[0].Remote)
+
+	ok, bad := ioctx.Outputs.TransformToLocal(context.Background(), protocol.FileList{
+		{Path: "build/util.o"},
+		{Path: "build/other.o"},
+	})
+	require.Equal(t, 1, len(ok))
+	assert.Equal(t, `build\util.o`, ok[0].Path)
+	assert.Equal(t, 1, len(bad))
+}
+
+func TestBackslashOutputRoundTrip(t *testing.T) {
+	var ioctx IOContext
+	out, err := ioctx.Output(`odd\name.txt`)
+	require.NoError(t, err)
+	assert.Equal(t, "odd/name.txt", out)
+
+	// The runtime canonicalizes the output list the same way, so
+	// the file it reports maps back to the path we asked for.
+	remote, err := protocol.CleanPath(out)
+	require.NoError(t, err)
+	ok, bad := ioctx.Outputs.TransformToLocal(context.Background(), protocol.FileList{
+		{Path: remote},
+	})
+	require.Equal(t, 1, len(ok))
+	assert.Equal(t, `odd\name.txt`, ok[0].Path)
+	assert.Empty(t, bad)
+}
+
+func TestTransformToLocal_Directories(t *testing.T) {
+	outputs := List{
+		{Local: LocalFile{Path: "/work/obj"}, Remote: "build/obj"},
+		{Local: LocalFile{Path: "/work/log.txt"}, Remote: "log.txt"},
+	}
+	ok, bad := outputs.TransformToLocal(context.Background(), protocol.FileList{
+		{Path: "build/obj/a.o"},
+		{Path: "build/obj/sub/b.o"},
+		{Path: "log.txt"},
+		{Path: "build/objects.txt"},
+	})
+	var local []string
+	for _, f := range ok {
+		local = append(local, f.Path)
+	}
+	assert.Equal(t, []string{"/work/obj/a.o", "/work/obj/sub/b.o", "/work/log.txt"}, local)
+	require.Equal(t, 1, len(bad))
+	assert.Equal(t, "build/objects.txt", bad[0].Path)
+}
+
+// limitedStore serializes access to an in-memory store, and records
+// how many callers were ever inside it at once.
+type limitedStore struct {
+	inner store.Store
+	limit int
+
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (l *limitedStore) Concurrency() int { return l.limit }
+
+func (l *limitedStore) Store(ctx context.Context, obj []byte) (string, error) {
+	l.mu.Lock()
+	l.active++
+	if l.active > l.maxSeen {
+		l.maxSeen = l.active
+	}
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.active--
+		l.mu.Unlock()
+	}()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inner.Store(ctx, obj)
+}
+
+func (l *limitedStore) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inner.GetObjects(ctx, gets)
+}
+
+func (l *limitedStore) FetchAWSUsage(u *protocol.StoreUsage) {}
+
+func TestUploadWith(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-upload")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	// Large enough not to be inlined
+	data := bytes.Repeat([]byte("x"), 2*protocol.MaxInlineBlob)
+	var list List
+	for _, name := range []string{"a", "b", "c"} {
+		p := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(p, append([]byte(name), data...), 0644))
+		list = list.Append(Mapped{Local: LocalFile{Path: p}, Remote: name})
+	}
+	list = list.Append(
+		Mapped{Local: LocalFile{Bytes: []byte("hello"), Mode: 0644}, Remote: "mem"},
+		Mapped{Local: LocalFile{Path: filepath.Join(dir, "missing")}, Remote: "missing"},
+	)
+
+	st := &limitedStore{inner: store.InMemory(), limit: 2}
+	var calls []UploadProgress
+	got, err := list.UploadWith(context.Background(), st, nil, UploadOptions{
+		Concurrency: 8,
+		Progress:    func(p UploadProgress) { calls = append(calls, p) },
+	})
+
+	var upErr *UploadError
+	require.True(t, errors.As(err, &upErr), "err=%v", err)
+	if assert.Len(t, upErr.Failed, 1) {
+		assert.Equal(t, filepath.Join(dir, "missing"), upErr.Failed[0].Path)
+	}
+	assert.Contains(t, err.Error(), "missing")
+
+	var paths []string
+	for _, f := range got {
+		paths = append(paths, f.Path)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "mem"}, paths)
+
+	require.Len(t, calls, len(list))
+	last := calls[len(calls)-1]
+	assert.Equal(t, len(list), last.Files)
+	assert.Equal(t, len(list), last.TotalFiles)
+	assert.Equal(t, int64(3*(len(data)+1)+len("hello")), last.Bytes)
+	assert.LessOrEqual(t, st.maxSeen, 2)
+}
+
+func TestReupload(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("z"), 2*protocol.MaxInlineBlob)
+	list := List{
+		{Local: LocalFile{Bytes: data, Mode: 0644}, Remote: "big"},
+		{Local: LocalFile{Bytes: []byte("tiny"), Mode: 0644}, Remote: "small"},
+	}
+	uploaded, err := list.Upload(ctx, store.InMemory(), nil)
+	require.NoError(t, err)
+	ref := uploaded[0].Ref
+	require.NotEmpty(t, ref)
+
+	// A store that has lost everything
+	st := store.InMemory()
+	unresolved, err := list.Reupload(ctx, st, uploaded, []string{ref, "unknown"}, UploadOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unknown"}, unresolved)
+	assert.Equal(t, ref, uploaded[0].Ref)
+	got, err := store.Get(ctx, st, ref)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
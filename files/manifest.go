@@ -0,0 +1,252 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// ManifestVersion is the version of the manifest format. Readers
+// reject manifests with other versions.
+const ManifestVersion = 1
+
+// A Manifest describes a job's outputs in place of fetching them,
+// so that some or all of them can be fetched later with
+// FetchManifest. Its JSON form is stable, for the benefit of other
+// tools.
+type Manifest struct {
+	Version int    `json:"version"`
+	JobID   string `json:"job_id,omitempty"`
+	// Store names the object store the outputs are in, if known
+	Store   string          `json:"store,omitempty"`
+	Outputs []ManifestEntry `json:"outputs"`
+}
+
+// ManifestEntry describes one output
+type ManifestEntry struct {
+	// Path is the output's path, relative to the job's
+	// workspace, and Local the local path it would have been
+	// fetched to
+	Path  string `json:"path"`
+	Local string `json:"local,omitempty"`
+	// Size is the file's length in bytes, if it is known without
+	// fetching the file
+	Size *int64      `json:"size,omitempty"`
+	Mode os.FileMode `json:"mode"`
+	// Objects lists the IDs of the objects that hold the file's
+	// contents. It is empty for files small enough to be stored
+	// inline.
+	Objects []string `json:"objects,omitempty"`
+	// File is the output as the runtime returned it, which is
+	// what FetchManifest fetches
+	File protocol.File `json:"file"`
+}
+
+// NewManifest describes `outputs`, the outputs a job returned,
+// mapping each to a local path using `local`, the outputs the job
+// was invoked with. Outputs that don't correspond to any of them
+// are described without a local path.
+func NewManifest(jobID string, local List, outputs protocol.FileList) *Manifest {
+	m := &Manifest{Version: ManifestVersion, JobID: jobID, Outputs: []ManifestEntry{}}
+	byPath := make(map[string]string)
+	for _, out := range local {
+		byPath[out.Remote] = out.Local.Path
+	}
+	for _, out := range outputs {
+		ent := ManifestEntry{
+			Path:    out.Path,
+			Mode:    out.Mode,
+			Objects: fileRefs(&out.File),
+			File:    out.File,
+		}
+		ent.Local, _ = lookupOutput(byPath, out.Path)
+		if size, ok := fileSize(&out.File); ok {
+			ent.Size = &size
+		}
+		m.Outputs = append(m.Outputs, ent)
+	}
+	return m
+}
+
+// fileSize returns the length of `f`, if it is known without
+// fetching it
+func fileSize(f *protocol.File) (int64, bool) {
+	switch {
+	case f.Compression != "" || len(f.Extents) > 0:
+		return f.Size, true
+	case f.Ref != "" || f.Err != "":
+		return 0, false
+	case f.Bytes != nil:
+		return int64(len(f.Bytes)), true
+	default:
+		return int64(len(f.String)), true
+	}
+}
+
+// ReadManifest reads the manifest saved at `path`
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d", path, m.Version)
+	}
+	return &m, nil
+}
+
+// Write saves the manifest to `where`, replacing it atomically
+func (m *Manifest) Write(where string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(where), filepath.Base(where)+".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), where)
+}
+
+// Select returns the outputs named by `paths`, each of which may be
+// an output's Path or its Local path, or all of the outputs if
+// `paths` is empty. If `dir` is non-empty, each output is written
+// to its Path under `dir`; otherwise it is written to its Local
+// path.
+func (m *Manifest) Select(paths []string, dir string) (protocol.FileList, error) {
+	want := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		want[p] = true
+	}
+	var list protocol.FileList
+	for _, ent := range m.Outputs {
+		if len(paths) > 0 && !want[ent.Path] && !want[ent.Local] {
+			continue
+		}
+		delete(want, ent.Path)
+		delete(want, ent.Local)
+		where := ent.Local
+		if dir != "" {
+			clean := path.Clean(ent.Path)
+			if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+				return nil, fmt.Errorf("output %q: path outside of the output directory", ent.Path)
+			}
+			where = path.Join(filepath.ToSlash(dir), clean)
+		}
+		if where == "" {
+			return nil, fmt.Errorf("output %q has no local path; pass an output directory", ent.Path)
+		}
+		list = append(list, protocol.FileAndPath{File: ent.File, Path: filepath.FromSlash(where)})
+	}
+	if len(want) > 0 {
+		var unknown []string
+		for p := range want {
+			unknown = append(unknown, p)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("not in the manifest: %s", strings.Join(unknown, ", "))
+	}
+	return list, nil
+}
+
+// MissingObjectsError reports outputs that couldn't be fetched
+// because objects they reference are gone from the store, such as
+// after being garbage-collected
+type MissingObjectsError struct {
+	IDs []string
+	// Fetch reports every output that failed
+	Fetch *FetchError
+}
+
+func (e *MissingObjectsError) Error() string {
+	return fmt.Sprintf("%d objects are missing from the store: %s", len(e.IDs), strings.Join(e.IDs, ", "))
+}
+
+func (e *MissingObjectsError) Unwrap() error {
+	return e.Fetch
+}
+
+// FetchManifest fetches the outputs `paths` selects from `m` (see
+// Manifest.Select) and writes them as FetchOutputs does. If any
+// fail because their objects are missing from the store, it
+// returns a *MissingObjectsError naming them.
+func FetchManifest(ctx context.Context, st store.Store, m *Manifest, paths []string, dir string, opts FetchOptions) error {
+	list, err := m.Select(paths, dir)
+	if err != nil {
+		return err
+	}
+	err = FetchOutputs(ctx, st, list, opts)
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		return err
+	}
+	byPath := make(map[string]*protocol.File, len(list))
+	for i := range list {
+		byPath[list[i].Path] = &list[i].File
+	}
+	seen := make(map[string]bool)
+	var missing []string
+	for _, failed := range fetchErr.Failed {
+		f, ok := byPath[failed.Path]
+		if !ok || !errors.Is(failed.Err, store.ErrNotExists) {
+			continue
+		}
+		for _, id := range fileRefs(f) {
+			if seen[id] || objectExists(ctx, st, id) {
+				continue
+			}
+			seen[id] = true
+			missing = append(missing, id)
+		}
+	}
+	if missing == nil {
+		return err
+	}
+	sort.Strings(missing)
+	return &MissingObjectsError{IDs: missing, Fetch: fetchErr}
+}
+
+func objectExists(ctx context.Context, st store.Store, id string) bool {
+	if ch, ok := store.AsChecker(st); ok {
+		found, err := ch.HasObject(ctx, id)
+		return err != nil || found
+	}
+	_, err := store.Get(ctx, st, id)
+	return !errors.Is(err, store.ErrNotExists)
+}
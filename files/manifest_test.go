@@ -0,0 +1,131 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := store.InMemory()
+	big := bytes.Repeat([]byte("b"), 2*protocol.MaxInlineBlob)
+	bigFile, err := files.NewFile(ctx, st, big, 0755, "")
+	require.NoError(t, err)
+	smallFile, err := files.NewFile(ctx, st, []byte("small"), 0644, "")
+	require.NoError(t, err)
+	outputs := protocol.FileList{
+		{File: *bigFile, Path: "out/big"},
+		{File: *smallFile, Path: "out/sub/small"},
+	}
+	local := List{{Local: LocalFile{Path: filepath.Join(dir, "build")}, Remote: "out"}}
+
+	m := NewManifest("job-1", local, outputs)
+	require.Len(t, m.Outputs, 2)
+	assert.Equal(t, filepath.Join(dir, "build", "big"), m.Outputs[0].Local)
+	assert.Nil(t, m.Outputs[0].Size)
+	assert.Equal(t, []string{bigFile.Ref}, m.Outputs[0].Objects)
+	require.NotNil(t, m.Outputs[1].Size)
+	assert.Equal(t, int64(5), *m.Outputs[1].Size)
+	assert.Empty(t, m.Outputs[1].Objects)
+
+	where := filepath.Join(dir, "manifest.json")
+	require.NoError(t, m.Write(where))
+	var raw map[string]interface{}
+	data, err := ioutil.ReadFile(where)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &raw))
+	assert.Equal(t, float64(ManifestVersion), raw["version"])
+	assert.Equal(t, "job-1", raw["job_id"])
+
+	m, err = ReadManifest(where)
+	require.NoError(t, err)
+
+	// Fetch just one output, to its local path
+	require.NoError(t, FetchManifest(ctx, st, m, []string{"out/big"}, "", FetchOptions{}))
+	got, err := ioutil.ReadFile(filepath.Join(dir, "build", "big"))
+	require.NoError(t, err)
+	assert.Equal(t, big, got)
+	_, err = os.Stat(filepath.Join(dir, "build", "sub", "small"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Or all of them, somewhere else
+	other := filepath.Join(dir, "other")
+	require.NoError(t, FetchManifest(ctx, st, m, nil, other, FetchOptions{}))
+	got, err = ioutil.ReadFile(filepath.Join(other, "out", "sub", "small"))
+	require.NoError(t, err)
+	assert.Equal(t, "small", string(got))
+
+	err = FetchManifest(ctx, st, m, []string{"out/big", "nope"}, "", FetchOptions{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not in the manifest: nope")
+}
+
+func TestManifest_Missing(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	big := bytes.Repeat([]byte("m"), 2*protocol.MaxInlineBlob)
+	bigFile, err := files.NewFile(ctx, store.InMemory(), big, 0644, "")
+	require.NoError(t, err)
+	m := NewManifest("job-2", nil, protocol.FileList{
+		{File: *bigFile, Path: "gone"},
+		{File: protocol.File{Blob: protocol.Blob{String: "here"}}, Path: "here"},
+	})
+
+	// A store that no longer has the big output
+	err = FetchManifest(ctx, store.InMemory(), m, nil, dir, FetchOptions{})
+	var missing *MissingObjectsError
+	require.True(t, errors.As(err, &missing), "err=%v", err)
+	assert.Equal(t, []string{bigFile.Ref}, missing.IDs)
+	assert.Contains(t, err.Error(), bigFile.Ref)
+	got, err := ioutil.ReadFile(filepath.Join(dir, "here"))
+	require.NoError(t, err)
+	assert.Equal(t, "here", string(got))
+
+	// Outputs without a local path need a directory
+	err = FetchManifest(ctx, store.InMemory(), m, []string{"here"}, "", FetchOptions{})
+	assert.Error(t, err)
+}
+
+func TestReadManifest_Version(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-manifest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	where := filepath.Join(dir, "manifest.json")
+	require.NoError(t, ioutil.WriteFile(where, []byte(`{"version": 99, "outputs": []}`), 0644))
+	_, err = ReadManifest(where)
+	assert.Error(t, err)
+}
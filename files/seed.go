@@ -0,0 +1,313 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nelhage/llama/internal/humanize"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+)
+
+// IgnoreRules decides which files Seed skips. Each rule is a
+// path.Match pattern. Rules without a slash are matched against the
+// name of each file and directory; rules with one are matched
+// against paths relative to the directory being seeded. A trailing
+// slash restricts a rule to directories. Ignored directories aren't
+// descended into.
+type IgnoreRules []string
+
+// ReadIgnoreFile reads ignore rules from `path`, one per line.
+// Blank lines and lines starting with # are skipped.
+func ReadIgnoreFile(path string) (IgnoreRules, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	var rules IgnoreRules
+	scan := bufio.NewScanner(fh)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return rules, rules.check()
+}
+
+func (r *IgnoreRules) String() string { return strings.Join(*r, " ") }
+
+// Set adds a rule, so that IgnoreRules can be used as a flag
+func (r *IgnoreRules) Set(rule string) error {
+	if err := (IgnoreRules{rule}).check(); err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+func (r IgnoreRules) check() error {
+	for _, rule := range r {
+		if _, err := path.Match(strings.TrimSuffix(rule, "/"), ""); err != nil {
+			return fmt.Errorf("bad ignore rule %q: %w", rule, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether `rel`, a slash-separated path relative to
+// the directory being seeded, is ignored
+func (r IgnoreRules) Match(rel string, dir bool) bool {
+	for _, rule := range r {
+		if strings.HasSuffix(rule, "/") {
+			if !dir {
+				continue
+			}
+			rule = strings.TrimSuffix(rule, "/")
+		}
+		target := path.Base(rel)
+		if strings.Contains(rule, "/") {
+			target = rel
+			rule = strings.TrimPrefix(rule, "/")
+		}
+		if ok, _ := path.Match(rule, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SeedManifestVersion is the version of the seed manifest format
+const SeedManifestVersion = 1
+
+// A SeedManifest records how the files under the directories passed
+// to Seed were stored, so that later uploads can use those objects
+// without reading the files again; see UploadOptions.Seed. An entry
+// is only used while its file keeps the size and modification time
+// it was seeded with, and was seeded with the compression the upload
+// asks for.
+type SeedManifest struct {
+	Version     int         `json:"version"`
+	Store       string      `json:"store,omitempty"`
+	Compression string      `json:"compression,omitempty"`
+	Files       []SeedEntry `json:"files"`
+
+	once   sync.Once
+	byPath map[string]*SeedEntry
+}
+
+// SeedEntry describes one seeded file
+type SeedEntry struct {
+	// Path is the file's absolute local path
+	Path  string        `json:"path"`
+	Size  int64         `json:"size"`
+	MTime int64         `json:"mtime"`
+	File  protocol.File `json:"file"`
+}
+
+// ReadSeedManifest reads the seed manifest at `path`
+func ReadSeedManifest(path string) (*SeedManifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m SeedManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if m.Version != SeedManifestVersion {
+		return nil, fmt.Errorf("%s: unsupported seed manifest version %d", path, m.Version)
+	}
+	return &m, nil
+}
+
+// Write writes the manifest to `where`, as JSON
+func (m *SeedManifest) Write(where string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return files.WriteFile(where, append(data, '\n'), 0644, files.WriteOptions{})
+}
+
+// lookup returns the seeded upload of the local file `path`, and its
+// size, if it is still good
+func (m *SeedManifest) lookup(path, compression string) (*protocol.File, int64) {
+	if compression != m.Compression {
+		return nil, 0
+	}
+	m.once.Do(func() {
+		m.byPath = make(map[string]*SeedEntry, len(m.Files))
+		for i := range m.Files {
+			m.byPath[m.Files[i].Path] = &m.Files[i]
+		}
+	})
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, 0
+	}
+	e, ok := m.byPath[abs]
+	if !ok {
+		return nil, 0
+	}
+	fi, err := os.Stat(abs)
+	if err != nil || fi.Size() != e.Size || fi.ModTime().UnixNano() != e.MTime {
+		return nil, 0
+	}
+	pf := e.File
+	return &pf, e.Size
+}
+
+// SeedOptions controls Seed
+type SeedOptions struct {
+	UploadOptions
+	Ignore IgnoreRules
+}
+
+// SeedResult summarizes a call to Seed
+type SeedResult struct {
+	Manifest *SeedManifest
+	// Files and Bytes count the files seeded, and Ignored those
+	// skipped by the ignore rules
+	Files   int
+	Bytes   int64
+	Ignored int
+	// Cached counts the files that weren't read again, because
+	// the stat cache showed they hadn't changed
+	Cached int
+	// Objects counts the objects the files were stored as, by
+	// whether they were already in the store. It is only
+	// populated if the store can check for objects.
+	Objects store.CheckFirstStats
+}
+
+func (r *SeedResult) String() string {
+	s := fmt.Sprintf("%d files, %s", r.Files, humanize.Bytes(float64(r.Bytes)))
+	if r.Ignored > 0 {
+		s += fmt.Sprintf(" (%d ignored)", r.Ignored)
+	}
+	if r.Cached > 0 {
+		s += fmt.Sprintf("; %d unchanged since they were last uploaded", r.Cached)
+	}
+	if o := r.Objects; o.Uploaded+o.Present > 0 {
+		s += fmt.Sprintf("; %d objects uploaded (%s), %d already in the store (%s)",
+			o.Uploaded, humanize.Bytes(float64(o.UploadedBytes)), o.Present, humanize.Bytes(float64(o.PresentBytes)))
+	}
+	return s
+}
+
+// Seed uploads every regular file under `dirs` to `st`, so that jobs
+// that use them later don't need to, and returns a manifest
+// describing how they were stored. Objects the store already has
+// aren't uploaded again, if the store can check for them, so seeding
+// the same files twice mostly costs the time to hash them; with a
+// StatCache, unchanged files aren't even read. Symlinks to files
+// are followed.
+func Seed(ctx context.Context, st store.Store, dirs []string, opts SeedOptions) (*SeedResult, error) {
+	if err := opts.Ignore.check(); err != nil {
+		return nil, err
+	}
+	res := &SeedResult{
+		Manifest: &SeedManifest{Version: SeedManifestVersion, Compression: opts.Compression},
+	}
+	var list List
+	var infos []os.FileInfo
+	for _, dir := range dirs {
+		root, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = os.Stat(p); err != nil {
+					return nil
+				}
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if rel != "." && opts.Ignore.Match(filepath.ToSlash(rel), fi.IsDir()) {
+				res.Ignored++
+				if fi.IsDir() && p != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			list = list.Append(Mapped{Local: LocalFile{Path: p}, Remote: p})
+			infos = append(infos, fi)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	checked, err := store.NewCheckFirst(st)
+	if err == nil {
+		st = checked
+	}
+	var before StatCacheStats
+	if opts.StatCache != nil {
+		before = opts.StatCache.Stats()
+	}
+	opts.Seed = nil
+	uploaded, err := list.UploadWith(ctx, st, nil, opts.UploadOptions)
+	if err != nil {
+		return nil, err
+	}
+	if opts.StatCache != nil {
+		after := opts.StatCache.Stats()
+		res.Cached = (after.Hits - before.Hits) - (after.Verified - before.Verified)
+	}
+	if checked != nil {
+		res.Objects = checked.Stats()
+	}
+
+	for i, f := range uploaded {
+		fi := infos[i]
+		res.Manifest.Files = append(res.Manifest.Files, SeedEntry{
+			Path:  f.Path,
+			Size:  fi.Size(),
+			MTime: fi.ModTime().UnixNano(),
+			File:  f.File,
+		})
+		res.Files++
+		res.Bytes += fi.Size()
+	}
+	return res, nil
+}
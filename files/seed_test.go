@@ -0,0 +1,112 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := IgnoreRules{"*.o", "build/", "/src/gen/*.h"}
+	for _, tc := range []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{"main.o", false, true},
+		{"lib/x.o", false, true},
+		{"main.c", false, false},
+		{"build", true, true},
+		{"src/build", true, true},
+		{"build", false, false},
+		{"src/gen/a.h", false, true},
+		{"gen/a.h", false, false},
+	} {
+		assert.Equal(t, tc.want, rules.Match(tc.rel, tc.dir), "%s", tc.rel)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-seed")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	big := bytes.Repeat([]byte("x"), 2*protocol.MaxInlineBlob)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "include", "sys"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "build"), 0755))
+	writeOld(t, filepath.Join(dir, "include", "stdio.h"), append([]byte("stdio"), big...))
+	writeOld(t, filepath.Join(dir, "include", "sys", "types.h"), append([]byte("types"), big...))
+	writeOld(t, filepath.Join(dir, "build", "junk"), []byte("junk"))
+	writeOld(t, filepath.Join(dir, "include", "stdio.o"), []byte("junk"))
+
+	st := &countingStore{inner: store.InMemory()}
+	opts := SeedOptions{
+		UploadOptions: UploadOptions{Concurrency: 1},
+		Ignore:        IgnoreRules{"build/", "*.o"},
+	}
+	res, err := Seed(ctx, st, []string{dir}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Files)
+	assert.Equal(t, 2, res.Ignored)
+	require.Len(t, res.Manifest.Files, 2)
+	assert.Equal(t, filepath.Join(dir, "include", "stdio.h"), res.Manifest.Files[0].Path)
+	assert.Equal(t, 2, st.stores)
+
+	// The countingStore isn't a Checker, so seeding through it
+	// again uploads everything again; the in-memory store is.
+	checked := store.InMemory()
+	res, err = Seed(ctx, checked, []string{dir}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Objects.Uploaded)
+	res, err = Seed(ctx, checked, []string{dir}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Objects.Uploaded)
+	assert.Equal(t, 2, res.Objects.Present)
+
+	// The manifest round-trips, and lets uploads skip unchanged
+	// files
+	where := filepath.Join(dir, "seed.json")
+	require.NoError(t, res.Manifest.Write(where))
+	m, err := ReadSeedManifest(where)
+	require.NoError(t, err)
+
+	list := List{}.Append(
+		Mapped{Local: LocalFile{Path: filepath.Join(dir, "include", "stdio.h")}, Remote: "stdio.h"},
+		Mapped{Local: LocalFile{Path: filepath.Join(dir, "include", "sys", "types.h")}, Remote: "types.h"},
+	)
+	writeOld(t, filepath.Join(dir, "include", "sys", "types.h"), append([]byte("changed"), big...))
+	st.stores = 0
+	uploaded, err := list.UploadWith(ctx, st, nil, UploadOptions{Seed: m})
+	require.NoError(t, err)
+	assert.Equal(t, 1, st.stores)
+	require.Len(t, uploaded, 2)
+	assert.Equal(t, m.Files[0].File, uploaded[0].File)
+
+	// but not ones uploaded with a different compression
+	uploaded, err = list.UploadWith(ctx, st, nil, UploadOptions{Seed: m, Compression: protocol.CompressionZstd})
+	require.NoError(t, err)
+	assert.Equal(t, protocol.CompressionZstd, uploaded[0].Compression)
+}
@@ -0,0 +1,268 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/nelhage/llama/protocol"
+)
+
+// A StatCache remembers how local files were uploaded, keyed by
+// their absolute path and the size, modification time, and inode
+// they had at the time, so that unchanged files needn't be read and
+// hashed again. A file is only looked up if it is uploaded with a
+// StatCache in its UploadOptions.
+//
+// A hit skips storing the file, too, trusting that the store still
+// has the objects it referenced. If it doesn't, the runtime reports
+// them missing, and Reupload reads the file again.
+//
+// Files that change without changing their size or mtime will be
+// missed; Verify offers a way to catch them. A StatCache is safe for
+// concurrent use.
+type StatCache struct {
+	path string
+
+	// Verify is the fraction of hits, between 0 and 1, that are
+	// read and hashed anyway, and checked against the cache.
+	Verify float64
+
+	mu      sync.Mutex
+	entries map[string]*statEntry
+	stats   StatCacheStats
+	dirty   bool
+}
+
+// StatCacheStats counts a StatCache's lookups
+type StatCacheStats struct {
+	Hits   int
+	Misses int
+	// Verified counts the hits that were rehashed because of
+	// StatCache.Verify, of which Stale had changed.
+	Verified int
+	Stale    int
+}
+
+type statEntry struct {
+	Size  int64  `json:"size"`
+	MTime int64  `json:"mtime"`
+	Inode uint64 `json:"inode"`
+	// The compression the file was uploaded with, as requested
+	// in UploadOptions
+	Compression string        `json:"compression,omitempty"`
+	File        protocol.File `json:"file"`
+	Used        int64         `json:"used"`
+}
+
+type statCacheFile struct {
+	Version int                   `json:"version"`
+	Entries map[string]*statEntry `json:"entries"`
+}
+
+const statCacheVersion = 1
+
+// MaxStatCacheAge bounds how long an entry is kept after it was last
+// used
+const MaxStatCacheAge = 30 * 24 * time.Hour
+
+// statRacyWindow guards against files modified within the
+// granularity of their filesystem's timestamps: a file modified
+// again right after it was statted may keep its mtime, so entries
+// for files modified this recently aren't recorded.
+const statRacyWindow = 2 * time.Second
+
+// DefaultStatCachePath returns the path of the stat cache for the
+// store at `storeURL`, under $XDG_CACHE_HOME/llama or
+// ~/.cache/llama. Each store gets its own cache, since a hit is
+// only good if the store has the file's objects.
+func DefaultStatCachePath(storeURL string) (string, error) {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".cache")
+	}
+	sum := sha256.Sum256([]byte(storeURL))
+	return filepath.Join(dir, "llama", "stat", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// OpenStatCache loads the stat cache saved at `path`. A missing or
+// unreadable cache, or one written by an incompatible version of
+// llama, is treated as empty.
+func OpenStatCache(path string) (*StatCache, error) {
+	c := &StatCache{path: path, entries: make(map[string]*statEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved statCacheFile
+	if json.Unmarshal(data, &saved) == nil && saved.Version == statCacheVersion && saved.Entries != nil {
+		c.entries = saved.Entries
+	}
+	return c, nil
+}
+
+// Path returns the path the cache is saved to
+func (c *StatCache) Path() string {
+	return c.path
+}
+
+// Stats returns the cache's counts since it was opened
+func (c *StatCache) Stats() StatCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Len returns the number of files in the cache
+func (c *StatCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Save writes the cache back to its path, if it has changed, after
+// dropping entries that haven't been used in MaxStatCacheAge.
+func (c *StatCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	cutoff := time.Now().Add(-MaxStatCacheAge).UnixNano()
+	for path, ent := range c.entries {
+		if ent.Used < cutoff {
+			delete(c.entries, path)
+		}
+	}
+	data, err := json.Marshal(&statCacheFile{Version: statCacheVersion, Entries: c.entries})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// statKey is what a StatCache knows about a file before reading it
+type statKey struct {
+	path  string
+	fi    os.FileInfo
+	stat  time.Time
+	inode uint64
+}
+
+// stat looks up the file at `path`, resolving it to an absolute
+// path
+func (c *StatCache) stat(path string) (*statKey, error) {
+	return statFile(path)
+}
+
+func statFile(path string) (*statKey, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &statKey{path: abs, fi: fi, stat: time.Now(), inode: fileInode(fi)}, nil
+}
+
+func (e *statEntry) matches(key *statKey, compression string) bool {
+	return e.Size == key.fi.Size() &&
+		e.MTime == key.fi.ModTime().UnixNano() &&
+		e.Inode == key.inode &&
+		e.Compression == compression &&
+		e.File.Mode == key.fi.Mode()
+}
+
+// lookup returns the cached upload of the file described by `key`.
+// If the file should be checked against the cache, it returns
+// verify=true, with the cached file, if any.
+func (c *StatCache) lookup(key *statKey, compression string) (file *protocol.File, verify bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ent, ok := c.entries[key.path]
+	if !ok || !ent.matches(key, compression) {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	ent.Used = key.stat.UnixNano()
+	c.dirty = true
+	if c.Verify > 0 && rand.Float64() < c.Verify {
+		c.stats.Verified++
+		return &ent.File, true
+	}
+	f := ent.File
+	return &f, false
+}
+
+// record remembers that the file described by `key` was uploaded
+// as `file`. If `cached` is non-nil, it is the entry the file was
+// verified against.
+func (c *StatCache) record(key *statKey, compression string, file *protocol.File, cached *protocol.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached != nil && !protocol.SameFile(cached, file) {
+		c.stats.Stale++
+	}
+	if key.stat.Sub(key.fi.ModTime()) < statRacyWindow {
+		delete(c.entries, key.path)
+		return
+	}
+	c.entries[key.path] = &statEntry{
+		Size:        key.fi.Size(),
+		MTime:       key.fi.ModTime().UnixNano(),
+		Inode:       key.inode,
+		Compression: compression,
+		File:        *file,
+		Used:        key.stat.UnixNano(),
+	}
+	c.dirty = true
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingStore struct {
+	inner store.Store
+
+	mu     sync.Mutex
+	stores int
+}
+
+func (c *countingStore) Store(ctx context.Context, obj []byte) (string, error) {
+	c.mu.Lock()
+	c.stores++
+	c.mu.Unlock()
+	return c.inner.Store(ctx, obj)
+}
+
+func (c *countingStore) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	c.inner.GetObjects(ctx, gets)
+}
+
+func (c *countingStore) FetchAWSUsage(u *protocol.StoreUsage) {}
+
+func writeOld(t *testing.T, path string, data []byte) {
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+}
+
+func TestStatCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-statcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("x"), 2*protocol.MaxInlineBlob)
+	var list List
+	for _, name := range []string{"a", "b"} {
+		p := filepath.Join(dir, name)
+		writeOld(t, p, append([]byte(name), data...))
+		list = list.Append(Mapped{Local: LocalFile{Path: p}, Remote: name})
+	}
+	cachePath := filepath.Join(dir, "cache", "stat.json")
+	cache, err := OpenStatCache(cachePath)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cache.Len())
+
+	st := &countingStore{inner: store.InMemory()}
+	opts := UploadOptions{StatCache: cache}
+	first, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, st.stores)
+	assert.Equal(t, StatCacheStats{Misses: 2}, cache.Stats())
+	require.NoError(t, cache.Save())
+
+	cache, err = OpenStatCache(cachePath)
+	require.NoError(t, err)
+	assert.Equal(t, 2, cache.Len())
+	opts.StatCache = cache
+	st.stores = 0
+	second, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 0, st.stores)
+	assert.Equal(t, StatCacheStats{Hits: 2}, cache.Stats())
+
+	// A file whose contents change behind the cache's back, keeping
+	// its size and mtime, is only caught when verifying.
+	stale := filepath.Join(dir, "b")
+	fi, err := os.Stat(stale)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(stale, append([]byte("c"), data...), 0644))
+	require.NoError(t, os.Chtimes(stale, fi.ModTime(), fi.ModTime()))
+
+	third, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, first, third)
+
+	cache.Verify = 1
+	fourth, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, first[0], fourth[0])
+	assert.NotEqual(t, first[1].Ref, fourth[1].Ref)
+	assert.Equal(t, StatCacheStats{Hits: 6, Verified: 2, Stale: 1}, cache.Stats())
+
+	// Once verified, the entry is corrected
+	cache.Verify = 0
+	fifth, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, fourth, fifth)
+}
+
+func TestStatCache_Changes(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-statcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "f")
+	writeOld(t, p, []byte("one"))
+	list := List{{Local: LocalFile{Path: p}, Remote: "f"}}
+	cache, err := OpenStatCache(filepath.Join(dir, "stat.json"))
+	require.NoError(t, err)
+	opts := UploadOptions{StatCache: cache}
+	st := store.InMemory()
+
+	_, err = list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+
+	// Recently-modified files aren't trusted
+	require.NoError(t, ioutil.WriteFile(p, []byte("three"), 0644))
+	got, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "three", got[0].String)
+	assert.Equal(t, 0, cache.Len())
+	got, err = list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "three", got[0].String)
+	assert.Equal(t, StatCacheStats{Misses: 3}, cache.Stats())
+
+	// Nor is the cache consulted under a different compression
+	writeOld(t, p, []byte("four"))
+	_, err = list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	opts.Compression = protocol.CompressionZstd
+	_, err = list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, StatCacheStats{Misses: 5}, cache.Stats())
+}
+
+func TestStatCache_Reupload(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "llama-statcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "big")
+	data := bytes.Repeat([]byte("y"), 2*protocol.MaxInlineBlob)
+	writeOld(t, p, data)
+	list := List{{Local: LocalFile{Path: p}, Remote: "big"}}
+	cache, err := OpenStatCache(filepath.Join(dir, "stat.json"))
+	require.NoError(t, err)
+	opts := UploadOptions{StatCache: cache}
+
+	_, err = list.UploadWith(ctx, store.InMemory(), nil, opts)
+	require.NoError(t, err)
+
+	// A new store lacks the objects the cache refers to
+	st := store.InMemory()
+	uploaded, err := list.UploadWith(ctx, st, nil, opts)
+	require.NoError(t, err)
+	unresolved, err := list.Reupload(ctx, st, uploaded, []string{uploaded[0].Ref}, opts)
+	require.NoError(t, err)
+	assert.Empty(t, unresolved)
+	got, err := store.Get(ctx, st, uploaded[0].Ref)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestOpenStatCache_Corrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-statcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "stat.json")
+	require.NoError(t, ioutil.WriteFile(p, []byte("{not json"), 0644))
+	cache, err := OpenStatCache(p)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cache.Len())
+}
@@ -3,7 +3,6 @@ module github.com/nelhage/llama
 go 1.14
 
 require (
-	github.com/aws/aws-lambda-go v1.20.0
 	github.com/aws/aws-sdk-go v1.38.13
 	github.com/fraugster/parquet-go v0.4.0
 	github.com/gofrs/flock v0.8.0
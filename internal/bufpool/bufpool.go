@@ -0,0 +1,73 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bufpool provides a shared pool of scratch buffers, so that
+// hot paths which read or encode objects don't need to allocate
+// fresh buffers every time.
+package bufpool
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// MaxRetained is the default for the largest buffer capacity we will
+// return to the pool. Holding on to larger buffers would pin memory
+// in a long-lived process after a single large job.
+const MaxRetained = 16 << 20
+
+var maxRetained int64 = MaxRetained
+
+// SetMaxRetained changes the largest buffer capacity we will return
+// to the pool, for processes with less memory to spare.
+func SetMaxRetained(n int) {
+	atomic.StoreInt64(&maxRetained, int64(n))
+}
+
+var pool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// Get returns an empty buffer from the pool.
+func Get() *bytes.Buffer {
+	return pool.Get().(*bytes.Buffer)
+}
+
+// Put returns `b` to the pool. The caller must not retain any
+// references to `b` or its contents.
+func Put(b *bytes.Buffer) {
+	if int64(b.Cap()) > atomic.LoadInt64(&maxRetained) {
+		return
+	}
+	b.Reset()
+	pool.Put(b)
+}
+
+// An Encoder appends an encoding of `src` to `dst`, growing it as
+// needed, as a *zstd.Encoder does.
+type Encoder interface {
+	EncodeAll(src, dst []byte) []byte
+}
+
+// Encode encodes `src` with `enc` into `b`, and returns the encoded
+// bytes, which still belong to `b`. The encoder grows its own slice,
+// so the result is copied back into `b` so that the pool retains the
+// larger buffer.
+func Encode(b *bytes.Buffer, enc Encoder, src []byte) []byte {
+	out := enc.EncodeAll(src, b.Bytes())
+	b.Reset()
+	b.Write(out)
+	return b.Bytes()
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/store"
+)
+
+// BulkOptions controls InvokeBulk
+type BulkOptions struct {
+	// Concurrency bounds the jobs in flight at once. It defaults
+	// to DefaultBulkConcurrency.
+	Concurrency int
+	// MaxFailures, if positive, stops the run once that many
+	// jobs have failed: no further jobs are started, and those
+	// in flight are canceled. A MaxFailures of 1 fails fast; 0
+	// keeps going through every job.
+	MaxFailures int
+	// OnResult, if set, is called with each job's result as the
+	// job completes. Calls are made one at a time, from the
+	// goroutine that called InvokeBulk, so OnResult needn't
+	// synchronize, but a slow OnResult holds up the run.
+	OnResult func(*BulkResult)
+	// Slowest is the number of the slowest jobs the summary
+	// lists. It defaults to 10.
+	Slowest int
+}
+
+const DefaultBulkConcurrency = 100
+
+// BulkResult is the outcome of one job of a bulk run
+type BulkResult struct {
+	// Index is the job's position among the jobs submitted
+	Index    int
+	Args     *InvokeArgs
+	Result   *InvokeResult
+	Err      error
+	Duration time.Duration
+	// Canceled is set if the job failed because the run was
+	// canceled or stopped while it was in flight
+	Canceled bool
+}
+
+// Failed reports whether the job failed to run, other than by
+// being canceled, or its command exited unsuccessfully
+func (r *BulkResult) Failed() bool {
+	if r.Canceled {
+		return false
+	}
+	return r.Err != nil || r.Result.Response.ExitStatus != 0
+}
+
+// BulkSummary aggregates a bulk run. Canceled jobs count as neither
+// succeeded nor failed.
+type BulkSummary struct {
+	Started   int
+	Succeeded int
+	Failed    int
+	Canceled  int
+	// Retries totals the retries of all jobs; see
+	// InvokeResult.Retries
+	Retries  int
+	Duration time.Duration
+	// Slowest lists the slowest jobs, slowest first
+	Slowest []*BulkResult
+}
+
+func (s *BulkSummary) String() string {
+	return fmt.Sprintf("%d jobs: %d succeeded, %d failed, %d canceled, %d retries in %s",
+		s.Started, s.Succeeded, s.Failed, s.Canceled, s.Retries, s.Duration.Round(time.Millisecond))
+}
+
+// ErrTooManyFailures is returned by InvokeBulk if a run is stopped
+// by BulkOptions.MaxFailures
+var ErrTooManyFailures = errors.New("too many jobs failed")
+
+// InvokeBulk invokes each job received on `jobs`, until it is
+// closed, opts.Concurrency at a time. It returns once every job it
+// started has finished, with a summary of the run. The error is
+// ctx.Err() if `ctx` was canceled, ErrTooManyFailures if the run
+// stopped early, and nil otherwise, even if some jobs failed.
+//
+// A run that ends early stops reading from `jobs`; the caller is
+// responsible for unblocking whatever is sending on it.
+func InvokeBulk(ctx context.Context, svc *lambda.Lambda, st store.Store,
+	jobs <-chan *InvokeArgs, opts BulkOptions) (*BulkSummary, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBulkConcurrency
+	}
+	slowest := opts.Slowest
+	if slowest == 0 {
+		slowest = 10
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		index int
+		args  *InvokeArgs
+	}
+	work := make(chan job)
+	results := make(chan *BulkResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				t := time.Now()
+				res, err := Invoke(ctx, svc, st, j.args)
+				results <- &BulkResult{
+					Index:    j.index,
+					Args:     j.args,
+					Result:   res,
+					Err:      err,
+					Duration: time.Since(t),
+					Canceled: err != nil && ctx.Err() != nil,
+				}
+			}
+		}()
+	}
+	// stop is closed to stop feeding jobs to the workers
+	stop := make(chan struct{})
+	var started int
+	go func() {
+		defer close(work)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			case args, ok := <-jobs:
+				if !ok {
+					return
+				}
+				select {
+				case work <- job{started, args}:
+					started++
+				case <-stop:
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var summary BulkSummary
+	var all []*BulkResult
+	var stopped bool
+	for res := range results {
+		switch {
+		case res.Canceled:
+			summary.Canceled++
+		case res.Failed():
+			summary.Failed++
+		default:
+			summary.Succeeded++
+		}
+		if res.Result != nil {
+			summary.Retries += res.Result.Retries
+		}
+		all = append(all, res)
+		if opts.OnResult != nil {
+			opts.OnResult(res)
+		}
+		if !stopped && opts.MaxFailures > 0 && summary.Failed >= opts.MaxFailures {
+			stopped = true
+			close(stop)
+			cancel()
+		}
+	}
+	// The feeder exited before the workers did, so this is
+	// safe to read.
+	summary.Started = started
+	summary.Duration = time.Since(start)
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Duration > all[j].Duration })
+	if len(all) > slowest {
+		all = all[:slowest]
+	}
+	summary.Slowest = all
+
+	if stopped {
+		return &summary, ErrTooManyFailures
+	}
+	return &summary, ctx.Err()
+}
+
+// InvokeAll runs InvokeBulk over a slice of jobs
+func InvokeAll(ctx context.Context, svc *lambda.Lambda, st store.Store,
+	jobs []*InvokeArgs, opts BulkOptions) (*BulkSummary, error) {
+	ch := make(chan *InvokeArgs)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(ch)
+		for _, j := range jobs {
+			select {
+			case ch <- j:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return InvokeBulk(ctx, svc, st, ch, opts)
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sleepRunner runs jobs whose Args are a duration to sleep and an
+// exit status, tracking how many run at once
+type sleepRunner struct {
+	running, peak int32
+}
+
+func (s *sleepRunner) RunOneStreaming(ctx context.Context, job *protocol.InvocationSpec, stdout io.Writer) (*protocol.InvocationResponse, error) {
+	n := atomic.AddInt32(&s.running, 1)
+	defer atomic.AddInt32(&s.running, -1)
+	for {
+		peak := atomic.LoadInt32(&s.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&s.peak, peak, n) {
+			break
+		}
+	}
+	d, _ := time.ParseDuration(job.Args[0])
+	status, _ := strconv.Atoi(job.Args[1])
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &protocol.InvocationResponse{ExitStatus: status}, nil
+}
+
+func bulkJobs(runner LocalRunner, jobs ...string) []*InvokeArgs {
+	var args []*InvokeArgs
+	for i := 0; i < len(jobs); i += 2 {
+		args = append(args, &InvokeArgs{
+			Function: "fn",
+			Spec:     protocol.InvocationSpec{Args: []string{jobs[i], jobs[i+1]}},
+			Local:    runner,
+		})
+	}
+	return args
+}
+
+func TestInvokeAll(t *testing.T) {
+	runner := &sleepRunner{}
+	var jobs []*InvokeArgs
+	for i := 0; i < 20; i++ {
+		status := "0"
+		if i%5 == 4 {
+			status = "1"
+		}
+		jobs = append(jobs, bulkJobs(runner, "10ms", status)...)
+	}
+	jobs = append(jobs, bulkJobs(runner, "100ms", "0")...)
+
+	var seen []int
+	summary, err := InvokeAll(context.Background(), nil, store.InMemory(), jobs, BulkOptions{
+		Concurrency: 4,
+		Slowest:     2,
+		OnResult: func(r *BulkResult) {
+			seen = append(seen, r.Index)
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 21, summary.Started)
+	assert.Equal(t, 17, summary.Succeeded)
+	assert.Equal(t, 4, summary.Failed)
+	assert.Equal(t, 0, summary.Canceled)
+	assert.Len(t, seen, 21)
+	assert.LessOrEqual(t, runner.peak, int32(4))
+	require.Len(t, summary.Slowest, 2)
+	assert.Equal(t, 20, summary.Slowest[0].Index)
+	assert.GreaterOrEqual(t, int64(summary.Slowest[0].Duration), int64(summary.Slowest[1].Duration))
+}
+
+func TestInvokeAll_FailFast(t *testing.T) {
+	runner := &sleepRunner{}
+	jobs := bulkJobs(runner, "1ms", "1", "10s", "0")
+	for i := 0; i < 50; i++ {
+		jobs = append(jobs, bulkJobs(runner, "10s", "0")...)
+	}
+
+	start := time.Now()
+	summary, err := InvokeAll(context.Background(), nil, store.InMemory(), jobs, BulkOptions{
+		Concurrency: 2,
+		MaxFailures: 1,
+	})
+	assert.Equal(t, ErrTooManyFailures, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 0, summary.Succeeded)
+	assert.Equal(t, summary.Started-1, summary.Canceled)
+	assert.Less(t, summary.Started, len(jobs))
+}
+
+func TestInvokeBulk_Cancel(t *testing.T) {
+	runner := &sleepRunner{}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan *InvokeArgs)
+	go func() {
+		for _, j := range bulkJobs(runner, "1ms", "0", "1ms", "0", "10s", "0") {
+			jobs <- j
+		}
+		// Never closed; cancellation ends the run
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	summary, err := InvokeBulk(ctx, nil, store.InMemory(), jobs, BulkOptions{})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 3, summary.Started)
+	assert.Equal(t, 2, summary.Succeeded)
+	assert.Equal(t, 1, summary.Canceled)
+}
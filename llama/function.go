@@ -0,0 +1,46 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+)
+
+// FunctionCmdline returns the command line the runtime of
+// `function` prepends to each job's Args; see protocol.Cmdline. It
+// returns ok=false if the command comes from the function image's
+// CMD, which Lambda doesn't report unless the function's
+// configuration overrides it.
+func FunctionCmdline(ctx context.Context, svc *lambda.Lambda, function string) (_ []string, ok bool, err error) {
+	cfg, err := svc.GetFunctionConfigurationWithContext(ctx, &lambda.GetFunctionConfigurationInput{
+		FunctionName: &function,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if cfg.Handler != nil && *cfg.Handler != "" {
+		cmdline, _ := protocol.Cmdline(*cfg.Handler, nil)
+		return cmdline, true, nil
+	}
+	if ic := cfg.ImageConfigResponse; ic != nil && ic.ImageConfig != nil && len(ic.ImageConfig.Command) > 0 {
+		cmdline, _ := protocol.Cmdline("", aws.StringValueSlice(ic.ImageConfig.Command))
+		return cmdline, true, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+)
+
+// A FunctionURL invokes a function through its Lambda function URL,
+// over plain HTTPS, instead of through the Lambda API. Requests are
+// authenticated either with a shared Token, which the runtime checks
+// against protocol.URLTokenEnv, or, for URLs that use IAM auth, by
+// signing them with Credentials.
+//
+// Function URLs can't stream responses or return logs, so
+// InvokeArgs.Stdout must be nil, and InvokeArgs.ReturnLogs is
+// ignored.
+type FunctionURL struct {
+	URL string
+
+	Token string
+
+	// Credentials, if set, are used to sign requests for Region
+	Credentials *credentials.Credentials
+	Region      string
+
+	// Client sends the requests. It defaults to a client with no
+	// timeout of its own, since jobs may run for up to 15
+	// minutes; requests are bounded by the invocation's context.
+	Client *http.Client
+}
+
+// invoke POSTs `payload` to the URL, returning the function's
+// response, and whether it is an error payload. Failures to get a
+// response from the function are reported as awserr.Errors, with
+// the codes the Lambda API would have used, so that they are
+// retried like the Lambda API's.
+func (u *FunctionURL) invoke(ctx context.Context, payload []byte) ([]byte, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+	}
+	if u.Credentials != nil {
+		signer := v4.NewSigner(u.Credentials)
+		if _, err := signer.Sign(req, bytes.NewReader(payload), "lambda", u.Region, time.Now()); err != nil {
+			return nil, false, fmt.Errorf("signing request: %w", err)
+		}
+	}
+	client := u.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		return nil, false, awserr.New(request.ErrCodeRequestError, "send request failed", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, awserr.New(request.ErrCodeRequestError, "reading response failed", err)
+	}
+	requestID := resp.Header.Get("X-Amzn-Requestid")
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return body, resp.Header.Get(protocol.HeaderFunctionError) != "", nil
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return nil, false, awserr.NewRequestFailure(
+			awserr.New(lambda.ErrCodeTooManyRequestsException, "function URL throttled the request", nil),
+			resp.StatusCode, requestID)
+	case resp.StatusCode == http.StatusBadGateway:
+		// Lambda answers 502 if the function itself failed
+		// without responding, as when the runtime crashes or the
+		// invocation times out.
+		return []byte(fmt.Sprintf(`{"errorMessage":%q}`, strings.TrimSpace(string(body)))), true, nil
+	case resp.StatusCode >= 500:
+		return nil, false, awserr.NewRequestFailure(
+			awserr.New(lambda.ErrCodeServiceException, strings.TrimSpace(string(body)), nil),
+			resp.StatusCode, requestID)
+	default:
+		return nil, false, fmt.Errorf("function URL: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunctionURL(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "),
+			"Authorization=%q", r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		var spec protocol.InvocationSpec
+		require.NoError(t, json.Unmarshal(body, &spec))
+		switch {
+		case n == 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case spec.Args[0] == "fail":
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("Internal Server Error"))
+		default:
+			json.NewEncoder(w).Encode(&protocol.InvocationResponse{ExitStatus: 7})
+		}
+	}))
+	defer srv.Close()
+
+	url := &FunctionURL{
+		URL:         srv.URL,
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		Region:      "us-west-2",
+	}
+	retry := &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxTotalDelay: time.Second}
+	res, err := Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "f",
+		Spec:     protocol.InvocationSpec{Args: []string{"ok"}},
+		Retry:    retry,
+		URL:      url,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 7, res.Response.ExitStatus)
+	assert.Equal(t, 1, res.Retries)
+
+	_, err = Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "f",
+		Spec:     protocol.InvocationSpec{Args: []string{"fail"}},
+		Retry:    retry,
+		URL:      url,
+	})
+	ret, ok := err.(*ErrorReturn)
+	require.True(t, ok, "got %#v", err)
+	assert.Contains(t, string(ret.Payload), "Internal Server Error")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
@@ -16,14 +16,23 @@ package llama
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/golang/snappy"
+	"github.com/nelhage/llama/budget"
+	"github.com/nelhage/llama/progress"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/protocol/files"
 	"github.com/nelhage/llama/store"
@@ -34,11 +43,82 @@ type InvokeArgs struct {
 	Function   string
 	ReturnLogs bool
 	Spec       protocol.InvocationSpec
+
+	// If Stdout is non-nil, the function is invoked using
+	// response streaming, and the command's stdout is copied to
+	// Stdout as it is produced. The function must be configured
+	// with the RESPONSE_STREAM invoke mode. The complete stdout
+	// is still returned in the response.
+	Stdout io.Writer
+
+	// UploadTimeout bounds how long to wait for outputs the
+	// runtime uploads after responding, if Spec.AsyncUploads is
+	// set. It defaults to files.DefaultUploadTimeout.
+	UploadTimeout time.Duration
+
+	// Retry controls how invocations that fail transiently are
+	// retried. If nil, DefaultRetryPolicy is used.
+	Retry *RetryPolicy
+
+	// Reupload, if set, is called if the runtime reports that
+	// objects the job references are missing from the store. It
+	// should store them again from their local sources, updating
+	// `spec` if their IDs changed, and return the IDs it has no
+	// source for. If it found them all, the job is resubmitted,
+	// up to MaxReuploads times.
+	Reupload func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error)
+
+	// Local, if set, runs the job in-process instead of on
+	// Lambda; see NewLocal. If LocalFallback is also set, the job
+	// is only run locally if it can't be run on Lambda: that is,
+	// if invoking the function fails other than by the job itself
+	// failing, before any of its streamed stdout was written.
+	Local         LocalRunner
+	LocalFallback bool
+
+	// Record, if set, names a directory in which to write a
+	// Recording of the invocation.
+	Record string
+
+	// URL, if set, invokes the function through its function URL
+	// instead of through the Lambda API; see FunctionURL.
+	URL *FunctionURL
+
+	// Budget, if set, bounds the invocations in flight across
+	// the machine. Invoke waits for a slot before invoking the
+	// function, and holds it until the function returns; jobs run
+	// locally don't need one.
+	Budget *budget.Budget
+
+	// Memoize, if set, and if the spec is Deterministic, returns
+	// the result of an identical earlier job, if one is stored
+	// under MemoKey and its outputs are all still in the store,
+	// instead of invoking the function. Successful results are
+	// stored for reuse. RefreshMemo skips the lookup, but still
+	// stores the result, replacing any earlier one.
+	Memoize     bool
+	RefreshMemo bool
+
+	// Progress, if set, is told when the job is submitted, and
+	// then periodically while it runs
+	Progress progress.Func
 }
 
+// MaxReuploads bounds the number of times Invoke resubmits a job
+// after re-uploading objects missing from the store
+const MaxReuploads = 2
+
 type InvokeResult struct {
 	Logs     []byte
 	Response protocol.InvocationResponse
+	// Function is the function that was invoked. Jobs run
+	// locally also have Response.Local set.
+	Function string
+	// Retries counts the attempts that failed before this one
+	Retries int
+	// Recording is the path of the invocation's Recording, if
+	// args.Record was set
+	Recording string
 }
 
 type ErrorReturn struct {
@@ -47,25 +127,289 @@ type ErrorReturn struct {
 }
 
 func (e *ErrorReturn) Error() string {
+	if se := e.Structured(); se != nil {
+		if se.Code == protocol.ErrOOM {
+			return se.Message
+		}
+		return fmt.Sprintf("Function returned error: %s: %s", se.Code, se.Message)
+	}
 	return fmt.Sprintf("Function returned error: %q", e.Payload)
 }
 
+// Structured returns the structured error in the function's error
+// payload, or nil if it did not return one.
+func (e *ErrorReturn) Structured() *protocol.Error {
+	if se := protocol.ParseError(e.Payload); se != nil {
+		return se
+	}
+	// If the whole container runs out of memory, the runtime
+	// dies with it, and Lambda reports the failure itself.
+	var lambdaErr struct {
+		Type string `json:"errorType"`
+	}
+	if json.Unmarshal(e.Payload, &lambdaErr) == nil && lambdaErr.Type == "Runtime.OutOfMemory" {
+		return &protocol.Error{
+			Code:    protocol.ErrOOM,
+			Message: "job ran out of memory, taking the runtime with it; try raising the function's memory size",
+		}
+	}
+	return nil
+}
+
+// Invoke runs a job on Lambda. If the job is interrupted because
+// its container was shut down, it is resubmitted once, unless its
+// stdout was being streamed and so has already been partly written.
+//
+// Invocations that are throttled or fail transiently are retried
+// according to args.Retry. Each job is given an idempotency token,
+// if it doesn't have one, so that a container that already ran the
+// job returns its earlier result instead of running it again. If
+// the job fails because objects it references are missing from the
+// store, and args.Reupload can restore them, it is resubmitted.
+//
+// If args.Local is set, the job may instead run in-process; see
+// InvokeArgs.LocalFallback. If args.Record is set, the invocation
+// is recorded even if it fails. If args.Memoize is set, the job may
+// not run at all; see InvokeArgs.Memoize.
 func Invoke(ctx context.Context, svc *lambda.Lambda,
+	st store.Store, args *InvokeArgs) (out *InvokeResult, err error) {
+	// Fill in the token, and anything else we set on the spec,
+	// on our own copy: callers reuse their InvokeArgs, and a
+	// token leaking back into them would make their next job
+	// replay this one's result.
+	copied := *args
+	args = &copied
+	if args.Spec.IdempotencyToken == "" {
+		args.Spec.IdempotencyToken = newToken()
+	}
+	if memoizable(args) {
+		key := MemoKey(args.Function, &args.Spec)
+		if !args.RefreshMemo {
+			if out := lookupMemo(ctx, st, args.Function, key); out != nil {
+				return out, nil
+			}
+		}
+		defer func() {
+			if err == nil {
+				storeMemo(ctx, st, key, out)
+			}
+		}()
+	}
+	if err := setDepth(&args.Spec); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if out != nil {
+			out.Function = args.Function
+		}
+		recordNested(args.Function, out, err)
+	}()
+	if args.Record != "" {
+		defer func() {
+			where, rerr := record(args, out, err)
+			if rerr != nil {
+				log.Printf("%s: recording invocation: %s", args.Function, rerr.Error())
+			} else if out != nil {
+				out.Recording = where
+			}
+		}()
+	}
+	args.Progress.Report(progress.Event{Stage: progress.Invoking})
+	if args.Local != nil && !args.LocalFallback {
+		return invokeLocal(ctx, st, args)
+	}
+	stdout := args.Stdout
+	var written *countingWriter
+	if stdout != nil {
+		written = &countingWriter{w: stdout}
+		args.Stdout = written
+		defer func() { args.Stdout = stdout }()
+	}
+	out, err = invokeBudgeted(ctx, svc, st, args)
+	if err != nil && fallBack(ctx, args, err, written) {
+		args.Stdout = stdout
+		return invokeLocal(ctx, st, args)
+	}
+	return out, err
+}
+
+// invokeBudgeted runs invokeRemote in one of args.Budget's slots,
+// if it has one
+func invokeBudgeted(ctx context.Context, svc *lambda.Lambda,
 	st store.Store, args *InvokeArgs) (*InvokeResult, error) {
+	if args.Budget == nil {
+		defer args.Progress.Tick(progress.Running)()
+		return invokeRemote(ctx, svc, st, args)
+	}
+	var slot *budget.Slot
+	err := tracing.Trace(ctx, "budget.acquire", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		var err error
+		slot, err = args.Budget.Acquire(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", args.Function, err)
+	}
+	defer slot.Release()
+	defer args.Progress.Tick(progress.Running)()
+	return invokeRemote(ctx, svc, st, args)
+}
+
+func invokeRemote(ctx context.Context, svc *lambda.Lambda,
+	st store.Store, args *InvokeArgs) (*InvokeResult, error) {
+	out, err := invokeWithRetries(ctx, svc, st, args, false)
+	for i := 0; i < MaxReuploads && args.Reupload != nil; i++ {
+		missing := missingIDs(err)
+		if missing == nil || !reupload(ctx, st, args, missing) {
+			break
+		}
+		log.Printf("%s: re-uploaded %d objects missing from the store; retrying", args.Function, len(missing))
+		out, err = invokeWithRetries(ctx, svc, st, args, true)
+	}
+	if err == nil && out.Response.Interrupted && args.Stdout == nil {
+		log.Printf("%s: job interrupted by container shutdown; retrying", args.Function)
+		// The interrupted attempt's result is final for its
+		// token, so the resubmission needs a new one.
+		args.Spec.IdempotencyToken = newToken()
+		retries := out.Retries
+		out, err = invokeWithRetries(ctx, svc, st, args, true)
+		if out != nil {
+			out.Retries += retries + 1
+		}
+	}
+	return out, err
+}
+
+// missingIDs returns the IDs of the objects a job failed for lack
+// of, if that's why it failed
+func missingIDs(err error) []string {
+	ret, ok := err.(*ErrorReturn)
+	if !ok {
+		return nil
+	}
+	if se := ret.Structured(); se != nil {
+		return se.MissingIDs()
+	}
+	return nil
+}
+
+// reupload stores the objects `missing` again, reporting whether it
+// was able to store all of them
+func reupload(ctx context.Context, st store.Store, args *InvokeArgs, missing []string) bool {
+	for _, id := range missing {
+		store.Invalidate(st, id)
+	}
+	unresolved, err := args.Reupload(ctx, &args.Spec, missing)
+	if err != nil {
+		log.Printf("%s: re-uploading missing objects: %s", args.Function, err.Error())
+		return false
+	}
+	return len(unresolved) == 0
+}
+
+func newToken() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("rand: %s", err.Error()))
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// invokeWithRetries calls invokeOnce, retrying transient failures
+func invokeWithRetries(ctx context.Context, svc *lambda.Lambda,
+	st store.Store, args *InvokeArgs, retry bool) (*InvokeResult, error) {
+	policy := args.Retry
+	if policy == nil {
+		policy = &DefaultRetryPolicy
+	}
+	stdout := args.Stdout
+	var written *countingWriter
+	if stdout != nil {
+		written = &countingWriter{w: stdout}
+		args.Stdout = written
+		defer func() { args.Stdout = stdout }()
+	}
+
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		out, err := invokeOnce(ctx, svc, st, args, retry || attempt > 0, attempt)
+		if err == nil {
+			out.Retries = attempt
+			return out, nil
+		}
+		if !retryable(err) || attempt+1 >= policy.MaxAttempts {
+			return nil, err
+		}
+		// Once streamed output has been passed on, we can't
+		// take it back.
+		if written != nil && written.n > 0 {
+			return nil, err
+		}
+		delay := policy.delay(attempt)
+		if waited+delay > policy.MaxTotalDelay {
+			return nil, err
+		}
+		waited += delay
+		log.Printf("%s: %s; retrying in %s", args.Function, err.Error(), delay.Round(time.Millisecond))
+		if cerr := sleepContext(ctx, delay); cerr != nil {
+			return nil, err
+		}
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func noRetries(r *request.Request) {
+	r.Retryer = client.NoOpRetryer{}
+}
+
+// submitRemoteSpans submits the spans the runtime returned as
+// children of our invoke span, so that they appear in the same trace
+// even if the runtime trimmed some of them.
+func submitRemoteSpans(ctx context.Context, span *tracing.SpanBuilder, spans []tracing.Span) {
+	tracing.Reparent(spans, span.TraceId(), span.Id())
+	tracing.SubmitAll(ctx, spans)
+}
+
+func invokeOnce(ctx context.Context, svc *lambda.Lambda,
+	st store.Store, args *InvokeArgs, retry bool, attempt int) (_ *InvokeResult, err error) {
 	ctx, span := tracing.StartSpan(ctx, "llama.Invoke")
-	defer span.End()
+	defer func() {
+		// Failed invocations are traced even if their trace
+		// wasn't sampled.
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
 	span.AddField("function", args.Function)
+	if retry {
+		span.AddField("retry", true)
+	}
+	if attempt > 0 {
+		span.SetMetric("attempt", float64(attempt))
+	}
 
 	if span.WillSubmit() {
 		args.Spec.Trace = span.Propagation()
 	}
+	args.Spec.Stream = args.Stdout != nil
 
 	payload, err := json.Marshal(&args.Spec)
 	if err != nil {
 		return nil, fmt.Errorf("marshal: %w", err)
 	}
 
-	span.AddField("payload_bytes", len(payload))
+	span.SetMetric("payload_bytes", float64(len(payload)))
 
 	input := lambda.InvokeInput{
 		FunctionName: &args.Function,
@@ -77,26 +421,77 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 
 	var out InvokeResult
 
-	resp, err := svc.Invoke(&input)
-	if err != nil {
-		return nil, fmt.Errorf("Invoke(): %w", err)
-	}
-	if resp.LogResult != nil {
-		logs, _ := base64.StdEncoding.DecodeString(*resp.LogResult)
+	if args.URL != nil {
+		if args.Stdout != nil {
+			return nil, errors.New("response streaming isn't supported through function URLs")
+		}
+		span.AddField("function_url", true)
+		resp, funcErr, err := args.URL.invoke(ctx, payload)
+		if err != nil {
+			return nil, fmt.Errorf("POST %s: %w", args.URL.URL, err)
+		}
+		if funcErr {
+			return nil, &ErrorReturn{Payload: resp}
+		}
+		span.SetMetric("response_bytes", float64(len(resp)))
+		if err := json.Unmarshal(resp, &out.Response); err != nil {
+			return nil, fmt.Errorf("unmarshal: %q", err)
+		}
+	} else if args.Stdout != nil {
+		span.AddField("stream", true)
+		last, logs, err := invokeStreaming(ctx, svc, &input, args.Stdout)
+		if err != nil {
+			return nil, fmt.Errorf("InvokeWithResponseStream(): %w", err)
+		}
 		out.Logs = logs
-	}
+		if last.Error != nil {
+			return nil, &ErrorReturn{
+				Payload: last.Error,
+				Logs:    out.Logs,
+			}
+		}
+		out.Response = *last.Response
+	} else {
+		// Invoke does its own retries, so the SDK's are
+		// disabled.
+		resp, err := svc.InvokeWithContext(ctx, &input, noRetries)
+		if err != nil {
+			return nil, fmt.Errorf("Invoke(): %w", err)
+		}
+		if resp.LogResult != nil {
+			logs, _ := base64.StdEncoding.DecodeString(*resp.LogResult)
+			out.Logs = logs
+		}
 
-	if resp.FunctionError != nil {
-		return nil, &ErrorReturn{
-			Payload: resp.Payload,
-			Logs:    out.Logs,
+		if resp.FunctionError != nil {
+			return nil, &ErrorReturn{
+				Payload: resp.Payload,
+				Logs:    out.Logs,
+			}
+		}
+
+		span.SetMetric("response_bytes", float64(len(resp.Payload)))
+
+		if err := json.Unmarshal(resp.Payload, &out.Response); err != nil {
+			return nil, fmt.Errorf("unmarshal: %q", err)
 		}
 	}
 
-	span.AddField("response_bytes", len(resp.Payload))
+	finishResponse(ctx, span, st, args, &out)
+	return &out, nil
+}
 
-	if err := json.Unmarshal(resp.Payload, &out.Response); err != nil {
-		return nil, fmt.Errorf("unmarshal: %q", err)
+// finishResponse waits for the response's pending uploads, submits
+// its spans, and records its timings on `span`.
+func finishResponse(ctx context.Context, span *tracing.SpanBuilder, st store.Store, args *InvokeArgs, out *InvokeResult) {
+	if args.Spec.AsyncUploads {
+		timeout := args.UploadTimeout
+		if timeout == 0 {
+			timeout = files.DefaultUploadTimeout
+		}
+		_, span := tracing.StartSpan(ctx, "await_uploads")
+		files.AwaitUploads(ctx, st, out.Response.Outputs, timeout)
+		span.End()
 	}
 
 	if out.Response.Spans != nil {
@@ -111,12 +506,12 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 		} else {
 			var spans []tracing.Span
 			if json.Unmarshal(spandata, &spans) == nil {
-				tracing.SubmitAll(ctx, spans)
+				submitRemoteSpans(ctx, span, spans)
 			}
 		}
 	}
 	if out.Response.InlineSpans != nil {
-		tracing.SubmitAll(ctx, out.Response.InlineSpans)
+		submitRemoteSpans(ctx, span, out.Response.InlineSpans)
 	}
 
 	span.AddField("e2e_ms", out.Response.Times.E2E.Milliseconds())
@@ -126,6 +521,17 @@ func Invoke(ctx context.Context, svc *lambda.Lambda,
 	if out.Response.Times.ColdStart {
 		span.AddField("cold_start", true)
 	}
+	if d := out.Response.Diagnostics; d != nil && d.Container != nil {
+		span.AddField("container_invocations", d.Container.Invocations)
+		if out.Response.Times.ColdStart {
+			span.AddField("init_ms", d.Container.Init.Milliseconds())
+		}
+	}
+	if out.Response.Interrupted {
+		span.AddField("interrupted", true)
+	}
+	if out.Response.Replayed {
+		span.AddField("replayed", true)
+	}
 
-	return &out, nil
 }
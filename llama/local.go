@@ -0,0 +1,84 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/nelhage/llama/progress"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
+)
+
+// A LocalRunner runs jobs in-process, the way the runtime runs them
+// on Lambda. NewLocal returns one that uses the runtime's own code.
+type LocalRunner interface {
+	RunOneStreaming(ctx context.Context, job *protocol.InvocationSpec, stdout io.Writer) (*protocol.InvocationResponse, error)
+}
+
+// ErrLocalUnsupported is returned by NewLocal on platforms the
+// runtime doesn't run on
+var ErrLocalUnsupported = errors.New("local execution is only supported on Linux")
+
+// invokeLocal runs a job with args.Local. Failures are reported as
+// an ErrorReturn carrying the payload the runtime would have
+// returned on Lambda.
+func invokeLocal(ctx context.Context, st store.Store, args *InvokeArgs) (_ *InvokeResult, err error) {
+	ctx, span := tracing.StartSpan(ctx, "llama.Invoke")
+	defer func() {
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+	span.AddField("function", args.Function)
+	span.AddField("local", true)
+
+	if span.WillSubmit() {
+		args.Spec.Trace = span.Propagation()
+	}
+	args.Spec.Stream = args.Stdout != nil
+
+	stop := args.Progress.Tick(progress.Running)
+	resp, err := args.Local.RunOneStreaming(ctx, &args.Spec, args.Stdout)
+	stop()
+	if err != nil {
+		return nil, &ErrorReturn{Payload: protocol.ErrorPayload(err)}
+	}
+	out := InvokeResult{Response: *resp}
+	finishResponse(ctx, span, st, args, &out)
+	return &out, nil
+}
+
+// fallBack reports whether a job that failed to run on Lambda with
+// `err` should be run locally instead
+func fallBack(ctx context.Context, args *InvokeArgs, err error, written *countingWriter) bool {
+	if args.Local == nil || !args.LocalFallback || ctx.Err() != nil {
+		return false
+	}
+	// If the job itself failed, it would fail locally, too.
+	if _, ok := err.(*ErrorReturn); ok {
+		return false
+	}
+	if written != nil && written.n > 0 {
+		return false
+	}
+	log.Printf("%s: %s; running locally", args.Function, err.Error())
+	return true
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package llama
+
+import (
+	"github.com/nelhage/llama/runner"
+	"github.com/nelhage/llama/store"
+)
+
+// NewLocal returns a LocalRunner that runs jobs against `st`. Jobs
+// only get the namespace sandbox if the program calls
+// runner.SandboxHelper at startup.
+func NewLocal(st store.Store) (LocalRunner, error) {
+	return runner.NewLocal(st), nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeLocal struct {
+	specs []protocol.InvocationSpec
+	err   error
+}
+
+func (f *fakeLocal) RunOneStreaming(ctx context.Context, job *protocol.InvocationSpec, stdout io.Writer) (*protocol.InvocationResponse, error) {
+	f.specs = append(f.specs, *job)
+	if f.err != nil {
+		return nil, f.err
+	}
+	if stdout != nil {
+		io.WriteString(stdout, "hello\n")
+	}
+	return &protocol.InvocationResponse{ExitStatus: 3, Local: true}, nil
+}
+
+func TestInvoke_Local(t *testing.T) {
+	local := &fakeLocal{}
+	res, err := Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Spec:     protocol.InvocationSpec{Args: []string{"true"}},
+		Local:    local,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Response.ExitStatus)
+	assert.True(t, res.Response.Local)
+	require.Len(t, local.specs, 1)
+	assert.Equal(t, []string{"true"}, local.specs[0].Args)
+	assert.NotEmpty(t, local.specs[0].IdempotencyToken)
+
+	local.err = &protocol.Error{Code: protocol.ErrArgMax, Message: "too long"}
+	_, err = Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Local:    local,
+	})
+	ret, ok := err.(*ErrorReturn)
+	require.True(t, ok, "err=%v", err)
+	require.NotNil(t, ret.Structured())
+	assert.Equal(t, protocol.ErrArgMax, ret.Structured().Code)
+}
+
+func TestInvoke_LocalFallback(t *testing.T) {
+	svc, specs := flakyServer(t, 10, 500, lambda.ErrCodeServiceException)
+	local := &fakeLocal{}
+	res, err := Invoke(context.Background(), svc, store.InMemory(), &InvokeArgs{
+		Function:      "fn",
+		Retry:         &fastRetries,
+		Local:         local,
+		LocalFallback: true,
+	})
+	require.NoError(t, err)
+	assert.True(t, res.Response.Local)
+	assert.Len(t, specs(), fastRetries.MaxAttempts)
+	require.Len(t, local.specs, 1)
+	assert.Equal(t, specs()[0].IdempotencyToken, local.specs[0].IdempotencyToken)
+
+	// If Lambda works, the job runs there.
+	svc, _ = flakyServer(t, 0, 500, lambda.ErrCodeServiceException)
+	res, err = Invoke(context.Background(), svc, store.InMemory(), &InvokeArgs{
+		Function:      "fn",
+		Local:         local,
+		LocalFallback: true,
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Response.Local)
+	assert.Equal(t, 7, res.Response.ExitStatus)
+	assert.Len(t, local.specs, 1)
+}
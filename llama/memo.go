@@ -0,0 +1,173 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// memoRecord is what the result cache stores for a job
+type memoRecord struct {
+	Function string                      `json:"function"`
+	Response protocol.InvocationResponse `json:"response"`
+}
+
+// MemoKey returns the key under which the result of running `spec`
+// on `function` is memoized: a hash of the function and of the
+// parts of the spec that can affect the job's outcome. Settings
+// that only affect how the job is invoked or reported, such as its
+// trace, idempotency token, and routing hints, are left out, and
+// its files are taken in path order.
+func MemoKey(function string, spec *protocol.InvocationSpec) string {
+	canon := *spec
+	canon.Trace = nil
+	canon.IdempotencyToken = ""
+	canon.Stream = false
+	canon.PersistTrace = false
+	canon.Repro = nil
+	canon.Depth = 0
+	canon.Route, canon.MemoryMB, canon.InputBytes = "", 0, 0
+	canon.Files = append(protocol.FileList(nil), spec.Files...)
+	sort.SliceStable(canon.Files, func(i, j int) bool { return canon.Files[i].Path < canon.Files[j].Path })
+	data, err := json.Marshal(struct {
+		Function string                  `json:"function"`
+		Spec     protocol.InvocationSpec `json:"spec"`
+	}{function, canon})
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(data)
+	return "results/" + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// memoizable reports whether the result of a job may be memoized
+func memoizable(args *InvokeArgs) bool {
+	return args.Memoize && args.Spec.Deterministic
+}
+
+// responseRefs returns the objects a response refers to
+func responseRefs(resp *protocol.InvocationResponse) []string {
+	var refs []string
+	for _, b := range []*protocol.Blob{resp.Stdout, resp.Stderr} {
+		if b != nil && b.Ref != "" {
+			refs = append(refs, b.Ref)
+		}
+	}
+	for _, out := range resp.Outputs {
+		if out.Ref != "" {
+			refs = append(refs, out.Ref)
+		}
+		for _, ext := range out.Extents {
+			if ext.Ref != "" {
+				refs = append(refs, ext.Ref)
+			}
+		}
+	}
+	return refs
+}
+
+// complete reports whether every object in `refs` is still in the
+// store
+func complete(ctx context.Context, st store.Store, refs []string) bool {
+	if len(refs) == 0 {
+		return true
+	}
+	if ch, ok := store.AsChecker(st); ok {
+		for _, id := range refs {
+			if ok, err := ch.HasObject(ctx, id); err != nil || !ok {
+				return false
+			}
+		}
+		return true
+	}
+	gets := make([]store.GetRequest, len(refs))
+	for i, id := range refs {
+		gets[i].Id = id
+	}
+	st.GetObjects(ctx, gets)
+	for _, g := range gets {
+		if g.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupMemo returns the memoized result stored under `key`, or nil
+// if there isn't a usable one. An entry whose outputs have gone
+// missing from the store is stale, and counts as a miss; the new
+// result replaces it.
+func lookupMemo(ctx context.Context, st store.Store, function, key string) *InvokeResult {
+	ks, ok := store.AsKeyed(st)
+	if !ok {
+		return nil
+	}
+	data, err := ks.GetKey(ctx, key)
+	if err != nil {
+		return nil
+	}
+	var rec memoRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		log.Printf("%s: ignoring corrupt memoized result %s: %s", function, key, err.Error())
+		return nil
+	}
+	if !complete(ctx, st, responseRefs(&rec.Response)) {
+		log.Printf("%s: memoized result %s refers to objects missing from the store; rerunning", function, key)
+		return nil
+	}
+	// The job cost nothing this time
+	rec.Response.Usage = protocol.UsageMetrics{}
+	rec.Response.Nested = nil
+	rec.Response.Memoized = true
+	return &InvokeResult{Response: rec.Response, Function: rec.Function}
+}
+
+// storeMemo memoizes `out` under `key`, if it is a successful
+// result whose outputs are all in the store
+func storeMemo(ctx context.Context, st store.Store, key string, out *InvokeResult) {
+	resp := out.Response
+	if resp.ExitStatus != 0 || resp.Interrupted {
+		return
+	}
+	for _, f := range resp.Outputs {
+		if f.Pending {
+			return
+		}
+	}
+	ks, ok := store.AsKeyed(st)
+	if !ok {
+		return
+	}
+	// Drop what only describes this one run
+	resp.InlineSpans, resp.Spans = nil, nil
+	resp.Diagnostics = nil
+	resp.Transfer = protocol.Transfer{}
+	resp.Replayed, resp.Memoized = false, false
+	data, err := json.Marshal(&memoRecord{Function: out.Function, Response: resp})
+	if err != nil {
+		return
+	}
+	if err := ks.PutKey(ctx, key, data); err != nil {
+		log.Printf("%s: memoizing result: %s", out.Function, err.Error())
+	}
+}
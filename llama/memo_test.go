@@ -0,0 +1,107 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoKey(t *testing.T) {
+	a := protocol.InvocationSpec{
+		Args: []string{"cc", "-c", "a.c"},
+		Files: protocol.FileList{
+			{Path: "a.c", File: protocol.File{Blob: protocol.Blob{Ref: "a"}}},
+			{Path: "b.h", File: protocol.File{Blob: protocol.Blob{Ref: "b"}}},
+		},
+		Deterministic: true,
+	}
+	b := a
+	b.Files = protocol.FileList{a.Files[1], a.Files[0]}
+	b.IdempotencyToken = "token"
+	b.Depth = 2
+	b.MemoryMB = 4096
+	assert.Equal(t, MemoKey("fn", &a), MemoKey("fn", &b))
+
+	assert.NotEqual(t, MemoKey("fn", &a), MemoKey("other", &a))
+	b.Args = []string{"cc", "-O2", "-c", "a.c"}
+	assert.NotEqual(t, MemoKey("fn", &a), MemoKey("fn", &b))
+}
+
+func TestInvoke_Memoize(t *testing.T) {
+	st := store.InMemory()
+	out, err := st.Store(context.Background(), []byte("object code"))
+	require.NoError(t, err)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		json.NewEncoder(w).Encode(&protocol.InvocationResponse{
+			Outputs: protocol.FileList{{Path: "a.o", File: protocol.File{Blob: protocol.Blob{Ref: out}}}},
+			Usage:   protocol.UsageMetrics{Lambda: protocol.LambdaUsage{Millis: 1000}},
+		})
+	}))
+	defer srv.Close()
+	svc := lambda.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	invoke := func(args InvokeArgs) *InvokeResult {
+		args.Function = "fn"
+		args.Spec.Args = []string{"cc", "-c", "a.c"}
+		res, err := Invoke(context.Background(), svc, st, &args)
+		require.NoError(t, err)
+		return res
+	}
+	deterministic := protocol.InvocationSpec{Deterministic: true}
+
+	res := invoke(InvokeArgs{Memoize: true, Spec: deterministic})
+	assert.False(t, res.Response.Memoized)
+	res = invoke(InvokeArgs{Memoize: true, Spec: deterministic})
+	assert.True(t, res.Response.Memoized)
+	assert.Equal(t, "fn", res.Function)
+	assert.Equal(t, out, res.Response.Outputs[0].Ref)
+	assert.Zero(t, res.Response.Usage.Lambda.Millis)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Jobs that aren't memoized, or aren't declared
+	// deterministic, always run
+	invoke(InvokeArgs{Spec: deterministic})
+	invoke(InvokeArgs{Memoize: true})
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	res = invoke(InvokeArgs{Memoize: true, RefreshMemo: true, Spec: deterministic})
+	assert.False(t, res.Response.Memoized)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// An entry whose outputs are gone is a miss
+	require.NoError(t, st.(store.Deleter).Delete(context.Background(), out))
+	res = invoke(InvokeArgs{Memoize: true, Spec: deterministic})
+	assert.False(t, res.Response.Memoized)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+}
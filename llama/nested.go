@@ -0,0 +1,72 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// setDepth fills in `spec`'s nesting depth from the job this
+// process is running inside of, if any, and refuses to invoke
+// anything if that would nest too deeply.
+func setDepth(spec *protocol.InvocationSpec) error {
+	if env := os.Getenv(protocol.NestingDepthEnv); env != "" && spec.Depth == 0 {
+		depth, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("%s: %w", protocol.NestingDepthEnv, err)
+		}
+		spec.Depth = depth
+	}
+	if spec.Depth > protocol.MaxNestingDepth {
+		return fmt.Errorf("invocation would be nested %d deep, past the limit of %d", spec.Depth, protocol.MaxNestingDepth)
+	}
+	return nil
+}
+
+var nestedMu sync.Mutex
+
+// recordNested reports a completed invocation to the Nested job
+// this process is running inside of, if any, so that its runtime
+// can account for it. This is best-effort.
+func recordNested(function string, out *InvokeResult, err error) {
+	where := os.Getenv(protocol.NestedStatsEnv)
+	if where == "" || out == nil {
+		return
+	}
+	rec := protocol.NestedRecord(&out.Response, err != nil || out.Response.ExitStatus != 0)
+	line, jerr := json.Marshal(&rec)
+	if jerr != nil {
+		return
+	}
+	nestedMu.Lock()
+	defer nestedMu.Unlock()
+	f, ferr := os.OpenFile(where, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if ferr == nil {
+		_, ferr = f.Write(append(line, '\n'))
+		if cerr := f.Close(); ferr == nil {
+			ferr = cerr
+		}
+	}
+	if ferr != nil {
+		log.Printf("%s: recording nested invocation: %s", function, ferr.Error())
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvoke_Nested(t *testing.T) {
+	stats := path.Join(t.TempDir(), "nested.jsonl")
+	os.Setenv(protocol.NestingDepthEnv, "2")
+	defer os.Unsetenv(protocol.NestingDepthEnv)
+	os.Setenv(protocol.NestedStatsEnv, stats)
+	defer os.Unsetenv(protocol.NestedStatsEnv)
+
+	local := &fakeLocal{}
+	for i := 0; i < 2; i++ {
+		_, err := Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+			Function: "fn",
+			Local:    local,
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, local.specs, 2)
+	assert.Equal(t, 2, local.specs[0].Depth)
+
+	f, err := os.Open(stats)
+	require.NoError(t, err)
+	defer f.Close()
+	var total protocol.NestedUsage
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		var rec protocol.NestedUsage
+		require.NoError(t, json.Unmarshal(scan.Bytes(), &rec))
+		total.Add(&rec)
+	}
+	// fakeLocal's jobs exit 3
+	assert.Equal(t, protocol.NestedUsage{Invocations: 2, Failed: 2}, total)
+
+	os.Setenv(protocol.NestingDepthEnv, strconv.Itoa(protocol.MaxNestingDepth+1))
+	_, err = Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Local:    local,
+	})
+	assert.Error(t, err)
+	assert.Len(t, local.specs, 2)
+}
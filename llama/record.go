@@ -0,0 +1,168 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// A Recording captures an invocation: the spec that was sent, and
+// the response or error that came back. Blobs are recorded as the
+// spec and response carry them, so large ones are only referenced
+// by their IDs in the object store.
+type Recording struct {
+	Function string                       `json:"function"`
+	Time     time.Time                    `json:"time"`
+	Spec     protocol.InvocationSpec      `json:"spec"`
+	Response *protocol.InvocationResponse `json:"response,omitempty"`
+	// Error is set if the invocation failed. ErrorPayload is the
+	// function's error payload, if it returned one.
+	Error        string          `json:"error,omitempty"`
+	ErrorPayload json.RawMessage `json:"error_payload,omitempty"`
+}
+
+// record writes a Recording of an invocation to args.Record,
+// returning its path
+func record(args *InvokeArgs, out *InvokeResult, err error) (string, error) {
+	rec := Recording{
+		Function: args.Function,
+		Time:     time.Now().UTC(),
+		Spec:     args.Spec,
+	}
+	if out != nil {
+		rec.Response = &out.Response
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		if ret, ok := err.(*ErrorReturn); ok && json.Valid(ret.Payload) {
+			rec.ErrorPayload = ret.Payload
+		}
+	}
+	data, merr := json.MarshalIndent(&rec, "", "  ")
+	if merr != nil {
+		return "", merr
+	}
+	if err := os.MkdirAll(args.Record, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%.8s.json", rec.Time.Format("20060102T150405.000"), args.Spec.IdempotencyToken)
+	where := path.Join(args.Record, name)
+	return where, ioutil.WriteFile(where, append(data, '\n'), 0644)
+}
+
+// ReadRecording reads a Recording written by Invoke
+func ReadRecording(file string) (*Recording, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &rec, nil
+}
+
+// DiffResponses compares the parts of two responses to the same
+// spec that a deterministic job should reproduce: the exit status,
+// the contents of stdout and stderr, and the outputs. It returns a
+// description of each difference. Blobs are compared by their IDs
+// or inline contents, without fetching them.
+func DiffResponses(old, new *protocol.InvocationResponse) []string {
+	var diffs []string
+	if old.ExitStatus != new.ExitStatus {
+		diffs = append(diffs, fmt.Sprintf("exit status: %d -> %d", old.ExitStatus, new.ExitStatus))
+	}
+	if !sameBlob(old.Stdout, new.Stdout) {
+		diffs = append(diffs, fmt.Sprintf("stdout: %s -> %s", describeBlob(old.Stdout), describeBlob(new.Stdout)))
+	}
+	if !sameBlob(old.Stderr, new.Stderr) {
+		diffs = append(diffs, fmt.Sprintf("stderr: %s -> %s", describeBlob(old.Stderr), describeBlob(new.Stderr)))
+	}
+
+	was, is := outputsByPath(old.Outputs), outputsByPath(new.Outputs)
+	var paths []string
+	for p := range was {
+		paths = append(paths, p)
+	}
+	for p := range is {
+		if was[p] == nil {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		was, is := was[p], is[p]
+		switch {
+		case was == nil:
+			diffs = append(diffs, fmt.Sprintf("output %s: added", p))
+		case is == nil:
+			diffs = append(diffs, fmt.Sprintf("output %s: removed", p))
+		case !protocol.SameFile(was, is):
+			diffs = append(diffs, fmt.Sprintf("output %s: %s -> %s", p, describeFile(was), describeFile(is)))
+		}
+	}
+	return diffs
+}
+
+func outputsByPath(list protocol.FileList) map[string]*protocol.File {
+	out := make(map[string]*protocol.File, len(list))
+	for i := range list {
+		out[list[i].Path] = &list[i].File
+	}
+	return out
+}
+
+func sameBlob(a, b *protocol.Blob) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.DeepEqual(*a, *b)
+}
+
+func describeBlob(b *protocol.Blob) string {
+	switch {
+	case b == nil:
+		return "none"
+	case b.Err != "":
+		return fmt.Sprintf("error %q", b.Err)
+	case b.Ref != "":
+		return b.Ref
+	case b.String != "":
+		return fmt.Sprintf("%q", b.String)
+	default:
+		return fmt.Sprintf("%q", b.Bytes)
+	}
+}
+
+func describeFile(f *protocol.File) string {
+	desc := describeBlob(&f.Blob)
+	if len(f.Extents) > 0 {
+		desc = fmt.Sprintf("sparse, %d extents", len(f.Extents))
+	}
+	if f.Hash != "" {
+		desc = f.Hash
+	}
+	return fmt.Sprintf("%s (mode %s)", desc, f.Mode)
+}
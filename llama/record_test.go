@@ -0,0 +1,97 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvoke_Record(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-record")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	local := &fakeLocal{}
+	res, err := Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Spec:     protocol.InvocationSpec{Args: []string{"true"}},
+		Local:    local,
+		Record:   dir,
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, res.Recording)
+
+	rec, err := ReadRecording(res.Recording)
+	require.NoError(t, err)
+	assert.Equal(t, "fn", rec.Function)
+	assert.Equal(t, local.specs[0], rec.Spec)
+	require.NotNil(t, rec.Response)
+	assert.Equal(t, 3, rec.Response.ExitStatus)
+	assert.Empty(t, rec.Error)
+
+	local.err = &protocol.Error{Code: protocol.ErrArgMax, Message: "too long"}
+	_, err = Invoke(context.Background(), nil, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Local:    local,
+		Record:   dir,
+	})
+	require.Error(t, err)
+	ents, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, ents, 2)
+}
+
+func TestDiffResponses(t *testing.T) {
+	old := protocol.InvocationResponse{
+		ExitStatus: 0,
+		Stdout:     &protocol.Blob{String: "hi\n"},
+		Stderr:     &protocol.Blob{Ref: "aaa"},
+		Outputs: protocol.FileList{
+			{Path: "a.o", File: protocol.File{Blob: protocol.Blob{Ref: "a1"}, Mode: 0644, MTime: 1}},
+			{Path: "b.o", File: protocol.File{Blob: protocol.Blob{Ref: "b1"}, Mode: 0644}},
+		},
+	}
+	same := old
+	same.Outputs = protocol.FileList{
+		{Path: "b.o", File: protocol.File{Blob: protocol.Blob{Ref: "b1"}, Mode: 0644}},
+		{Path: "a.o", File: protocol.File{Blob: protocol.Blob{Ref: "a1"}, Mode: 0644, MTime: 2}},
+	}
+	assert.Empty(t, DiffResponses(&old, &same))
+
+	changed := protocol.InvocationResponse{
+		ExitStatus: 1,
+		Stdout:     &protocol.Blob{String: "hi\n"},
+		Stderr:     &protocol.Blob{Ref: "bbb"},
+		Outputs: protocol.FileList{
+			{Path: "a.o", File: protocol.File{Blob: protocol.Blob{Ref: "a2"}, Mode: 0644}},
+			{Path: "c.o", File: protocol.File{Blob: protocol.Blob{Ref: "c1"}, Mode: 0644}},
+		},
+	}
+	assert.Equal(t, []string{
+		"exit status: 0 -> 1",
+		"stderr: aaa -> bbb",
+		"output a.o: a1 (mode -rw-r--r--) -> a2 (mode -rw-r--r--)",
+		"output b.o: removed",
+		"output c.o: added",
+	}, DiffResponses(&old, &changed))
+}
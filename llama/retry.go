@@ -0,0 +1,104 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// RetryPolicy controls how Invoke retries invocations that fail
+// because Lambda throttled them or because of a transient service
+// or network error. Errors returned by the function itself are
+// never retried.
+type RetryPolicy struct {
+	// MaxAttempts bounds the number of times an invocation is
+	// attempted, including the first. A value of 1 disables
+	// retries.
+	MaxAttempts int
+	// Delays between attempts grow exponentially from BaseDelay
+	// up to MaxDelay, and each is chosen uniformly at random up
+	// to that bound.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxTotalDelay bounds the time spent waiting between
+	// attempts over all of them.
+	MaxTotalDelay time.Duration
+}
+
+// DefaultRetryPolicy is used if InvokeArgs.Retry is unset
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   5,
+	BaseDelay:     100 * time.Millisecond,
+	MaxDelay:      5 * time.Second,
+	MaxTotalDelay: 30 * time.Second,
+}
+
+// delay returns how long to wait before retry number `retry`,
+// counting from 0
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	bound := p.MaxDelay
+	if retry < 32 {
+		if d := p.BaseDelay << uint(retry); d > 0 && d < bound {
+			bound = d
+		}
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1))
+}
+
+var retryableCodes = map[string]bool{
+	lambda.ErrCodeTooManyRequestsException:  true,
+	lambda.ErrCodeServiceException:          true,
+	lambda.ErrCodeEC2ThrottledException:     true,
+	lambda.ErrCodeResourceNotReadyException: true,
+}
+
+// retryable reports whether an invocation that failed with `err`
+// may succeed if it is retried
+func retryable(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if retryableCodes[aerr.Code()] {
+		return true
+	}
+	var reqerr awserr.RequestFailure
+	if errors.As(err, &reqerr) && reqerr.StatusCode() >= 500 {
+		return true
+	}
+	return request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr)
+}
+
+// sleepContext waits for `d`, or until `ctx` is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/budget"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer fails the first `failures` invocations with
+// `status` and `errType`, and records the spec of every attempt.
+func flakyServer(t *testing.T, failures, status int, errType string) (*lambda.Lambda, func() []protocol.InvocationSpec) {
+	var mu sync.Mutex
+	var specs []protocol.InvocationSpec
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spec protocol.InvocationSpec
+		body, _ := ioutil.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &spec))
+		mu.Lock()
+		specs = append(specs, spec)
+		n := len(specs)
+		mu.Unlock()
+		if n <= failures {
+			w.Header().Set("X-Amzn-Errortype", errType)
+			w.WriteHeader(status)
+			w.Write([]byte(`{"message":"try again"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(&protocol.InvocationResponse{ExitStatus: 7})
+	}))
+	t.Cleanup(srv.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return lambda.New(sess), func() []protocol.InvocationSpec {
+		mu.Lock()
+		defer mu.Unlock()
+		return specs
+	}
+}
+
+var fastRetries = RetryPolicy{
+	MaxAttempts:   4,
+	BaseDelay:     time.Millisecond,
+	MaxDelay:      time.Millisecond,
+	MaxTotalDelay: time.Second,
+}
+
+func TestInvoke_RetriesThrottles(t *testing.T) {
+	svc, specs := flakyServer(t, 2, 429, lambda.ErrCodeTooManyRequestsException)
+	res, err := Invoke(context.Background(), svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Retry:    &fastRetries,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 7, res.Response.ExitStatus)
+	assert.Equal(t, 2, res.Retries)
+
+	got := specs()
+	require.Len(t, got, 3)
+	assert.NotEmpty(t, got[0].IdempotencyToken)
+	for _, spec := range got {
+		assert.Equal(t, got[0].IdempotencyToken, spec.IdempotencyToken)
+	}
+}
+
+func TestInvoke_TokenPerCall(t *testing.T) {
+	svc, specs := flakyServer(t, 0, 500, lambda.ErrCodeServiceException)
+	args := InvokeArgs{Function: "fn"}
+	for i := 0; i < 2; i++ {
+		_, err := Invoke(context.Background(), svc, store.InMemory(), &args)
+		require.NoError(t, err)
+		assert.Empty(t, args.Spec.IdempotencyToken)
+	}
+
+	got := specs()
+	require.Len(t, got, 2)
+	assert.NotEmpty(t, got[0].IdempotencyToken)
+	assert.NotEqual(t, got[0].IdempotencyToken, got[1].IdempotencyToken)
+}
+
+func TestInvoke_GivesUp(t *testing.T) {
+	svc, specs := flakyServer(t, 10, 500, lambda.ErrCodeServiceException)
+	_, err := Invoke(context.Background(), svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Retry:    &fastRetries,
+	})
+	var aerr awserr.Error
+	require.True(t, errors.As(err, &aerr), "err=%v", err)
+	assert.Equal(t, lambda.ErrCodeServiceException, aerr.Code())
+	assert.Len(t, specs(), fastRetries.MaxAttempts)
+}
+
+func TestInvoke_NoRetryOnClientErrors(t *testing.T) {
+	svc, specs := flakyServer(t, 1, 400, lambda.ErrCodeInvalidParameterValueException)
+	_, err := Invoke(context.Background(), svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Retry:    &fastRetries,
+	})
+	require.Error(t, err)
+	assert.Len(t, specs(), 1)
+}
+
+func TestInvoke_RetryCanceled(t *testing.T) {
+	svc, specs := flakyServer(t, 10, 429, lambda.ErrCodeTooManyRequestsException)
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour, MaxTotalDelay: 100 * time.Hour}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := Invoke(ctx, svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Retry:    &policy,
+	})
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	assert.LessOrEqual(t, len(specs()), 2)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for retry := 0; retry < 40; retry++ {
+		d := p.delay(retry)
+		assert.GreaterOrEqual(t, int64(d), int64(0))
+		assert.LessOrEqual(t, int64(d), int64(p.MaxDelay))
+		if retry == 0 {
+			assert.LessOrEqual(t, int64(d), int64(p.BaseDelay))
+		}
+	}
+}
+
+func TestInvoke_ReuploadsMissingBlobs(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spec protocol.InvocationSpec
+		body, _ := ioutil.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &spec))
+		attempts++
+		if spec.Files[0].Ref == "gone" {
+			w.Header().Set("X-Amz-Function-Error", "Unhandled")
+			json.NewEncoder(w).Encode(&protocol.Error{
+				Code:    protocol.ErrMissingBlob,
+				Message: "1 objects are missing from the store: gone",
+				Details: map[string]string{"ids": "gone"},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(&protocol.InvocationResponse{ExitStatus: 0})
+	}))
+	defer srv.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+
+	var reuploaded []string
+	args := &InvokeArgs{
+		Function: "fn",
+		Spec: protocol.InvocationSpec{Files: protocol.FileList{
+			{Path: "f", File: protocol.File{Blob: protocol.Blob{Ref: "gone"}}},
+		}},
+		Reupload: func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error) {
+			reuploaded = append(reuploaded, missing...)
+			spec.Files[0].Ref = "restored"
+			return nil, nil
+		},
+	}
+	_, err := Invoke(context.Background(), lambda.New(sess), store.InMemory(), args)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gone"}, reuploaded)
+	assert.Equal(t, 2, attempts)
+
+	// Without a source for the blob, the error is returned as-is
+	attempts = 0
+	args.Spec.Files[0].Ref = "gone"
+	args.Reupload = func(ctx context.Context, spec *protocol.InvocationSpec, missing []string) ([]string, error) {
+		return missing, nil
+	}
+	_, err = Invoke(context.Background(), lambda.New(sess), store.InMemory(), args)
+	ret, ok := err.(*ErrorReturn)
+	require.True(t, ok, "err=%v", err)
+	assert.Equal(t, protocol.ErrMissingBlob, ret.Structured().Code)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestInvoke_Budget(t *testing.T) {
+	svc, specs := flakyServer(t, 0, 0, "")
+	b, err := budget.Open(t.TempDir(), 1)
+	require.NoError(t, err)
+	args := &InvokeArgs{Function: "fn", Budget: b}
+
+	res, err := Invoke(context.Background(), svc, store.InMemory(), args)
+	require.NoError(t, err)
+	assert.Equal(t, 7, res.Response.ExitStatus)
+
+	// With the only slot taken, the invocation times out
+	// without reaching the function
+	slot, err := b.Acquire(context.Background())
+	require.NoError(t, err)
+	defer slot.Release()
+	b.Timeout = 10 * time.Millisecond
+	_, err = Invoke(context.Background(), svc, store.InMemory(), args)
+	assert.True(t, errors.Is(err, budget.ErrTimeout), "err=%v", err)
+	assert.Len(t, specs(), 1)
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// A Route is one of the functions a Router sends jobs to
+type Route struct {
+	// Name identifies the route to protocol.InvocationSpec.Route.
+	// It defaults to Function.
+	Name     string `json:"name,omitempty"`
+	Function string `json:"function"`
+	// URL, if set, invokes Function through its function URL
+	URL *FunctionURL `json:"-"`
+	// MemoryMB is the function's memory size. Jobs that declare
+	// they need more aren't sent to it.
+	MemoryMB int `json:"memory_mb,omitempty"`
+	// MaxInputBytes, if non-zero, is the most input jobs sent to
+	// the function may declare.
+	MaxInputBytes int64 `json:"max_input_bytes,omitempty"`
+}
+
+func (r *Route) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Function
+}
+
+// fits reports whether a job with `spec` may be sent to the route,
+// going by what the spec declares about itself
+func (r *Route) fits(spec *protocol.InvocationSpec) bool {
+	if r.MemoryMB != 0 && spec.MemoryMB > r.MemoryMB {
+		return false
+	}
+	if r.MaxInputBytes != 0 && spec.InputBytes > r.MaxInputBytes {
+		return false
+	}
+	return true
+}
+
+// A Router picks which of several functions to run each job on: a
+// small one for most jobs, say, and a large one for those that need
+// more memory.
+type Router struct {
+	// Routes is ordered from smallest to largest. Jobs go to
+	// the first route that fits them, or to the last if none
+	// do.
+	Routes []Route `json:"routes"`
+	// Escalate resubmits jobs that run out of memory to the next
+	// route with more memory, if there is one.
+	Escalate bool `json:"escalate,omitempty"`
+}
+
+// Pick returns the index of the route to run `spec` on. A spec that
+// names its route gets that one, even if it doesn't fit.
+func (r *Router) Pick(spec *protocol.InvocationSpec) (int, error) {
+	if len(r.Routes) == 0 {
+		return 0, errors.New("router: no routes configured")
+	}
+	if spec.Route != "" {
+		for i := range r.Routes {
+			if r.Routes[i].name() == spec.Route {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("router: no route named %q", spec.Route)
+	}
+	for i := range r.Routes {
+		if r.Routes[i].fits(spec) {
+			return i, nil
+		}
+	}
+	return len(r.Routes) - 1, nil
+}
+
+// larger returns the index of the first route after `i` with more
+// memory than it, or -1 if there isn't one
+func (r *Router) larger(i int) int {
+	for j := i + 1; j < len(r.Routes); j++ {
+		if r.Routes[j].MemoryMB > r.Routes[i].MemoryMB {
+			return j
+		}
+	}
+	return -1
+}
+
+// A MisroutedError is returned by InvokeRouted if a job runs out of
+// memory on a route, without escalation, when a larger route was
+// available.
+type MisroutedError struct {
+	Err    error
+	Route  string
+	Larger string
+}
+
+func (e *MisroutedError) Error() string {
+	return fmt.Sprintf("%s (on route %q; route %q has more memory: declare the job's memory needs, route it there explicitly, or enable escalation)",
+		e.Err.Error(), e.Route, e.Larger)
+}
+
+func (e *MisroutedError) Unwrap() error {
+	return e.Err
+}
+
+// isOOM reports whether a job failed by running out of memory
+func isOOM(err error) bool {
+	var ret *ErrorReturn
+	if !errors.As(err, &ret) {
+		return false
+	}
+	se := ret.Structured()
+	return se != nil && se.Code == protocol.ErrOOM
+}
+
+// InvokeRouted runs a job, as Invoke does, on the function the
+// router picks for it, overriding args.Function and args.URL. The
+// result's Function records the function that served it.
+func InvokeRouted(ctx context.Context, svc *lambda.Lambda,
+	st store.Store, r *Router, args *InvokeArgs) (*InvokeResult, error) {
+	copied := *args
+	args = &copied
+	i, err := r.Pick(&args.Spec)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		route := &r.Routes[i]
+		args.Function, args.URL = route.Function, route.URL
+		out, err := Invoke(ctx, svc, st, args)
+		if !isOOM(err) {
+			return out, err
+		}
+		next := r.larger(i)
+		if next < 0 {
+			return out, err
+		}
+		if !r.Escalate {
+			return out, &MisroutedError{Err: err, Route: route.name(), Larger: r.Routes[next].name()}
+		}
+		log.Printf("%s: job ran out of memory; retrying on %s", route.Function, r.Routes[next].Function)
+		args.Spec.IdempotencyToken = newToken()
+		i = next
+	}
+}
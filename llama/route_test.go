@@ -0,0 +1,122 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRouter = Router{Routes: []Route{
+	{Function: "small", MemoryMB: 1769, MaxInputBytes: 1 << 20},
+	{Name: "link", Function: "big", MemoryMB: 10240},
+}}
+
+func TestRouter_Pick(t *testing.T) {
+	tests := []struct {
+		spec protocol.InvocationSpec
+		want int
+	}{
+		{protocol.InvocationSpec{}, 0},
+		{protocol.InvocationSpec{MemoryMB: 1000, InputBytes: 1000}, 0},
+		{protocol.InvocationSpec{MemoryMB: 4096}, 1},
+		{protocol.InvocationSpec{InputBytes: 2 << 20}, 1},
+		{protocol.InvocationSpec{MemoryMB: 1 << 20}, 1},
+		{protocol.InvocationSpec{Route: "link"}, 1},
+		{protocol.InvocationSpec{Route: "small", MemoryMB: 4096}, 0},
+	}
+	for _, tc := range tests {
+		got, err := testRouter.Pick(&tc.spec)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got, "spec=%+v", tc.spec)
+	}
+	_, err := testRouter.Pick(&protocol.InvocationSpec{Route: "nope"})
+	assert.Error(t, err)
+}
+
+// oomServer runs out of memory on the function "small", and
+// records the functions invoked
+func oomServer(t *testing.T) (*lambda.Lambda, func() []string) {
+	var mu sync.Mutex
+	var invoked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		function := strings.Split(strings.TrimPrefix(r.URL.Path, "/2015-03-31/functions/"), "/")[0]
+		mu.Lock()
+		invoked = append(invoked, function)
+		mu.Unlock()
+		if function == "small" {
+			w.Header().Set("X-Amz-Function-Error", "Unhandled")
+			json.NewEncoder(w).Encode(&protocol.Error{
+				Code:    protocol.ErrOOM,
+				Message: "job ran out of memory",
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(&protocol.InvocationResponse{ExitStatus: 0})
+	}))
+	t.Cleanup(srv.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return lambda.New(sess), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return invoked
+	}
+}
+
+func TestInvokeRouted(t *testing.T) {
+	svc, invoked := oomServer(t)
+	router := testRouter
+
+	_, err := InvokeRouted(context.Background(), svc, store.InMemory(), &router, &InvokeArgs{})
+	var misrouted *MisroutedError
+	require.True(t, errors.As(err, &misrouted), "err=%v", err)
+	assert.Equal(t, "small", misrouted.Route)
+	assert.Equal(t, "link", misrouted.Larger)
+	var ret *ErrorReturn
+	assert.True(t, errors.As(err, &ret))
+	assert.Equal(t, []string{"small"}, invoked())
+
+	router.Escalate = true
+	res, err := InvokeRouted(context.Background(), svc, store.InMemory(), &router, &InvokeArgs{})
+	require.NoError(t, err)
+	assert.Equal(t, "big", res.Function)
+	assert.Equal(t, []string{"small", "small", "big"}, invoked())
+
+	res, err = InvokeRouted(context.Background(), svc, store.InMemory(), &router, &InvokeArgs{
+		Spec: protocol.InvocationSpec{MemoryMB: 8192},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "big", res.Function)
+	assert.Equal(t, []string{"small", "small", "big", "big"}, invoked())
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+)
+
+// Our version of aws-sdk-go predates InvokeWithResponseStream, so
+// we describe the operation ourselves and decode the event stream
+// by hand.
+// See https://docs.aws.amazon.com/lambda/latest/dg/API_InvokeWithResponseStream.html
+
+var opInvokeWithResponseStream = request.Operation{
+	Name:       "InvokeWithResponseStream",
+	HTTPMethod: "POST",
+	HTTPPath:   "/2021-11-15/functions/{FunctionName}/response-streaming-invocations",
+}
+
+type invokeStreamOutput struct {
+	_ struct{} `type:"structure" payload:"Body"`
+
+	Body io.ReadCloser `type:"blob"`
+}
+
+type invokeComplete struct {
+	ErrorCode    string
+	ErrorDetails string
+	LogResult    string
+}
+
+func headerString(msg *eventstream.Message, name string) string {
+	v := msg.Headers.Get(name)
+	if v == nil {
+		return ""
+	}
+	s, _ := v.Get().(string)
+	return s
+}
+
+// invokeStreaming invokes a function using response streaming,
+// copying stdout to `stdout` as it arrives and returning the
+// terminal frame and any logs.
+func invokeStreaming(ctx context.Context, svc *lambda.Lambda, input *lambda.InvokeInput, stdout io.Writer) (*protocol.StreamFrame, []byte, error) {
+	var output invokeStreamOutput
+	req := svc.NewRequest(&opInvokeWithResponseStream, input, &output)
+	req.SetContext(ctx)
+	noRetries(req)
+	if err := req.Send(); err != nil {
+		return nil, nil, err
+	}
+	defer output.Body.Close()
+
+	// The response is an event stream whose chunks, concatenated,
+	// form our own newline-delimited stream of frames.
+	pr, pw := io.Pipe()
+	type result struct {
+		last *protocol.StreamFrame
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		last, err := readFrames(pr, stdout)
+		pr.CloseWithError(errors.New("stream abandoned"))
+		done <- result{last, err}
+	}()
+
+	var complete *invokeComplete
+	dec := eventstream.NewDecoder(output.Body)
+	var err error
+	for complete == nil && err == nil {
+		var msg eventstream.Message
+		if msg, err = dec.Decode(nil); err != nil {
+			if err == io.EOF {
+				err = errors.New("stream ended without InvokeComplete")
+			}
+			break
+		}
+		if headerString(&msg, ":message-type") == "exception" {
+			err = fmt.Errorf("%s: %s", headerString(&msg, ":exception-type"), msg.Payload)
+			break
+		}
+		switch headerString(&msg, ":event-type") {
+		case "PayloadChunk":
+			// If the reader has gone away it will
+			// report why, below.
+			pw.Write(msg.Payload)
+		case "InvokeComplete":
+			complete = &invokeComplete{}
+			err = json.Unmarshal(msg.Payload, complete)
+		}
+	}
+	pw.Close()
+	res := <-done
+
+	if err != nil {
+		return nil, nil, err
+	}
+	var logs []byte
+	if complete.LogResult != "" {
+		logs, _ = base64.StdEncoding.DecodeString(complete.LogResult)
+	}
+	if complete.ErrorCode != "" {
+		return &protocol.StreamFrame{Error: json.RawMessage(complete.ErrorDetails)}, logs, nil
+	}
+	if res.err != nil {
+		return nil, logs, res.err
+	}
+	return res.last, logs, nil
+}
+
+// readFrames reads a stream of protocol.StreamFrames, copying
+// stdout chunks to `stdout` and returning the terminal frame.
+func readFrames(r io.Reader, stdout io.Writer) (*protocol.StreamFrame, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var frame protocol.StreamFrame
+		if err := dec.Decode(&frame); err != nil {
+			if err == io.EOF {
+				return nil, errors.New("stream ended without a response")
+			}
+			return nil, fmt.Errorf("decoding frame: %w", err)
+		}
+		if frame.Response != nil || frame.Error != nil {
+			return &frame, nil
+		}
+		stdout.Write(frame.Stdout)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package llama
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func streamingServer(t *testing.T, chunks [][]byte, complete string) *lambda.Lambda {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/2021-11-15/functions/fn/response-streaming-invocations", r.URL.Path)
+		var spec protocol.InvocationSpec
+		body, _ := ioutil.ReadAll(r.Body)
+		require.NoError(t, json.Unmarshal(body, &spec))
+		assert.True(t, spec.Stream)
+
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		enc := eventstream.NewEncoder(w)
+		event := func(typ string, payload []byte) {
+			var msg eventstream.Message
+			msg.Headers.Set(":message-type", eventstream.StringValue("event"))
+			msg.Headers.Set(":event-type", eventstream.StringValue(typ))
+			msg.Payload = payload
+			require.NoError(t, enc.Encode(msg))
+		}
+		for _, c := range chunks {
+			event("PayloadChunk", c)
+		}
+		event("InvokeComplete", []byte(complete))
+	}))
+	t.Cleanup(srv.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+	return lambda.New(sess)
+}
+
+func marshalFrames(t *testing.T, frames ...protocol.StreamFrame) []byte {
+	var buf bytes.Buffer
+	for _, f := range frames {
+		data, err := json.Marshal(&f)
+		require.NoError(t, err)
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+func TestInvokeStreaming(t *testing.T) {
+	ctx := context.Background()
+	frames := marshalFrames(t,
+		protocol.StreamFrame{Stdout: []byte("hello, ")},
+		protocol.StreamFrame{Stdout: []byte("world\n")},
+		protocol.StreamFrame{Response: &protocol.InvocationResponse{ExitStatus: 3}},
+	)
+	// Split the frames across event boundaries arbitrarily
+	svc := streamingServer(t, [][]byte{frames[:5], frames[5:30], frames[30:]}, `{}`)
+
+	var stdout bytes.Buffer
+	res, err := Invoke(ctx, svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Spec:     protocol.InvocationSpec{Args: []string{"true"}},
+		Stdout:   &stdout,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Response.ExitStatus)
+	assert.Equal(t, "hello, world\n", stdout.String())
+}
+
+func TestInvokeStreaming_Error(t *testing.T) {
+	ctx := context.Background()
+	svc := streamingServer(t,
+		[][]byte{marshalFrames(t, protocol.StreamFrame{Error: json.RawMessage(`{"errorMessage":"boom"}`)})},
+		`{}`)
+	_, err := Invoke(ctx, svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Stdout:   ioutil.Discard,
+	})
+	require.Error(t, err)
+	ret, ok := err.(*ErrorReturn)
+	require.True(t, ok, "got %#v", err)
+	assert.Equal(t, `{"errorMessage":"boom"}`, string(ret.Payload))
+
+	svc = streamingServer(t, nil, `{"ErrorCode":"Function.Timeout","ErrorDetails":"timed out"}`)
+	_, err = Invoke(ctx, svc, store.InMemory(), &InvokeArgs{
+		Function: "fn",
+		Stdout:   ioutil.Discard,
+	})
+	ret, ok = err.(*ErrorReturn)
+	require.True(t, ok, "got %#v", err)
+	assert.Equal(t, "timed out", string(ret.Payload))
+}
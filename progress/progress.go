@@ -0,0 +1,115 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package progress reports how an invocation is getting along, as
+// it moves through the stages of uploading its inputs, running on
+// the function, and fetching its outputs.
+package progress
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nelhage/llama/internal/humanize"
+)
+
+// Stage names a stage of an invocation
+type Stage string
+
+const (
+	// Hashing: the job's input files are being read and hashed
+	// to find which are already stored. TotalFiles counts them.
+	Hashing Stage = "hashing"
+	// Uploading: Files of TotalFiles inputs, Bytes in all, have
+	// been stored.
+	Uploading Stage = "uploading"
+	// Invoking: the job is waiting to be accepted by the
+	// function, or for an invocation slot
+	Invoking Stage = "invoking"
+	// Running: the job has been running for Elapsed
+	Running Stage = "running"
+	// Downloading: Files of TotalFiles outputs, Bytes in all,
+	// have been written.
+	Downloading Stage = "downloading"
+	// Done: the invocation is over, successfully or not
+	Done Stage = "done"
+)
+
+// An Event reports that an invocation has reached or progressed
+// through a stage
+type Event struct {
+	Stage      Stage
+	Files      int
+	TotalFiles int
+	Bytes      int64
+	// Elapsed is the time spent in the stage so far
+	Elapsed time.Duration
+}
+
+func (e Event) String() string {
+	switch e.Stage {
+	case Hashing:
+		return fmt.Sprintf("hashing %d input files", e.TotalFiles)
+	case Uploading, Downloading:
+		return fmt.Sprintf("%s %d/%d files, %s", e.Stage, e.Files, e.TotalFiles, humanize.Bytes(float64(e.Bytes)))
+	case Running:
+		return fmt.Sprintf("running (%s)", e.Elapsed.Round(time.Second))
+	default:
+		return string(e.Stage)
+	}
+}
+
+// A Func receives the events of an invocation. Calls for one
+// invocation are not concurrent.
+type Func func(Event)
+
+// Report calls f with `e`, if f is non-nil
+func (f Func) Report(e Event) {
+	if f != nil {
+		f(e)
+	}
+}
+
+// TickInterval is how often Tick repeats its event
+var TickInterval = time.Second
+
+// Tick reports `stage` now, and again every TickInterval with the
+// time elapsed since, until the returned function is called. It
+// does nothing if f is nil.
+func (f Func) Tick(stage Stage) (stop func()) {
+	if f == nil {
+		return func() {}
+	}
+	start := time.Now()
+	f(Event{Stage: stage})
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		t := time.NewTicker(TickInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				f(Event{Stage: stage, Elapsed: time.Since(start)})
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
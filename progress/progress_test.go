@@ -0,0 +1,59 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package progress
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvent_String(t *testing.T) {
+	assert.Equal(t, "hashing 3 input files", Event{Stage: Hashing, TotalFiles: 3}.String())
+	assert.Equal(t, "uploading 1/3 files, 1.5KiB", Event{Stage: Uploading, Files: 1, TotalFiles: 3, Bytes: 1536}.String())
+	assert.Equal(t, "running (12s)", Event{Stage: Running, Elapsed: 12300 * time.Millisecond}.String())
+	assert.Equal(t, "invoking", Event{Stage: Invoking}.String())
+}
+
+func TestTick(t *testing.T) {
+	defer func(old time.Duration) { TickInterval = old }(TickInterval)
+	TickInterval = time.Millisecond
+
+	var mu sync.Mutex
+	var events []Event
+	f := Func(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	})
+	stop := f.Tick(Running)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+
+	mu.Lock()
+	n := len(events)
+	mu.Unlock()
+	assert.True(t, n > 1, "got %d events", n)
+	assert.Equal(t, Event{Stage: Running}, events[0])
+	assert.True(t, events[n-1].Elapsed > 0)
+	time.Sleep(5 * time.Millisecond)
+	assert.Len(t, events, n, "no events after stop")
+
+	var nilFunc Func
+	nilFunc.Report(Event{Stage: Done})
+	nilFunc.Tick(Running)()
+}
@@ -16,6 +16,7 @@ package protocol
 
 import (
 	"os"
+	"reflect"
 )
 
 const MaxInlineBlob = 100
@@ -27,9 +28,51 @@ type Blob struct {
 	Err    string `json:"e,omitempty"`
 }
 
+// CompressionZstd names zstd compression for File.Compression
+const CompressionZstd = "zstd"
+
 type File struct {
 	Blob
 	Mode os.FileMode `json:"m,omitempty"`
+
+	// If Compression is non-empty, the Blob holds the file's
+	// contents compressed with the named algorithm, and Size and
+	// Hash describe the uncompressed contents. Both are verified
+	// when the file is materialized.
+	Compression string `json:"c,omitempty"`
+	Size        int64  `json:"z,omitempty"`
+	Hash        string `json:"h,omitempty"`
+
+	// If Extents is non-empty, the file is sparse: it is Size
+	// bytes long and reads as zeros outside of the listed
+	// extents. The Blob is unused.
+	Extents []Extent `json:"x,omitempty"`
+
+	// If Pending is set, the file's blobs are still being
+	// uploaded, and may not be in the store yet. See
+	// InvocationSpec.AsyncUploads.
+	Pending bool `json:"p,omitempty"`
+
+	// MTime, if non-zero, is the file's modification time, in
+	// nanoseconds since the Unix epoch. The runtime sets it on
+	// the outputs it returns, and it is restored when they are
+	// fetched.
+	MTime int64 `json:"t,omitempty"`
+}
+
+// SameFile compares files by contents and mode, ignoring the mtimes
+// they were produced with and whether they are still being uploaded.
+func SameFile(a, b *File) bool {
+	ac, bc := *a, *b
+	ac.MTime, bc.MTime = 0, 0
+	ac.Pending, bc.Pending = false, false
+	return reflect.DeepEqual(ac, bc)
+}
+
+// Extent is a region of a sparse file that holds data.
+type Extent struct {
+	Blob
+	Offset int64 `json:"o"`
 }
 
 type FileAndPath struct {
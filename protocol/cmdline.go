@@ -0,0 +1,49 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cmdline computes the command line a runtime prepends to each
+// job's Args. A packaged runtime, with a Lambda handler, runs the
+// handler; a runtime in a container runs the command it was passed,
+// as `argv`, by the image's CMD.
+//
+// If the command line wraps the tool it runs in a shell, `tool`
+// names that tool; otherwise it is empty, and the tool is the
+// command line's first word.
+func Cmdline(handler string, argv []string) (cmdline []string, tool string) {
+	if handler != "" {
+		return []string{handler}, ""
+	}
+
+	if len(argv) == 3 && argv[0] == "/bin/sh" && argv[1] == "-c" {
+		// The Dockerfile used the [CMD "STRING"]
+		// version of CMD, so it is being evaluated by
+		// /bin/sh -c. In order to be able to append
+		// arguments, we need to munge it a bit.
+		tool := strings.SplitN(argv[2], " ", 2)[0]
+		return []string{
+			"/bin/sh",
+			"-c",
+			fmt.Sprintf(`%s "$@"`, argv[2]),
+			tool,
+		}, tool
+	}
+	return argv, ""
+}
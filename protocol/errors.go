@@ -0,0 +1,96 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// Error is a structured error from the runtime. It is returned as
+// the function's error payload, alongside the errorMessage and
+// errorType fields Lambda itself uses, so that clients can act on
+// specific failures.
+type Error struct {
+	Code    string            `json:"errorCode,omitempty"`
+	Message string            `json:"errorMessage"`
+	Details map[string]string `json:"errorDetails,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Error codes
+const (
+	// The command's arguments and environment exceed the
+	// kernel's ARG_MAX. Details include the size, the limit, and
+	// how far over it the command was.
+	ErrArgMax = "ERR_ARG_MAX"
+	// The command was killed for running out of memory.
+	// Details include the peak memory use observed and the
+	// function's memory size, in MB.
+	ErrOOM = "ERR_OOM"
+	// The command, or its interpreter, can't be executed on
+	// the function's architecture. Details include the path,
+	// and the binary's and the function's architectures.
+	ErrExecFormat = "ERR_EXEC_FORMAT"
+	// Objects the job references are missing from the object
+	// store. Details list their IDs, comma-separated, as "ids".
+	ErrMissingBlob = "ERR_MISSING_BLOB"
+)
+
+// MissingIDs returns the object IDs listed by an ErrMissingBlob
+// error
+func (e *Error) MissingIDs() []string {
+	if e.Code != ErrMissingBlob || e.Details["ids"] == "" {
+		return nil
+	}
+	return strings.Split(e.Details["ids"], ",")
+}
+
+// ParseError extracts a structured Error from a function error
+// payload, returning nil if the payload does not contain one.
+func ParseError(payload []byte) *Error {
+	var e Error
+	if json.Unmarshal(payload, &e) != nil || e.Code == "" {
+		return nil
+	}
+	return &e
+}
+
+// ErrorPayload formats an error the same way aws-lambda-go does, so
+// that clients see the same payloads they always have, adding the
+// code and details of an Error.
+func ErrorPayload(err error) []byte {
+	t := reflect.TypeOf(err)
+	typ := t.Name()
+	if t.Kind() == reflect.Ptr {
+		typ = t.Elem().Name()
+	}
+	var structured Error
+	var pe *Error
+	if errors.As(err, &pe) {
+		structured = *pe
+	}
+	structured.Message = err.Error()
+	payload, _ := json.Marshal(struct {
+		Type string `json:"errorType"`
+		Error
+	}{typ, structured})
+	return payload
+}
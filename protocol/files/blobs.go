@@ -15,18 +15,44 @@
 package files
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 	"unicode/utf8"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/nelhage/llama/internal/bufpool"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/store"
+	"golang.org/x/crypto/blake2b"
 )
 
+var (
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+	encoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(fmt.Sprintf("zstd: init writer: %s", err.Error()))
+	}
+	decoder, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(fmt.Sprintf("zstd: init reader: %s", err.Error()))
+	}
+}
+
 func AppendGet(reqs []store.GetRequest, b *protocol.Blob) []store.GetRequest {
 	if b.Ref != "" {
 		reqs = append(reqs, store.GetRequest{Id: b.Ref})
@@ -34,6 +60,16 @@ func AppendGet(reqs []store.GetRequest, b *protocol.Blob) []store.GetRequest {
 	return reqs
 }
 
+// AppendGetFile appends the requests needed to fetch the contents
+// of `f`, including the extents of a sparse file.
+func AppendGetFile(reqs []store.GetRequest, f *protocol.File) []store.GetRequest {
+	reqs = AppendGet(reqs, &f.Blob)
+	for i := range f.Extents {
+		reqs = AppendGet(reqs, &f.Extents[i].Blob)
+	}
+	return reqs
+}
+
 func ReadBlob(b *protocol.Blob, gets []store.GetRequest) ([]byte, error, []store.GetRequest) {
 	if b.Err != "" {
 		return nil, errors.New(b.Err), gets
@@ -53,22 +89,164 @@ func ReadBlob(b *protocol.Blob, gets []store.GetRequest) ([]byte, error, []store
 	return nil, nil, gets
 }
 
+// Read returns the contents of `b`, fetching them from `st` if they
+// aren't inline.
 func Read(ctx context.Context, st store.Store, b *protocol.Blob) ([]byte, error) {
 	gets := AppendGet(nil, b)
+	if len(gets) > 0 {
+		st.GetObjects(ctx, gets)
+	}
 	data, err, _ := ReadBlob(b, gets)
 	return data, err
 }
 
+// WriteOptions controls how files are materialized to disk.
+type WriteOptions struct {
+	// Sync requests that file contents be fsync()ed before they
+	// are renamed into place.
+	Sync bool
+}
+
 func FetchFile(f *protocol.File, where string, gets []store.GetRequest) (error, []store.GetRequest) {
+	return FetchFileWith(f, where, gets, WriteOptions{})
+}
+
+// FetchFileWith behaves like FetchFile, using the provided
+// WriteOptions.
+func FetchFileWith(f *protocol.File, where string, gets []store.GetRequest, opts WriteOptions) (error, []store.GetRequest) {
+	mode := f.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+	if len(f.Extents) > 0 {
+		return writeSparse(f, where, gets, mode, opts)
+	}
 	data, err, gets := ReadBlob(&f.Blob, gets)
 	if err != nil {
 		return err, gets
 	}
-	mode := f.Mode
-	if mode == 0 {
-		mode = 0644
+	data, err = Decompress(f, data)
+	if err != nil {
+		return err, gets
+	}
+	return writeAtomic(where, mode, fileMTime(f), opts, func(fh *os.File) error {
+		return writeSkippingZeros(fh, data)
+	}), gets
+}
+
+func fileMTime(f *protocol.File) time.Time {
+	if f.MTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, f.MTime)
+}
+
+// TempPrefix marks the temporary files WriteFile creates while a
+// write is in progress.
+const TempPrefix = ".llama-tmp."
+
+// WriteFile atomically replaces `where` with `data`. The contents
+// are written to a temporary file in the same directory and renamed
+// into place only once they have been completely written, so an
+// interrupted write never leaves a truncated file at `where`. Long
+// runs of zeros are left as holes.
+func WriteFile(where string, data []byte, mode os.FileMode, opts WriteOptions) error {
+	return writeAtomic(where, mode, time.Time{}, opts, func(fh *os.File) error {
+		return writeSkippingZeros(fh, data)
+	})
+}
+
+// partialFiles tracks the temporary files of writes in progress
+type partialFiles struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+var partial partialFiles
+
+func (p *partialFiles) add(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paths == nil {
+		p.paths = make(map[string]struct{})
+	}
+	p.paths[path] = struct{}{}
+}
+
+func (p *partialFiles) remove(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.paths, path)
+}
+
+// RemovePartial deletes the temporary files of any writes still in
+// progress, returning how many it removed. It is meant for
+// processes about to exit without letting those writes finish, such
+// as on a second interrupt; writes that fail or are canceled clean
+// up after themselves.
+func RemovePartial() int {
+	partial.mu.Lock()
+	defer partial.mu.Unlock()
+	n := 0
+	for path := range partial.paths {
+		if os.Remove(path) == nil {
+			n++
+		}
 	}
-	return ioutil.WriteFile(where, data, mode), gets
+	partial.paths = nil
+	return n
+}
+
+// WriteStream atomically replaces `where` with whatever `fill`
+// writes, in the same way as WriteFile. If `fill` fails, `where` is
+// left alone.
+func WriteStream(where string, mode os.FileMode, opts WriteOptions, fill func(io.Writer) error) error {
+	return writeAtomic(where, mode, time.Time{}, opts, func(fh *os.File) error {
+		return fill(fh)
+	})
+}
+
+// writeAtomic implements WriteFile, calling `fill` to write the
+// contents of the temporary file. If `mtime` is non-zero, the file
+// is given it as its modification time before it is renamed into
+// place.
+func writeAtomic(where string, mode os.FileMode, mtime time.Time, opts WriteOptions, fill func(*os.File) error) (err error) {
+	dir, base := filepath.Split(where)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, TempPrefix+base+".*")
+	if err != nil {
+		return err
+	}
+	partial.add(tmp.Name())
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		partial.remove(tmp.Name())
+	}()
+	if err = fill(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode.Perm()); err != nil {
+		return err
+	}
+	if opts.Sync {
+		if err = tmp.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		if err = os.Chtimes(tmp.Name(), time.Now(), mtime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), where)
 }
 
 func NewBlob(ctx context.Context, store store.Store, bytes []byte) (*protocol.Blob, error) {
@@ -77,7 +255,7 @@ func NewBlob(ctx context.Context, store store.Store, bytes []byte) (*protocol.Bl
 		return &protocol.Blob{String: string(bytes)}, nil
 	}
 	if base64.StdEncoding.EncodedLen(len(bytes)) < protocol.MaxInlineBlob {
-		return &protocol.Blob{Bytes: bytes}, nil
+		return &protocol.Blob{Bytes: append([]byte(nil), bytes...)}, nil
 	}
 	id, err := store.Store(ctx, bytes)
 	if err != nil {
@@ -86,7 +264,87 @@ func NewBlob(ctx context.Context, store store.Store, bytes []byte) (*protocol.Bl
 	return &protocol.Blob{Ref: id}, nil
 }
 
+func hashContents(data []byte) string {
+	csum := blake2b.Sum256(data)
+	return hex.EncodeToString(csum[:])
+}
+
+// maxDecompressPrealloc bounds how much Decompress allocates up
+// front on the strength of a File's recorded size, which comes from
+// the other end of the wire and may be wrong.
+const maxDecompressPrealloc = 64 << 20
+
+// Decompress returns the uncompressed contents of `f`, given the
+// contents of its Blob, verifying them against the size and hash
+// recorded in the File.
+func Decompress(f *protocol.File, data []byte) ([]byte, error) {
+	switch f.Compression {
+	case "":
+		return data, nil
+	case protocol.CompressionZstd:
+		if f.Size < 0 {
+			return nil, fmt.Errorf("decompressing: invalid size %d", f.Size)
+		}
+		prealloc := f.Size
+		if prealloc > maxDecompressPrealloc {
+			prealloc = maxDecompressPrealloc
+		}
+		var err error
+		data, err = decoder.DecodeAll(data, make([]byte, 0, prealloc))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression: %q", f.Compression)
+	}
+	if int64(len(data)) != f.Size {
+		return nil, fmt.Errorf("decompressing: size mismatch: got %d bytes, expected %d", len(data), f.Size)
+	}
+	if got := hashContents(data); got != f.Hash {
+		return nil, fmt.Errorf("decompressing: hash mismatch: got %s, expected %s", got, f.Hash)
+	}
+	return data, nil
+}
+
+// NewFile constructs a File holding `data`. Neither NewFile nor
+// NewBlob retain `data`, so callers may reuse it. If `compression` is
+// non-empty, contents too large to inline are compressed with the
+// named algorithm before being stored, as long as doing so actually
+// saves space.
+func NewFile(ctx context.Context, store store.Store, data []byte, mode os.FileMode, compression string) (*protocol.File, error) {
+	file := protocol.File{Mode: mode}
+	if compression != "" && len(data) >= protocol.MaxInlineBlob {
+		buf := bufpool.Get()
+		defer bufpool.Put(buf)
+		var compressed []byte
+		switch compression {
+		case protocol.CompressionZstd:
+			compressed = bufpool.Encode(buf, encoder, data)
+		default:
+			return nil, fmt.Errorf("unsupported compression: %q", compression)
+		}
+		if len(compressed) < len(data) {
+			file.Compression = compression
+			file.Size = int64(len(data))
+			file.Hash = hashContents(data)
+			data = compressed
+		}
+	}
+	blob, err := NewBlob(ctx, store, data)
+	if err != nil {
+		return nil, err
+	}
+	file.Blob = *blob
+	return &file, nil
+}
+
 func ReadFile(ctx context.Context, store store.Store, path string) (*protocol.File, error) {
+	return ReadFileCompressed(ctx, store, path, "")
+}
+
+// ReadFileCompressed behaves like ReadFile, compressing the file's
+// contents as described in NewFile.
+func ReadFileCompressed(ctx context.Context, store store.Store, path string, compression string) (*protocol.File, error) {
 	fh, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -100,16 +358,14 @@ func ReadFile(ctx context.Context, store store.Store, path string) (*protocol.Fi
 	if fi.Mode().IsDir() {
 		return nil, errors.New("ReadFile: got directory")
 	}
-	bytes, err := ioutil.ReadAll(fh)
-	if err != nil {
-		return nil, err
+	if extents, ok := sparseExtents(fh, fi); ok {
+		return readSparse(ctx, store, fh, fi, extents)
 	}
-	blob, err := NewBlob(ctx, store, bytes)
-	if err != nil {
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	buf.Grow(int(fi.Size()) + bytes.MinRead)
+	if _, err := buf.ReadFrom(fh); err != nil {
 		return nil, err
 	}
-	return &protocol.File{
-		Blob: *blob,
-		Mode: fi.Mode(),
-	}, nil
+	return NewFile(ctx, store, buf.Bytes(), fi.Mode(), compression)
 }
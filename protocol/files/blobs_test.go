@@ -0,0 +1,323 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	where := path.Join(dir, "out")
+	require.NoError(t, ioutil.WriteFile(where, []byte("old contents"), 0644))
+
+	for _, sync := range []bool{false, true} {
+		err = WriteFile(where, []byte("new"), 0755, WriteOptions{Sync: sync})
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadFile(where)
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(data))
+		fi, err := os.Stat(where)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	}
+
+	// A failed write leaves the destination untouched and no
+	// temporaries behind.
+	require.NoError(t, os.Mkdir(path.Join(dir, "sub"), 0755))
+	err = WriteFile(path.Join(dir, "sub"), []byte("x"), 0644, WriteOptions{})
+	assert.Error(t, err)
+
+	ents, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"out", "sub"}, names)
+}
+
+func TestRemovePartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- WriteStream(path.Join(dir, "out"), 0644, WriteOptions{}, func(w io.Writer) error {
+			w.Write([]byte("partial"))
+			close(started)
+			<-release
+			return errors.New("abandoned")
+		})
+	}()
+	<-started
+	ents, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, ents, 1)
+
+	assert.Equal(t, 1, RemovePartial())
+	ents, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, ents)
+
+	close(release)
+	assert.Error(t, <-done)
+	assert.Equal(t, 0, RemovePartial())
+}
+
+func TestRead(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	small, err := NewBlob(ctx, st, []byte("hi"))
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("x"), 2*protocol.MaxInlineBlob)
+	large, err := NewBlob(ctx, st, data)
+	require.NoError(t, err)
+	require.NotEmpty(t, large.Ref)
+
+	got, err := Read(ctx, st, small)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(got))
+
+	// Blobs too large to inline are fetched from the store,
+	// rather than silently reading as empty.
+	got, err = Read(ctx, st, large)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = Read(ctx, store.InMemory(), large)
+	assert.Error(t, err)
+}
+
+func TestCompressedFile(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	dir, err := ioutil.TempDir("", "llama-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("int main(void) { return 0; }\n"), 1000)
+
+	f, err := NewFile(ctx, st, data, 0644, protocol.CompressionZstd)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.CompressionZstd, f.Compression)
+	assert.Equal(t, int64(len(data)), f.Size)
+
+	fetch := func(f *protocol.File) ([]byte, error) {
+		gets := AppendGet(nil, &f.Blob)
+		st.GetObjects(ctx, gets)
+		where := path.Join(dir, "out")
+		os.Remove(where)
+		if err, _ := FetchFile(f, where, gets); err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(where)
+	}
+
+	got, err := fetch(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	bad := *f
+	bad.Hash = hashContents([]byte("something else"))
+	_, err = fetch(&bad)
+	assert.Error(t, err)
+
+	for _, size := range []int64{-1, f.Size - 1, 1 << 40} {
+		bad := *f
+		bad.Size = size
+		_, err = fetch(&bad)
+		assert.Error(t, err, "size=%d", size)
+	}
+
+	// Small or incompressible contents are stored as-is
+	small, err := NewFile(ctx, st, []byte("hi"), 0644, protocol.CompressionZstd)
+	require.NoError(t, err)
+	assert.Equal(t, "", small.Compression)
+	assert.Equal(t, "hi", small.String)
+
+	_, err = NewFile(ctx, st, data, 0644, "lz4")
+	assert.Error(t, err)
+}
+
+func allocated(t *testing.T, where string) int64 {
+	fi, err := os.Stat(where)
+	require.NoError(t, err)
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseFile(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sparse files are only detected on Linux")
+	}
+	const size = 1 << 30
+
+	ctx := context.Background()
+	st := store.InMemory()
+	dir, err := ioutil.TempDir("", "llama-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "disk.img")
+	fh, err := os.Create(src)
+	require.NoError(t, err)
+	require.NoError(t, fh.Truncate(size))
+	chunk := bytes.Repeat([]byte("data"), 1024)
+	for _, off := range []int64{0, size / 2, size - int64(len(chunk))} {
+		_, err := fh.WriteAt(chunk, off)
+		require.NoError(t, err)
+	}
+	require.NoError(t, fh.Close())
+	if allocated(t, src) >= size {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	file, err := ReadFile(ctx, st, src)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), file.Size)
+	require.NotEmpty(t, file.Extents)
+	var shipped int
+	for _, ext := range file.Extents {
+		data, err := Read(ctx, st, &ext.Blob)
+		require.NoError(t, err)
+		shipped += len(data)
+	}
+	assert.Less(t, shipped, 1<<20)
+
+	dst := path.Join(dir, "copy.img")
+	gets := AppendGetFile(nil, file)
+	st.GetObjects(ctx, gets)
+	err, gets = FetchFile(file, dst, gets)
+	require.NoError(t, err)
+	assert.Empty(t, gets)
+	fi, err := os.Stat(dst)
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), fi.Size())
+	assert.Less(t, allocated(t, dst), int64(1<<20))
+
+	got, err := os.Open(dst)
+	require.NoError(t, err)
+	defer got.Close()
+	buf := make([]byte, len(chunk))
+	for _, off := range []int64{0, size / 2, size - int64(len(chunk))} {
+		_, err := got.ReadAt(buf, off)
+		require.NoError(t, err)
+		assert.Equal(t, chunk, buf)
+	}
+	_, err = got.ReadAt(buf, size/4)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, len(chunk)), buf)
+}
+
+func TestWriteFile_Holes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "llama-files")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, 4<<20)
+	copy(data[1<<20:], "hello")
+	where := path.Join(dir, "out")
+	require.NoError(t, WriteFile(where, data, 0644, WriteOptions{}))
+
+	got, err := ioutil.ReadFile(where)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Less(t, allocated(t, where), int64(len(data)))
+}
+
+func TestAwaitUploads(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	uploaded, err := NewFile(ctx, st, bytes.Repeat([]byte("uploaded"), 1024), 0644, "")
+	require.NoError(t, err)
+	uploaded.Pending = true
+	missing := protocol.File{Blob: protocol.Blob{Ref: "missing"}, Pending: true}
+	inline := protocol.File{Blob: protocol.Blob{String: "inline"}}
+
+	list := protocol.FileList{
+		{Path: "uploaded", File: *uploaded},
+		{Path: "missing", File: missing},
+		{Path: "inline", File: inline},
+	}
+	AwaitUploads(ctx, st, list, 100*time.Millisecond)
+
+	assert.False(t, list[0].Pending)
+	assert.Equal(t, uploaded.Ref, list[0].Ref)
+	assert.False(t, list[1].Pending)
+	assert.Contains(t, list[1].Err, "did not complete")
+	assert.Equal(t, inline, list[2].File)
+}
+
+// unwrapOnly wraps a store without implementing store.Checker, and
+// counts the objects fetched through it.
+type unwrapOnly struct {
+	inner store.Store
+	gets  int
+}
+
+func (u *unwrapOnly) Store(ctx context.Context, obj []byte) (string, error) {
+	return u.inner.Store(ctx, obj)
+}
+
+func (u *unwrapOnly) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	u.gets += len(gets)
+	u.inner.GetObjects(ctx, gets)
+}
+
+func (u *unwrapOnly) FetchAWSUsage(usage *protocol.StoreUsage) {
+	u.inner.FetchAWSUsage(usage)
+}
+
+func (u *unwrapOnly) Unwrap() store.Store {
+	return u.inner
+}
+
+func TestAwaitUploads_Unwraps(t *testing.T) {
+	ctx := context.Background()
+	st := &unwrapOnly{inner: store.InMemory()}
+
+	uploaded, err := NewFile(ctx, st, bytes.Repeat([]byte("uploaded"), 1024), 0644, "")
+	require.NoError(t, err)
+	uploaded.Pending = true
+	list := protocol.FileList{{Path: "uploaded", File: *uploaded}}
+	AwaitUploads(ctx, st, list, 100*time.Millisecond)
+
+	assert.False(t, list[0].Pending)
+	assert.Equal(t, 0, st.gets, "checked for the object by downloading it")
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// DefaultUploadTimeout is how long clients wait for pending
+// uploads by default.
+const DefaultUploadTimeout = 2 * time.Minute
+
+func pendingRefs(f *protocol.File) []string {
+	var refs []string
+	if f.Ref != "" {
+		refs = append(refs, f.Ref)
+	}
+	for _, ext := range f.Extents {
+		if ext.Ref != "" {
+			refs = append(refs, ext.Ref)
+		}
+	}
+	return refs
+}
+
+func hasObject(ctx context.Context, st store.Store, id string) bool {
+	if ch, ok := store.AsChecker(st); ok {
+		found, err := ch.HasObject(ctx, id)
+		return err == nil && found
+	}
+	_, err := store.Get(ctx, st, id)
+	return err == nil
+}
+
+// AwaitUploads waits for the blobs of any Pending files in `list`
+// to appear in the store, polling for up to `timeout`. Files whose
+// uploads complete are no longer Pending; any still missing when
+// time runs out are marked with an error, so that fetching them
+// fails.
+func AwaitUploads(ctx context.Context, st store.Store, list protocol.FileList, timeout time.Duration) {
+	waiting := make(map[int][]string)
+	for i := range list {
+		if list[i].Pending {
+			waiting[i] = pendingRefs(&list[i].File)
+		}
+	}
+	if len(waiting) == 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	delay := 50 * time.Millisecond
+	for {
+		for i, refs := range waiting {
+			for len(refs) > 0 && hasObject(ctx, st, refs[0]) {
+				refs = refs[1:]
+			}
+			if len(refs) == 0 {
+				list[i].Pending = false
+				delete(waiting, i)
+			} else {
+				waiting[i] = refs
+			}
+		}
+		if len(waiting) == 0 || ctx.Err() != nil || !time.Now().Before(deadline) {
+			break
+		}
+		if until := time.Until(deadline); delay > until {
+			delay = until
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > 2*time.Second {
+			delay = 2 * time.Second
+		}
+	}
+	for i := range waiting {
+		list[i].File = protocol.File{
+			Blob: protocol.Blob{Err: fmt.Sprintf("upload did not complete within %s", timeout)},
+		}
+	}
+}
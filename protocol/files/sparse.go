@@ -0,0 +1,135 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nelhage/llama/internal/bufpool"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// Sparse files are shipped as a list of their data extents, so that
+// the holes in a mostly-empty disk image cost nothing to upload or
+// materialize. Finding the holes needs SEEK_DATA and SEEK_HOLE (see
+// sparseExtents); on platforms without them files are read densely,
+// and WriteFile still leaves long runs of zeros as holes.
+
+// Files shorter than this are always read densely
+const sparseMinSize = 64 << 10
+
+// The granularity at which WriteFile looks for runs of zeros
+const holeBlockSize = 4096
+
+var zeroBlock [holeBlockSize]byte
+
+// extent is a range [start, end) of a file that holds data
+type extent struct {
+	start, end int64
+}
+
+func readSparse(ctx context.Context, store store.Store, fh *os.File, fi os.FileInfo, extents []extent) (*protocol.File, error) {
+	file := protocol.File{Mode: fi.Mode(), Size: fi.Size()}
+	if len(extents) == 0 {
+		// A file that is entirely a hole still needs an
+		// extent to mark it as sparse.
+		extents = []extent{{0, 0}}
+	}
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	for _, ext := range extents {
+		buf.Reset()
+		if _, err := buf.ReadFrom(io.NewSectionReader(fh, ext.start, ext.end-ext.start)); err != nil {
+			return nil, err
+		}
+		blob, err := NewBlob(ctx, store, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		file.Extents = append(file.Extents, protocol.Extent{Blob: *blob, Offset: ext.start})
+	}
+	return &file, nil
+}
+
+func writeSparse(f *protocol.File, where string, gets []store.GetRequest, mode os.FileMode, opts WriteOptions) (error, []store.GetRequest) {
+	// Consume the requests for every extent before checking
+	// any of them, so that `gets` stays in step with the
+	// caller's file list even if this file is bad.
+	datas := make([][]byte, len(f.Extents))
+	var firstErr error
+	for i := range f.Extents {
+		var err error
+		datas[i], err, gets = ReadBlob(&f.Extents[i].Blob, gets)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr, gets
+	}
+	return writeAtomic(where, mode, fileMTime(f), opts, func(fh *os.File) error {
+		if err := fh.Truncate(f.Size); err != nil {
+			return err
+		}
+		for i, data := range datas {
+			off := f.Extents[i].Offset
+			if off < 0 || off+int64(len(data)) > f.Size {
+				return fmt.Errorf("extent at %d (%d bytes) is outside of a %d-byte file", off, len(data), f.Size)
+			}
+			if _, err := fh.WriteAt(data, off); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), gets
+}
+
+// writeSkippingZeros writes `data` to `fh`, seeking over blocks
+// of zeros instead of writing them.
+func writeSkippingZeros(fh *os.File, data []byte) error {
+	size := int64(len(data))
+	blockEnd := func(off int64) int64 {
+		if off+holeBlockSize > size {
+			return size
+		}
+		return off + holeBlockSize
+	}
+	isZero := func(off int64) bool {
+		b := data[off:blockEnd(off)]
+		return bytes.Equal(b, zeroBlock[:len(b)])
+	}
+	var off int64
+	for off < size {
+		for off < size && isZero(off) {
+			off = blockEnd(off)
+		}
+		start := off
+		for off < size && !isZero(off) {
+			off = blockEnd(off)
+		}
+		if off > start {
+			if _, err := fh.WriteAt(data[start:off], start); err != nil {
+				return err
+			}
+		}
+	}
+	// Extend the file over any trailing zeros
+	return fh.Truncate(size)
+}
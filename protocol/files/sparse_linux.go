@@ -0,0 +1,59 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// x/sys/unix doesn't define these for Linux at the version we use
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// sparseExtents returns the data extents of `fh`, if it has holes
+// worth preserving.
+func sparseExtents(fh *os.File, fi os.FileInfo) ([]extent, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	size := fi.Size()
+	if !ok || size < sparseMinSize || st.Blocks*512 >= size {
+		return nil, false
+	}
+	var extents []extent
+	var off int64
+	for off < size {
+		start, err := fh.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// No data after `off`
+			break
+		}
+		if err != nil {
+			return nil, false
+		}
+		end, err := fh.Seek(start, seekHole)
+		if err != nil {
+			return nil, false
+		}
+		if end > size {
+			end = size
+		}
+		extents = append(extents, extent{start, end})
+		off = end
+	}
+	return extents, true
+}
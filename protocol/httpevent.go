@@ -0,0 +1,93 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// Function URLs deliver requests to the function as HTTP events,
+// in the 2.0 payload format, and expect HTTP responses back. This
+// lets clients that can't use the Lambda API POST an
+// InvocationSpec to a function URL and read back the
+// InvocationResponse.
+// See https://docs.aws.amazon.com/lambda/latest/dg/urls-invocation.html
+
+// HTTPRequest is the event a function URL delivers. Only the fields
+// llama uses are described.
+type HTTPRequest struct {
+	Version         string            `json:"version"`
+	RawPath         string            `json:"rawPath"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  struct {
+		HTTP struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	} `json:"requestContext"`
+}
+
+// HTTPResponse is the response a function returns to a function URL
+// request
+type HTTPResponse struct {
+	StatusCode      int               `json:"statusCode"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded,omitempty"`
+}
+
+// HeaderFunctionError marks a response to a function URL request
+// whose body is the error payload of a failed invocation. Its value
+// is what the Lambda API would report as the invocation's
+// FunctionError. Errors the function reports to Lambda itself can't
+// reach function URL clients, so the runtime returns them this way
+// instead.
+const HeaderFunctionError = "X-Llama-Function-Error"
+
+// URLTokenEnv names the environment variable holding the shared
+// token that authenticates requests to a function URL, in an
+// `Authorization: Bearer` header. The runtime only checks it if it
+// is set; otherwise it relies on the URL's own IAM authentication.
+const URLTokenEnv = "LLAMA_URL_TOKEN"
+
+// ParseHTTPRequest returns the HTTP event in `payload`, if it is
+// one, as opposed to a bare InvocationSpec
+func ParseHTTPRequest(payload []byte) (*HTTPRequest, bool) {
+	var req HTTPRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, false
+	}
+	if req.Version != "2.0" || req.RequestContext.HTTP.Method == "" {
+		return nil, false
+	}
+	return &req, true
+}
+
+// Header returns the value of the request header `name`. Function
+// URLs deliver header names in lower case.
+func (r *HTTPRequest) Header(name string) string {
+	return r.Headers[strings.ToLower(name)]
+}
+
+// BodyBytes returns the request's body, decoding it if necessary
+func (r *HTTPRequest) BodyBytes() ([]byte, error) {
+	if r.IsBase64Encoded {
+		return base64.StdEncoding.DecodeString(r.Body)
+	}
+	return []byte(r.Body), nil
+}
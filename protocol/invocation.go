@@ -15,6 +15,7 @@
 package protocol
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/nelhage/llama/tracing"
@@ -26,9 +27,199 @@ type InvocationSpec struct {
 	Stdin   *Blob                `json:"stdin,omitempty"`
 	Files   FileList             `json:"files,omitempty"`
 	Outputs []string             `json:"outputs,emitempty"`
+
+	// Sandbox requests that the runtime confine the command to
+	// its workspace as far as the platform allows. The level
+	// actually applied is reported in InvocationResponse.Sandbox.
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// CompressOutputs, if set, names a compression algorithm
+	// (see File.Compression) the runtime should use for large
+	// output files.
+	CompressOutputs string `json:"compress_outputs,omitempty"`
+
+	// Stream requests that the runtime stream the command's
+	// stdout as it is produced, using Lambda response
+	// streaming. The response is then a sequence of StreamFrames
+	// instead of a bare InvocationResponse. The function must be
+	// invoked with InvokeWithResponseStream.
+	Stream bool `json:"stream,omitempty"`
+
+	// ResponseFiles permits the runtime to move arguments into
+	// a response file, passed as `@file`, if the command line
+	// would otherwise exceed ARG_MAX. This is only done for
+	// tools known to accept response files.
+	ResponseFiles bool `json:"response_files,omitempty"`
+
+	// AsyncUploads permits the runtime to respond before large
+	// output files have been uploaded. Such outputs are marked
+	// Pending with the IDs they will be stored under, and the
+	// uploads finish before the runtime accepts its next
+	// invocation. Clients must wait for pending blobs to appear
+	// in the store (see files.AwaitUploads) before fetching them.
+	AsyncUploads bool `json:"async_uploads,omitempty"`
+
+	// Setup and Teardown are commands to run in the job's
+	// workspace before and after the main command, with the same
+	// sandboxing. Setup commands run in order; if one fails, the
+	// job is aborted: neither the main command nor the teardown
+	// commands run, no outputs are collected, and the failing
+	// command's status is reported as the job's ExitStatus. A
+	// failing teardown command only produces a warning. All of
+	// them share the invocation's deadline with the main
+	// command.
+	Setup    [][]string `json:"setup,omitempty"`
+	Teardown [][]string `json:"teardown,omitempty"`
+
+	// The runtime always tells commands how many CPUs the
+	// function's memory size buys, as NPROC and LLAMA_CPUS in
+	// their environment. ExportParallelism additionally sets
+	// GOMAXPROCS, OMP_NUM_THREADS (which nproc(1) honors), and
+	// MAKEFLAGS=-jN.
+	ExportParallelism bool `json:"export_parallelism,omitempty"`
+
+	// Env holds KEY=VALUE settings added to the environment of
+	// the job's commands.
+	Env []string `json:"env,omitempty"`
+
+	// ExpandVars requests that $VAR and ${VAR} references in Args
+	// and in the values of Env be expanded before the command
+	// runs, with $$ standing for a literal $. Variables are
+	// looked up in the command's environment, which always
+	// includes LLAMA_ROOT (the job root), LLAMA_TMPDIR (its
+	// scratch directory), and LLAMA_JOB_ID, as the command sees
+	// them. References to unknown variables are left alone.
+	ExpandVars bool `json:"expand_vars,omitempty"`
+
+	// Nice, if non-zero, is the niceness commands run with.
+	// Negative values need privileges Lambda doesn't grant.
+	Nice int `json:"nice,omitempty"`
+
+	// Repro, if set, requests a reproduction bundle of the
+	// job's workspace if the job fails.
+	Repro *ReproSpec `json:"repro,omitempty"`
+
+	// Worker, if set, runs the job by sending a request to a
+	// persistent worker process instead of starting a command.
+	Worker *WorkerSpec `json:"worker,omitempty"`
+
+	// PersistTrace requests that the runtime trace the job, even
+	// if Trace is unset, and save its spans in the object store
+	// under store.TraceKey(JobID). This is best-effort: if the
+	// spans can't be saved, the job still succeeds, with a
+	// warning.
+	PersistTrace bool `json:"persist_trace,omitempty"`
+
+	// IdempotencyToken, if set, identifies the job across
+	// retries. A runtime that has already completed a job with
+	// the same token returns the earlier response, marked
+	// Replayed, instead of running it again. Runtimes only
+	// remember their own recent jobs, so this only protects
+	// against retries that reach the same container.
+	IdempotencyToken string `json:"idempotency_token,omitempty"`
+
+	// Nested lets the job's commands invoke llama functions
+	// themselves. The runtime gives them the store URL, the
+	// function's name (as FunctionEnv), and the function's
+	// execution-role credentials, even if the job is sandboxed,
+	// and rolls the usage of their invocations up into the
+	// response's Nested field.
+	Nested bool `json:"nested,omitempty"`
+	// Depth counts the invocations between this one and the
+	// client that started the outermost job. Clients fill it in
+	// from NestingDepthEnv; runtimes refuse jobs deeper than
+	// MaxNestingDepth.
+	Depth int `json:"depth,omitempty"`
+
+	// Deterministic declares that the job's outcome depends only
+	// on its spec, so that clients may reuse the result of an
+	// identical earlier job instead of running it again; see
+	// llama.InvokeArgs.Memoize.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	// Route, MemoryMB, and InputBytes help clients that route
+	// jobs among several functions (see llama.Router) pick one:
+	// Route names one explicitly, MemoryMB is the most memory,
+	// in MB, the job is expected to need, and InputBytes is the
+	// total size of its inputs. The runtime ignores them.
+	Route      string `json:"route,omitempty"`
+	MemoryMB   int    `json:"memory_mb,omitempty"`
+	InputBytes int64  `json:"input_bytes,omitempty"`
+}
+
+// WorkerSpec describes a persistent worker. The runtime starts the
+// worker once per container and keeps it running across
+// invocations, so that tools with slow startup only pay for it
+// once.
+//
+// Workers speak a protocol modeled on Bazel's JSON workers: each
+// job is sent as a newline-delimited WorkRequest on the worker's
+// stdin, and the worker answers each with a WorkResponse line on
+// its stdout. Requests carry the job's Args, not prefixed with the
+// function's own command line, and the absolute path of the job's
+// workspace in SandboxDir; the worker must resolve the job's paths
+// against it. Workers don't get stdin and can't be sandboxed.
+type WorkerSpec struct {
+	// Args starts the worker. It runs in a directory of its
+	// own, which outlives any one job; a relative Args[0] is
+	// resolved there.
+	Args []string `json:"args"`
+	// Inputs lists files from the job's FileList that are
+	// copied into the worker's directory before it starts. The
+	// worker is restarted if their contents change.
+	Inputs []string `json:"inputs,omitempty"`
+}
+
+type WorkRequest struct {
+	Arguments  []string `json:"arguments"`
+	RequestID  int      `json:"requestId"`
+	SandboxDir string   `json:"sandboxDir"`
+}
+
+type WorkResponse struct {
+	ExitCode  int    `json:"exitCode"`
+	Output    string `json:"output"`
+	RequestID int    `json:"requestId"`
 }
 
+// HookResult reports the outcome of a Setup or Teardown command
+type HookResult struct {
+	Args       []string `json:"args"`
+	ExitStatus int      `json:"status"`
+	Stdout     *Blob    `json:"stdout,omitempty"`
+	Stderr     *Blob    `json:"stderr,omitempty"`
+}
+
+// StreamFrame is one frame of a streamed invocation response. A
+// streamed response is a sequence of newline-delimited JSON
+// frames. Every frame but the last carries a chunk of stdout; the
+// last carries either the complete InvocationResponse or, if the
+// invocation failed, the same error payload a non-streamed
+// invocation would have returned.
+type StreamFrame struct {
+	Stdout   []byte              `json:"o,omitempty"`
+	Response *InvocationResponse `json:"r,omitempty"`
+	Error    json.RawMessage     `json:"e,omitempty"`
+}
+
+// Sandbox levels reported in InvocationResponse.Sandbox
+const (
+	// The command ran in its own user, mount, and PID
+	// namespaces, chrooted into its workspace with read-only
+	// access to a minimal set of system directories.
+	SandboxNamespace = "namespace"
+	// Namespaces were unavailable. The command ran with a
+	// scrubbed environment and its working directory in its
+	// workspace, and the runtime checked for writes outside of
+	// the workspace after the fact. Absolute paths are not
+	// confined in this mode.
+	SandboxWeak = "weak"
+)
+
 type InvocationResponse struct {
+	// JobID identifies the job among all of the function's
+	// invocations
+	JobID       string         `json:"job_id,omitempty"`
 	ExitStatus  int            `json:"status"`
 	Stdout      *Blob          `json:"stdout,omitempty"`
 	Stderr      *Blob          `json:"stderr,omitempty"`
@@ -37,8 +228,110 @@ type InvocationResponse struct {
 	Spans       *Blob          `json:"spans,omitempty"`
 	Usage       UsageMetrics   `json:"usage"`
 	Times       Timing         `json:"times"`
+	Sandbox     string         `json:"sandbox,omitempty"`
+	Warnings    []string       `json:"warnings,omitempty"`
+	Setup       []HookResult   `json:"setup,omitempty"`
+	Teardown    []HookResult   `json:"teardown,omitempty"`
+	// The CPU count and niceness the command ran with
+	CPUs int `json:"cpus,omitempty"`
+	Nice int `json:"nice,omitempty"`
+	// Signal names the signal that killed the command, such as
+	// "SIGSEGV", if one did; ExitStatus is then -1.
+	Signal string `json:"signal,omitempty"`
+
+	Transfer Transfer `json:"transfer"`
+	// Interrupted is set if the job was cut short because its
+	// container was shut down. Its stdout and outputs are
+	// whatever it produced before then, and the job can safely
+	// be retried.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// Replayed is set if the job had already run, and this is
+	// the response it produced then; see
+	// InvocationSpec.IdempotencyToken.
+	Replayed bool `json:"replayed,omitempty"`
+	// Local is set if the job ran on the client, instead of on
+	// Lambda; see runner.Local.
+	Local bool `json:"local,omitempty"`
+	// Memoized is set if the job didn't run at all, and this is
+	// the stored result of an identical earlier job.
+	Memoized bool `json:"memoized,omitempty"`
+
+	// Nested totals the invocations the job made itself, if it
+	// was Nested and made any.
+	Nested *NestedUsage `json:"nested,omitempty"`
+
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// InterruptedWarning is the warning accompanying an Interrupted
+// response
+const InterruptedWarning = "interrupted by container shutdown"
+
+// Diagnostics holds information to help debug a job
+type Diagnostics struct {
+	Repro  *ReproBundle       `json:"repro,omitempty"`
+	Worker *WorkerDiagnostics `json:"worker,omitempty"`
+
+	Container *ContainerDiagnostics `json:"container,omitempty"`
+}
+
+// ContainerDiagnostics describes the container that ran a job.
+// Whether this was its first invocation is reported by
+// Timing.ColdStart.
+type ContainerDiagnostics struct {
+	// Invocations counts the invocations the container has
+	// served, including this one
+	Invocations int `json:"invocations"`
+	// Init is how long the runtime took to get ready for its
+	// first invocation after it started, of which InitStore was
+	// spent setting up the object store client.
+	Init      time.Duration `json:"init"`
+	InitStore time.Duration `json:"init_store"`
+	// Arch is the runtime's architecture, as named by GOARCH
+	Arch string `json:"arch,omitempty"`
+	// StoreConcurrency is the number of objects the runtime
+	// transfers to or from the store at once.
+	StoreConcurrency int `json:"store_concurrency,omitempty"`
+}
+
+// WorkerDiagnostics describes the worker that ran a job
+type WorkerDiagnostics struct {
+	PID int `json:"pid"`
+	// The number of jobs this worker process has been sent,
+	// including this one
+	Requests int `json:"requests"`
+	// Lifecycle events since the previous job that used this
+	// worker
+	Events []string `json:"events,omitempty"`
+	// The worker's stderr since the previous job, along with
+	// anything it wrote to stdout that wasn't a WorkResponse
+	Stderr *Blob `json:"stderr,omitempty"`
+}
+
+// Transfer describes the objects a job moved through the object
+// store.
+type Transfer struct {
+	// Fetched lists each object the runtime fetched to
+	// materialize the job, in the order they were requested.
+	Fetched []Fetch `json:"fetched,omitempty"`
+}
+
+type Fetch struct {
+	ID    string `json:"id"`
+	Bytes int64  `json:"bytes"`
+	// Cached is set if the object came from the runtime's local
+	// cache rather than the store itself.
+	Cached bool `json:"cached,omitempty"`
+	// Source names the replica of the store the object was read
+	// from, if the runtime has replicas; see StoreReplicasEnv.
+	Source string `json:"source,omitempty"`
 }
 
+// StoreReplicasEnv names the environment variable listing the URLs
+// of replicas of the function's object store, separated by spaces,
+// to read from when it is unavailable; see store.Failover.
+const StoreReplicasEnv = "LLAMA_OBJECT_STORE_REPLICAS"
+
 type StoreUsage struct {
 	Write_Requests uint64
 	Read_Requests  uint64
@@ -52,9 +345,16 @@ type LambdaUsage struct {
 	Requests  uint64
 }
 
+// DiskUsage reports a job's use of local scratch space, measured
+// when the command exits.
+type DiskUsage struct {
+	Scratch_Bytes uint64
+}
+
 type UsageMetrics struct {
 	Lambda LambdaUsage
 	S3     StoreUsage
+	Disk   DiskUsage
 }
 
 type Timing struct {
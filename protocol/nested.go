@@ -0,0 +1,87 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+// Environment variables the runtime sets for a job's commands so
+// that they can invoke llama functions themselves
+const (
+	// NestingDepthEnv holds the Depth that invocations made from
+	// inside the job must carry. The runtime sets it for every
+	// job, nested or not, and llama clients honor it.
+	NestingDepthEnv = "LLAMA_NESTING_DEPTH"
+	// NestedStatsEnv names a file to which clients running inside
+	// a Nested job append a NestedUsage line for each invocation
+	// they complete, for the runtime to roll up into the job's
+	// response.
+	NestedStatsEnv = "LLAMA_NESTED_STATS"
+	// FunctionEnv names the function running a Nested job, as the
+	// default target for its own invocations.
+	FunctionEnv = "LLAMA_FUNCTION"
+)
+
+// MaxNestingDepth is the deepest chain of nested invocations llama
+// allows. Runtimes refuse jobs whose Depth exceeds it, and clients
+// refuse to send them.
+const MaxNestingDepth = 4
+
+// NestedUsage totals the invocations a job made itself, including
+// those made, in turn, by the jobs it started.
+type NestedUsage struct {
+	Invocations int          `json:"invocations"`
+	Failed      int          `json:"failed,omitempty"`
+	Usage       UsageMetrics `json:"usage"`
+	// FetchBytes counts the bytes the nested jobs' runtimes
+	// fetched from the store to materialize them.
+	FetchBytes int64 `json:"fetch_bytes,omitempty"`
+}
+
+// Add adds `o` into `n`
+func (n *NestedUsage) Add(o *NestedUsage) {
+	n.Invocations += o.Invocations
+	n.Failed += o.Failed
+	n.Usage.Add(&o.Usage)
+	n.FetchBytes += o.FetchBytes
+}
+
+// Add adds `o` into `u`
+func (u *UsageMetrics) Add(o *UsageMetrics) {
+	u.Lambda.Millis += o.Lambda.Millis
+	u.Lambda.MB_Millis += o.Lambda.MB_Millis
+	u.Lambda.Requests += o.Lambda.Requests
+	u.S3.Write_Requests += o.S3.Write_Requests
+	u.S3.Read_Requests += o.S3.Read_Requests
+	u.S3.Xfer_In += o.S3.Xfer_In
+	u.S3.Xfer_Out += o.S3.Xfer_Out
+	u.Disk.Scratch_Bytes += o.Disk.Scratch_Bytes
+}
+
+// NestedRecord summarizes one completed invocation `resp` as a
+// NestedUsage, including the nested invocations it made. `failed`
+// reports whether the job failed.
+func NestedRecord(resp *InvocationResponse, failed bool) NestedUsage {
+	rec := NestedUsage{Invocations: 1, Usage: resp.Usage}
+	if failed {
+		rec.Failed = 1
+	}
+	for _, f := range resp.Transfer.Fetched {
+		if !f.Cached {
+			rec.FetchBytes += f.Bytes
+		}
+	}
+	if resp.Nested != nil {
+		rec.Add(resp.Nested)
+	}
+	return rec
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// NormalizePath converts a path that may use Windows-style `\`
+// separators into a clean, slash-separated path. Paths in a job spec
+// treat `\` as a separator on every platform, so the client and the
+// runtime must both canonicalize them with this function; a literal
+// `\` can never appear in a remote filename.
+func NormalizePath(p string) string {
+	return path.Clean(strings.ReplaceAll(p, `\`, "/"))
+}
+
+// IsAbs reports whether the slash-separated path `p` is absolute,
+// counting Windows drive-letter paths such as C:/src.
+func IsAbs(p string) bool {
+	if path.IsAbs(p) {
+		return true
+	}
+	return len(p) >= 2 && p[1] == ':' &&
+		(('a' <= p[0] && p[0] <= 'z') || ('A' <= p[0] && p[0] <= 'Z'))
+}
+
+// CleanPath canonicalizes a path from a FileList or output list
+// using NormalizePath, and verifies that it names a location inside
+// the job root.
+func CleanPath(p string) (string, error) {
+	clean := NormalizePath(p)
+	if IsAbs(clean) {
+		return "", fmt.Errorf("path must be relative: %q", p)
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path is outside the job root: %q", p)
+	}
+	if clean == "." {
+		return "", fmt.Errorf("path names the job root: %q", p)
+	}
+	return clean, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		ok  bool
+	}{
+		{"a.txt", "a.txt", true},
+		{`src\main.c`, "src/main.c", true},
+		{`src\lib/util.c`, "src/lib/util.c", true},
+		{`.\src\\main.c`, "src/main.c", true},
+		{"a/./b/../c", "a/c", true},
+		{`a\..\..\etc\passwd`, "", false},
+		{"../x", "", false},
+		{"/etc/passwd", "", false},
+		{`\etc\passwd`, "", false},
+		{`C:\src\main.c`, "", false},
+		{"c:/src", "", false},
+		{".", "", false},
+	}
+	for _, tc := range tests {
+		got, err := CleanPath(tc.in)
+		if tc.ok {
+			assert.NoError(t, err, "CleanPath(%q)", tc.in)
+			assert.Equal(t, tc.out, got, "CleanPath(%q)", tc.in)
+		} else {
+			assert.Error(t, err, "CleanPath(%q)", tc.in)
+		}
+	}
+}
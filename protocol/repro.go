@@ -0,0 +1,71 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+// A reproduction bundle is a gzipped tarball of a failed job's
+// workspace, as it was when the command exited, so that the job can
+// be re-run locally. It contains a ReproManifest at
+// ReproManifestPath and, if the job had any, its stdin at
+// ReproStdinPath.
+
+const (
+	ReproManifestPath = ".llama-repro.json"
+	ReproStdinPath    = ".llama-repro.stdin"
+
+	// DefaultReproMaxBytes is the default cap on the size of
+	// the files in a bundle.
+	DefaultReproMaxBytes = 64 << 20
+)
+
+type ReproSpec struct {
+	// ExcludeInputs leaves the files shipped with the job out
+	// of the bundle, since the client already has them.
+	ExcludeInputs bool `json:"exclude_inputs,omitempty"`
+	// MaxBytes caps the total size of the files in the
+	// bundle. Files past the cap are omitted. Zero means
+	// DefaultReproMaxBytes.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// ReproBundle references a stored reproduction bundle
+type ReproBundle struct {
+	// The bundle's ID in the object store
+	Ref string `json:"ref,omitempty"`
+	// Err is set if the bundle couldn't be built
+	Err string `json:"err,omitempty"`
+	// The number of bytes stored
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+type ReproManifest struct {
+	// Args is the command line that ran, after the runtime
+	// prepended the function's own command, relative to the
+	// root of the workspace.
+	Args []string `json:"args"`
+	// Env holds the variables the runtime added to the
+	// command's environment.
+	Env []string `json:"env,omitempty"`
+	// Stdin is true if the job had stdin, stored at
+	// ReproStdinPath.
+	Stdin bool `json:"stdin,omitempty"`
+	// ExitStatus is the status the command failed with
+	ExitStatus int `json:"status"`
+	// Excluded lists the inputs left out at the client's
+	// request.
+	Excluded []string `json:"excluded,omitempty"`
+	// Omitted lists files left out because the bundle reached
+	// its size cap.
+	Omitted []string `json:"omitted,omitempty"`
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+
+	"github.com/nelhage/llama/protocol"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// The kernel refuses any single argument or environment
+	// string longer than MAX_ARG_STRLEN (32 pages).
+	maxArgStrlen = 32 * 4096
+	// ARG_MAX is a quarter of the stack limit, but never less
+	// than 32 pages and never more than 3/4 of the default 8MB
+	// stack limit.
+	minArgMax = 32 * 4096
+	maxArgMax = 6 << 20
+)
+
+// systemArgMax computes the kernel's limit on the combined size of
+// argv and envp, the same way execve(2) does.
+func systemArgMax() int {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_STACK, &lim); err != nil {
+		return minArgMax
+	}
+	max := uint64(maxArgMax)
+	if lim.Cur/4 < max {
+		max = lim.Cur / 4
+	}
+	if max < minArgMax {
+		max = minArgMax
+	}
+	return int(max)
+}
+
+// execSize computes the space execve(2) needs for a set of strings:
+// the strings themselves, their NUL terminators, and the pointer
+// array.
+func execSize(strs []string) int {
+	size := 0
+	for _, s := range strs {
+		size += len(s) + 1 + 8
+	}
+	return size
+}
+
+func environ(cmd *exec.Cmd) []string {
+	if cmd.Env != nil {
+		return cmd.Env
+	}
+	return os.Environ()
+}
+
+// checkArgMax reports a structured ErrArgMax error if `cmd` can't
+// be exec()ed because its arguments and environment are too large.
+func checkArgMax(cmd *exec.Cmd, limit int) error {
+	for i, arg := range cmd.Args {
+		if len(arg) > maxArgStrlen {
+			return &protocol.Error{
+				Code:    protocol.ErrArgMax,
+				Message: fmt.Sprintf("argument %d is %d bytes long, over the kernel's limit of %d bytes per argument", i, len(arg), maxArgStrlen),
+				Details: map[string]string{
+					"arg_index": strconv.Itoa(i),
+					"size":      strconv.Itoa(len(arg)),
+					"limit":     strconv.Itoa(maxArgStrlen),
+					"over":      strconv.Itoa(len(arg) - maxArgStrlen),
+				},
+			}
+		}
+	}
+	args, env := execSize(cmd.Args), execSize(environ(cmd))
+	if args+env <= limit {
+		return nil
+	}
+	return &protocol.Error{
+		Code: protocol.ErrArgMax,
+		Message: fmt.Sprintf("command line too long: %d bytes of arguments and %d bytes of environment exceed ARG_MAX (%d bytes) by %d bytes; set response_files in the spec to pass arguments via a response file",
+			args, env, limit, args+env-limit),
+		Details: map[string]string{
+			"args_size": strconv.Itoa(args),
+			"env_size":  strconv.Itoa(env),
+			"limit":     strconv.Itoa(limit),
+			"over":      strconv.Itoa(args + env - limit),
+		},
+	}
+}
+
+// Tools that read arguments from `@file`. The GNU toolchain and
+// clang all share libiberty's quoting rules, which writeResponseFile
+// implements. Cross-compiler prefixes ("aarch64-linux-gnu-") and
+// version suffixes ("-10") are allowed.
+var responseFileTools = regexp.MustCompile(`^([\w.]+-)*(gcc|g\+\+|cc|c\+\+|cpp|clang|clang\+\+|ld|ld\.bfd|ld\.gold|ld\.lld|lld|ar|nm|objcopy|strip)(-[\d.]+)?$`)
+
+func acceptsResponseFile(tool string) bool {
+	return responseFileTools.MatchString(path.Base(tool))
+}
+
+// quoteResponseArg quotes an argument for a GNU-style response file
+func quoteResponseArg(arg string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(arg) {
+		switch c {
+		case ' ', '\t', '\n', '\r', '\f', '\v', '\'', '"', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	if arg == "" {
+		return `""`
+	}
+	return buf.String()
+}
+
+// writeResponseFile moves `args` into a response file in the job
+// root, returning the `@file` argument that replaces them. The path
+// is relative, since the command runs in the job root.
+func (p *ParsedJob) writeResponseFile(args []string) (string, error) {
+	fh, err := ioutil.TempFile(p.Root, ".llama-args.*.rsp")
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	var buf bytes.Buffer
+	for _, arg := range args {
+		buf.WriteString(quoteResponseArg(arg))
+		buf.WriteByte('\n')
+	}
+	if _, err := fh.Write(buf.Bytes()); err != nil {
+		return "", err
+	}
+	return "@" + path.Base(fh.Name()), nil
+}
+
+// fitArgMax ensures that `cmd` fits within ARG_MAX. If it doesn't,
+// and the spec permits it, the job's own arguments (the last
+// `movable` entries of cmd.Args) are moved into a response file if
+// `tool` is known to accept one.
+func (r *Runtime) fitArgMax(cmd *exec.Cmd, job *ParsedJob, spec *protocol.InvocationSpec, tool string, movable int) error {
+	limit := r.argMax
+	if limit == 0 {
+		limit = systemArgMax()
+	}
+	err := checkArgMax(cmd, limit)
+	if err == nil || !spec.ResponseFiles || movable == 0 || !acceptsResponseFile(tool) {
+		return err
+	}
+	keep := len(cmd.Args) - movable
+	rsp, werr := job.writeResponseFile(cmd.Args[keep:])
+	if werr != nil {
+		return fmt.Errorf("writing response file: %w", werr)
+	}
+	cmd.Args = append(cmd.Args[:keep:keep], rsp)
+	return checkArgMax(cmd, limit)
+}
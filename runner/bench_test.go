@@ -0,0 +1,111 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+)
+
+// BenchmarkRunOne runs a small spec end-to-end against an in-memory
+// store, to track per-invocation allocations on the hot path.
+func BenchmarkRunOne(b *testing.B) {
+	ctx := context.Background()
+	st := store.InMemory()
+	input, _ := files.NewBlob(ctx, st, bytes.Repeat([]byte("x"), 4096))
+	r := Runtime{store: st}
+	defaultLogger = newLogger(ioutil.Discard, false)
+	defer func() { defaultLogger = newLogger(os.Stderr, false) }()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		spec := protocol.InvocationSpec{
+			Args: []string{"/bin/sh", "-c", "cat in.txt in.txt in.txt in.txt; cp in.txt out.txt"},
+			Files: protocol.FileList{
+				{Path: "in.txt", File: protocol.File{Blob: *input}},
+			},
+			Outputs: []string{"out.txt"},
+		}
+		resp, err := r.RunOne(ctx, &spec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if resp.ExitStatus != 0 {
+			b.Fatalf("exit=%d", resp.ExitStatus)
+		}
+	}
+}
+
+// BenchmarkCompressOutput measures compressing an output that is
+// already in memory, which encodes into a pooled scratch buffer.
+// What remains is the in-memory store's own copy of the object.
+//
+//	before keeping EncodeAll's result in the pool: 639480 B/op  8 allocs/op
+//	after:                                          49650 B/op  7 allocs/op
+func BenchmarkCompressOutput(b *testing.B) {
+	ctx := context.Background()
+	st := store.InMemory()
+	var data bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&data, "%d\n", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := files.NewFile(ctx, st, data.Bytes(), 0644, protocol.CompressionZstd); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHandle additionally includes the runtime API round-trip.
+func BenchmarkHandle(b *testing.B) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+	defaultLogger = newLogger(ioutil.Discard, false)
+	defer func() { defaultLogger = newLogger(os.Stderr, false) }()
+
+	srv, _ := fakeRuntimeAPI(b, &protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", "head -c 16384 /dev/zero"},
+	}, b.N)
+	defer srv.Close()
+	api := newRuntimeAPI(strings.TrimPrefix(srv.URL, "http://"))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inv, err := api.next(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := r.handle(ctx, api, inv); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
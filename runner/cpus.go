@@ -0,0 +1,118 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/nelhage/llama/internal/bufpool"
+	"github.com/nelhage/llama/store/s3store"
+	"golang.org/x/sys/unix"
+)
+
+// Lambda allocates CPU in proportion to memory, one vCPU's worth
+// per 1,769MB, but the host's cores are all visible, so nproc(1)
+// and runtime.NumCPU overstate what a function can use.
+const (
+	mbPerCPU      = 1769
+	maxLambdaCPUs = 6
+)
+
+// effectiveCPUs computes the number of CPUs the function's memory
+// size buys, rounded to the nearest whole CPU.
+func effectiveCPUs() int {
+	n := runtime.NumCPU()
+	mem, err := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))
+	if err != nil || mem <= 0 {
+		return n
+	}
+	cpus := (mem + mbPerCPU/2) / mbPerCPU
+	if cpus > maxLambdaCPUs {
+		cpus = maxLambdaCPUs
+	}
+	if cpus > n {
+		cpus = n
+	}
+	if cpus < 1 {
+		cpus = 1
+	}
+	return cpus
+}
+
+// StoreTuning picks how many objects the runtime moves to or from
+// the store at once, and the largest scratch buffer it keeps
+// around, in proportion to the function's memory size. The
+// concurrency can be set explicitly with LLAMA_STORE_CONCURRENCY.
+func StoreTuning() (concurrency int, retain int) {
+	concurrency, retain = s3store.DefaultConcurrency, bufpool.MaxRetained
+	if mem, err := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")); err == nil && mem > 0 {
+		// One request in flight per 64MB, and buffers of
+		// up to 1/64th of memory.
+		concurrency = clamp(mem/64, 2, s3store.DefaultConcurrency)
+		retain = clamp(mem<<20/64, 1<<20, bufpool.MaxRetained)
+	}
+	if n, err := strconv.Atoi(os.Getenv("LLAMA_STORE_CONCURRENCY")); err == nil && n > 0 {
+		concurrency = n
+	}
+	return concurrency, retain
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+func cpuEnv(cpus int, parallelism bool) []string {
+	n := strconv.Itoa(cpus)
+	env := []string{"NPROC=" + n, "LLAMA_CPUS=" + n}
+	if parallelism {
+		env = append(env, "GOMAXPROCS="+n, "OMP_NUM_THREADS="+n, "MAKEFLAGS=-j"+n)
+	}
+	return env
+}
+
+// startCommand starts `cmd` with niceness `nice`.
+//
+// Niceness is per-thread on Linux and inherited across fork, and an
+// unprivileged thread can't undo an increase. So we start the
+// command from a dedicated OS thread, renice it, and then let it be
+// discarded: a goroutine that exits while locked to its thread takes
+// the thread with it.
+func startCommand(cmd *exec.Cmd, nice int) error {
+	if nice == 0 {
+		return cmd.Start()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, nice); err != nil {
+			errc <- fmt.Errorf("setting niceness %d: %w", nice, err)
+			return
+		}
+		errc <- cmd.Start()
+	}()
+	return <-errc
+}
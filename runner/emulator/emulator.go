@@ -0,0 +1,697 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Package emulator runs llama's runtime behind a local emulation of
+// the Lambda runtime and Invoke APIs, so that tests can drive the
+// client's invoke path and the runtime's job loop against each
+// other without an AWS account.
+//
+// An Emulator serves one function. Like Lambda, it starts a
+// container, here a runner.Runtime serving the runtime API, for
+// each invocation that arrives while every existing container is
+// busy, and reuses idle containers for later invocations. Each
+// invocation is given a deadline the function's Timeout from when
+// it arrives; a container that misses it is killed, and the
+// invocation fails with a timeout, as it would on Lambda.
+package emulator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/runner"
+	"github.com/nelhage/llama/store"
+)
+
+type Options struct {
+	// Function is the name the function is invoked as; it
+	// defaults to "llama".
+	Function string
+	// Store defaults to a fresh store.InMemory().
+	Store store.Store
+	// Cmdline is the function's own command line, as its
+	// handler would set it, and Tool the program it wraps; see
+	// runner.Options.
+	Cmdline []string
+	Tool    string
+	// Timeout is the function's timeout; it defaults to a
+	// minute.
+	Timeout time.Duration
+	// MaxConcurrency, if positive, bounds the number of
+	// containers. Invocations that arrive while that many are
+	// busy are throttled.
+	MaxConcurrency int
+	// URLToken, if set, is the token requests to the function
+	// URL must present; see runner.Options.
+	URLToken string
+}
+
+type Emulator struct {
+	opts Options
+	srv  *httptest.Server
+	svc  *lambda.Lambda
+
+	mu sync.Mutex
+	// changed is signalled when a container becomes idle or is
+	// killed
+	changed     *sync.Cond
+	containers  []*container
+	started     int
+	nextID      int
+	invocations map[string]*invocation
+
+	wg sync.WaitGroup
+}
+
+type container struct {
+	id     int
+	ctx    context.Context
+	cancel context.CancelFunc
+	// jobs holds the invocation assigned to the container, until
+	// it asks for it. idle is set while it waits for one to be
+	// assigned.
+	jobs chan *invocation
+	idle bool
+	// answered is set once the container has responded to its
+	// invocation, until it asks for the next one. Before it
+	// does, the runtime finishes up after the job, such as
+	// uploading deferred outputs.
+	answered bool
+	// retired containers are killed, instead of being given
+	// another invocation, once they finish their current one
+	retired bool
+}
+
+type invocation struct {
+	id       string
+	payload  []byte
+	deadline time.Time
+	c        *container
+
+	// started is closed once the runtime begins to respond,
+	// after failed records whether it reported an error. The
+	// body of its response arrives on r.
+	started chan struct{}
+	failed  bool
+	r       *io.PipeReader
+	w       *io.PipeWriter
+
+	// done is set once the client has its response; timedOut
+	// is closed if the deadline passes first.
+	done     bool
+	timedOut chan struct{}
+}
+
+var errTimedOut = errors.New("invocation timed out")
+
+// New starts an Emulator. Callers must Close it when they are done.
+func New(opts Options) *Emulator {
+	if opts.Function == "" {
+		opts.Function = "llama"
+	}
+	if opts.Store == nil {
+		opts.Store = store.InMemory()
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Minute
+	}
+	e := &Emulator{
+		opts:        opts,
+		invocations: make(map[string]*invocation),
+	}
+	e.changed = sync.NewCond(&e.mu)
+	e.srv = httptest.NewServer(http.HandlerFunc(e.serveHTTP))
+	e.svc = lambda.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(e.srv.URL),
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	return e
+}
+
+// Lambda returns a client for the emulated Lambda API, to pass to
+// llama.Invoke.
+func (e *Emulator) Lambda() *lambda.Lambda {
+	return e.svc
+}
+
+// Store returns the store the emulated function's containers use.
+func (e *Emulator) Store() store.Store {
+	return e.opts.Store
+}
+
+// FunctionURL returns the emulated function's function URL, which
+// accepts requests from any client, as for a function URL with
+// auth type NONE.
+func (e *Emulator) FunctionURL() string {
+	return e.srv.URL + "/url/" + e.opts.Function + "/"
+}
+
+// Function returns the emulated function's name.
+func (e *Emulator) Function() string {
+	return e.opts.Function
+}
+
+// Starts returns the number of containers started so far; each
+// served at least one cold invocation.
+func (e *Emulator) Starts() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.started
+}
+
+// Reset retires all containers, so that the next invocation
+// starts cold, as it would after the function's configuration
+// changed. Busy containers finish their current invocation first.
+func (e *Emulator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range append([]*container(nil), e.containers...) {
+		c.retired = true
+		if c.idle {
+			e.kill(c)
+		}
+	}
+}
+
+// Close kills all containers and waits for them to exit, and shuts
+// down the emulator's server.
+func (e *Emulator) Close() {
+	e.mu.Lock()
+	for len(e.containers) > 0 {
+		e.kill(e.containers[0])
+	}
+	e.mu.Unlock()
+	e.wg.Wait()
+	e.srv.Close()
+}
+
+// kill stops a container. e.mu must be held.
+func (e *Emulator) kill(c *container) {
+	c.cancel()
+	e.changed.Broadcast()
+	for i, o := range e.containers {
+		if o == c {
+			e.containers = append(e.containers[:i], e.containers[i+1:]...)
+			break
+		}
+	}
+}
+
+// start starts a container. e.mu must be held.
+func (e *Emulator) start() *container {
+	e.started++
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &container{
+		id:     e.started,
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   make(chan *invocation, 1),
+	}
+	e.containers = append(e.containers, c)
+	rt := runner.New(runner.Options{
+		Store:       e.opts.Store,
+		Cmdline:     e.opts.Cmdline,
+		Tool:        e.opts.Tool,
+		Concurrency: store.Concurrency(e.opts.Store),
+		Started:     time.Now(),
+		Shared:      true,
+		URLToken:    e.opts.URLToken,
+	})
+	address := fmt.Sprintf("%s/c/%d", strings.TrimPrefix(e.srv.URL, "http://"), c.id)
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		rt.Serve(ctx, address)
+		e.mu.Lock()
+		e.kill(c)
+		e.mu.Unlock()
+	}()
+	return c
+}
+
+// busy counts the containers that aren't waiting for an
+// invocation. e.mu must be held.
+func (e *Emulator) busy() int {
+	n := 0
+	for _, c := range e.containers {
+		if !c.idle {
+			n++
+		}
+	}
+	return n
+}
+
+// submit assigns an invocation to an idle container, or a new one.
+// It returns nil if the invocation is throttled.
+//
+// A container that has answered its last invocation, but not yet
+// asked for another, will be idle shortly, so we wait for it, for up
+// to the function's timeout, rather than starting a new one: a
+// client's next invocation would otherwise race with the previous
+// one's cleanup for a warm container.
+func (e *Emulator) submit(payload []byte) *invocation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	deadline := time.Now().Add(e.opts.Timeout)
+	var c *container
+	for {
+		finishing := false
+		for _, o := range e.containers {
+			if o.retired {
+				continue
+			}
+			if o.idle {
+				c = o
+				break
+			}
+			finishing = finishing || o.answered
+		}
+		if c != nil || !finishing || !time.Now().Before(deadline) {
+			break
+		}
+		t := time.AfterFunc(time.Until(deadline), func() {
+			e.mu.Lock()
+			e.changed.Broadcast()
+			e.mu.Unlock()
+		})
+		e.changed.Wait()
+		t.Stop()
+	}
+	if c == nil {
+		if e.opts.MaxConcurrency > 0 && e.busy() >= e.opts.MaxConcurrency {
+			return nil
+		}
+		c = e.start()
+	}
+	c.idle = false
+	e.nextID++
+	inv := &invocation{
+		id:       fmt.Sprintf("%08x-emulated", e.nextID),
+		payload:  payload,
+		deadline: time.Now().Add(e.opts.Timeout),
+		c:        c,
+		started:  make(chan struct{}),
+		timedOut: make(chan struct{}),
+	}
+	inv.r, inv.w = io.Pipe()
+	e.invocations[inv.id] = inv
+	c.jobs <- inv
+	return inv
+}
+
+// expire fails an invocation whose deadline has passed, killing
+// its container.
+func (e *Emulator) expire(inv *invocation) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if inv.done {
+		return
+	}
+	inv.done = true
+	close(inv.timedOut)
+	inv.w.CloseWithError(errTimedOut)
+	delete(e.invocations, inv.id)
+	e.kill(inv.c)
+}
+
+func (e *Emulator) finish(inv *invocation) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	inv.done = true
+	delete(e.invocations, inv.id)
+}
+
+// wait waits for the runtime to begin its response, reporting
+// false if the deadline passes first.
+func (inv *invocation) wait(ctx context.Context) bool {
+	select {
+	case <-inv.started:
+		return true
+	case <-inv.timedOut:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (inv *invocation) timeoutMessage(timeout time.Duration) []byte {
+	msg, _ := json.Marshal(map[string]string{
+		"errorMessage": fmt.Sprintf("%s %s Task timed out after %.2f seconds",
+			time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), inv.id, timeout.Seconds()),
+	})
+	return msg
+}
+
+func (e *Emulator) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) >= 4 && parts[0] == "c" && parts[2] == "2018-06-01" && parts[3] == "runtime":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			break
+		}
+		e.serveRuntime(w, r, id, parts[4:])
+		return
+	case len(parts) >= 2 && parts[0] == "url":
+		if parts[1] != e.opts.Function {
+			http.NotFound(w, r)
+			return
+		}
+		e.serveURL(w, r, "/"+strings.Join(parts[2:], "/"))
+		return
+	case len(parts) == 4 && parts[1] == "functions" && r.Method == "POST":
+		if parts[2] != e.opts.Function {
+			writeError(w, http.StatusNotFound, lambda.ErrCodeResourceNotFoundException,
+				"Function not found: "+parts[2])
+			return
+		}
+		switch {
+		case parts[0] == "2015-03-31" && parts[3] == "invocations":
+			e.serveInvoke(w, r)
+			return
+		case parts[0] == "2021-11-15" && parts[3] == "response-streaming-invocations":
+			e.serveInvokeStream(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("X-Amzn-Errortype", code)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"Type": "User", "message": message})
+}
+
+// invoke reads and submits an invocation, writing an error and
+// returning nil if it can't be.
+func (e *Emulator) invoke(w http.ResponseWriter, r *http.Request) *invocation {
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, lambda.ErrCodeInvalidRequestContentException, err.Error())
+		return nil
+	}
+	inv := e.submit(payload)
+	if inv == nil {
+		writeError(w, http.StatusTooManyRequests, lambda.ErrCodeTooManyRequestsException, "Rate Exceeded.")
+		return nil
+	}
+	return inv
+}
+
+func (e *Emulator) serveInvoke(w http.ResponseWriter, r *http.Request) {
+	inv := e.invoke(w, r)
+	if inv == nil {
+		return
+	}
+	t := time.AfterFunc(time.Until(inv.deadline), func() { e.expire(inv) })
+	defer t.Stop()
+	defer e.finish(inv)
+
+	var body []byte
+	var err error
+	if inv.wait(r.Context()) {
+		body, err = ioutil.ReadAll(inv.r)
+	} else {
+		err = errTimedOut
+	}
+	w.Header().Set("X-Amz-Executed-Version", "$LATEST")
+	switch {
+	case errors.Is(err, errTimedOut):
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+		body = inv.timeoutMessage(e.opts.Timeout)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, lambda.ErrCodeServiceException, err.Error())
+		return
+	case inv.failed:
+		w.Header().Set("X-Amz-Function-Error", "Unhandled")
+	}
+	w.Write(body)
+}
+
+// serveURL serves a request to the function URL, delivering it to
+// the function as an HTTP event and translating its response back.
+func (e *Emulator) serveURL(w http.ResponseWriter, r *http.Request, path string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	event := protocol.HTTPRequest{
+		Version:         "2.0",
+		RawPath:         path,
+		Headers:         make(map[string]string),
+		Body:            base64.StdEncoding.EncodeToString(body),
+		IsBase64Encoded: true,
+	}
+	event.RequestContext.HTTP.Method = r.Method
+	for k := range r.Header {
+		event.Headers[strings.ToLower(k)] = r.Header.Get(k)
+	}
+	payload, err := json.Marshal(&event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	inv := e.submit(payload)
+	if inv == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"Message":"Rate Exceeded."}`))
+		return
+	}
+	t := time.AfterFunc(time.Until(inv.deadline), func() { e.expire(inv) })
+	defer t.Stop()
+	defer e.finish(inv)
+
+	var out []byte
+	if inv.wait(r.Context()) {
+		out, err = ioutil.ReadAll(inv.r)
+	} else {
+		err = errTimedOut
+	}
+	var resp protocol.HTTPResponse
+	if err == nil && !inv.failed {
+		err = json.Unmarshal(out, &resp)
+	}
+	// Like Lambda, we don't pass on errors, or responses we
+	// can't make sense of.
+	if err != nil || inv.failed {
+		http.Error(w, "Internal Server Error", http.StatusBadGateway)
+		return
+	}
+	data := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		if data, err = base64.StdEncoding.DecodeString(resp.Body); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusBadGateway)
+			return
+		}
+	}
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(data)
+}
+
+func (e *Emulator) serveInvokeStream(w http.ResponseWriter, r *http.Request) {
+	inv := e.invoke(w, r)
+	if inv == nil {
+		return
+	}
+	t := time.AfterFunc(time.Until(inv.deadline), func() { e.expire(inv) })
+	defer t.Stop()
+	defer e.finish(inv)
+
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	w.Header().Set("X-Amz-Executed-Version", "$LATEST")
+	w.WriteHeader(http.StatusOK)
+	enc := eventstream.NewEncoder(w)
+	event := func(typ string, payload []byte) {
+		var msg eventstream.Message
+		msg.Headers.Set(":message-type", eventstream.StringValue("event"))
+		msg.Headers.Set(":event-type", eventstream.StringValue(typ))
+		msg.Headers.Set(":content-type", eventstream.StringValue("application/octet-stream"))
+		msg.Payload = payload
+		enc.Encode(msg)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	complete := func(code string, details []byte) {
+		payload, _ := json.Marshal(map[string]string{
+			"ErrorCode":    code,
+			"ErrorDetails": string(details),
+		})
+		event("InvokeComplete", payload)
+	}
+
+	if !inv.wait(r.Context()) {
+		complete("Function.Timeout", inv.timeoutMessage(e.opts.Timeout))
+		return
+	}
+	if inv.failed {
+		body, err := ioutil.ReadAll(inv.r)
+		if errors.Is(err, errTimedOut) {
+			complete("Function.Timeout", inv.timeoutMessage(e.opts.Timeout))
+		} else {
+			complete("Unhandled", body)
+		}
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := inv.r.Read(buf)
+		if n > 0 {
+			event("PayloadChunk", buf[:n])
+		}
+		if err == io.EOF {
+			complete("", nil)
+			return
+		}
+		if err != nil {
+			complete("Function.Timeout", inv.timeoutMessage(e.opts.Timeout))
+			return
+		}
+	}
+}
+
+func (e *Emulator) container(id int) *container {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range e.containers {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// serveRuntime serves container `id`'s runtime API.
+func (e *Emulator) serveRuntime(w http.ResponseWriter, r *http.Request, id int, path []string) {
+	c := e.container(id)
+	if c == nil {
+		// Its container was killed
+		http.Error(w, "container killed", http.StatusGone)
+		return
+	}
+	switch {
+	case r.Method == "GET" && len(path) == 2 && path[0] == "invocation" && path[1] == "next":
+		e.serveNext(w, r, c)
+	case r.Method == "POST" && len(path) == 3 && path[0] == "invocation" &&
+		(path[2] == "response" || path[2] == "error"):
+		e.serveResponse(w, r, path[1], path[2] == "error")
+	case r.Method == "POST" && len(path) == 2 && path[0] == "init" && path[1] == "error":
+		io.Copy(ioutil.Discard, r.Body)
+		e.mu.Lock()
+		e.kill(c)
+		e.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (e *Emulator) serveNext(w http.ResponseWriter, r *http.Request, c *container) {
+	e.mu.Lock()
+	if c.retired && len(c.jobs) == 0 {
+		e.kill(c)
+	} else if len(c.jobs) == 0 {
+		c.idle = true
+		c.answered = false
+		e.changed.Broadcast()
+	}
+	e.mu.Unlock()
+
+	var inv *invocation
+	select {
+	case inv = <-c.jobs:
+	case <-c.ctx.Done():
+		http.Error(w, "container killed", http.StatusGone)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Lambda-Runtime-Aws-Request-Id", inv.id)
+	w.Header().Set("Lambda-Runtime-Deadline-Ms",
+		strconv.FormatInt(inv.deadline.UnixNano()/int64(time.Millisecond), 10))
+	w.Header().Set("Lambda-Runtime-Invoked-Function-Arn",
+		"arn:aws:lambda:us-west-2:000000000000:function:"+e.opts.Function)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(inv.payload)
+}
+
+func (e *Emulator) serveResponse(w http.ResponseWriter, r *http.Request, id string, failed bool) {
+	e.mu.Lock()
+	inv := e.invocations[id]
+	if inv != nil && isStarted(inv) {
+		inv = nil
+	}
+	if inv != nil {
+		inv.failed = failed
+		close(inv.started)
+	}
+	e.mu.Unlock()
+	if inv == nil {
+		io.Copy(ioutil.Discard, r.Body)
+		http.Error(w, "unknown or completed invocation", http.StatusBadRequest)
+		return
+	}
+	_, err := io.Copy(inv.w, r.Body)
+	if err == nil {
+		// Before the client sees the end of the response, so
+		// that its next invocation can wait for this container
+		e.mu.Lock()
+		inv.c.answered = true
+		e.mu.Unlock()
+	}
+	inv.w.CloseWithError(err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func isStarted(inv *invocation) bool {
+	select {
+	case <-inv.started:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/llama"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func invoke(e *Emulator, spec protocol.InvocationSpec) (*llama.InvokeResult, error) {
+	return llama.Invoke(context.Background(), e.Lambda(), e.Store(), &llama.InvokeArgs{
+		Function: e.Function(),
+		Spec:     spec,
+		Retry:    &llama.RetryPolicy{MaxAttempts: 1},
+	})
+}
+
+func TestEmulator(t *testing.T) {
+	e := New(Options{})
+	defer e.Close()
+
+	res, err := invoke(e, protocol.InvocationSpec{
+		Args:    []string{"/bin/sh", "-c", "cat; echo built > out"},
+		Stdin:   &protocol.Blob{String: "hello\n"},
+		Outputs: []string{"out"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.Response.ExitStatus)
+	assert.Equal(t, "hello\n", res.Response.Stdout.String)
+	assert.True(t, res.Response.Times.ColdStart)
+	require.Len(t, res.Response.Outputs, 1)
+	out := res.Response.Outputs[0]
+	assert.Equal(t, "out", out.Path)
+	gets := files.AppendGet(nil, &out.Blob)
+	e.Store().GetObjects(context.Background(), gets)
+	data, err, _ := files.ReadBlob(&out.Blob, gets)
+	require.NoError(t, err)
+	assert.Equal(t, "built\n", string(data))
+
+	res, err = invoke(e, protocol.InvocationSpec{Args: []string{"/bin/sh", "-c", "exit 3"}})
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Response.ExitStatus)
+	assert.False(t, res.Response.Times.ColdStart)
+	assert.Equal(t, 2, res.Response.Diagnostics.Container.Invocations)
+	assert.Equal(t, 1, e.Starts())
+
+	e.Reset()
+	res, err = invoke(e, protocol.InvocationSpec{Args: []string{"true"}})
+	require.NoError(t, err)
+	assert.True(t, res.Response.Times.ColdStart)
+	assert.Equal(t, 2, e.Starts())
+}
+
+func TestEmulator_Error(t *testing.T) {
+	e := New(Options{})
+	defer e.Close()
+
+	_, err := invoke(e, protocol.InvocationSpec{Args: []string{"/nonexistent/command"}})
+	require.Error(t, err)
+	ret, ok := err.(*llama.ErrorReturn)
+	require.True(t, ok, "got %#v", err)
+	assert.Contains(t, string(ret.Payload), "starting command")
+
+	_, err = llama.Invoke(context.Background(), e.Lambda(), e.Store(), &llama.InvokeArgs{
+		Function: "other",
+		Retry:    &llama.RetryPolicy{MaxAttempts: 1},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ResourceNotFoundException")
+}
+
+func TestEmulator_FunctionURL(t *testing.T) {
+	e := New(Options{URLToken: "sekrit"})
+	defer e.Close()
+
+	invokeURL := func(token string, spec protocol.InvocationSpec) (*llama.InvokeResult, error) {
+		return llama.Invoke(context.Background(), nil, e.Store(), &llama.InvokeArgs{
+			Function: e.Function(),
+			Spec:     spec,
+			Retry:    &llama.RetryPolicy{MaxAttempts: 1},
+			URL:      &llama.FunctionURL{URL: e.FunctionURL(), Token: token},
+		})
+	}
+
+	res, err := invokeURL("sekrit", protocol.InvocationSpec{
+		Args:  []string{"/bin/sh", "-c", "cat; exit 2"},
+		Stdin: &protocol.Blob{String: "via url\n"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Response.ExitStatus)
+	assert.Equal(t, "via url\n", res.Response.Stdout.String)
+
+	// Structured errors make it through
+	_, err = invokeURL("sekrit", protocol.InvocationSpec{
+		Args:  []string{"cat"},
+		Stdin: &protocol.Blob{Ref: "missing"},
+	})
+	ret, ok := err.(*llama.ErrorReturn)
+	require.True(t, ok, "got %#v", err)
+	se := ret.Structured()
+	require.NotNil(t, se, "payload=%s", ret.Payload)
+	assert.Equal(t, []string{"missing"}, se.MissingIDs())
+
+	_, err = invokeURL("wrong", protocol.InvocationSpec{Args: []string{"true"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+
+	_, err = llama.Invoke(context.Background(), nil, e.Store(), &llama.InvokeArgs{
+		Function: e.Function(),
+		Spec:     protocol.InvocationSpec{Args: []string{"true"}},
+		URL:      &llama.FunctionURL{URL: e.FunctionURL(), Token: "sekrit"},
+		Stdout:   &bytes.Buffer{},
+	})
+	assert.Error(t, err)
+}
+
+func TestEmulator_Stream(t *testing.T) {
+	e := New(Options{})
+	defer e.Close()
+
+	var stdout bytes.Buffer
+	res, err := llama.Invoke(context.Background(), e.Lambda(), e.Store(), &llama.InvokeArgs{
+		Function: e.Function(),
+		Spec:     protocol.InvocationSpec{Args: []string{"/bin/sh", "-c", "echo one; sleep 0.1; echo two"}},
+		Stdout:   &stdout,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", stdout.String())
+	assert.Equal(t, "one\ntwo\n", res.Response.Stdout.String)
+}
+
+func TestEmulator_Timeout(t *testing.T) {
+	e := New(Options{Timeout: 500 * time.Millisecond})
+	defer e.Close()
+
+	start := time.Now()
+	_, err := invoke(e, protocol.InvocationSpec{Args: []string{"sleep", "10"}})
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	ret, ok := err.(*llama.ErrorReturn)
+	require.True(t, ok, "got %#v", err)
+	assert.Contains(t, string(ret.Payload), "Task timed out after 0.50 seconds")
+
+	// The container that timed out is gone
+	res, err := invoke(e, protocol.InvocationSpec{Args: []string{"true"}})
+	require.NoError(t, err)
+	assert.True(t, res.Response.Times.ColdStart)
+	assert.Equal(t, 2, e.Starts())
+}
+
+func TestEmulator_Concurrency(t *testing.T) {
+	e := New(Options{MaxConcurrency: 1})
+	defer e.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := invoke(e, protocol.InvocationSpec{Args: []string{"sleep", "1"}})
+		assert.NoError(t, err)
+	}()
+	for e.Starts() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err := invoke(e, protocol.InvocationSpec{Args: []string{"true"}})
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "TooManyRequestsException"), "got %v", err)
+	wg.Wait()
+
+	// Once the container is free it is reused. It may still be
+	// finishing up, so this invocation is allowed to retry.
+	res, err := llama.Invoke(context.Background(), e.Lambda(), e.Store(), &llama.InvokeArgs{
+		Function: e.Function(),
+		Spec:     protocol.InvocationSpec{Args: []string{"true"}},
+	})
+	require.NoError(t, err)
+	assert.False(t, res.Response.Times.ColdStart)
+	assert.Equal(t, 1, e.Starts())
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// shippedPath reports whether `exe` names a file inside the job
+// root, either because it appears in the spec's FileList or because
+// it is explicitly relative ("./foo"). It returns the cleaned path
+// relative to the root. Paths that climb out of the root ("./../foo")
+// are never shipped.
+func (p *ParsedJob) shippedPath(exe string) (string, bool) {
+	if path.IsAbs(exe) {
+		return "", false
+	}
+	rel, err := protocol.CleanPath(exe)
+	if err != nil {
+		return "", false
+	}
+	if _, ok := p.Inputs[rel]; ok {
+		return rel, true
+	}
+	if strings.HasPrefix(exe, "./") {
+		return rel, true
+	}
+	return "", false
+}
+
+// checkShippedExecutable verifies that a file materialized from the
+// FileList can be executed, restoring the shipped executable bits if
+// they were lost along the way.
+func (p *ParsedJob) checkShippedExecutable(rel string) (string, error) {
+	local := path.Join(p.Root, rel)
+	fi, err := os.Stat(local)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%q: not present in the job root; did you forget to include it in the file list?", rel)
+		}
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%q: not a regular file (mode %s)", rel, fi.Mode())
+	}
+	shipped, inList := p.Inputs[rel]
+	if fi.Mode()&0111 == 0 && shipped&0111 != 0 {
+		if err := os.Chmod(local, shipped.Perm()); err != nil {
+			return "", err
+		}
+		return local, nil
+	}
+	if fi.Mode()&0111 == 0 {
+		if inList && shipped == 0 {
+			return "", fmt.Errorf("%q: file is not executable: it was shipped without a file mode, so the executable bit was not preserved", rel)
+		}
+		return "", fmt.Errorf("%q: file is not executable (mode %s)", rel, fi.Mode())
+	}
+	return local, nil
+}
+
+// readInterpreter parses a "#!" line at the start of `file`,
+// returning the interpreter and its optional single argument, as
+// the kernel would.
+func readInterpreter(file string) (string, string, bool) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return "", "", false
+	}
+	defer fh.Close()
+	var buf [256]byte
+	n, err := io.ReadFull(fh, buf[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", "", false
+	}
+	line := buf[:n]
+	if !bytes.HasPrefix(line, []byte("#!")) {
+		return "", "", false
+	}
+	line = line[2:]
+	if nl := bytes.IndexByte(line, '\n'); nl >= 0 {
+		line = line[:nl]
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(line)), " ", 2)
+	if fields[0] == "" {
+		return "", "", false
+	}
+	var arg string
+	if len(fields) > 1 {
+		arg = strings.TrimSpace(fields[1])
+	}
+	return fields[0], arg, true
+}
+
+// resolveCommand determines the executable and argument vector to
+// run for a parsed job.
+//
+// Commands that name a file shipped in the FileList are resolved
+// against the job root instead of the image's PATH. If such a file
+// is a script whose "#!" interpreter is itself a relative path, we
+// resolve the interpreter against the job root, too, and run it
+// directly, since the kernel would otherwise resolve it against
+// whatever the working directory happens to be.
+func (p *ParsedJob) resolveCommand() (string, []string, error) {
+	exe := p.Args[0]
+	if rel, ok := p.shippedPath(exe); ok {
+		local, err := p.checkShippedExecutable(rel)
+		if err != nil {
+			return "", nil, err
+		}
+		interp, arg, ok := readInterpreter(local)
+		if !ok || path.IsAbs(interp) {
+			return local, p.Args, nil
+		}
+		interpRel, err := protocol.CleanPath(interp)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: interpreter: %w", rel, err)
+		}
+		interpLocal, err := p.checkShippedExecutable(interpRel)
+		if err != nil {
+			return "", nil, fmt.Errorf("%q: interpreter: %w", rel, err)
+		}
+		args := []string{interp}
+		if arg != "" {
+			args = append(args, arg)
+		}
+		args = append(args, local)
+		args = append(args, p.Args[1:]...)
+		return interpLocal, args, nil
+	}
+
+	if strings.ContainsRune(exe, '/') {
+		// Use as-is. Will be interpreted relative to the root
+		return exe, p.Args, nil
+	}
+	exe, err := exec.LookPath(exe)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolving %q: %s", p.Args[0], err.Error())
+	}
+	return exe, p.Args, nil
+}
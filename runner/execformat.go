@@ -0,0 +1,133 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// archNames maps ELF machines to the names people know them by
+var archNames = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64",
+	elf.EM_AARCH64: "arm64",
+	elf.EM_386:     "i386",
+	elf.EM_ARM:     "arm",
+	elf.EM_PPC64:   "ppc64",
+	elf.EM_S390:    "s390x",
+	elf.EM_RISCV:   "riscv64",
+}
+
+var goarchMachines = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"arm64":   elf.EM_AARCH64,
+	"386":     elf.EM_386,
+	"arm":     elf.EM_ARM,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+	"riscv64": elf.EM_RISCV,
+}
+
+func archName(m elf.Machine) string {
+	if name, ok := archNames[m]; ok {
+		return name
+	}
+	return m.String()
+}
+
+// maxInterpDepth matches the kernel's limit on nested #! interpreters
+const maxInterpDepth = 4
+
+// execFormatError explains why the kernel refused to execute `file`
+// with ENOEXEC, or returns nil if we can't tell.
+func execFormatError(file string) error {
+	for depth := 0; depth < maxInterpDepth; depth++ {
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil
+		}
+		var magic [4]byte
+		_, err = io.ReadFull(fh, magic[:])
+		fh.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil
+		}
+		if bytes.Equal(magic[:], []byte(elf.ELFMAG)) {
+			return elfFormatError(file)
+		}
+		interp, _, ok := readInterpreter(file)
+		if !ok {
+			return &protocol.Error{
+				Code:    protocol.ErrExecFormat,
+				Message: fmt.Sprintf("%s: not executable: it is neither an ELF binary nor a script starting with #!", file),
+				Details: map[string]string{"path": file},
+			}
+		}
+		if !path.IsAbs(interp) {
+			return nil
+		}
+		file = interp
+	}
+	return nil
+}
+
+func elfFormatError(file string) error {
+	f, err := elf.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	want, ok := goarchMachines[runtime.GOARCH]
+	if !ok || f.Machine == want {
+		return nil
+	}
+	have, ours := archName(f.Machine), archName(want)
+	return &protocol.Error{
+		Code:    protocol.ErrExecFormat,
+		Message: fmt.Sprintf("%s: binary is %s but this function runs %s", file, have, ours),
+		Details: map[string]string{
+			"path":         file,
+			"binary_arch":  have,
+			"runtime_arch": ours,
+		},
+	}
+}
+
+// diagnoseExecFailure looks for an explanation when a command exits
+// complaining of an exec format error, as shells do when they can't
+// run a program. We check the command itself, and then any shipped
+// files named in its arguments.
+func (p *ParsedJob) diagnoseExecFailure(exe string, args []string) error {
+	if err := execFormatError(exe); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if rel, ok := p.shippedPath(arg); ok {
+			if err := execFormatError(path.Join(p.Root, rel)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"os/exec"
+	"strings"
+)
+
+func envLookup(env []string) func(string) (string, bool) {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if eq := strings.IndexByte(kv, '='); eq >= 0 {
+			vars[kv[:eq]] = kv[eq+1:]
+		}
+	}
+	return func(k string) (string, bool) {
+		v, ok := vars[k]
+		return v, ok
+	}
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// expandVars replaces $VAR and ${VAR} in `s` with their values from
+// `lookup`, and $$ with a literal $. References to unknown
+// variables, and any other $, are left as they are.
+func expandVars(s string, lookup func(string) (string, bool)) string {
+	if strings.IndexByte(s, '$') < 0 {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != '$' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			i++
+			continue
+		}
+		var name string
+		var end int
+		switch {
+		case s[i+1] == '$':
+			out.WriteByte('$')
+			i += 2
+			continue
+		case s[i+1] == '{':
+			close := strings.IndexByte(s[i+2:], '}')
+			if close < 0 {
+				out.WriteString(s[i:])
+				return out.String()
+			}
+			name, end = s[i+2:i+2+close], i+3+close
+		default:
+			end = i + 1
+			for end < len(s) && isNameByte(s[end], end == i+1) {
+				end++
+			}
+			name = s[i+1 : end]
+		}
+		if v, ok := lookup(name); ok && name != "" {
+			out.WriteString(v)
+		} else {
+			out.WriteString(s[i:end])
+			if end == i+1 {
+				// A lone $
+				end++
+				out.WriteByte(s[i+1])
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// expandArgs expands the last `n` arguments of `cmd` (the job's own
+// arguments) against its environment.
+func expandArgs(cmd *exec.Cmd, n int) {
+	lookup := envLookup(environ(cmd))
+	for i := len(cmd.Args) - n; i < len(cmd.Args); i++ {
+		cmd.Args[i] = expandVars(cmd.Args[i], lookup)
+	}
+}
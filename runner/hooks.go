@@ -0,0 +1,123 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/nelhage/llama/internal/bufpool"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+)
+
+// waitContext waits for `cmd` to exit, killing it if `ctx` is
+// done first.
+func waitContext(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// runHooks runs a job's setup or teardown commands in order,
+// stopping at the first one that fails. It returns their results,
+// any warnings, and whether they all succeeded.
+func (r *Runtime) runHooks(ctx context.Context, phase string, parsed *ParsedJob, spec *protocol.InvocationSpec, hooks [][]string) ([]protocol.HookResult, []string, bool) {
+	var results []protocol.HookResult
+	var warnings []string
+	log := logFrom(ctx).With("phase", phase)
+	for i, argv := range hooks {
+		t_start := time.Now()
+		res, warns := r.runHook(ctx, parsed, spec, argv)
+		results = append(results, *res)
+		warnings = append(warnings, warns...)
+		log.Info("hook exited",
+			"hook", i,
+			"args", argv,
+			"exit_status", res.ExitStatus,
+			"duration_ms", time.Since(t_start).Milliseconds(),
+		)
+		if res.ExitStatus != 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: command %d %q exited with status %d", phase, i, argv, res.ExitStatus))
+			return results, warnings, false
+		}
+	}
+	return results, warnings, true
+}
+
+func (r *Runtime) runHook(ctx context.Context, parsed *ParsedJob, spec *protocol.InvocationSpec, argv []string) (*protocol.HookResult, []string) {
+	res := protocol.HookResult{Args: argv, ExitStatus: -1}
+	stdout, stderr := bufpool.Get(), bufpool.Get()
+	defer bufpool.Put(stdout)
+	defer bufpool.Put(stderr)
+
+	var warnings []string
+	err := func() error {
+		if len(argv) == 0 {
+			return fmt.Errorf("empty command")
+		}
+		hook := *parsed
+		hook.Args = argv
+		exe, args, err := hook.resolveCommand()
+		if err != nil {
+			return err
+		}
+		cmd := exec.Cmd{
+			Path:   exe,
+			Dir:    parsed.Root,
+			Args:   args,
+			Env:    parsed.environ(os.Environ(), parsed.Root, parsed.Scratch),
+			Stdout: stdout,
+			Stderr: stderr,
+		}
+		if spec.Sandbox {
+			sandbox, err := r.sandboxCommand(&cmd, parsed)
+			if err != nil {
+				return err
+			}
+			defer func() { warnings = sandbox.finish() }()
+		}
+		if err := startCommand(&cmd, parsed.Nice); err != nil {
+			return fmt.Errorf("starting command: %w", err)
+		}
+		waitContext(ctx, &cmd)
+		res.ExitStatus = cmd.ProcessState.ExitCode()
+		return nil
+	}()
+	if err != nil {
+		fmt.Fprintf(stderr, "llama: %s\n", err.Error())
+	}
+
+	var berr error
+	if res.Stdout, berr = files.NewBlob(ctx, r.store, stdout.Bytes()); berr != nil {
+		res.Stdout = &protocol.Blob{Err: berr.Error()}
+	}
+	if res.Stderr, berr = files.NewBlob(ctx, r.store, stderr.Bytes()); berr != nil {
+		res.Stderr = &protocol.Blob{Err: berr.Error()}
+	}
+	return &res, warnings
+}
@@ -0,0 +1,361 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nelhage/llama/internal/bufpool"
+	"github.com/nelhage/llama/protocol"
+)
+
+// We speak the Lambda runtime API directly, instead of using
+// aws-lambda-go's invoke loop, so that we can stream responses.
+// See https://docs.aws.amazon.com/lambda/latest/dg/runtimes-api.html
+
+const (
+	headerRequestID    = "Lambda-Runtime-Aws-Request-Id"
+	headerDeadlineMS   = "Lambda-Runtime-Deadline-Ms"
+	headerTraceID      = "Lambda-Runtime-Trace-Id"
+	headerResponseMode = "Lambda-Runtime-Function-Response-Mode"
+)
+
+type runtimeAPI struct {
+	base   string
+	client http.Client
+
+	// payload holds the current invocation's payload. We only
+	// handle one invocation at a time, so it is reused across
+	// invocations.
+	payload bytes.Buffer
+}
+
+func newRuntimeAPI(address string) *runtimeAPI {
+	return &runtimeAPI{base: fmt.Sprintf("http://%s/2018-06-01/runtime/", address)}
+}
+
+type invocation struct {
+	id       string
+	deadline time.Time
+	traceID  string
+	payload  []byte
+}
+
+func (a *runtimeAPI) post(ctx context.Context, url string, body io.Reader, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.base+url, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("POST %s: unexpected status: %s", url, resp.Status)
+	}
+	return nil
+}
+
+func (a *runtimeAPI) next(ctx context.Context) (*invocation, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.base+"invocation/next", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting next invocation: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting next invocation: unexpected status: %s", resp.Status)
+	}
+	a.payload.Reset()
+	if _, err := a.payload.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("reading invocation: %w", err)
+	}
+	ms, err := strconv.ParseInt(resp.Header.Get(headerDeadlineMS), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s header: %q", headerDeadlineMS, resp.Header.Get(headerDeadlineMS))
+	}
+	return &invocation{
+		id:       resp.Header.Get(headerRequestID),
+		deadline: time.Unix(0, ms*int64(time.Millisecond)),
+		traceID:  resp.Header.Get(headerTraceID),
+		payload:  a.payload.Bytes(),
+	}, nil
+}
+
+var jsonHeader = http.Header{"Content-Type": {"application/json"}}
+
+func (a *runtimeAPI) respond(ctx context.Context, inv *invocation, payload []byte) error {
+	return a.post(ctx, "invocation/"+inv.id+"/response", bytes.NewReader(payload), jsonHeader)
+}
+
+func (a *runtimeAPI) fail(ctx context.Context, inv *invocation, err error) error {
+	return a.post(ctx, "invocation/"+inv.id+"/error", bytes.NewReader(protocol.ErrorPayload(err)), jsonHeader)
+}
+
+// InitError reports to the runtime API at `address` that the
+// runtime failed to initialize.
+func InitError(ctx context.Context, address string, err error) error {
+	defaultLogger.Error("initialization error", "error", err)
+	return newRuntimeAPI(address).initError(ctx, err)
+}
+
+func (a *runtimeAPI) initError(ctx context.Context, err error) error {
+	return a.post(ctx, "init/error", bytes.NewReader(protocol.ErrorPayload(err)), jsonHeader)
+}
+
+// responseStream is a streamed invocation response. Writes are
+// sent to the runtime API as they happen; Close completes the
+// response and reports whether it was delivered.
+type responseStream struct {
+	w    *io.PipeWriter
+	done chan error
+}
+
+func (a *runtimeAPI) stream(ctx context.Context, inv *invocation) *responseStream {
+	r, w := io.Pipe()
+	s := &responseStream{w: w, done: make(chan error, 1)}
+	go func() {
+		err := a.post(ctx, "invocation/"+inv.id+"/response", r, http.Header{
+			"Content-Type":     {"application/x-ndjson"},
+			headerResponseMode: {"streaming"},
+		})
+		// Unblock any writers if the request ended early
+		r.CloseWithError(fmt.Errorf("response stream closed: %v", err))
+		s.done <- err
+	}()
+	return s
+}
+
+func (s *responseStream) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *responseStream) Close() error {
+	s.w.Close()
+	return <-s.done
+}
+
+// frameWriter writes protocol.StreamFrames to a response stream.
+type frameWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (f *frameWriter) frame(frame *protocol.StreamFrame) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := json.NewEncoder(buf).Encode(frame); err != nil {
+		return err
+	}
+	_, f.err = f.w.Write(buf.Bytes())
+	return f.err
+}
+
+// Write sends `p` as a chunk of stdout. It never fails, so that a
+// client that goes away can't interfere with the running command;
+// the full stdout is still returned in the final response.
+func (f *frameWriter) Write(p []byte) (int, error) {
+	f.frame(&protocol.StreamFrame{Stdout: p})
+	return len(p), nil
+}
+
+// Serve runs the Lambda invoke loop against the runtime API at
+// `address`, only returning if we lose contact with it, or with
+// ErrShutdown once the container is shutting down.
+func (r *Runtime) Serve(ctx context.Context, address string) error {
+	defaultLogger.Info("runtime initialized",
+		"duration_ms", r.initTime.Milliseconds(),
+		"store_ms", r.initStore.Milliseconds(),
+		"store_concurrency", r.concurrency,
+	)
+	return r.serve(ctx, newRuntimeAPI(address))
+}
+
+func (r *Runtime) serve(ctx context.Context, api *runtimeAPI) error {
+	r.sweepWorkspaces(ctx)
+	for {
+		nextCtx, cancel := r.withShutdown(ctx)
+		inv, err := api.next(nextCtx)
+		cancel()
+		if r.shuttingDown() {
+			if inv != nil {
+				api.fail(ctx, inv, ErrShutdown)
+			}
+			return ErrShutdown
+		}
+		if err != nil {
+			return err
+		}
+		if err := r.handle(ctx, api, inv); err != nil {
+			return err
+		}
+		if r.shuttingDown() {
+			return ErrShutdown
+		}
+	}
+}
+
+func (r *Runtime) handle(ctx context.Context, api *runtimeAPI, inv *invocation) error {
+	defer func() {
+		if v := recover(); v != nil {
+			api.fail(ctx, inv, fmt.Errorf("panic: %v", v))
+			panic(v)
+		}
+	}()
+
+	// Lambda lets us keep working after we respond, until we
+	// ask for the next invocation.
+	if r.xray != nil {
+		defer r.xray.Flush()
+	}
+	defer r.sweepWorkspaces(ctx)
+	defer r.finishUploads(ctx)
+
+	invokeCtx, cancel := context.WithDeadline(ctx, inv.deadline)
+	defer cancel()
+	os.Setenv("_X_AMZN_TRACE_ID", inv.traceID)
+	log := logFrom(ctx).With("request_id", inv.id)
+	invokeCtx = withLogger(invokeCtx, log)
+
+	if req, ok := protocol.ParseHTTPRequest(inv.payload); ok {
+		return r.handleHTTP(ctx, invokeCtx, api, inv, req)
+	}
+
+	var spec protocol.InvocationSpec
+	if err := json.Unmarshal(inv.payload, &spec); err != nil {
+		log.Error("bad invocation payload", "error", err)
+		return api.fail(ctx, inv, err)
+	}
+
+	if spec.Stream {
+		stream := api.stream(ctx, inv)
+		frames := frameWriter{w: stream}
+		resp, err := r.RunOneStreaming(invokeCtx, &spec, &frames)
+		if err != nil {
+			frames.frame(&protocol.StreamFrame{Error: protocol.ErrorPayload(err)})
+		} else {
+			frames.frame(&protocol.StreamFrame{Response: resp})
+		}
+		if err := stream.Close(); err != nil {
+			log.Error("streaming response failed", "error", err)
+		}
+		return nil
+	}
+
+	resp, err := r.RunOne(invokeCtx, &spec)
+	if err != nil {
+		return api.fail(ctx, inv, err)
+	}
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	if err := json.NewEncoder(buf).Encode(resp); err != nil {
+		return api.fail(ctx, inv, err)
+	}
+	return api.respond(ctx, inv, buf.Bytes())
+}
+
+// handleHTTP handles an invocation through a function URL. Even if
+// the job fails, we respond with an HTTP response for the client,
+// since function URLs don't pass on the errors we report to Lambda.
+func (r *Runtime) handleHTTP(ctx, invokeCtx context.Context, api *runtimeAPI, inv *invocation, req *protocol.HTTPRequest) error {
+	reply := func(resp *protocol.HTTPResponse) error {
+		buf, err := json.Marshal(resp)
+		if err != nil {
+			return api.fail(ctx, inv, err)
+		}
+		return api.respond(ctx, inv, buf)
+	}
+	status := func(code int, msg string) error {
+		return reply(&protocol.HTTPResponse{
+			StatusCode: code,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       msg + "\n",
+		})
+	}
+	failed := func(err error) error {
+		return reply(&protocol.HTTPResponse{
+			StatusCode: http.StatusOK,
+			Headers: map[string]string{
+				"Content-Type":               "application/json",
+				protocol.HeaderFunctionError: "Unhandled",
+			},
+			Body: string(protocol.ErrorPayload(err)),
+		})
+	}
+
+	if req.RequestContext.HTTP.Method != http.MethodPost {
+		return status(http.StatusMethodNotAllowed, "invocations must be POSTed")
+	}
+	if r.urlToken != "" {
+		want := "Bearer " + r.urlToken
+		if subtle.ConstantTimeCompare([]byte(req.Header("Authorization")), []byte(want)) != 1 {
+			logFrom(invokeCtx).Warn("rejected function URL request with a bad token")
+			return status(http.StatusUnauthorized, "bad or missing token")
+		}
+	}
+	body, err := req.BodyBytes()
+	if err != nil {
+		return status(http.StatusBadRequest, err.Error())
+	}
+	var spec protocol.InvocationSpec
+	if err := json.Unmarshal(body, &spec); err != nil {
+		return status(http.StatusBadRequest, fmt.Sprintf("bad invocation spec: %s", err.Error()))
+	}
+	if spec.Stream {
+		return failed(errors.New("response streaming isn't supported through function URLs"))
+	}
+
+	resp, err := r.RunOne(invokeCtx, &spec)
+	if err != nil {
+		return failed(err)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return failed(err)
+	}
+	return reply(&protocol.HTTPResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(data),
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type posted struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// fakeRuntimeAPI serves `n` copies of an invocation and records
+// what the runtime posts back.
+func fakeRuntimeAPI(t testing.TB, spec *protocol.InvocationSpec, n int) (*httptest.Server, *[]posted) {
+	payload, err := json.Marshal(spec)
+	require.NoError(t, err)
+	served := 0
+	var posts []posted
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/invocation/next") {
+			if served == n {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			served++
+			w.Header().Set(headerRequestID, "req-1")
+			w.Header().Set(headerDeadlineMS, fmt.Sprint(time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond)))
+			w.Write(payload)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		posts = append(posts, posted{r.URL.Path, r.Header, body})
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	return srv, &posts
+}
+
+func TestServe(t *testing.T) {
+	ctx := context.Background()
+	srv, posts := fakeRuntimeAPI(t, &protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", "echo hello"},
+	}, 1)
+	defer srv.Close()
+
+	r := Runtime{store: store.InMemory()}
+	err := r.serve(ctx, newRuntimeAPI(strings.TrimPrefix(srv.URL, "http://")))
+	assert.Error(t, err)
+
+	require.Equal(t, 1, len(*posts))
+	p := (*posts)[0]
+	assert.Equal(t, "/2018-06-01/runtime/invocation/req-1/response", p.path)
+	assert.Equal(t, "", p.header.Get(headerResponseMode))
+	var resp protocol.InvocationResponse
+	require.NoError(t, json.Unmarshal(p.body, &resp))
+	assert.Equal(t, "hello\n", resp.Stdout.String)
+}
+
+func TestServe_Stream(t *testing.T) {
+	ctx := context.Background()
+	srv, posts := fakeRuntimeAPI(t, &protocol.InvocationSpec{
+		Args:   []string{"/bin/sh", "-c", "echo one; sleep 0.1; echo two"},
+		Stream: true,
+	}, 1)
+	defer srv.Close()
+
+	r := Runtime{store: store.InMemory()}
+	err := r.serve(ctx, newRuntimeAPI(strings.TrimPrefix(srv.URL, "http://")))
+	assert.Error(t, err)
+
+	require.Equal(t, 1, len(*posts))
+	p := (*posts)[0]
+	assert.Equal(t, "/2018-06-01/runtime/invocation/req-1/response", p.path)
+	assert.Equal(t, "streaming", p.header.Get(headerResponseMode))
+
+	var frames []protocol.StreamFrame
+	scanner := bufio.NewScanner(bytes.NewReader(p.body))
+	for scanner.Scan() {
+		var frame protocol.StreamFrame
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &frame))
+		frames = append(frames, frame)
+	}
+	require.Equal(t, 3, len(frames))
+	assert.Equal(t, "one\n", string(frames[0].Stdout))
+	assert.Equal(t, "two\n", string(frames[1].Stdout))
+	require.NotNil(t, frames[2].Response)
+	assert.Equal(t, "one\ntwo\n", frames[2].Response.Stdout.String)
+}
+
+func TestServe_StreamError(t *testing.T) {
+	ctx := context.Background()
+	srv, posts := fakeRuntimeAPI(t, &protocol.InvocationSpec{
+		Stream: true,
+	}, 1)
+	defer srv.Close()
+
+	r := Runtime{store: store.InMemory()}
+	r.serve(ctx, newRuntimeAPI(strings.TrimPrefix(srv.URL, "http://")))
+
+	require.Equal(t, 1, len(*posts))
+	var frame protocol.StreamFrame
+	require.NoError(t, json.Unmarshal((*posts)[0].body, &frame))
+	assert.Nil(t, frame.Response)
+	assert.Contains(t, string(frame.Error), "No arguments provided")
+}
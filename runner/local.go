@@ -0,0 +1,77 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// Local runs jobs in-process, for clients that can't, or would
+// rather not, invoke Lambda. Jobs are materialized, run, and their
+// outputs collected exactly as they would be on Lambda, against the
+// client's own store, and their responses are marked Local.
+//
+// The function's own command line isn't known locally, so a job's
+// Args must name its whole command. Unlike a container, a Local runs
+// any number of jobs at once.
+type Local struct {
+	store store.Store
+
+	mu   sync.Mutex
+	idle []*Runtime
+}
+
+func NewLocal(st store.Store) *Local {
+	return &Local{store: st}
+}
+
+// RunOneStreaming runs a job, returning once its outputs, including
+// any uploads deferred by Spec.AsyncUploads, are in the store.
+func (l *Local) RunOneStreaming(ctx context.Context, job *protocol.InvocationSpec, stdout io.Writer) (*protocol.InvocationResponse, error) {
+	r := l.get()
+	defer l.put(r)
+	resp, err := r.RunOneStreaming(ctx, job, stdout)
+	r.finishUploads(ctx)
+	return resp, err
+}
+
+// get returns an idle Runtime, so that persistent workers and
+// idempotency tokens carry over between jobs, or a new one if they
+// are all busy.
+func (l *Local) get() *Runtime {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := len(l.idle); n > 0 {
+		r := l.idle[n-1]
+		l.idle = l.idle[:n-1]
+		return r
+	}
+	r := New(Options{Store: l.store, Concurrency: store.Concurrency(l.store)})
+	r.local = true
+	return r
+}
+
+func (l *Local) put(r *Runtime) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.idle = append(l.idle, r)
+}
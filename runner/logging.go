@@ -0,0 +1,165 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger writes structured log lines, one per event. By default
+// each line is a JSON object, so that runtime logs can be queried
+// with CloudWatch Logs Insights; LLAMA_LOG_FORMAT=text selects a
+// plain-text format for local debugging.
+//
+// Loggers are immutable; With returns a new logger carrying
+// additional fields, which is attached to a context with
+// withLogger so that per-job fields appear on every line.
+type logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+type logOutput struct {
+	mu   sync.Mutex
+	w    io.Writer
+	text bool
+	now  func() time.Time
+}
+
+func newLogger(w io.Writer, text bool) *logger {
+	return &logger{out: &logOutput{w: w, text: text, now: time.Now}}
+}
+
+var defaultLogger = newLogger(os.Stderr, false)
+
+// SetLogOutput directs the runtime's logs, and those of the standard
+// "log" package, to `w`, as text lines if `text` is set and as JSON
+// otherwise.
+func SetLogOutput(w io.Writer, text bool) {
+	defaultLogger = newLogger(w, text)
+	log.SetFlags(0)
+	log.SetOutput(stdlogWriter{defaultLogger})
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, l *logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logFrom returns the logger attached to `ctx`, or the default
+// logger.
+func logFrom(ctx context.Context) *logger {
+	if l, ok := ctx.Value(loggerKey{}).(*logger); ok {
+		return l
+	}
+	return defaultLogger
+}
+
+// With returns a logger that adds the given key/value pairs to each
+// line.
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{out: l.out, fields: fields}
+}
+
+func (l *logger) Info(msg string, kv ...interface{})  { l.log("info", msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log("warn", msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+func (l *logger) log(level, msg string, kv []interface{}) {
+	var buf bytes.Buffer
+	ts := l.out.now().UTC().Format(time.RFC3339Nano)
+	if l.out.text {
+		fmt.Fprintf(&buf, "%s %s %s", ts, strings.ToUpper(level), msg)
+	} else {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, ts)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level)
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+	}
+	l.writeFields(&buf, l.fields)
+	l.writeFields(&buf, kv)
+	if !l.out.text {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func (l *logger) writeFields(buf *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var val interface{} = "<missing>"
+		if i+1 < len(kv) {
+			val = kv[i+1]
+		}
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		if l.out.text {
+			s := fmt.Sprint(val)
+			if strings.ContainsAny(s, " \t\n\"=") || s == "" {
+				s = strconv.Quote(s)
+			}
+			fmt.Fprintf(buf, " %s=%s", key, s)
+		} else {
+			buf.WriteByte(',')
+			writeJSON(buf, key)
+			buf.WriteByte(':')
+			writeJSON(buf, val)
+		}
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		out.Reset()
+		enc.Encode(fmt.Sprint(v))
+	}
+	buf.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+}
+
+// stdlogWriter adapts a logger for use with the standard library's
+// "log" package, so that messages logged by other packages are
+// structured, too.
+type stdlogWriter struct{ l *logger }
+
+func (w stdlogWriter) Write(p []byte) (int, error) {
+	w.l.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
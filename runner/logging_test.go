@@ -0,0 +1,48 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, false)
+	l.out.now = func() time.Time { return time.Unix(0, 0) }
+
+	ctx := withLogger(context.Background(), l.With("job_id", "w-1"))
+	logFrom(ctx).With("phase", "exec").Error("failed", "error", errors.New("a <b>"), "bytes", 10)
+	assert.Equal(t,
+		`{"time":"1970-01-01T00:00:00Z","level":"error","msg":"failed","job_id":"w-1","phase":"exec","error":"a <b>","bytes":10}`+"\n",
+		buf.String())
+
+	buf.Reset()
+	l.out.text = true
+	logFrom(ctx).Info("done", "path", "out dir/a.txt", "n", 1)
+	assert.Equal(t,
+		`1970-01-01T00:00:00Z INFO done job_id=w-1 path="out dir/a.txt" n=1`+"\n",
+		buf.String())
+
+	assert.Equal(t, defaultLogger, logFrom(context.Background()))
+}
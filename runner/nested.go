@@ -0,0 +1,119 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// nestedStatsFile is where, in the job's scratch directory, nested
+// clients record their invocations
+const nestedStatsFile = ".llama-nested.jsonl"
+
+// nestedEnvAllow lists the variables a Nested job inherits from the
+// runtime even when it is sandboxed: the execution role's
+// credentials and the region they're for.
+var nestedEnvAllow = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"AWS_REGION", "AWS_DEFAULT_REGION",
+}
+
+// checkDepth refuses specs nested too deeply
+func checkDepth(spec *protocol.InvocationSpec) error {
+	if spec.Depth < 0 || spec.Depth > protocol.MaxNestingDepth {
+		return fmt.Errorf("nesting depth %d exceeds the limit of %d", spec.Depth, protocol.MaxNestingDepth)
+	}
+	return nil
+}
+
+// nestedEnv returns the variables a Nested job needs to invoke
+// llama itself
+func (r *Runtime) nestedEnv() []string {
+	var env []string
+	for _, k := range nestedEnvAllow {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	if r.storeURL != "" {
+		env = append(env, "LLAMA_OBJECT_STORE="+r.storeURL)
+	}
+	if len(r.storeReplicas) > 0 {
+		env = append(env, protocol.StoreReplicasEnv+"="+strings.Join(r.storeReplicas, " "))
+	}
+	if r.function != "" {
+		env = append(env, protocol.FunctionEnv+"="+r.function)
+	}
+	return env
+}
+
+// nestingEnv returns the nesting variables for the environment of
+// one of the job's commands, given its scratch directory as the
+// command sees it
+func (p *ParsedJob) nestingEnv(scratch string) []string {
+	vars := []string{protocol.NestingDepthEnv + "=" + strconv.Itoa(p.Depth+1)}
+	if p.Nested != nil {
+		vars = append(vars, p.Nested...)
+		vars = append(vars, protocol.NestedStatsEnv+"="+path.Join(scratch, nestedStatsFile))
+	}
+	return vars
+}
+
+// nestedUsage totals the invocations the job's commands recorded,
+// if it was Nested. Malformed lines, from clients killed mid-write,
+// are skipped.
+func nestedUsage(p *ParsedJob) *protocol.NestedUsage {
+	if p.Nested == nil {
+		return nil
+	}
+	// A namespaced job that shipped its own tmp/ saw that as
+	// /tmp, instead of its scratch directory.
+	var f *os.File
+	var err error
+	for _, dir := range []string{p.Scratch, path.Join(p.Root, "tmp")} {
+		if dir == "" {
+			continue
+		}
+		if f, err = os.Open(path.Join(dir, nestedStatsFile)); err == nil {
+			break
+		}
+	}
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	var total protocol.NestedUsage
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		var rec protocol.NestedUsage
+		if json.Unmarshal(scan.Bytes(), &rec) == nil {
+			total.Add(&rec)
+		}
+	}
+	if total.Invocations == 0 {
+		return nil
+	}
+	return &total
+}
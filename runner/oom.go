@@ -0,0 +1,163 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// We can't see the kernel's OOM decisions directly, so we infer
+// them: a command that dies of SIGKILL we didn't send is assumed to
+// have been OOM-killed if the kernel's OOM-kill counter moved while
+// it ran, or if memory use came close to the function's limit.
+
+// oomThreshold is the fraction of the memory limit above which we
+// blame a SIGKILL on memory pressure.
+const oomThreshold = 0.9
+
+// oomKills returns the kernel's count of OOM kills, from
+// /proc/vmstat.
+func oomKills() (uint64, bool) {
+	data, err := ioutil.ReadFile("/proc/vmstat")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if f := bytes.Fields(line); len(f) == 2 && string(f[0]) == "oom_kill" {
+			n, err := strconv.ParseUint(string(f[1]), 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// readMeminfo returns the named fields of /proc/meminfo, in bytes
+func readMeminfo(fields ...string) map[string]uint64 {
+	out := make(map[string]uint64, len(fields))
+	fh, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return out
+	}
+	defer fh.Close()
+	scan := bufio.NewScanner(fh)
+	for scan.Scan() {
+		f := bytes.Fields(scan.Bytes())
+		if len(f) < 2 {
+			continue
+		}
+		key := string(bytes.TrimSuffix(f[0], []byte(":")))
+		for _, want := range fields {
+			if key == want {
+				kb, _ := strconv.ParseUint(string(f[1]), 10, 64)
+				out[key] = kb * 1024
+			}
+		}
+	}
+	return out
+}
+
+// memoryLimit returns the function's memory limit in bytes
+func memoryLimit() uint64 {
+	if mb, err := strconv.ParseUint(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64); err == nil {
+		return mb << 20
+	}
+	return readMeminfo("MemTotal")["MemTotal"]
+}
+
+// memWatch is a watchdog that samples the container's memory use
+// while a command runs, recording the peak.
+type memWatch struct {
+	stop chan struct{}
+	done chan struct{}
+	peak uint64
+}
+
+const memWatchInterval = 50 * time.Millisecond
+
+func watchMemory() *memWatch {
+	w := &memWatch{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		tick := time.NewTicker(memWatchInterval)
+		defer tick.Stop()
+		for {
+			w.sample()
+			select {
+			case <-w.stop:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return w
+}
+
+func (w *memWatch) sample() {
+	mi := readMeminfo("MemTotal", "MemAvailable")
+	total, avail := mi["MemTotal"], mi["MemAvailable"]
+	if total > avail && total-avail > w.peak {
+		w.peak = total - avail
+	}
+}
+
+// Stop stops the watchdog and returns the peak memory use it saw,
+// in bytes.
+func (w *memWatch) Stop() uint64 {
+	close(w.stop)
+	<-w.done
+	return w.peak
+}
+
+// oomError returns an ErrOOM error if `state` looks like an OOM
+// kill. `peak` is the peak memory use observed, `limit` the
+// function's memory limit, and `kills` the number of kernel OOM
+// kills while the command ran, if known.
+func oomError(state *os.ProcessState, peak, limit uint64, kills uint64) error {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() || ws.Signal() != syscall.SIGKILL {
+		return nil
+	}
+	if ru, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// ru_maxrss is in kilobytes
+		if rss := uint64(ru.Maxrss) * 1024; rss > peak {
+			peak = rss
+		}
+	}
+	if kills == 0 && float64(peak) < oomThreshold*float64(limit) {
+		return nil
+	}
+	peakMB, limitMB := peak>>20, limit>>20
+	return &protocol.Error{
+		Code: protocol.ErrOOM,
+		Message: fmt.Sprintf("job ran out of memory (used ~%dMB of %dMB); try raising the function's memory size",
+			peakMB, limitMB),
+		Details: map[string]string{
+			"peak_rss_mb": strconv.FormatUint(peakMB, 10),
+			"memory_mb":   strconv.FormatUint(limitMB, 10),
+			"oom_kills":   strconv.FormatUint(kills, 10),
+		},
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+)
+
+// asyncUploadMin is the smallest output that is uploaded after the
+// response is sent, if the spec permits it.
+const asyncUploadMin = 1 << 20
+
+// defaultDeferLimit bounds the bytes of output a job holds in memory
+// to upload after its response is sent, if we don't know the
+// function's memory size.
+const defaultDeferLimit = 256 << 20
+
+// deferLimit returns the bound on the bytes of output a job holds in
+// memory to upload later: a quarter of the function's memory.
+func (r *Runtime) deferLimit() int64 {
+	if r.maxDeferred > 0 {
+		return r.maxDeferred
+	}
+	if mem, err := strconv.Atoi(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")); err == nil && mem > 0 {
+		return int64(mem) << 20 / 4
+	}
+	return defaultDeferLimit
+}
+
+// outputCollector gathers a job's outputs after the command has
+// exited.
+//
+// Each declared output is stat()ed before we touch it: regular files
+// are uploaded, directories are walked recursively, and anything
+// else (sockets, fifos, devices) is skipped with a warning, since
+// opening those could block forever or read garbage. Symlinks, both
+// declared outputs and those found while walking a directory, are
+// only followed if they resolve to somewhere inside the job root;
+// anything else is skipped with a warning, so that a link to / can't
+// ship the whole filesystem back to the client.
+//
+// Two links may lead to the same directory or file without forming a
+// cycle, so we track the directories on the current walk (active) to
+// detect cycles, and separately remember each file we have already
+// read (visited) so that it is uploaded only once however many paths
+// lead to it.
+type outputCollector struct {
+	r           *Runtime
+	root        string
+	compression string
+	// If non-nil, large outputs are queued here instead of
+	// being uploaded immediately.
+	deferred *deferredStore
+
+	realRoot string
+	active   map[fileID]bool
+	visited  map[fileID]protocol.File
+	outputs  protocol.FileList
+	warnings []string
+	bytes    int64
+}
+
+type fileID struct {
+	dev, ino uint64
+}
+
+func describeMode(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return fmt.Sprintf("irregular file (mode %s)", mode)
+	}
+}
+
+func (c *outputCollector) warn(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+func (c *outputCollector) collect(ctx context.Context, out string) {
+	c.visit(ctx, out, true)
+}
+
+func (c *outputCollector) visit(ctx context.Context, rel string, top bool) {
+	local := path.Join(c.root, rel)
+	stat := os.Stat
+	if !top {
+		stat = os.Lstat
+	}
+	fi, err := stat(local)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.fail(ctx, rel, err)
+		}
+		// Missing outputs are silently omitted.
+		return
+	}
+	if top || fi.Mode()&os.ModeSymlink != 0 {
+		// A declared output may itself be a symlink, or lie
+		// under one, so check where it really is.
+		if fi, err = c.followLink(rel, local); err != nil {
+			c.fail(ctx, rel, err)
+			return
+		}
+		if fi == nil {
+			return
+		}
+	}
+
+	var id *fileID
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		id = &fileID{uint64(st.Dev), uint64(st.Ino)}
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		if id != nil {
+			if file, ok := c.visited[*id]; ok {
+				c.outputs = append(c.outputs, protocol.FileAndPath{Path: rel, File: file})
+				return
+			}
+		}
+		var st store.Store = c.r.store
+		if c.deferred != nil && fi.Size() >= asyncUploadMin && c.deferred.admit(fi.Size()) {
+			st = c.deferred
+		}
+		file, err := files.ReadFileCompressed(ctx, st, local, c.compression)
+		if err != nil {
+			c.fail(ctx, rel, err)
+			return
+		}
+		file.Pending = st != c.r.store
+		file.MTime = fi.ModTime().UnixNano()
+		c.bytes += fi.Size()
+		c.outputs = append(c.outputs, protocol.FileAndPath{Path: rel, File: *file})
+		if id != nil {
+			c.visited[*id] = *file
+		}
+	case fi.IsDir():
+		if id != nil {
+			if c.active[*id] {
+				c.warn("output %q: skipping directory cycle", rel)
+				return
+			}
+			c.active[*id] = true
+			defer delete(c.active, *id)
+		}
+		ents, err := ioutil.ReadDir(local)
+		if err != nil {
+			c.fail(ctx, rel, err)
+			return
+		}
+		for _, ent := range ents {
+			c.visit(ctx, path.Join(rel, ent.Name()), false)
+		}
+	default:
+		c.warn("output %q: skipping %s", rel, describeMode(fi.Mode()))
+	}
+}
+
+// followLink resolves the symlinks in the path to an output. It
+// returns nil, with a warning recorded, if a link dangles or points
+// outside of the job root.
+func (c *outputCollector) followLink(rel, local string) (os.FileInfo, error) {
+	if c.realRoot == "" {
+		root, err := filepath.EvalSymlinks(c.root)
+		if err != nil {
+			return nil, err
+		}
+		c.realRoot = root
+	}
+	target, err := filepath.EvalSymlinks(local)
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.warn("output %q: skipping dangling symlink", rel)
+			return nil, nil
+		}
+		return nil, err
+	}
+	if inside, err := filepath.Rel(c.realRoot, target); err != nil ||
+		inside == ".." || strings.HasPrefix(inside, "../") {
+		c.warn("output %q: skipping symlink outside the job root", rel)
+		return nil, nil
+	}
+	return os.Stat(target)
+}
+
+// deferredStore computes the IDs of the objects stored in it, and
+// holds on to them so that they can be uploaded later. It holds at
+// most `limit` bytes; outputs that don't fit are uploaded right away.
+type deferredStore struct {
+	base    store.Store
+	ids     store.Identifier
+	limit   int64
+	held    int64
+	pending []pendingObject
+}
+
+// admit reserves room for an output of `size` bytes, reporting
+// whether there was any.
+func (d *deferredStore) admit(size int64) bool {
+	if d.held+size > d.limit {
+		return false
+	}
+	d.held += size
+	return true
+}
+
+type pendingObject struct {
+	id  string
+	obj []byte
+}
+
+func (d *deferredStore) Store(ctx context.Context, obj []byte) (string, error) {
+	id := d.ids.ObjectID(obj)
+	d.pending = append(d.pending, pendingObject{id, append([]byte(nil), obj...)})
+	return id, nil
+}
+
+func (d *deferredStore) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	d.base.GetObjects(ctx, gets)
+}
+
+func (d *deferredStore) FetchAWSUsage(u *protocol.StoreUsage) {
+	d.base.FetchAWSUsage(u)
+}
+
+// finishUploads uploads the outputs that previous jobs left pending.
+func (r *Runtime) finishUploads(ctx context.Context) {
+	if len(r.pending) == 0 {
+		return
+	}
+	log := logFrom(ctx).With("phase", "async_upload")
+	t_start := time.Now()
+	var bytes int
+	for _, p := range r.pending {
+		id, err := r.store.Store(ctx, p.obj)
+		if err == nil && id != p.id {
+			err = fmt.Errorf("stored as %s", id)
+		}
+		if err != nil {
+			log.Error("uploading pending output failed", "id", p.id, "error", err)
+		}
+		bytes += len(p.obj)
+	}
+	log.Info("uploaded pending outputs",
+		"objects", len(r.pending),
+		"bytes", bytes,
+		"duration_ms", time.Since(t_start).Milliseconds(),
+	)
+	r.pending = nil
+}
+
+func (c *outputCollector) fail(ctx context.Context, rel string, err error) {
+	logFrom(ctx).Error("reading output failed", "phase", "upload", "path", rel, "error", err)
+	c.outputs = append(c.outputs, protocol.FileAndPath{
+		Path: rel,
+		File: protocol.File{Blob: protocol.Blob{Err: err.Error()}},
+	})
+}
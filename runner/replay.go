@@ -0,0 +1,80 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"context"
+	"io"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+)
+
+// maxReplays is the number of recent responses a runtime keeps, in
+// case the client retries those jobs
+const maxReplays = 32
+
+// replayCache remembers the responses to recent jobs, by their
+// idempotency tokens.
+type replayCache struct {
+	tokens    []string
+	responses map[string]protocol.InvocationResponse
+}
+
+func (c *replayCache) get(token string) (protocol.InvocationResponse, bool) {
+	if token == "" {
+		return protocol.InvocationResponse{}, false
+	}
+	resp, ok := c.responses[token]
+	return resp, ok
+}
+
+func (c *replayCache) put(token string, resp *protocol.InvocationResponse) {
+	if token == "" {
+		return
+	}
+	if c.responses == nil {
+		c.responses = make(map[string]protocol.InvocationResponse)
+	}
+	if _, ok := c.responses[token]; !ok {
+		c.tokens = append(c.tokens, token)
+	}
+	c.responses[token] = *resp
+	if len(c.tokens) > maxReplays {
+		delete(c.responses, c.tokens[0])
+		c.tokens = c.tokens[1:]
+	}
+}
+
+// replay answers a job that already ran with its earlier response.
+// The earlier spans belong to the earlier attempt's trace, and the
+// attempt that produced them has already been billed, so neither is
+// returned again.
+func (r *Runtime) replay(ctx context.Context, prev protocol.InvocationResponse, stdout io.Writer) *protocol.InvocationResponse {
+	logFrom(ctx).Info("replaying response to a retried job", "job_id", prev.JobID)
+	resp := prev
+	resp.Replayed = true
+	resp.InlineSpans = nil
+	resp.Spans = nil
+	resp.Usage = protocol.UsageMetrics{}
+	if stdout != nil && resp.Stdout != nil {
+		if data, err := files.Read(ctx, r.store, resp.Stdout); err == nil {
+			stdout.Write(data)
+		}
+	}
+	return &resp
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// reproBundle builds and stores a reproduction bundle of a failed
+// job's workspace.
+func (r *Runtime) reproBundle(ctx context.Context, parsed *ParsedJob, spec *protocol.InvocationSpec, status int) *protocol.ReproBundle {
+	var buf bytes.Buffer
+	if err := writeReproBundle(&buf, parsed, spec.Repro, status); err != nil {
+		logFrom(ctx).Error("building reproduction bundle failed", "error", err)
+		return &protocol.ReproBundle{Err: err.Error()}
+	}
+	id, err := r.store.Store(ctx, buf.Bytes())
+	if err != nil {
+		return &protocol.ReproBundle{Err: err.Error()}
+	}
+	logFrom(ctx).Info("stored reproduction bundle", "id", id, "bytes", buf.Len())
+	return &protocol.ReproBundle{Ref: id, Bytes: int64(buf.Len())}
+}
+
+func writeReproBundle(w io.Writer, parsed *ParsedJob, opts *protocol.ReproSpec, status int) error {
+	max := opts.MaxBytes
+	if max == 0 {
+		max = protocol.DefaultReproMaxBytes
+	}
+	manifest := protocol.ReproManifest{
+		Args:       parsed.Args,
+		Env:        parsed.Env,
+		Stdin:      parsed.Stdin != nil,
+		ExitStatus: status,
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	addFile := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	var total int64
+	err := filepath.Walk(parsed.Root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parsed.Root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if opts.ExcludeInputs {
+			if _, ok := parsed.Inputs[rel]; ok {
+				manifest.Excluded = append(manifest.Excluded, rel)
+				return nil
+			}
+		}
+		var link string
+		switch {
+		case fi.Mode().IsRegular():
+			if total+fi.Size() > max {
+				manifest.Omitted = append(manifest.Omitted, rel)
+				return nil
+			}
+			total += fi.Size()
+		case fi.IsDir():
+		case fi.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		fh, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		_, err = io.CopyN(tw, fh, fi.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if parsed.Stdin != nil {
+		if err := addFile(protocol.ReproStdinPath, parsed.Stdin); err != nil {
+			return err
+		}
+	}
+	sort.Strings(manifest.Excluded)
+	data, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addFile(protocol.ReproManifestPath, data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,780 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+// Package runner runs llama jobs: it materializes an
+// InvocationSpec's files from the object store into a fresh
+// workspace, runs its command, and collects its outputs. The Lambda
+// runtime, cmd/llama_runtime, serves invocations with a Runtime;
+// clients can also run jobs in-process with a Local.
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/nelhage/llama/internal/bufpool"
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
+	"golang.org/x/sys/unix"
+)
+
+type Runtime struct {
+	store    store.Store
+	cmdline  []string
+	tool     string
+	jobCount int
+	workerId string
+	cacheDir string
+	fsync    bool
+	// argMax overrides the system's ARG_MAX, for tests
+	argMax int
+	// maxDeferred overrides deferLimit, for tests
+	maxDeferred int64
+	// How long initialization, and setting up the store, took
+	initTime, initStore time.Duration
+	// The number of objects the store moves at once
+	concurrency int
+
+	workers workerPool
+	// replays holds recent responses, by idempotency token
+	replays replayCache
+
+	// The root of the running job's workspace, if any
+	activeRoot string
+
+	// Outputs to upload once the current invocation has been
+	// answered
+	pending []pendingObject
+
+	// shutdown is closed on Shutdown. shutdownOnce creates it,
+	// and closeOnce closes it.
+	shutdownOnce sync.Once
+	closeOnce    sync.Once
+	shutdown     chan struct{}
+
+	// xray, if set, receives the spans of each invocation that
+	// Lambda samples for X-Ray
+	xray *tracing.XRayTracer
+
+	sandboxOnce sync.Once
+	sandbox     string
+	sandboxExe  string
+
+	// local is set if jobs run on the client, rather than on
+	// Lambda
+	local bool
+	// shared is set if other Runtimes run in this process
+	shared bool
+	// urlToken authenticates function URL requests
+	urlToken string
+	// storeURL and function configure Nested jobs
+	storeURL      string
+	storeReplicas []string
+	function      string
+}
+
+type Options struct {
+	Store   store.Store
+	Cmdline []string
+	// Tool names the program Cmdline runs, if Cmdline hides it
+	// behind a shell wrapper; see protocol.Cmdline.
+	Tool string
+	// CacheDir is the store's disk cache, which sandboxed jobs may
+	// write to
+	CacheDir string
+	// Fsync requests that outputs be synced to disk before upload
+	Fsync bool
+	// MaxWorkers bounds the number of idle persistent workers; it
+	// defaults to DefaultMaxWorkers.
+	MaxWorkers int
+	// Concurrency is the number of objects Store moves at once,
+	// for diagnostics.
+	Concurrency int
+	// Started is when the process started, and InitStore is how
+	// long setting up Store took, for diagnostics.
+	Started   time.Time
+	InitStore time.Duration
+	// XRay, if set, receives the spans of each invocation that
+	// Lambda samples for X-Ray.
+	XRay *tracing.XRayTracer
+	// Shared is set if other Runtimes serve invocations in the
+	// same process, as they do under runner/emulator. Such a
+	// Runtime leaves this process's workspaces alone when it
+	// sweeps for stale ones, since they may be another's.
+	Shared bool
+	// URLToken, if set, is the token requests through a function
+	// URL must present; see protocol.URLTokenEnv.
+	URLToken string
+	// StoreURL and Function are the object store's URL and the
+	// function's name, which Nested jobs are given, along with
+	// the URLs of the store's StoreReplicas.
+	StoreURL      string
+	StoreReplicas []string
+	Function      string
+}
+
+// New returns a Runtime that runs jobs against opts.Store
+func New(opts Options) *Runtime {
+	var workerId [8]byte
+	if _, err := rand.Read(workerId[:]); err != nil {
+		panic(fmt.Sprintf("rand: %s", err.Error()))
+	}
+	r := &Runtime{
+		store:         opts.Store,
+		cmdline:       opts.Cmdline,
+		tool:          opts.Tool,
+		workerId:      hex.EncodeToString(workerId[:]),
+		cacheDir:      opts.CacheDir,
+		fsync:         opts.Fsync,
+		workers:       workerPool{max: opts.MaxWorkers},
+		initStore:     opts.InitStore,
+		concurrency:   opts.Concurrency,
+		xray:          opts.XRay,
+		shared:        opts.Shared,
+		urlToken:      opts.URLToken,
+		storeURL:      opts.StoreURL,
+		storeReplicas: opts.StoreReplicas,
+		function:      opts.Function,
+	}
+	if !opts.Started.IsZero() {
+		r.initTime = time.Since(opts.Started)
+	}
+	return r
+}
+
+type ParsedJob struct {
+	Root string
+	// Scratch is the job's private temporary directory, which
+	// lives alongside Root. The command's TMPDIR points here, so
+	// that temporary files can't leak into later jobs.
+	Scratch string
+	Args    []string
+	Stdin   []byte
+
+	// Inputs maps the path (relative to Root) of each file
+	// materialized from the spec's FileList to the mode it was
+	// shipped with, if any.
+	Inputs map[string]os.FileMode
+
+	// FetchBytes counts the bytes fetched from the object store
+	// to materialize the job.
+	FetchBytes int64
+	// Fetched records each of those fetches.
+	Fetched []protocol.Fetch
+
+	// ID identifies the job within the container's lifetime
+	ID string
+	// Env holds KEY=VALUE settings added to the environment of
+	// each of the job's commands.
+	Env []string
+	// Expand is set if Env values and the job's arguments should
+	// have variable references expanded.
+	Expand bool
+	// CPUs is the number of CPUs the job's commands are told
+	// they have.
+	CPUs int
+	// Nice is the niceness the job's commands run with.
+	Nice int
+	// Depth is the spec's nesting depth. Nested, if the spec
+	// was Nested, holds the variables that let the job's commands
+	// invoke llama themselves; unlike Env, it's kept out of
+	// reproduction bundles, since it includes credentials.
+	Depth  int
+	Nested []string
+}
+
+// Cleanup removes the job's workspace, including any temporary
+// files left behind by an interrupted materialization.
+func (p *ParsedJob) Cleanup() error {
+	err := os.RemoveAll(p.Root)
+	if p.Scratch != "" {
+		if serr := os.RemoveAll(p.Scratch); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+func (p *ParsedJob) TempPath(name string) (string, error) {
+	out := path.Join(p.Root, "tmp", name)
+	if err := os.MkdirAll(path.Dir(out), 0755); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+const MaxInlineSpans = 100
+
+// MaxSpanBytes caps the encoded size of the spans we return with a
+// response. Responses can carry up to 6MB, but spans are only a
+// diagnostic.
+const MaxSpanBytes = 1 << 20
+
+func (r *Runtime) jobID() string {
+	return fmt.Sprintf("%s-%d", r.workerId, r.jobCount)
+}
+
+func diagnostics(resp *protocol.InvocationResponse) *protocol.Diagnostics {
+	if resp.Diagnostics == nil {
+		resp.Diagnostics = &protocol.Diagnostics{}
+	}
+	return resp.Diagnostics
+}
+
+func (r *Runtime) RunOne(ctx context.Context, job *protocol.InvocationSpec) (*protocol.InvocationResponse, error) {
+	return r.RunOneStreaming(ctx, job, nil)
+}
+
+// RunOneStreaming behaves like RunOne, but additionally copies the
+// command's stdout to `stdout`, if non-nil, as it is produced.
+func (r *Runtime) RunOneStreaming(ctx context.Context, job *protocol.InvocationSpec, stdout io.Writer) (*protocol.InvocationResponse, error) {
+	start := time.Now()
+
+	if prev, ok := r.replays.get(job.IdempotencyToken); ok {
+		return r.replay(ctx, prev, stdout), nil
+	}
+
+	var tracer *tracing.MemoryTracer
+	var resp *protocol.InvocationResponse
+	var err error
+
+	r.jobCount += 1
+	log := logFrom(ctx).With("job_id", r.jobID())
+	ctx = withLogger(ctx, log)
+
+	defer func() {
+		if resp != nil && err == nil {
+			r.replays.put(job.IdempotencyToken, resp)
+		}
+	}()
+	defer func() {
+		if resp == nil {
+			return
+		}
+		resp.JobID = r.jobID()
+		resp.Local = r.local
+		r.store.FetchAWSUsage(&resp.Usage.S3)
+		diagnostics(resp).Container = &protocol.ContainerDiagnostics{
+			Invocations:      r.jobCount,
+			Init:             r.initTime,
+			InitStore:        r.initStore,
+			StoreConcurrency: r.concurrency,
+			Arch:             runtime.GOARCH,
+		}
+		if r.local {
+			return
+		}
+		mem, _ := strconv.ParseUint(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64)
+		resp.Usage.Lambda.Millis = uint64((time.Since(start) + 3*time.Millisecond/2 - 1).Milliseconds())
+		resp.Usage.Lambda.MB_Millis = resp.Usage.Lambda.Millis * mem
+	}()
+
+	xray := r.xrayTracer(job)
+	if job.Trace != nil || job.PersistTrace || xray != nil {
+		var span *tracing.SpanBuilder
+		topctx := ctx
+		var tracers []tracing.Tracer
+		if job.Trace != nil || job.PersistTrace {
+			tracer = tracing.NewMemoryTracer(ctx)
+			tracers = append(tracers, tracer)
+		}
+		if xray != nil {
+			tracers = append(tracers, xray)
+		}
+		ctx = tracing.WithTracer(ctx, tracing.Multi(tracers...))
+		ctx, span = tracing.StartPropagatedSpan(ctx, "runtime.Execute", job.Trace)
+		span.AddField("job_count", r.jobCount)
+		span.AddField("worker_id", r.workerId)
+		defer func() {
+			if err != nil {
+				span.SetError(err)
+			}
+			span.End()
+			if tracer == nil {
+				return
+			}
+			spans := tracer.Close()
+			if job.PersistTrace {
+				r.persistTrace(topctx, spans, resp)
+			}
+			if resp == nil || job.Trace == nil {
+				return
+			}
+			spans, dropped := tracing.TrimSpans(spans, span.Id(), MaxSpanBytes)
+			if dropped > 0 {
+				log.Warn("dropped spans to fit the response", "dropped", dropped)
+				for i := range spans {
+					if spans[i].SpanId == span.Id() {
+						spans[i].Fields["dropped_spans"] = dropped
+					}
+				}
+			}
+			if len(spans) < MaxInlineSpans {
+				resp.InlineSpans = spans
+			} else {
+				spandata, err := json.Marshal(spans)
+				if err == nil {
+					compressed := snappy.Encode(nil, spandata)
+					// We have to use topctx so we
+					// don't try to log spans to
+					// the tracer we just
+					// closed. This does mean we
+					// won't see this upload in
+					// tracing, but doing that
+					// would involve an entire
+					// additional layer of
+					// complexity...
+					resp.Spans, err = files.NewBlob(topctx, r.store, compressed)
+				}
+				if err != nil {
+					resp.Spans = &protocol.Blob{Err: err.Error()}
+				}
+			}
+		}()
+	}
+
+	resp, err = r.executeJob(ctx, job, stdout)
+	if err != nil {
+		log.Error("job failed", "error", err, "duration_ms", time.Since(start).Milliseconds())
+	} else {
+		log.Info("job complete",
+			"exit_status", resp.ExitStatus,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	}
+
+	return resp, err
+}
+
+// persistTrace saves the job's spans in the object store, even if
+// the job failed. Failing to save them only earns the job a
+// warning.
+func (r *Runtime) persistTrace(ctx context.Context, spans []tracing.Span, resp *protocol.InvocationResponse) {
+	if err := store.PutTrace(ctx, r.store, r.jobID(), spans); err != nil {
+		logFrom(ctx).Warn("persisting trace failed", "error", err)
+		if resp == nil {
+			return
+		}
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("persisting trace: %s", err.Error()))
+	}
+}
+
+// xrayTracer returns the tracer for the invocation's X-Ray trace,
+// or nil if X-Ray is disabled or Lambda didn't sample this
+// invocation. Spans at the top of the job's trace are attached to
+// the Lambda function's segment.
+func (r *Runtime) xrayTracer(job *protocol.InvocationSpec) tracing.Tracer {
+	if r.xray == nil {
+		return nil
+	}
+	h, ok := tracing.ParseXRayHeader(os.Getenv("_X_AMZN_TRACE_ID"))
+	if !ok || !h.Sampled {
+		return nil
+	}
+	var parent string
+	if job.Trace != nil {
+		parent = job.Trace.ParentId
+	}
+	return r.xray.Attach(h, parent)
+}
+
+func (r *Runtime) executeJob(ctx context.Context, job *protocol.InvocationSpec, stream io.Writer) (*protocol.InvocationResponse, error) {
+	t_start := time.Now()
+	var parsed *ParsedJob
+	err := tracing.Trace(ctx, "materialize", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		var err error
+		parsed, err = r.parseJob(ctx, job)
+		if err == nil {
+			span.AddField("files", len(job.Files))
+			span.SetMetric("fetch_bytes", float64(parsed.FetchBytes))
+		}
+		return err
+	})
+	if err != nil {
+		logFrom(ctx).Error("materializing job failed", "phase", "materialize", "error", err)
+		return nil, err
+	}
+	defer parsed.Cleanup()
+	r.activeRoot = parsed.Root
+	defer func() { r.activeRoot = "" }()
+	logFrom(ctx).Info("materialized job",
+		"phase", "materialize",
+		"files", len(job.Files),
+		"fetch_bytes", parsed.FetchBytes,
+		"duration_ms", time.Since(t_start).Milliseconds(),
+	)
+
+	if err := os.MkdirAll(parsed.Root, 0755); err != nil {
+		return nil, err
+	}
+
+	if len(parsed.Args) == 0 {
+		return nil, errors.New("No arguments provided")
+	}
+
+	resp := protocol.InvocationResponse{CPUs: parsed.CPUs, Nice: parsed.Nice}
+	resp.Transfer.Fetched = parsed.Fetched
+	var warnings []string
+	var ok bool
+	resp.Setup, warnings, ok = r.runHooks(ctx, "setup", parsed, job, job.Setup)
+	resp.Warnings = append(resp.Warnings, warnings...)
+	if !ok {
+		failed := resp.Setup[len(resp.Setup)-1]
+		resp.ExitStatus = failed.ExitStatus
+		resp.Warnings = append(resp.Warnings, "setup failed; the command was not run")
+		if job.Repro != nil {
+			diagnostics(&resp).Repro = r.reproBundle(ctx, parsed, job, resp.ExitStatus)
+		}
+		resp.Times.ColdStart = r.jobCount == 1
+		resp.Times.Fetch = time.Since(t_start)
+		resp.Times.E2E = resp.Times.Fetch
+		return &resp, nil
+	}
+
+	stdout, stderr := bufpool.Get(), bufpool.Get()
+	defer bufpool.Put(stdout)
+	defer bufpool.Put(stderr)
+
+	t_exec := time.Now()
+	if job.Worker != nil {
+		err = r.runWorker(ctx, parsed, job, stdout, stderr, stream, &resp)
+	} else {
+		err = r.runCommand(ctx, parsed, job, stdout, stderr, stream, &resp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t_wait := time.Now()
+
+	// If we're being shut down, we spend what time we have left
+	// on uploading the partial results.
+	if !resp.Interrupted {
+		if resp.ExitStatus != 0 && job.Repro != nil {
+			diagnostics(&resp).Repro = r.reproBundle(ctx, parsed, job, resp.ExitStatus)
+		}
+
+		resp.Teardown, warnings, _ = r.runHooks(ctx, "teardown", parsed, job, job.Teardown)
+		resp.Warnings = append(resp.Warnings, warnings...)
+	}
+	resp.Usage.Disk.Scratch_Bytes = diskUsage(parsed.Scratch)
+	resp.Nested = nestedUsage(parsed)
+
+	{
+		log := logFrom(ctx).With("phase", "upload")
+		ctx, span := tracing.StartSpan(ctx, "upload")
+		resp.Stdout, err = files.NewBlob(ctx, r.store, stdout.Bytes())
+		if err != nil {
+			span.SetError(err)
+			resp.Stdout = &protocol.Blob{Err: err.Error()}
+		}
+		resp.Stderr, err = files.NewBlob(ctx, r.store, stderr.Bytes())
+		if err != nil {
+			span.SetError(err)
+			resp.Stderr = &protocol.Blob{Err: err.Error()}
+		}
+		outputs := outputCollector{
+			r:           r,
+			root:        parsed.Root,
+			compression: job.CompressOutputs,
+			active:      make(map[fileID]bool),
+			visited:     make(map[fileID]protocol.File),
+		}
+		if ids, ok := store.AsIdentifier(r.store); ok && job.AsyncUploads {
+			outputs.deferred = &deferredStore{base: r.store, ids: ids, limit: r.deferLimit()}
+		}
+		for _, out := range job.Outputs {
+			outputs.collect(ctx, out)
+		}
+		if outputs.deferred != nil {
+			r.pending = append(r.pending, outputs.deferred.pending...)
+		}
+		resp.Outputs = outputs.outputs
+		for _, w := range outputs.warnings {
+			log.Warn(w)
+		}
+		resp.Warnings = append(resp.Warnings, outputs.warnings...)
+		span.End()
+		log.Info("uploaded outputs",
+			"outputs", len(resp.Outputs),
+			"output_bytes", outputs.bytes,
+			"duration_ms", time.Since(t_wait).Milliseconds(),
+		)
+	}
+	t_done := time.Now()
+
+	resp.Times.ColdStart = r.jobCount == 1
+	resp.Times.Fetch = t_exec.Sub(t_start)
+	resp.Times.Exec = t_wait.Sub(t_exec)
+	resp.Times.Upload = t_done.Sub(t_wait)
+	resp.Times.E2E = t_done.Sub(t_start)
+
+	return &resp, nil
+}
+
+// runCommand runs the job's command, recording its exit status in
+// `resp`.
+func (r *Runtime) runCommand(ctx context.Context, parsed *ParsedJob, job *protocol.InvocationSpec, stdout, stderr *bytes.Buffer, stream io.Writer, resp *protocol.InvocationResponse) error {
+	exe, argv, err := parsed.resolveCommand()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Cmd{
+		Path: exe,
+		Dir:  parsed.Root,
+		Args: argv,
+	}
+	cmd.Env = parsed.environ(os.Environ(), parsed.Root, parsed.Scratch)
+	if parsed.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(parsed.Stdin)
+	}
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	if stream != nil {
+		cmd.Stdout = io.MultiWriter(stdout, stream)
+	}
+
+	var sandbox *sandboxRun
+	if job.Sandbox {
+		sandbox, err = r.sandboxCommand(&cmd, parsed)
+		if err != nil {
+			return err
+		}
+	}
+
+	setpgid(&cmd)
+
+	tool, movable := parsed.Args[0], len(job.Args)
+	if r.tool != "" {
+		tool = r.tool
+	} else if len(r.cmdline) == 0 {
+		movable = len(parsed.Args) - 1
+	}
+	if parsed.Expand {
+		expandArgs(&cmd, movable)
+	}
+	if err := r.fitArgMax(&cmd, parsed, job, tool, movable); err != nil {
+		logFrom(ctx).Error("command line too long", "phase", "exec", "error", err)
+		return err
+	}
+
+	log := logFrom(ctx).With("phase", "exec")
+	log.Info("starting command", "args", cmd.Args)
+
+	t_exec := time.Now()
+
+	err = tracing.Trace(ctx, "exec", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		kills, haveKills := oomKills()
+		mem := watchMemory()
+		if err := startCommand(&cmd, parsed.Nice); err != nil {
+			mem.Stop()
+			log.Error("starting command failed", "error", err)
+			if errors.Is(err, syscall.ENOEXEC) {
+				if ferr := execFormatError(exe); ferr != nil {
+					return ferr
+				}
+			}
+			return fmt.Errorf("starting command: %q", err)
+		}
+		interrupted, _ := r.waitJob(ctx, &cmd)
+		peak := mem.Stop()
+		span.AddField("exit_status", cmd.ProcessState.ExitCode())
+		if after, ok := oomKills(); ok && haveKills {
+			kills = after - kills
+		} else {
+			kills = 0
+		}
+		if interrupted {
+			log.Warn(protocol.InterruptedWarning)
+			span.AddField("interrupted", true)
+			resp.Interrupted = true
+			resp.Warnings = append(resp.Warnings, protocol.InterruptedWarning)
+		} else if ctx.Err() == nil {
+			if err := oomError(cmd.ProcessState, peak, memoryLimit(), kills); err != nil {
+				log.Error("command ran out of memory", "error", err)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if status := cmd.ProcessState.ExitCode(); status == 126 || status == 127 {
+		if bytes.Contains(bytes.ToLower(stderr.Bytes()), []byte("exec format error")) {
+			if err := parsed.diagnoseExecFailure(exe, argv[1:]); err != nil {
+				log.Error("command could not be executed", "error", err)
+				return err
+			}
+		}
+	}
+	log.Info("command exited",
+		"exit_status", cmd.ProcessState.ExitCode(),
+		"stdout_bytes", stdout.Len(),
+		"stderr_bytes", stderr.Len(),
+		"duration_ms", time.Since(t_exec).Milliseconds(),
+	)
+
+	resp.ExitStatus = cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		resp.Signal = unix.SignalName(ws.Signal())
+	}
+	if sandbox != nil {
+		resp.Sandbox = sandbox.level
+		warnings := sandbox.finish()
+		for _, w := range warnings {
+			log.Warn(w, "sandbox", sandbox.level)
+		}
+		resp.Warnings = append(resp.Warnings, warnings...)
+	}
+	return nil
+}
+
+// missingBlobError reports that the objects `ids` are not in the
+// store, so that the client can upload them again.
+func missingBlobError(ids []string) error {
+	return &protocol.Error{
+		Code:    protocol.ErrMissingBlob,
+		Message: fmt.Sprintf("%d objects are missing from the store: %s", len(ids), strings.Join(ids, ", ")),
+		Details: map[string]string{"ids": strings.Join(ids, ",")},
+	}
+}
+
+func (r *Runtime) parseJob(ctx context.Context, spec *protocol.InvocationSpec) (_ *ParsedJob, err error) {
+	temp, err := ioutil.TempDir("", r.workspacePattern())
+	if err != nil {
+		return nil, err
+	}
+	job := ParsedJob{
+		Root:   temp,
+		Args:   r.cmdline,
+		Inputs: make(map[string]os.FileMode, len(spec.Files)),
+	}
+	defer func() {
+		if err != nil {
+			job.Cleanup()
+		}
+	}()
+
+	job.Scratch = temp + ".tmp"
+	if err := os.Mkdir(job.Scratch, 0700); err != nil {
+		job.Scratch = ""
+		return nil, err
+	}
+
+	job.Args = append(job.Args, spec.Args...)
+	job.CPUs = effectiveCPUs()
+	job.Nice = spec.Nice
+	for _, kv := range spec.Env {
+		if strings.IndexByte(kv, '=') <= 0 {
+			return nil, fmt.Errorf("env: %q is not of the form KEY=VALUE", kv)
+		}
+	}
+	job.Env = append(cpuEnv(job.CPUs, spec.ExportParallelism), spec.Env...)
+	job.Expand = spec.ExpandVars
+	job.ID = r.jobID()
+	if err := checkDepth(spec); err != nil {
+		return nil, err
+	}
+	job.Depth = spec.Depth
+	if spec.Nested {
+		job.Nested = r.nestedEnv()
+	}
+
+	var gets []store.GetRequest
+
+	if spec.Stdin != nil {
+		gets = files.AppendGet(gets, spec.Stdin)
+	}
+	for i, file := range spec.Files {
+		rel, err := protocol.CleanPath(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("file list: %w", err)
+		}
+		job.Inputs[rel] = file.Mode
+		spec.Files[i].Path = path.Join(job.Root, rel)
+		if err := os.MkdirAll(path.Dir(spec.Files[i].Path), 0755); err != nil {
+			return nil, err
+		}
+		gets = files.AppendGetFile(gets, &file.File)
+	}
+	r.store.GetObjects(ctx, gets)
+	var missing []string
+	for _, get := range gets {
+		if errors.Is(get.Err, store.ErrNotExists) {
+			missing = append(missing, get.Id)
+		}
+		job.FetchBytes += int64(len(get.Data))
+		job.Fetched = append(job.Fetched, protocol.Fetch{
+			ID:     get.Id,
+			Bytes:  int64(len(get.Data)),
+			Cached: get.Cached,
+			Source: get.Source,
+		})
+	}
+	if missing != nil {
+		return nil, missingBlobError(missing)
+	}
+
+	if spec.Stdin != nil {
+		var data []byte
+		var err error
+		data, err, gets = files.ReadBlob(spec.Stdin, gets)
+		if err != nil {
+			return nil, fmt.Errorf("read stdin: %w", err)
+		}
+		job.Stdin = data
+	}
+
+	opts := files.WriteOptions{Sync: r.fsync}
+	for _, f := range spec.Files {
+		err, gets = files.FetchFileWith(&f.File, f.Path, gets, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, f := range spec.Outputs {
+		f, err := protocol.CleanPath(f)
+		if err != nil {
+			return nil, fmt.Errorf("outputs: %w", err)
+		}
+		spec.Outputs[i] = f
+		if err := os.MkdirAll(path.Join(job.Root, path.Dir(f)), 0755); err != nil {
+			return nil, fmt.Errorf("creating output directory for %q: %s", f, err)
+		}
+	}
+	return &job, nil
+}
@@ -0,0 +1,1423 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"context"
+	"debug/elf"
+	"encoding/binary"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	SandboxHelper()
+	os.Exit(m.Run())
+}
+
+func TestParseJob(t *testing.T) {
+	const (
+		contentsA = "Hello, A\n"
+		contentsB = "This is B\n"
+	)
+
+	ctx := context.Background()
+	st := store.InMemory()
+	a_txt, _ := files.NewBlob(ctx, st, []byte(contentsA))
+	b_txt, _ := files.NewBlob(ctx, st, []byte(contentsB))
+
+	cmdline := []string{"/bin/echo", "Hello"}
+	spec := protocol.InvocationSpec{
+		Args: []string{"World"},
+		Files: protocol.FileList{
+			{Path: "a.txt", File: protocol.File{Blob: *a_txt}},
+			{Path: "indir/b.txt", File: protocol.File{Blob: *b_txt}},
+		},
+		Outputs: []string{"outdir/c.txt"},
+	}
+
+	r := Runtime{store: st, cmdline: cmdline}
+
+	job, err := r.parseJob(ctx, &spec)
+	if err != nil {
+		t.Fatal("parseJob", err)
+	}
+	defer job.Cleanup()
+	if !reflect.DeepEqual(job.Args, []string{"/bin/echo", "Hello", "World"}) {
+		t.Errorf("Bad args: %q", job.Args)
+	}
+	data, err := ioutil.ReadFile(path.Join(job.Root, "a.txt"))
+	if err != nil || string(data) != contentsA {
+		t.Errorf("Bad a.txt: %q/%v", data, err)
+	}
+	data, err = ioutil.ReadFile(path.Join(job.Root, "indir/b.txt"))
+	if err != nil || string(data) != contentsB {
+		t.Errorf("Bad b.txt: %q/%v", data, err)
+	}
+	fi, err := os.Stat(path.Join(job.Root, "outdir"))
+	if err != nil {
+		t.Errorf("coult not stat outdir: %s", err.Error())
+	} else if !fi.Mode().IsDir() {
+		t.Errorf("outdir should be a directory, is: %d", fi.Mode())
+	}
+}
+
+func TestRunOne(t *testing.T) {
+	const (
+		contentsA = "Hello, A\n"
+	)
+
+	ctx := context.Background()
+	st := store.InMemory()
+	a_txt, _ := files.NewBlob(ctx, st, []byte(contentsA))
+
+	cmdline := []string{"/bin/sh", "-c"}
+	spec := protocol.InvocationSpec{
+		Args: []string{`cat in/a.txt > b.txt; echo World >> b.txt; echo OutPUT; echo STDeRR >&2`},
+		Files: protocol.FileList{
+			{Path: "in/a.txt", File: protocol.File{Blob: *a_txt}},
+		},
+		Outputs: []string{"b.txt", "c.txt"},
+	}
+
+	r := Runtime{store: st, cmdline: cmdline}
+	resp, err := r.RunOne(ctx, &spec)
+	if err != nil {
+		t.Fatal("runOne", err)
+	}
+
+	// c.txt is not created and will not be included in the
+	// outputs
+	assert.Equal(t, 1, len(resp.Outputs))
+
+	b_blob := resp.Outputs[0]
+	assert.Equal(t, "b.txt", b_blob.Path)
+	b_txt, err := files.Read(ctx, st, &b_blob.Blob)
+	assert.NoError(t, err)
+	assert.Equal(t, contentsA+"World\n", string(b_txt))
+}
+
+func TestRunOne_Signal(t *testing.T) {
+	r := Runtime{store: store.InMemory(), cmdline: []string{"/bin/sh", "-c"}}
+	resp, err := r.RunOne(context.Background(), &protocol.InvocationSpec{
+		Args: []string{`kill -TERM $$`},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, -1, resp.ExitStatus)
+	assert.Equal(t, "SIGTERM", resp.Signal)
+}
+
+func TestRunOne_NoCmdLine(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args:    []string{`echo`, `hello`},
+		Files:   nil,
+		Outputs: nil,
+	}
+
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	if err != nil {
+		t.Fatal("runOne", err)
+	}
+
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, stdout, []byte("hello\n"))
+}
+
+func TestRunOne_ShippedExecutable(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	script, _ := files.NewBlob(ctx, st, []byte("#!/bin/sh\necho from script \"$@\"\n"))
+	interp, _ := files.NewBlob(ctx, st, []byte("#!/bin/sh\necho interp \"$1\"\n"))
+	tool, _ := files.NewBlob(ctx, st, []byte("#!tools/interp\n"))
+	escape, _ := files.NewBlob(ctx, st, []byte("#!../interp\n"))
+
+	tests := []struct {
+		name   string
+		args   []string
+		files  protocol.FileList
+		stdout string
+		err    string
+	}{
+		{
+			"in file list",
+			[]string{"bin/run.sh", "arg"},
+			protocol.FileList{{Path: "bin/run.sh", File: protocol.File{Blob: *script, Mode: 0755}}},
+			"from script arg\n",
+			"",
+		},
+		{
+			"dot-slash",
+			[]string{"./run.sh"},
+			protocol.FileList{{Path: "run.sh", File: protocol.File{Blob: *script, Mode: 0755}}},
+			"from script\n",
+			"",
+		},
+		{
+			"no mode shipped",
+			[]string{"./run.sh"},
+			protocol.FileList{{Path: "run.sh", File: protocol.File{Blob: *script}}},
+			"",
+			"shipped without a file mode",
+		},
+		{
+			"missing",
+			[]string{"./run.sh"},
+			nil,
+			"",
+			"not present in the job root",
+		},
+		{
+			"relative interpreter",
+			[]string{"./tool"},
+			protocol.FileList{
+				{Path: "tool", File: protocol.File{Blob: *tool, Mode: 0755}},
+				{Path: "tools/interp", File: protocol.File{Blob: *interp, Mode: 0755}},
+			},
+			"",
+			"",
+		},
+		{
+			"interpreter outside the root",
+			[]string{"./tool"},
+			protocol.FileList{{Path: "tool", File: protocol.File{Blob: *escape, Mode: 0755}}},
+			"",
+			"outside the job root",
+		},
+		{
+			"dot-slash outside the root",
+			[]string{"./../llama-no-such-tool"},
+			nil,
+			"",
+			"no such file",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec := protocol.InvocationSpec{
+				Args:  tc.args,
+				Files: tc.files,
+			}
+			r := Runtime{store: st}
+			resp, err := r.RunOne(ctx, &spec)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			stdout, err := files.Read(ctx, st, resp.Stdout)
+			require.NoError(t, err)
+			if tc.stdout != "" {
+				assert.Equal(t, tc.stdout, string(stdout))
+			} else {
+				assert.Regexp(t, `^interp /.*/tool\n$`, string(stdout))
+			}
+		})
+	}
+}
+
+func TestRunOne_Sandbox(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "hunter2")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	r := Runtime{store: st}
+	spec := protocol.InvocationSpec{
+		Args:    []string{"/bin/sh", "-c", `echo "key=$AWS_SECRET_ACCESS_KEY"; echo out > out.txt`},
+		Outputs: []string{"out.txt"},
+		Sandbox: true,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.Sandbox)
+	assert.Equal(t, 0, resp.ExitStatus)
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "key=\n", string(stdout))
+	require.Equal(t, 1, len(resp.Outputs))
+	assert.Equal(t, "out.txt", resp.Outputs[0].Path)
+}
+
+func TestRunOne_SandboxWeak(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	outside := path.Join(t.TempDir(), "escaped")
+	os.Setenv("TMPDIR", path.Dir(outside))
+	defer os.Unsetenv("TMPDIR")
+
+	r := Runtime{store: st}
+	r.sandboxOnce.Do(func() { r.sandbox = protocol.SandboxWeak })
+	spec := protocol.InvocationSpec{
+		Args:    []string{"/bin/sh", "-c", `echo hi > ` + outside},
+		Sandbox: true,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.SandboxWeak, resp.Sandbox)
+	require.Equal(t, 1, len(resp.Warnings))
+	assert.Contains(t, resp.Warnings[0], outside)
+}
+
+func TestRunOne_SandboxNoHelper(t *testing.T) {
+	defer func(old bool) { helperInstalled = old }(helperInstalled)
+	helperInstalled = false
+
+	r := Runtime{store: store.InMemory()}
+	resp, err := r.RunOne(context.Background(), &protocol.InvocationSpec{
+		Args:    []string{"/bin/true"},
+		Sandbox: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	assert.Equal(t, protocol.SandboxWeak, resp.Sandbox)
+}
+
+func TestParseJob_WindowsPaths(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	a_txt, _ := files.NewBlob(ctx, st, []byte("A\n"))
+
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", `cat src/lib/a.txt > out/b.txt`},
+		Files: protocol.FileList{
+			{Path: `src\lib/a.txt`, File: protocol.File{Blob: *a_txt}},
+		},
+		Outputs: []string{`out\b.txt`},
+	}
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Outputs))
+	assert.Equal(t, "out/b.txt", resp.Outputs[0].Path)
+	data, err := files.Read(ctx, st, &resp.Outputs[0].Blob)
+	require.NoError(t, err)
+	assert.Equal(t, "A\n", string(data))
+
+	for _, bad := range []string{`..\escape`, `\etc\passwd`, `C:\x`} {
+		spec := protocol.InvocationSpec{
+			Args:  []string{"true"},
+			Files: protocol.FileList{{Path: bad, File: protocol.File{Blob: *a_txt}}},
+		}
+		_, err := r.RunOne(ctx, &spec)
+		assert.Error(t, err, "path %q", bad)
+	}
+}
+
+func TestRunOne_CompressOutputs(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args:            []string{"/bin/sh", "-c", `for i in $(seq 1000); do echo line; done > out.txt`},
+		Outputs:         []string{"out.txt"},
+		CompressOutputs: protocol.CompressionZstd,
+	}
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Outputs))
+	out := resp.Outputs[0]
+	assert.Equal(t, protocol.CompressionZstd, out.Compression)
+
+	blob, err := files.Read(ctx, st, &out.Blob)
+	require.NoError(t, err)
+	data, err := files.Decompress(&out.File, blob)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("line\n", 1000), string(data))
+}
+
+func TestRunOne_SpecialOutputs(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", `
+mkdir -p out/sub
+echo a > out/a.txt
+echo b > out/sub/b.txt
+mkfifo out/fifo
+mkfifo pipe
+ln -s .. out/sub/loop
+ln -s missing out/dangling
+`},
+		Outputs: []string{"out", "pipe"},
+	}
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+
+	var paths []string
+	for _, out := range resp.Outputs {
+		assert.Empty(t, out.Err, "path %q", out.Path)
+		paths = append(paths, out.Path)
+	}
+	assert.Equal(t, []string{"out/a.txt", "out/sub/b.txt"}, paths)
+	assert.ElementsMatch(t, []string{
+		`output "out/dangling": skipping dangling symlink`,
+		`output "out/fifo": skipping fifo`,
+		`output "out/sub/loop": skipping directory cycle`,
+		`output "pipe": skipping fifo`,
+	}, resp.Warnings)
+}
+
+func TestRunOne_EscapingSymlink(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", `
+mkdir -p out
+echo a > out/a.txt
+ln -s / out/root
+ln -s /etc/passwd out/passwd
+ln -s ../../ out/up
+ln -s / top
+# up/ was created to hold the up/etc output
+rmdir up && ln -s / up
+ln -s /etc/passwd passwd
+ln -s out/a.txt inside
+`},
+		Outputs: []string{"out", "top", "passwd", "inside", "up/etc"},
+	}
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+
+	var paths []string
+	for _, out := range resp.Outputs {
+		paths = append(paths, out.Path)
+	}
+	assert.Equal(t, []string{"out/a.txt", "inside"}, paths)
+	assert.ElementsMatch(t, []string{
+		`output "out/passwd": skipping symlink outside the job root`,
+		`output "out/root": skipping symlink outside the job root`,
+		`output "out/up": skipping symlink outside the job root`,
+		`output "top": skipping symlink outside the job root`,
+		`output "passwd": skipping symlink outside the job root`,
+		`output "up/etc": skipping symlink outside the job root`,
+	}, resp.Warnings)
+}
+
+func TestRunOne_DiamondSymlinks(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", `
+mkdir -p out/shared
+echo s > out/shared/s.txt
+ln -s shared out/left
+ln -s shared out/right
+`},
+		Outputs: []string{"out"},
+	}
+	r := Runtime{store: st}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	assert.Empty(t, resp.Warnings)
+
+	var paths []string
+	for _, out := range resp.Outputs {
+		assert.Empty(t, out.Err, "path %q", out.Path)
+		assert.Equal(t, resp.Outputs[0].Blob, out.Blob, "path %q", out.Path)
+		paths = append(paths, out.Path)
+	}
+	assert.Equal(t, []string{"out/left/s.txt", "out/right/s.txt", "out/shared/s.txt"}, paths)
+}
+
+func TestRunOne_ArgMax(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	dir, err := ioutil.TempDir("", "llama.argmax.*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// A stand-in for a compiler: echoes its arguments, one per
+	// line, expanding a response file if it is given one.
+	script := `#!/bin/sh
+for a; do
+  case "$a" in
+    @*) cat "${a#@}" ;;
+    *) echo "$a" ;;
+  esac
+done
+`
+	for _, tool := range []string{"cc", "not-a-compiler"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, tool), []byte(script), 0755))
+	}
+
+	var args []string
+	for i := 0; i < 200; i++ {
+		args = append(args, strings.Repeat("x", 20))
+	}
+	args[0] = "has space"
+	limit := execSize(os.Environ()) + 2048
+
+	t.Run("Error", func(t *testing.T) {
+		r := Runtime{store: st, cmdline: []string{path.Join(dir, "cc")}, argMax: limit}
+		_, err := r.RunOne(ctx, &protocol.InvocationSpec{Args: args})
+		var pe *protocol.Error
+		require.True(t, errors.As(err, &pe), "err=%v", err)
+		assert.Equal(t, protocol.ErrArgMax, pe.Code)
+		assert.Equal(t, strconv.Itoa(limit), pe.Details["limit"])
+		over, _ := strconv.Atoi(pe.Details["over"])
+		assert.Greater(t, over, 0)
+
+		parsed := protocol.ParseError(protocol.ErrorPayload(err))
+		require.NotNil(t, parsed)
+		assert.Equal(t, protocol.ErrArgMax, parsed.Code)
+	})
+
+	t.Run("ResponseFile", func(t *testing.T) {
+		r := Runtime{store: st, cmdline: []string{path.Join(dir, "cc")}, argMax: limit}
+		resp, err := r.RunOne(ctx, &protocol.InvocationSpec{Args: args, ResponseFiles: true})
+		require.NoError(t, err)
+		require.Equal(t, 0, resp.ExitStatus)
+		stdout, err := files.Read(ctx, st, resp.Stdout)
+		require.NoError(t, err)
+		want := strings.ReplaceAll(strings.Join(args, "\n"), " ", `\ `) + "\n"
+		assert.Equal(t, want, string(stdout))
+	})
+
+	t.Run("ShellWrapped", func(t *testing.T) {
+		cmdline, tool := protocol.Cmdline("", []string{"/bin/sh", "-c", path.Join(dir, "cc")})
+		r := Runtime{store: st, cmdline: cmdline, tool: tool, argMax: limit}
+		resp, err := r.RunOne(ctx, &protocol.InvocationSpec{Args: args, ResponseFiles: true})
+		require.NoError(t, err)
+		require.Equal(t, 0, resp.ExitStatus)
+		stdout, err := files.Read(ctx, st, resp.Stdout)
+		require.NoError(t, err)
+		want := strings.ReplaceAll(strings.Join(args, "\n"), " ", `\ `) + "\n"
+		assert.Equal(t, want, string(stdout))
+	})
+
+	t.Run("UnknownTool", func(t *testing.T) {
+		r := Runtime{store: st, cmdline: []string{path.Join(dir, "not-a-compiler")}, argMax: limit}
+		_, err := r.RunOne(ctx, &protocol.InvocationSpec{Args: args, ResponseFiles: true})
+		var pe *protocol.Error
+		require.True(t, errors.As(err, &pe), "err=%v", err)
+		assert.Equal(t, protocol.ErrArgMax, pe.Code)
+	})
+}
+
+func TestAcceptsResponseFile(t *testing.T) {
+	for _, tool := range []string{"gcc", "/usr/bin/clang++", "aarch64-linux-gnu-gcc-10", "ld.lld", "ar"} {
+		assert.True(t, acceptsResponseFile(tool), tool)
+	}
+	for _, tool := range []string{"sh", "python3", "ccache", "gcc-wrapper"} {
+		assert.False(t, acceptsResponseFile(tool), tool)
+	}
+}
+
+func TestRunOne_Scratch(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	for _, sandbox := range []bool{false, true} {
+		r := Runtime{store: st}
+		spec := protocol.InvocationSpec{
+			Args: []string{"/bin/sh", "-c", `
+echo "$TMPDIR" > tmpdir.txt
+test "$TMPDIR" = "$TEMP" && test "$TMPDIR" = "$TMP" || exit 1
+head -c 8192 /dev/zero > "$TMPDIR/junk"
+`},
+			Outputs: []string{"tmpdir.txt"},
+			Sandbox: sandbox,
+		}
+		resp, err := r.RunOne(ctx, &spec)
+		require.NoError(t, err)
+		require.Equal(t, 0, resp.ExitStatus, "sandbox=%v", sandbox)
+		assert.GreaterOrEqual(t, resp.Usage.Disk.Scratch_Bytes, uint64(8192))
+		assert.Empty(t, resp.Warnings)
+
+		require.Equal(t, 1, len(resp.Outputs))
+		data, err := files.Read(ctx, st, &resp.Outputs[0].Blob)
+		require.NoError(t, err)
+		tmpdir := strings.TrimSpace(string(data))
+		assert.NotEmpty(t, tmpdir)
+		if resp.Sandbox != protocol.SandboxNamespace {
+			_, err = os.Stat(tmpdir)
+			assert.True(t, os.IsNotExist(err), "scratch %s was not removed", tmpdir)
+		}
+	}
+}
+
+func TestRunOne_Hooks(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	readBlob := func(b *protocol.Blob) string {
+		data, err := files.Read(ctx, st, b)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		spec := protocol.InvocationSpec{
+			Setup: [][]string{
+				{"/bin/sh", "-c", "echo generated > config.txt; echo setting up"},
+			},
+			Args: []string{"/bin/sh", "-c", "cp config.txt out.txt"},
+			Teardown: [][]string{
+				{"/bin/sh", "-c", "echo stripped >> out.txt"},
+				{"/bin/sh", "-c", "echo cleanup failed >&2; exit 3"},
+			},
+			Outputs: []string{"out.txt"},
+		}
+		resp, err := r.RunOne(ctx, &spec)
+		require.NoError(t, err)
+		assert.Equal(t, 0, resp.ExitStatus)
+
+		require.Equal(t, 1, len(resp.Setup))
+		assert.Equal(t, 0, resp.Setup[0].ExitStatus)
+		assert.Equal(t, "setting up\n", readBlob(resp.Setup[0].Stdout))
+
+		require.Equal(t, 2, len(resp.Teardown))
+		assert.Equal(t, 3, resp.Teardown[1].ExitStatus)
+		assert.Equal(t, "cleanup failed\n", readBlob(resp.Teardown[1].Stderr))
+		require.Equal(t, 1, len(resp.Warnings))
+		assert.Contains(t, resp.Warnings[0], "teardown: command 1")
+
+		require.Equal(t, 1, len(resp.Outputs))
+		assert.Equal(t, "generated\nstripped\n", readBlob(&resp.Outputs[0].Blob))
+	})
+
+	t.Run("SetupFails", func(t *testing.T) {
+		spec := protocol.InvocationSpec{
+			Setup: [][]string{
+				{"/bin/sh", "-c", "exit 7"},
+				{"/bin/sh", "-c", "echo never"},
+			},
+			Args:     []string{"/bin/sh", "-c", "echo main > out.txt"},
+			Teardown: [][]string{{"/bin/sh", "-c", "echo never"}},
+			Outputs:  []string{"out.txt"},
+		}
+		resp, err := r.RunOne(ctx, &spec)
+		require.NoError(t, err)
+		assert.Equal(t, 7, resp.ExitStatus)
+		assert.Equal(t, 1, len(resp.Setup))
+		assert.Empty(t, resp.Teardown)
+		assert.Empty(t, resp.Outputs)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		spec := protocol.InvocationSpec{
+			Setup: [][]string{{"no-such-command"}},
+			Args:  []string{"/bin/true"},
+		}
+		resp, err := r.RunOne(ctx, &spec)
+		require.NoError(t, err)
+		assert.Equal(t, -1, resp.ExitStatus)
+		assert.Contains(t, readBlob(resp.Setup[0].Stderr), "no-such-command")
+	})
+}
+
+func TestRunOne_CPUs(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	os.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "1769")
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")
+
+	spec := protocol.InvocationSpec{
+		Args:              []string{"/bin/sh", "-c", `echo "$NPROC $LLAMA_CPUS $GOMAXPROCS $MAKEFLAGS $(nice)"`},
+		ExportParallelism: true,
+		Nice:              5,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	require.Equal(t, 0, resp.ExitStatus)
+	assert.Equal(t, 1, resp.CPUs)
+	assert.Equal(t, 5, resp.Nice)
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "1 1 1 -j1 5\n", string(stdout))
+}
+
+func TestEffectiveCPUs(t *testing.T) {
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")
+	for _, tc := range []struct {
+		mem  string
+		want int
+	}{
+		{"128", 1},
+		{"3008", 2},
+		{"10240", 6},
+	} {
+		os.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", tc.mem)
+		want := tc.want
+		if n := runtime.NumCPU(); want > n {
+			want = n
+		}
+		assert.Equal(t, want, effectiveCPUs(), "mem=%s", tc.mem)
+	}
+}
+
+func TestRunOne_Repro(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st, cmdline: []string{"/bin/sh", "-c"}}
+
+	input, _ := files.NewBlob(ctx, st, []byte("input"))
+	spec := protocol.InvocationSpec{
+		Args:  []string{`mkdir work; echo partial > work/log.txt; head -c 2048 /dev/zero > big.bin; exit 2`},
+		Stdin: &protocol.Blob{String: "stdin"},
+		Files: protocol.FileList{
+			{Path: "in.txt", File: protocol.File{Blob: *input}},
+		},
+		Repro: &protocol.ReproSpec{ExcludeInputs: true, MaxBytes: 1024},
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp.ExitStatus)
+	require.NotNil(t, resp.Diagnostics)
+	require.NotNil(t, resp.Diagnostics.Repro)
+	require.Empty(t, resp.Diagnostics.Repro.Err)
+
+	data, err := store.Get(ctx, st, resp.Diagnostics.Repro.Ref)
+	require.NoError(t, err)
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		contents[hdr.Name] = string(body)
+	}
+	assert.Equal(t, "partial\n", contents["work/log.txt"])
+	assert.Equal(t, "stdin", contents[protocol.ReproStdinPath])
+	assert.NotContains(t, contents, "in.txt")
+	assert.NotContains(t, contents, "big.bin")
+
+	var manifest protocol.ReproManifest
+	require.NoError(t, json.Unmarshal([]byte(contents[protocol.ReproManifestPath]), &manifest))
+	assert.Equal(t, append(r.cmdline, spec.Args...), manifest.Args)
+	assert.Equal(t, 2, manifest.ExitStatus)
+	assert.True(t, manifest.Stdin)
+	assert.Equal(t, []string{"in.txt"}, manifest.Excluded)
+	assert.Equal(t, []string{"big.bin"}, manifest.Omitted)
+
+	// Successful jobs don't get a bundle
+	resp, err = r.RunOne(ctx, &protocol.InvocationSpec{
+		Args:  []string{"true"},
+		Repro: &protocol.ReproSpec{},
+	})
+	require.NoError(t, err)
+	assert.Nil(t, resp.Diagnostics.Repro)
+}
+
+func TestOOMError(t *testing.T) {
+	killed := exec.Command("/bin/sh", "-c", "kill -9 $$")
+	killed.Run()
+	exited := exec.Command("/bin/sh", "-c", "exit 1")
+	exited.Run()
+
+	const limit = 1769 << 20
+	err := oomError(killed.ProcessState, 1750<<20, limit, 0)
+	var pe *protocol.Error
+	require.True(t, errors.As(err, &pe), "err=%v", err)
+	assert.Equal(t, protocol.ErrOOM, pe.Code)
+	assert.Equal(t, "1750", pe.Details["peak_rss_mb"])
+	assert.Equal(t, "1769", pe.Details["memory_mb"])
+	assert.Contains(t, pe.Message, "used ~1750MB of 1769MB")
+
+	// The kernel's OOM counter is enough on its own
+	assert.Error(t, oomError(killed.ProcessState, 10<<20, limit, 1))
+	// but a kill with plenty of memory to spare is something else
+	assert.NoError(t, oomError(killed.ProcessState, 10<<20, limit, 0))
+	assert.NoError(t, oomError(exited.ProcessState, 1760<<20, limit, 1))
+}
+
+func TestMemWatch(t *testing.T) {
+	if _, err := os.Stat("/proc/meminfo"); err != nil {
+		t.Skip("no /proc/meminfo")
+	}
+	w := watchMemory()
+	time.Sleep(2 * memWatchInterval)
+	assert.NotZero(t, w.Stop())
+}
+
+func TestRunOne_Worker(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	readBlob := func(b *protocol.Blob) string {
+		if b == nil {
+			return ""
+		}
+		data, err := files.Read(ctx, st, b)
+		require.NoError(t, err)
+		return string(data)
+	}
+	script := func(version string) protocol.FileList {
+		blob, err := files.NewBlob(ctx, st, []byte(`#!/bin/sh
+# `+version+`
+echo "worker starting" >&2
+while read -r line; do
+  id=$(echo "$line" | sed 's/.*"requestId":\([0-9]*\).*/\1/')
+  dir=$(echo "$line" | sed 's/.*"sandboxDir":"\([^"]*\)".*/\1/')
+  case "$line" in *crash*) exit 1;; esac
+  echo "not a response"
+  echo "request $id" > "$dir/out.txt"
+  printf '{"exitCode":0,"output":"pid %s\\n","requestId":%s}\n' $$ $id
+  case "$line" in *quit*) exit 0;; esac
+done
+`))
+		require.NoError(t, err)
+		return protocol.FileList{{Path: "worker.sh", File: protocol.File{Blob: *blob, Mode: 0755}}}
+	}
+	run := func(files protocol.FileList, args ...string) *protocol.InvocationResponse {
+		spec := protocol.InvocationSpec{
+			Args:    args,
+			Files:   files,
+			Outputs: []string{"out.txt"},
+			Worker: &protocol.WorkerSpec{
+				Args:   []string{"./worker.sh"},
+				Inputs: []string{"worker.sh"},
+			},
+		}
+		resp, err := r.RunOne(ctx, &spec)
+		require.NoError(t, err)
+		require.NotNil(t, resp.Diagnostics)
+		require.NotNil(t, resp.Diagnostics.Worker)
+		return resp
+	}
+	waitExit := func() {
+		for _, w := range r.workers.workers {
+			<-w.exited
+		}
+	}
+
+	first := run(script("v1"), "build")
+	assert.Equal(t, 0, first.ExitStatus)
+	diag := first.Diagnostics.Worker
+	assert.Equal(t, 1, diag.Requests)
+	require.Equal(t, 1, len(diag.Events))
+	assert.Contains(t, diag.Events[0], "started")
+	assert.Equal(t, fmt.Sprintf("pid %d\n", diag.PID), readBlob(first.Stdout))
+	assert.Equal(t, "worker starting\nnot a response\n", readBlob(diag.Stderr))
+	require.Equal(t, 1, len(first.Outputs))
+	assert.Equal(t, "request 1\n", readBlob(&first.Outputs[0].Blob))
+
+	second := run(script("v1"), "build", "quit")
+	assert.Equal(t, 0, second.ExitStatus)
+	assert.Equal(t, diag.PID, second.Diagnostics.Worker.PID)
+	assert.Equal(t, 2, second.Diagnostics.Worker.Requests)
+	assert.Empty(t, second.Diagnostics.Worker.Events)
+	assert.Equal(t, "not a response\n", readBlob(second.Diagnostics.Worker.Stderr))
+	waitExit()
+
+	restarted := run(script("v1"), "build")
+	assert.Equal(t, 0, restarted.ExitStatus)
+	assert.NotEqual(t, diag.PID, restarted.Diagnostics.Worker.PID)
+	assert.Equal(t, 1, restarted.Diagnostics.Worker.Requests)
+	require.Equal(t, 2, len(restarted.Diagnostics.Worker.Events))
+	assert.Contains(t, restarted.Diagnostics.Worker.Events[0], "exited")
+
+	changed := run(script("v2"), "build")
+	assert.NotEqual(t, restarted.Diagnostics.Worker.PID, changed.Diagnostics.Worker.PID)
+	require.Equal(t, 2, len(changed.Diagnostics.Worker.Events))
+	assert.Contains(t, changed.Diagnostics.Worker.Events[0], "inputs changed")
+
+	crashed := run(script("v2"), "crash")
+	assert.Equal(t, -1, crashed.ExitStatus)
+	assert.Contains(t, readBlob(crashed.Stderr), "worker failed")
+	assert.Empty(t, r.workers.workers)
+}
+
+func TestRunOne_Shutdown(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", `
+trap 'echo terminated >> out.txt; exit 143' TERM
+echo partial
+echo started > out.txt
+sleep 30 &
+wait`},
+		Outputs:  []string{"out.txt"},
+		Teardown: [][]string{{"/bin/sh", "-c", "echo never > out.txt"}},
+	}
+	time.AfterFunc(200*time.Millisecond, r.Shutdown)
+	start := time.Now()
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+
+	assert.True(t, resp.Interrupted)
+	assert.Equal(t, 143, resp.ExitStatus)
+	assert.Contains(t, resp.Warnings, protocol.InterruptedWarning)
+	assert.Empty(t, resp.Teardown)
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "partial\n", string(stdout))
+	require.Equal(t, 1, len(resp.Outputs))
+	out, err := files.Read(ctx, st, &resp.Outputs[0].Blob)
+	require.NoError(t, err)
+	assert.Equal(t, "started\nterminated\n", string(out))
+
+	assert.Equal(t, ErrShutdown, r.serve(ctx, newRuntimeAPI("127.0.0.1:1")))
+}
+
+func TestShutdown_Concurrent(t *testing.T) {
+	var r Runtime
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Shutdown()
+		}()
+	}
+	wg.Wait()
+	assert.True(t, r.shuttingDown())
+}
+
+func TestRunOne_AsyncUploads(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	spec := protocol.InvocationSpec{
+		Args:         []string{"/bin/sh", "-c", "head -c 2097152 /dev/urandom > big; echo small > small"},
+		Outputs:      []string{"big", "small"},
+		AsyncUploads: true,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(resp.Outputs))
+	big, small := resp.Outputs[0], resp.Outputs[1]
+	assert.True(t, big.Pending)
+	assert.False(t, small.Pending)
+	_, err = store.Get(ctx, st, big.Ref)
+	assert.Equal(t, &store.NotFoundError{ID: big.Ref}, err)
+
+	r.finishUploads(ctx)
+	files.AwaitUploads(ctx, st, resp.Outputs, time.Second)
+	assert.False(t, resp.Outputs[0].Pending)
+	data, err := files.Read(ctx, st, &resp.Outputs[0].Blob)
+	require.NoError(t, err)
+	assert.Equal(t, 2097152, len(data))
+}
+
+// unwrapOnly wraps a store, exposing its optional interfaces only
+// through Unwrap
+type unwrapOnly struct{ inner store.Store }
+
+func (u unwrapOnly) Store(ctx context.Context, obj []byte) (string, error) {
+	return u.inner.Store(ctx, obj)
+}
+func (u unwrapOnly) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	u.inner.GetObjects(ctx, gets)
+}
+func (u unwrapOnly) FetchAWSUsage(usage *protocol.StoreUsage) { u.inner.FetchAWSUsage(usage) }
+func (u unwrapOnly) Unwrap() store.Store                      { return u.inner }
+
+func TestRunOne_AsyncUploadsUnwraps(t *testing.T) {
+	ctx := context.Background()
+	r := Runtime{store: unwrapOnly{store.InMemory()}}
+
+	spec := protocol.InvocationSpec{
+		Args:         []string{"/bin/sh", "-c", "head -c 2097152 /dev/urandom > big"},
+		Outputs:      []string{"big"},
+		AsyncUploads: true,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Outputs))
+	assert.True(t, resp.Outputs[0].Pending)
+	r.finishUploads(ctx)
+}
+
+func TestRunOne_AsyncUploadsLimit(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st, maxDeferred: 3 << 20}
+
+	spec := protocol.InvocationSpec{
+		Args:         []string{"/bin/sh", "-c", "head -c 2097152 /dev/urandom > a; head -c 2097152 /dev/urandom > b"},
+		Outputs:      []string{"a", "b"},
+		AsyncUploads: true,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(resp.Outputs))
+	assert.True(t, resp.Outputs[0].Pending)
+	assert.False(t, resp.Outputs[1].Pending)
+	assert.Equal(t, 1, len(r.pending))
+	_, err = store.Get(ctx, st, resp.Outputs[1].Ref)
+	assert.NoError(t, err)
+}
+
+func TestRunOne_Transfer(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	big := bytes.Repeat([]byte{0xff}, 2*protocol.MaxInlineBlob)
+	stdin, err := files.NewBlob(ctx, st, big[:protocol.MaxInlineBlob])
+	require.NoError(t, err)
+	file, err := files.NewBlob(ctx, st, big)
+	require.NoError(t, err)
+	inline, err := files.NewBlob(ctx, st, []byte("small"))
+	require.NoError(t, err)
+
+	spec := protocol.InvocationSpec{
+		Args:  []string{"/bin/true"},
+		Stdin: stdin,
+		Files: protocol.FileList{
+			{Path: "big", File: protocol.File{Blob: *file}},
+			{Path: "small", File: protocol.File{Blob: *inline}},
+		},
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, []protocol.Fetch{
+		{ID: stdin.Ref, Bytes: int64(protocol.MaxInlineBlob)},
+		{ID: file.Ref, Bytes: int64(2 * protocol.MaxInlineBlob)},
+	}, resp.Transfer.Fetched)
+}
+
+func TestRunOne_ContainerDiagnostics(t *testing.T) {
+	ctx := context.Background()
+	r := Runtime{store: store.InMemory(), initTime: 3 * time.Second, initStore: time.Second}
+
+	for i := 1; i <= 2; i++ {
+		resp, err := r.RunOne(ctx, &protocol.InvocationSpec{Args: []string{"/bin/true"}})
+		require.NoError(t, err)
+		require.NotNil(t, resp.Diagnostics)
+		assert.Equal(t, i == 1, resp.Times.ColdStart)
+		assert.Equal(t, &protocol.ContainerDiagnostics{
+			Invocations: i,
+			Init:        3 * time.Second,
+			InitStore:   time.Second,
+			Arch:        runtime.GOARCH,
+		}, resp.Diagnostics.Container)
+	}
+}
+
+func TestStoreTuning(t *testing.T) {
+	defer os.Unsetenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")
+	defer os.Unsetenv("LLAMA_STORE_CONCURRENCY")
+	for _, tc := range []struct {
+		mem, override string
+		concurrency   int
+		retain        int
+	}{
+		{"", "", 32, 16 << 20},
+		{"128", "", 2, 2 << 20},
+		{"256", "", 4, 4 << 20},
+		{"1024", "", 16, 16 << 20},
+		{"10240", "", 32, 16 << 20},
+		{"256", "12", 12, 4 << 20},
+	} {
+		os.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", tc.mem)
+		os.Setenv("LLAMA_STORE_CONCURRENCY", tc.override)
+		concurrency, retain := StoreTuning()
+		assert.Equal(t, tc.concurrency, concurrency, "mem=%s", tc.mem)
+		assert.Equal(t, tc.retain, retain, "mem=%s", tc.mem)
+	}
+}
+
+func foreignELF(t *testing.T) []byte {
+	machine := elf.EM_AARCH64
+	if runtime.GOARCH == "arm64" {
+		machine = elf.EM_X86_64
+	}
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    64,
+		Phentsize: 56,
+		Shentsize: 64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.LittleEndian, &hdr))
+	return buf.Bytes()
+}
+
+func TestRunOne_ExecFormat(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	foreign, err := files.NewBlob(ctx, st, foreignELF(t))
+	require.NoError(t, err)
+	text, err := files.NewBlob(ctx, st, []byte("\x00\x01 not a program\n"))
+	require.NoError(t, err)
+	shipped := func() protocol.FileList {
+		return protocol.FileList{
+			{Path: "tool", File: protocol.File{Blob: *foreign, Mode: 0755}},
+			{Path: "data", File: protocol.File{Blob: *text, Mode: 0755}},
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"direct", []string{"./tool"}, "but this function runs"},
+		{"via shell", []string{"/bin/sh", "-c", "./tool", "./tool"}, "but this function runs"},
+		{"not a program", []string{"./data"}, "neither an ELF binary nor a script"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := r.RunOne(ctx, &protocol.InvocationSpec{Args: tc.args, Files: shipped()})
+			require.Error(t, err)
+			var pe *protocol.Error
+			require.True(t, errors.As(err, &pe), "err=%v", err)
+			assert.Equal(t, protocol.ErrExecFormat, pe.Code)
+			assert.Contains(t, pe.Message, tc.want)
+		})
+	}
+}
+
+func TestSweepWorkspaces(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "llama-sweep")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	exited := exec.Command("/bin/true")
+	require.NoError(t, exited.Run())
+	dead, self := exited.Process.Pid, os.Getpid()
+
+	r := Runtime{activeRoot: path.Join(tmp, fmt.Sprintf("llama-job.%d.3.1", self))}
+	dirs := map[string]bool{
+		fmt.Sprintf("llama-job.%d.1.1", dead):      false,
+		fmt.Sprintf("llama-job.%d.1.1.tmp", dead):  false,
+		fmt.Sprintf("llama-worker.%d.abc.1", dead): false,
+		fmt.Sprintf("llama-job.%d.2.1", self):      false,
+		fmt.Sprintf("llama-job.%d.3.1", self):      true,
+		fmt.Sprintf("llama-job.%d.3.1.tmp", self):  true,
+		fmt.Sprintf("llama-worker.%d.abc.1", self): true,
+		fmt.Sprintf("llama-job.%d.1.1", 1):         true,
+		"llama.cache.1":                            true,
+		fmt.Sprintf("unrelated.%d.1.1", dead):      true,
+	}
+	for dir := range dirs {
+		require.NoError(t, os.MkdirAll(path.Join(tmp, dir, "sub"), 0755))
+		require.NoError(t, ioutil.WriteFile(path.Join(tmp, dir, "sub", "file"), []byte("data"), 0644))
+	}
+
+	r.sweepWorkspaces(context.Background())
+	for dir, kept := range dirs {
+		_, err := os.Stat(path.Join(tmp, dir))
+		assert.Equal(t, kept, err == nil, "%s", dir)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	lookup := envLookup([]string{"A=apple", "EMPTY=", "B_2=banana"})
+	for _, tc := range []struct{ in, want string }{
+		{"plain", "plain"},
+		{"$A", "apple"},
+		{"${A}pie", "applepie"},
+		{"$A.$B_2", "apple.banana"},
+		{"x$EMPTY.y", "x.y"},
+		{"$$A", "$A"},
+		{"$$$A", "$apple"},
+		{"$UNKNOWN ${UNKNOWN}", "$UNKNOWN ${UNKNOWN}"},
+		{"cost: $5, ${", "cost: $5, ${"},
+		{"trailing $", "trailing $"},
+		{"${}", "${}"},
+	} {
+		assert.Equal(t, tc.want, expandVars(tc.in, lookup), "in=%q", tc.in)
+	}
+}
+
+func TestRunOne_ExpandVars(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+
+	for _, tc := range []struct {
+		name    string
+		cmdline []string
+		args    []string
+	}{
+		{"direct", nil, []string{"/bin/sh", "-c", `echo "$OUT"; echo "$@"`, "sh"}},
+		{"shell wrapped", []string{"/bin/sh", "-c", `echo "$OUT"; echo "$@"`, "echo"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := Runtime{store: st, cmdline: tc.cmdline, workerId: "w"}
+			spec := protocol.InvocationSpec{
+				Args:       append(tc.args, "--out=$LLAMA_ROOT/build", "$$HOME", "$UNKNOWN", "${LLAMA_JOB_ID}"),
+				Env:        []string{"OUT=${LLAMA_TMPDIR}/out"},
+				ExpandVars: true,
+			}
+			resp, err := r.RunOne(ctx, &spec)
+			require.NoError(t, err)
+			stdout, err := files.Read(ctx, st, resp.Stdout)
+			require.NoError(t, err)
+			lines := strings.Split(strings.TrimSpace(string(stdout)), "\n")
+			require.Equal(t, 2, len(lines))
+			assert.Regexp(t, `^/.*/llama-job\.\d+\.1\.\d+\.tmp/out$`, lines[0])
+			assert.Regexp(t, `^--out=/.*/llama-job\.\d+\.1\.\d+/build \$HOME \$UNKNOWN w-1$`, lines[1])
+		})
+	}
+}
+
+func TestRunOne_Spans(t *testing.T) {
+	ctx := context.Background()
+	r := Runtime{store: store.Traced(store.InMemory(), "memory")}
+
+	resp, err := r.RunOne(ctx, &protocol.InvocationSpec{
+		Trace: &tracing.Propagation{TraceId: "0123456789abcdef", ParentId: "fedcba9876543210"},
+		// Enough output that stdout goes to the store
+		Args: []string{"/bin/sh", "-c", "head -c 100000 /dev/zero"},
+	})
+	require.NoError(t, err)
+
+	byName := make(map[string]tracing.Span)
+	for _, sp := range resp.InlineSpans {
+		assert.Equal(t, "0123456789abcdef", sp.TraceId)
+		byName[sp.Name] = sp
+	}
+	root := byName["runtime.Execute"]
+	assert.Equal(t, "fedcba9876543210", root.ParentId)
+	for _, name := range []string{"materialize", "exec", "upload"} {
+		if assert.Contains(t, byName, name) {
+			assert.Equal(t, root.SpanId, byName[name].ParentId, name)
+		}
+	}
+	assert.Equal(t, byName["upload"].SpanId, byName["store.put"].ParentId)
+}
+
+func TestRunOne_PersistTrace(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	r := Runtime{store: st}
+
+	resp, err := r.RunOne(ctx, &protocol.InvocationSpec{
+		Args:         []string{"/bin/true"},
+		PersistTrace: true,
+	})
+	require.NoError(t, err)
+	assert.NotEmpty(t, resp.JobID)
+	assert.Empty(t, resp.Warnings)
+	// The client didn't ask for spans, so they aren't returned
+	assert.Empty(t, resp.InlineSpans)
+
+	spans, err := store.GetTrace(ctx, st, resp.JobID)
+	require.NoError(t, err)
+	var names []string
+	for _, sp := range spans {
+		names = append(names, sp.Name)
+	}
+	assert.Contains(t, names, "runtime.Execute")
+	assert.Contains(t, names, "exec")
+
+	// Stores that can't hold traces don't fail the job
+	bare := Runtime{store: unkeyedStore{st}}
+	resp, err = bare.RunOne(ctx, &protocol.InvocationSpec{
+		Args:         []string{"/bin/true"},
+		PersistTrace: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	assert.Equal(t, []string{"persisting trace: " + store.ErrNotKeyed.Error()}, resp.Warnings)
+}
+
+// unkeyedStore passes objects through to the store it wraps, but
+// isn't a KeyedStore, and has no Unwrap to find one through, so a
+// job's trace has nowhere to be persisted.
+type unkeyedStore struct{ inner store.Store }
+
+func (u unkeyedStore) Store(ctx context.Context, obj []byte) (string, error) {
+	return u.inner.Store(ctx, obj)
+}
+func (u unkeyedStore) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	u.inner.GetObjects(ctx, gets)
+}
+func (u unkeyedStore) FetchAWSUsage(usage *protocol.StoreUsage) {}
+
+func TestRunOne_Replay(t *testing.T) {
+	ctx := context.Background()
+	r := Runtime{store: store.InMemory()}
+
+	job := &protocol.InvocationSpec{
+		Args:             []string{"/bin/sh", "-c", "echo ran; exit 3"},
+		IdempotencyToken: "token-1",
+	}
+	first, err := r.RunOne(ctx, job)
+	require.NoError(t, err)
+	assert.False(t, first.Replayed)
+
+	var stdout bytes.Buffer
+	again, err := r.RunOneStreaming(ctx, job, &stdout)
+	require.NoError(t, err)
+	assert.True(t, again.Replayed)
+	assert.Equal(t, first.JobID, again.JobID)
+	assert.Equal(t, 3, again.ExitStatus)
+	assert.Equal(t, "ran\n", stdout.String())
+	assert.Equal(t, 1, r.jobCount)
+
+	job.IdempotencyToken = "token-2"
+	other, err := r.RunOne(ctx, job)
+	require.NoError(t, err)
+	assert.False(t, other.Replayed)
+	assert.NotEqual(t, first.JobID, other.JobID)
+}
+
+func TestRunOne_MissingBlob(t *testing.T) {
+	ctx := context.Background()
+	r := Runtime{store: store.InMemory()}
+
+	_, err := r.RunOne(ctx, &protocol.InvocationSpec{
+		Args: []string{"/bin/true"},
+		Files: protocol.FileList{
+			{Path: "in.txt", File: protocol.File{Blob: protocol.Blob{Ref: "deadbeef"}}},
+		},
+	})
+	var pe *protocol.Error
+	require.True(t, errors.As(err, &pe), "err=%v", err)
+	assert.Equal(t, protocol.ErrMissingBlob, pe.Code)
+	assert.Equal(t, []string{"deadbeef"}, pe.MissingIDs())
+}
+
+func TestRunOne_Nested(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "hunter2")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	r := Runtime{store: st, storeURL: "s3://bucket/obj/", function: "fn"}
+	spec := protocol.InvocationSpec{
+		Args: []string{"/bin/sh", "-c", `echo "$LLAMA_NESTING_DEPTH $LLAMA_FUNCTION $LLAMA_OBJECT_STORE $AWS_SECRET_ACCESS_KEY"
+for i in 1 2; do echo '{"invocations":1,"usage":{"Lambda":{"Millis":10}},"fetch_bytes":5}' >> "$LLAMA_NESTED_STATS"; done
+echo 'truncat' >> "$LLAMA_NESTED_STATS"`},
+		Sandbox: true,
+		Nested:  true,
+		Depth:   1,
+	}
+	resp, err := r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	assert.Equal(t, 0, resp.ExitStatus)
+	stdout, err := files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "2 fn s3://bucket/obj/ hunter2\n", string(stdout))
+	require.NotNil(t, resp.Nested)
+	assert.Equal(t, 2, resp.Nested.Invocations)
+	assert.Equal(t, uint64(20), resp.Nested.Usage.Lambda.Millis)
+	assert.Equal(t, int64(10), resp.Nested.FetchBytes)
+
+	// Without Nested, the job only learns its depth.
+	spec = protocol.InvocationSpec{
+		Args:    []string{"/bin/sh", "-c", `echo "$LLAMA_NESTING_DEPTH $LLAMA_FUNCTION $AWS_SECRET_ACCESS_KEY"`},
+		Sandbox: true,
+	}
+	resp, err = r.RunOne(ctx, &spec)
+	require.NoError(t, err)
+	stdout, err = files.Read(ctx, st, resp.Stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "1  \n", string(stdout))
+	assert.Nil(t, resp.Nested)
+
+	_, err = r.RunOne(ctx, &protocol.InvocationSpec{
+		Args:  []string{"/bin/true"},
+		Depth: protocol.MaxNestingDepth + 1,
+	})
+	assert.Error(t, err)
+}
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	st := store.InMemory()
+	local := NewLocal(st)
+
+	spec := protocol.InvocationSpec{
+		Args:         []string{"/bin/sh", "-c", "head -c 2097152 /dev/zero > big; echo hi"},
+		Outputs:      []string{"big"},
+		AsyncUploads: true,
+	}
+	var stdout bytes.Buffer
+	resp, err := local.RunOneStreaming(ctx, &spec, &stdout)
+	require.NoError(t, err)
+	assert.True(t, resp.Local)
+	assert.Equal(t, 0, resp.ExitStatus)
+	assert.Equal(t, "hi\n", stdout.String())
+	assert.Zero(t, resp.Usage.Lambda.Millis)
+
+	// Deferred uploads are done by the time the job returns.
+	require.Equal(t, 1, len(resp.Outputs))
+	data, err := files.Read(ctx, st, &resp.Outputs[0].Blob)
+	require.NoError(t, err)
+	assert.Equal(t, 2097152, len(data))
+
+	// The next job reuses the idle runtime.
+	again, err := local.RunOneStreaming(ctx, &protocol.InvocationSpec{Args: []string{"true"}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, again.Diagnostics.Container.Invocations)
+
+	_, err = local.RunOneStreaming(ctx, &protocol.InvocationSpec{
+		Files: protocol.FileList{{Path: "in", File: protocol.File{Blob: protocol.Blob{Ref: "missing"}}}},
+	}, nil)
+	require.Error(t, err)
+}
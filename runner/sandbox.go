@@ -0,0 +1,424 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// sandboxHelperArg, passed as argv[1], makes the runtime binary act
+// as the setup helper for a namespaced sandbox instead of as a
+// Lambda runtime. See sandboxMain.
+const sandboxHelperArg = "__llama_sandbox"
+
+// helperInstalled records whether the program called SandboxHelper,
+// and so whether it is safe to re-execute it as the helper.
+var helperInstalled bool
+
+// Directories made visible (read-only) inside a namespaced
+// sandbox. Paths that are symlinks on the host (e.g. /bin on
+// merged-/usr systems) are recreated as symlinks instead.
+var sandboxMounts = []string{"/usr", "/bin", "/sbin", "/lib", "/lib64", "/etc"}
+
+// Device nodes made visible inside a namespaced sandbox.
+var sandboxDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom"}
+
+// Environment variables passed through to a sandboxed command. All
+// others, notably the function's AWS credentials, are dropped.
+var sandboxEnvAllow = []string{"PATH", "LANG", "LC_ALL", "TZ"}
+
+// sandboxLevel determines, once per container, the strongest
+// sandbox level the kernel will let us set up. A program that never
+// called SandboxHelper would just run its own main again if we
+// re-executed it, so it only gets weak sandboxing.
+func (r *Runtime) sandboxLevel() string {
+	r.sandboxOnce.Do(func() {
+		err := errors.New("the program did not call runner.SandboxHelper")
+		if helperInstalled {
+			var self string
+			if self, err = os.Executable(); err == nil {
+				r.sandboxExe = self
+				err = probeNamespaceSandbox(self)
+			}
+		}
+		if err != nil {
+			defaultLogger.Warn("namespaces unavailable, falling back to weak sandboxing", "phase", "sandbox", "error", err)
+			r.sandbox = protocol.SandboxWeak
+		} else {
+			r.sandbox = protocol.SandboxNamespace
+		}
+	})
+	return r.sandbox
+}
+
+func namespaceAttrs() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS |
+			syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+	}
+}
+
+func probeNamespaceSandbox(self string) error {
+	root, err := ioutil.TempDir("", "llama.sandbox-probe.*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	binds, cleanup, err := prepareSandboxRoot(root)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cmd := exec.Cmd{
+		Path:        self,
+		Args:        []string{self, sandboxHelperArg, root, strings.Join(binds, ":"), "", ""},
+		SysProcAttr: namespaceAttrs(),
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// prepareSandboxRoot creates the mount points and symlinks a
+// namespaced sandbox needs inside `root`, returning the list of
+// directories to bind-mount and a function that removes everything
+// it created. Anything that already exists in the workspace is left
+// alone and not mounted over.
+func prepareSandboxRoot(root string) ([]string, func(), error) {
+	var created []string
+	cleanup := func() {
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i])
+		}
+	}
+	create := func(where string, fn func() error) (bool, error) {
+		if _, err := os.Lstat(where); err == nil {
+			return false, nil
+		}
+		if err := fn(); err != nil {
+			return false, err
+		}
+		created = append(created, where)
+		return true, nil
+	}
+	var binds []string
+	for _, dir := range sandboxMounts {
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			continue
+		}
+		where := path.Join(root, dir)
+		var made bool
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(dir)
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			_, err = create(where, func() error { return os.Symlink(target, where) })
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			continue
+		}
+		made, err = create(where, func() error { return os.Mkdir(where, 0755) })
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if made {
+			binds = append(binds, dir)
+		}
+	}
+	for _, dir := range []string{"/dev", "/proc"} {
+		where := path.Join(root, dir)
+		if _, err := create(where, func() error { return os.Mkdir(where, 0755) }); err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+	}
+	for _, dev := range sandboxDevices {
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		where := path.Join(root, dev)
+		made, err := create(where, func() error { return ioutil.WriteFile(where, nil, 0644) })
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if made {
+			binds = append(binds, dev)
+		}
+	}
+	return binds, cleanup, nil
+}
+
+// SandboxHelper makes the process act as the sandbox helper, and
+// exit, if it was started as one. Any program that runs sandboxed
+// jobs must call it before doing anything else; jobs run by programs
+// that don't fall back to weak sandboxing.
+func SandboxHelper() {
+	helperInstalled = true
+	if len(os.Args) > 1 && os.Args[1] == sandboxHelperArg {
+		sandboxMain(os.Args[2:])
+	}
+}
+
+// sandboxMain runs inside a fresh set of namespaces as
+//
+//	runtime __llama_sandbox ROOT BINDS SCRATCH EXE ARGV...
+//
+// It bind-mounts BINDS (a colon-separated list) read-only into
+// ROOT, bind-mounts SCRATCH, if set, read-write at ROOT/tmp, mounts
+// /proc, chroots into ROOT, and execs EXE. An empty EXE
+// means we are only probing whether sandbox setup works.
+func sandboxMain(args []string) {
+	if err := sandboxExec(args); err != nil {
+		fmt.Fprintf(os.Stderr, "llama sandbox: %s\n", err.Error())
+		os.Exit(127)
+	}
+	os.Exit(0)
+}
+
+func sandboxExec(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("bad arguments: %q", args)
+	}
+	root, binds, scratch, exe, argv := args[0], args[1], args[2], args[3], args[4:]
+	if err := unix.Mount("none", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make / private: %w", err)
+	}
+	for _, bind := range strings.Split(binds, ":") {
+		if bind == "" {
+			continue
+		}
+		where := path.Join(root, bind)
+		if err := unix.Mount(bind, where, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", bind, err)
+		}
+		if strings.HasPrefix(bind, "/dev/") {
+			continue
+		}
+		var st unix.Statfs_t
+		if err := unix.Statfs(where, &st); err != nil {
+			return fmt.Errorf("statfs %s: %w", bind, err)
+		}
+		// Remounting inside a user namespace must preserve the
+		// locked flags of the original mount.
+		flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+		for _, f := range []struct{ st, ms int64 }{
+			{unix.ST_NOSUID, unix.MS_NOSUID},
+			{unix.ST_NODEV, unix.MS_NODEV},
+			{unix.ST_NOEXEC, unix.MS_NOEXEC},
+			{unix.ST_NOATIME, unix.MS_NOATIME},
+			{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+			{unix.ST_RELATIME, unix.MS_RELATIME},
+		} {
+			if int64(st.Flags)&f.st != 0 {
+				flags |= uintptr(f.ms)
+			}
+		}
+		if err := unix.Mount("", where, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %w", bind, err)
+		}
+	}
+	if scratch != "" {
+		if err := unix.Mount(scratch, path.Join(root, "tmp"), "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("bind scratch: %w", err)
+		}
+	}
+	if err := unix.Mount("proc", path.Join(root, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+	if err := unix.Chroot(root); err != nil {
+		return fmt.Errorf("chroot: %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("chdir: %w", err)
+	}
+	if exe == "" {
+		return nil
+	}
+	exe = rewriteSandboxPath(root, exe)
+	for i := range argv {
+		argv[i] = rewriteSandboxPath(root, argv[i])
+	}
+	return unix.Exec(exe, argv, os.Environ())
+}
+
+func rewriteSandboxPath(root, p string) string {
+	if p == root {
+		return "/"
+	}
+	if strings.HasPrefix(p, root+"/") {
+		return p[len(root):]
+	}
+	return p
+}
+
+func sandboxEnv(home string) []string {
+	env := []string{"HOME=" + home}
+	for _, k := range sandboxEnvAllow {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// sandboxRun tracks a command configured to run sandboxed.
+type sandboxRun struct {
+	level   string
+	cleanup func()
+	watch   *writeWatch
+}
+
+// sandboxCommand configures `cmd` to run in the strongest sandbox
+// available. The returned sandboxRun's finish method must be called
+// after the command exits.
+func (r *Runtime) sandboxCommand(cmd *exec.Cmd, job *ParsedJob) (*sandboxRun, error) {
+	run := &sandboxRun{level: r.sandboxLevel()}
+	switch run.level {
+	case protocol.SandboxNamespace:
+		binds, cleanup, err := prepareSandboxRoot(job.Root)
+		if err != nil {
+			return nil, fmt.Errorf("sandbox: %w", err)
+		}
+		// The scratch directory appears as /tmp, unless
+		// the job shipped its own.
+		scratch := ""
+		tmp := path.Join(job.Root, "tmp")
+		if _, err := os.Lstat(tmp); err != nil && job.Scratch != "" {
+			if err := os.Mkdir(tmp, 0755); err != nil {
+				cleanup()
+				return nil, fmt.Errorf("sandbox: %w", err)
+			}
+			scratch = job.Scratch
+			removeMounts := cleanup
+			cleanup = func() { removeMounts(); os.Remove(tmp) }
+		}
+		run.cleanup = cleanup
+		args := []string{r.sandboxExe, sandboxHelperArg, job.Root, strings.Join(binds, ":"), scratch, cmd.Path}
+		cmd.Args = append(args, cmd.Args...)
+		cmd.Path = r.sandboxExe
+		cmd.SysProcAttr = namespaceAttrs()
+		cmd.Env = job.environ(sandboxEnv("/"), "/", "/tmp")
+	case protocol.SandboxWeak:
+		cmd.Env = job.environ(sandboxEnv(job.Root), job.Root, job.Scratch)
+		run.watch = watchOutside(job.Root, job.Scratch, r.cacheDir)
+	}
+	return run, nil
+}
+
+// finish cleans up after a sandboxed command and returns any
+// warnings it produced.
+func (s *sandboxRun) finish() []string {
+	if s.cleanup != nil {
+		s.cleanup()
+	}
+	if s.watch != nil {
+		return s.watch.check()
+	}
+	return nil
+}
+
+// writeWatch is the weak sandbox's post-hoc check for writes
+// outside of the workspace. It records the modification times of
+// the entries in the temporary directory (which the workspace
+// shares with other jobs and the runtime's cache), and of
+// directories under the cache directory, and reports anything that
+// changed.
+type writeWatch struct {
+	root     string
+	scratch  string
+	cacheDir string
+	dirs     []string
+	before   map[string]time.Time
+}
+
+func watchOutside(root, scratch, cacheDir string) *writeWatch {
+	w := &writeWatch{root: root, scratch: scratch, cacheDir: cacheDir}
+	w.dirs = append(w.dirs, os.TempDir())
+	if home := os.Getenv("HOME"); home != "" {
+		w.dirs = append(w.dirs, home)
+	}
+	w.before = w.snapshot()
+	return w
+}
+
+func (w *writeWatch) snapshot() map[string]time.Time {
+	seen := make(map[string]time.Time)
+	for _, dir := range w.dirs {
+		ents, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, ent := range ents {
+			p := filepath.Join(dir, ent.Name())
+			if p == w.root || p == w.scratch {
+				continue
+			}
+			seen[p] = ent.ModTime()
+		}
+	}
+	if w.cacheDir != "" {
+		filepath.Walk(w.cacheDir, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.IsDir() {
+				seen[p] = fi.ModTime()
+			}
+			return nil
+		})
+	}
+	return seen
+}
+
+func (w *writeWatch) check() []string {
+	var warnings []string
+	for p, mtime := range w.snapshot() {
+		old, ok := w.before[p]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("sandbox: command created %s outside of its workspace", p))
+		} else if !old.Equal(mtime) {
+			warnings = append(warnings, fmt.Sprintf("sandbox: command modified %s outside of its workspace", p))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
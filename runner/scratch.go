@@ -0,0 +1,86 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Variables that point programs at a temporary directory
+var tempEnvVars = []string{"TMPDIR", "TEMP", "TMP"}
+
+// overrideEnv returns `env` with each KEY=VALUE in `vars` replacing
+// any existing setting of KEY.
+func overrideEnv(env []string, vars ...string) []string {
+	keys := make(map[string]bool, len(vars))
+	for _, kv := range vars {
+		keys[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	out := make([]string, 0, len(env)+len(vars))
+	for _, kv := range env {
+		if !keys[strings.SplitN(kv, "=", 2)[0]] {
+			out = append(out, kv)
+		}
+	}
+	return append(out, vars...)
+}
+
+// environ returns the environment for one of the job's commands:
+// `base`, with the temporary-directory variables pointed at
+// `scratch` and LLAMA_ROOT at `root` (the scratch directory and job
+// root, as the command sees them), and the job's own variables
+// added. If the spec asked for expansion, the values of the job's
+// variables are expanded against the environment built so far.
+func (p *ParsedJob) environ(base []string, root, scratch string) []string {
+	vars := make([]string, 0, len(tempEnvVars)+3)
+	for _, k := range tempEnvVars {
+		vars = append(vars, k+"="+scratch)
+	}
+	vars = append(vars, "LLAMA_ROOT="+root, "LLAMA_TMPDIR="+scratch, "LLAMA_JOB_ID="+p.ID)
+	vars = append(vars, p.nestingEnv(scratch)...)
+	env := overrideEnv(base, vars...)
+	own := p.Env
+	if p.Expand {
+		lookup := envLookup(env)
+		own = make([]string, len(p.Env))
+		for i, kv := range p.Env {
+			own[i] = expandVars(kv, lookup)
+		}
+	}
+	return overrideEnv(env, own...)
+}
+
+// diskUsage returns the space used by the files under `dir`, like
+// du(1). Errors are ignored; we report what we can see.
+func diskUsage(dir string) uint64 {
+	var total uint64
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			total += uint64(st.Blocks) * 512
+		} else {
+			total += uint64(fi.Size())
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// shutdownGrace is how long a job's processes get to exit after we
+// pass on SIGTERM before they are killed. Lambda allows a little
+// more than this in total, and we still need to upload the job's
+// results.
+const shutdownGrace = 200 * time.Millisecond
+
+// ErrShutdown is returned by Serve after the container is told to
+// shut down.
+var ErrShutdown = errors.New("container is shutting down")
+
+func (r *Runtime) shutdownCh() chan struct{} {
+	r.shutdownOnce.Do(func() { r.shutdown = make(chan struct{}) })
+	return r.shutdown
+}
+
+// Shutdown tells the runtime that the container is being reclaimed.
+// The running job's processes are terminated, its partial results are
+// returned, and no further invocations are accepted. It is safe to
+// call more than once, and concurrently.
+func (r *Runtime) Shutdown() {
+	ch := r.shutdownCh()
+	r.closeOnce.Do(func() {
+		defaultLogger.Warn("shutting down")
+		close(ch)
+	})
+}
+
+func (r *Runtime) shuttingDown() bool {
+	select {
+	case <-r.shutdownCh():
+		return true
+	default:
+		return false
+	}
+}
+
+// withShutdown returns a context that is also canceled on Shutdown.
+// The goroutine watching for Shutdown doesn't touch `r`, so that it
+// may linger after the context is canceled.
+func (r *Runtime) withShutdown(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	shutdown := r.shutdownCh()
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// setpgid puts `cmd` in a process group of its own, so that we can
+// signal everything it starts.
+func setpgid(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// waitJob waits for a command started with setpgid. Like
+// waitContext, it kills the command if `ctx` is done. On Shutdown,
+// the command's process group is sent SIGTERM and, after
+// shutdownGrace, SIGKILL; waitJob then reports that the command was
+// interrupted.
+func (r *Runtime) waitJob(ctx context.Context, cmd *exec.Cmd) (bool, error) {
+	var interrupted int32
+	done := make(chan struct{})
+	shutdown := r.shutdownCh()
+	go func() {
+		pgid := -cmd.Process.Pid
+		select {
+		case <-ctx.Done():
+			unix.Kill(pgid, unix.SIGKILL)
+		case <-shutdown:
+			atomic.StoreInt32(&interrupted, 1)
+			unix.Kill(pgid, unix.SIGTERM)
+			select {
+			case <-time.After(shutdownGrace):
+				unix.Kill(pgid, unix.SIGKILL)
+			case <-done:
+			}
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	return atomic.LoadInt32(&interrupted) != 0, err
+}
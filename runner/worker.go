@@ -0,0 +1,411 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/protocol/files"
+	"github.com/nelhage/llama/tracing"
+	"golang.org/x/crypto/blake2b"
+)
+
+// DefaultMaxWorkers is the number of idle workers kept alive per
+// container unless LLAMA_MAX_WORKERS says otherwise.
+const DefaultMaxWorkers = 2
+
+// maxWorkerLog caps how much of a worker's stderr we hold between
+// jobs
+const maxWorkerLog = 1 << 20
+
+var errWorkerExited = errors.New("worker exited")
+
+// workerLog collects a worker's stderr, and stray stdout, between
+// jobs.
+type workerLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *workerLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if room := maxWorkerLog - l.buf.Len(); room < len(p) {
+		if room > 0 {
+			l.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return l.buf.Write(p)
+}
+
+func (l *workerLog) take() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := append([]byte(nil), l.buf.Bytes()...)
+	l.buf.Reset()
+	return out
+}
+
+type worker struct {
+	key string
+	// fingerprint identifies the worker's command, environment,
+	// and inputs; if it changes, the worker is restarted.
+	fingerprint string
+	dir         string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	lines  chan []byte
+	exited chan struct{}
+	log    workerLog
+
+	events   []string
+	requests int
+	lastUsed time.Time
+}
+
+type workerPool struct {
+	max     int
+	workers map[string]*worker
+}
+
+// workerKey identifies the pool slot for a worker command
+func workerKey(args []string) string {
+	h, _ := blake2b.New256(nil)
+	json.NewEncoder(h).Encode(args)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// workerFingerprint hashes everything a worker was started with.
+func workerFingerprint(job *ParsedJob, spec *protocol.WorkerSpec) (string, error) {
+	h, _ := blake2b.New256(nil)
+	enc := json.NewEncoder(h)
+	enc.Encode(spec.Args)
+	enc.Encode(job.Env)
+	for _, in := range spec.Inputs {
+		data, err := ioutil.ReadFile(path.Join(job.Root, in))
+		if err != nil {
+			return "", fmt.Errorf("reading worker input: %w", err)
+		}
+		enc.Encode(in)
+		enc.Encode(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (w *worker) event(format string, args ...interface{}) {
+	w.events = append(w.events, fmt.Sprintf(format, args...))
+}
+
+func (w *worker) alive() bool {
+	select {
+	case <-w.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop kills the worker, waits for it to exit, and removes its
+// directory.
+func (w *worker) stop() {
+	w.stdin.Close()
+	w.cmd.Process.Kill()
+	<-w.exited
+	os.RemoveAll(w.dir)
+}
+
+func (w *worker) exitReason() string {
+	if w.cmd.ProcessState == nil {
+		return "exited"
+	}
+	return fmt.Sprintf("exited (%s)", w.cmd.ProcessState.String())
+}
+
+func startWorker(key, fingerprint string, job *ParsedJob, spec *protocol.WorkerSpec) (*worker, error) {
+	if len(spec.Args) == 0 {
+		return nil, errors.New("worker has no args")
+	}
+	dir, err := ioutil.TempDir("", workerPattern(key))
+	if err != nil {
+		return nil, err
+	}
+	w := &worker{
+		key:         key,
+		fingerprint: fingerprint,
+		dir:         dir,
+		lines:       make(chan []byte, 16),
+		exited:      make(chan struct{}),
+	}
+	if err := w.start(job, spec); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return w, nil
+}
+
+func copyFile(src, dst string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, fi.Mode().Perm())
+}
+
+func (w *worker) start(job *ParsedJob, spec *protocol.WorkerSpec) error {
+	for _, in := range spec.Inputs {
+		if err := copyFile(path.Join(job.Root, in), path.Join(w.dir, in)); err != nil {
+			return fmt.Errorf("copying worker input: %w", err)
+		}
+	}
+	tmp := path.Join(w.dir, ".tmp")
+	if err := os.Mkdir(tmp, 0700); err != nil {
+		return err
+	}
+
+	w.cmd = exec.Command(spec.Args[0], spec.Args[1:]...)
+	if strings.ContainsRune(spec.Args[0], '/') && !path.IsAbs(spec.Args[0]) {
+		w.cmd.Path = path.Join(w.dir, spec.Args[0])
+	}
+	w.cmd.Dir = w.dir
+	w.cmd.Env = job.environ(os.Environ(), w.dir, tmp)
+	w.cmd.Stderr = &w.log
+	var err error
+	if w.stdin, err = w.cmd.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := w.cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := startCommand(w.cmd, job.Nice); err != nil {
+		return fmt.Errorf("starting worker: %w", err)
+	}
+	go func() {
+		// Wait must not be called until we're done reading
+		// stdout.
+		r := bufio.NewReader(stdout)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				w.lines <- line
+			}
+			if err != nil {
+				break
+			}
+		}
+		close(w.lines)
+		w.cmd.Wait()
+		close(w.exited)
+	}()
+	w.event("started (pid %d)", w.cmd.Process.Pid)
+	return nil
+}
+
+// request sends a WorkRequest and waits for the matching response.
+// Lines the worker writes that aren't the response are logged.
+func (w *worker) request(ctx context.Context, req *protocol.WorkRequest) (*protocol.WorkResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.stdin.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				return nil, errWorkerExited
+			}
+			var resp protocol.WorkResponse
+			if json.Unmarshal(line, &resp) != nil || resp.RequestID != req.RequestID {
+				w.log.Write(line)
+				continue
+			}
+			return &resp, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// get returns a running worker for `spec`, starting or restarting
+// one if necessary.
+func (p *workerPool) get(job *ParsedJob, spec *protocol.WorkerSpec) (*worker, error) {
+	if p.workers == nil {
+		p.workers = make(map[string]*worker)
+	}
+	key := workerKey(spec.Args)
+	fingerprint, err := workerFingerprint(job, spec)
+	if err != nil {
+		return nil, err
+	}
+	var events []string
+	if w := p.workers[key]; w != nil {
+		switch {
+		case !w.alive():
+			events = append(w.events, w.exitReason()+"; restarting")
+		case w.fingerprint != fingerprint:
+			events = append(w.events, "inputs changed; restarting")
+		default:
+			return w, nil
+		}
+		w.stop()
+		delete(p.workers, key)
+	}
+	w, err := startWorker(key, fingerprint, job, spec)
+	if err != nil {
+		return nil, err
+	}
+	w.events = append(events, w.events...)
+	p.workers[key] = w
+	p.evict(w)
+	return w, nil
+}
+
+// evict stops the least-recently-used idle workers until the pool
+// is within its limit.
+func (p *workerPool) evict(keep *worker) {
+	max := p.max
+	if max <= 0 {
+		max = DefaultMaxWorkers
+	}
+	for len(p.workers) > max {
+		var lru *worker
+		for _, w := range p.workers {
+			if w != keep && (lru == nil || w.lastUsed.Before(lru.lastUsed)) {
+				lru = w
+			}
+		}
+		if lru == nil {
+			return
+		}
+		lru.stop()
+		delete(p.workers, lru.key)
+		keep.event("evicted idle worker %s", lru.key)
+	}
+}
+
+func (p *workerPool) discard(w *worker) {
+	w.stop()
+	if p.workers[w.key] == w {
+		delete(p.workers, w.key)
+	}
+}
+
+// runWorker runs the job by sending it to a persistent worker,
+// recording the worker's answer in `resp`.
+func (r *Runtime) runWorker(ctx context.Context, parsed *ParsedJob, job *protocol.InvocationSpec, stdout, stderr *bytes.Buffer, stream io.Writer, resp *protocol.InvocationResponse) error {
+	if job.Sandbox {
+		return errors.New("workers can't be sandboxed")
+	}
+	if parsed.Stdin != nil {
+		return errors.New("workers don't accept stdin")
+	}
+	log := logFrom(ctx).With("phase", "exec")
+
+	w, err := r.workers.get(parsed, job.Worker)
+	if err != nil {
+		log.Error("starting worker failed", "error", err)
+		return err
+	}
+	w.requests++
+	w.lastUsed = time.Now()
+
+	req := protocol.WorkRequest{
+		Arguments:  job.Args,
+		RequestID:  w.requests,
+		SandboxDir: parsed.Root,
+	}
+	log.Info("sending work request", "worker", w.key, "args", req.Arguments)
+
+	var work *protocol.WorkResponse
+	err = tracing.Trace(ctx, "exec", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		span.AddField("worker", w.key)
+		reqCtx, cancel := r.withShutdown(ctx)
+		defer cancel()
+		var err error
+		work, err = w.request(reqCtx, &req)
+		return err
+	})
+
+	if err != nil && r.shuttingDown() {
+		w.event("interrupted by shutdown")
+		r.workers.discard(w)
+		log.Warn(protocol.InterruptedWarning)
+		resp.Interrupted = true
+		resp.Warnings = append(resp.Warnings, protocol.InterruptedWarning)
+		resp.ExitStatus = -1
+	} else if err != nil {
+		// We don't know what state the worker is in, so we
+		// don't reuse it.
+		w.event("request failed: %s", err.Error())
+		r.workers.discard(w)
+		fmt.Fprintf(stderr, "llama: worker failed: %s\n", err.Error())
+		resp.ExitStatus = -1
+	} else {
+		stdout.WriteString(work.Output)
+		if stream != nil {
+			io.WriteString(stream, work.Output)
+		}
+		resp.ExitStatus = work.ExitCode
+	}
+	log.Info("worker finished request",
+		"worker", w.key,
+		"exit_status", resp.ExitStatus,
+		"requests", w.requests,
+	)
+
+	diag := &protocol.WorkerDiagnostics{
+		PID:      w.cmd.Process.Pid,
+		Requests: w.requests,
+		Events:   w.events,
+	}
+	w.events = nil
+	if out := w.log.take(); len(out) > 0 {
+		diag.Stderr, err = files.NewBlob(ctx, r.store, out)
+		if err != nil {
+			diag.Stderr = &protocol.Blob{Err: err.Error()}
+		}
+	}
+	diagnostics(resp).Worker = diag
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Job workspaces and worker directories are named after the PID of
+// the runtime that created them, so that a later runtime in the same
+// container can tell when they have been orphaned by a crash:
+//
+//	llama-job.PID.JOB.RANDOM      the job root
+//	llama-job.PID.JOB.RANDOM.tmp  its scratch directory
+//	llama-worker.PID.KEY.RANDOM   a persistent worker's directory
+const (
+	jobPrefix    = "llama-job."
+	workerPrefix = "llama-worker."
+)
+
+func (r *Runtime) workspacePattern() string {
+	return fmt.Sprintf("%s%d.%d.*", jobPrefix, os.Getpid(), r.jobCount)
+}
+
+func workerPattern(key string) string {
+	return fmt.Sprintf("%s%d.%s.*", workerPrefix, os.Getpid(), key)
+}
+
+// workspaceOwner parses the name of a workspace or worker
+// directory, returning the PID of the runtime that created it.
+func workspaceOwner(name string) (pid int, worker bool, ok bool) {
+	var rest string
+	switch {
+	case strings.HasPrefix(name, jobPrefix):
+		rest = name[len(jobPrefix):]
+	case strings.HasPrefix(name, workerPrefix):
+		rest, worker = name[len(workerPrefix):], true
+	default:
+		return 0, false, false
+	}
+	dot := strings.IndexByte(rest, '.')
+	if dot < 0 {
+		return 0, false, false
+	}
+	pid, err := strconv.Atoi(rest[:dot])
+	if err != nil {
+		return 0, false, false
+	}
+	return pid, worker, true
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// sweepWorkspaces removes workspaces and worker directories
+// abandoned by runtimes that died without cleaning up, as well as
+// any of our own job workspaces that outlived their jobs. Live
+// workers, the active job's workspace, and anything not named like a
+// workspace (notably the blob cache) are left alone. A shared
+// Runtime only sweeps up after other processes.
+func (r *Runtime) sweepWorkspaces(ctx context.Context) {
+	dir := os.TempDir()
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	t_start := time.Now()
+	self := os.Getpid()
+	var removed int
+	var reclaimed uint64
+	for _, ent := range ents {
+		pid, worker, ok := workspaceOwner(ent.Name())
+		if !ok {
+			continue
+		}
+		full := path.Join(dir, ent.Name())
+		if pid == self {
+			if r.shared {
+				continue
+			}
+			active := r.activeRoot != "" && (full == r.activeRoot || full == r.activeRoot+".tmp")
+			if worker || active {
+				continue
+			}
+		} else if processAlive(pid) {
+			continue
+		}
+		reclaimed += diskUsage(full)
+		if err := os.RemoveAll(full); err != nil {
+			logFrom(ctx).Warn("removing stale workspace failed", "path", full, "error", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		logFrom(ctx).Info("removed stale workspaces",
+			"phase", "sweep",
+			"workspaces", removed,
+			"bytes", reclaimed,
+			"duration_ms", time.Since(t_start).Milliseconds(),
+		)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// ErrNoChecker is returned by NewCheckFirst for stores that can't
+// check whether they have an object
+var ErrNoChecker = errors.New("store can't check for objects without fetching them")
+
+// CheckFirstStats counts the objects a CheckFirst store was asked to
+// store, by whether they had to be uploaded
+type CheckFirstStats struct {
+	Uploaded      int   `json:"uploaded"`
+	UploadedBytes int64 `json:"uploaded_bytes"`
+	Present       int   `json:"present"`
+	PresentBytes  int64 `json:"present_bytes"`
+}
+
+// CheckFirst is a store that checks whether the store it wraps
+// already has each object before storing it, and only stores the
+// ones it doesn't. This saves uploads for stores configured to skip
+// their own checks, as the CLI's S3 store is, when most objects are
+// expected to be present already. Gets are passed through.
+type CheckFirst struct {
+	inner Store
+	ids   Identifier
+	check Checker
+
+	mu    sync.Mutex
+	stats CheckFirstStats
+}
+
+func NewCheckFirst(inner Store) (*CheckFirst, error) {
+	ids, ok := inner.(Identifier)
+	if !ok {
+		return nil, ErrNoIdentifier
+	}
+	check, ok := inner.(Checker)
+	if !ok {
+		return nil, ErrNoChecker
+	}
+	return &CheckFirst{inner: inner, ids: ids, check: check}, nil
+}
+
+func (c *CheckFirst) ObjectID(obj []byte) string {
+	return c.ids.ObjectID(obj)
+}
+
+func (c *CheckFirst) HasObject(ctx context.Context, id string) (bool, error) {
+	return c.check.HasObject(ctx, id)
+}
+
+func (c *CheckFirst) Store(ctx context.Context, obj []byte) (string, error) {
+	id := c.ids.ObjectID(obj)
+	exists, err := c.check.HasObject(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if id, err = c.inner.Store(ctx, obj); err != nil {
+			return "", err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exists {
+		c.stats.Present++
+		c.stats.PresentBytes += int64(len(obj))
+	} else {
+		c.stats.Uploaded++
+		c.stats.UploadedBytes += int64(len(obj))
+	}
+	return id, nil
+}
+
+func (c *CheckFirst) GetObjects(ctx context.Context, gets []GetRequest) {
+	c.inner.GetObjects(ctx, gets)
+}
+
+func (c *CheckFirst) FetchAWSUsage(u *protocol.StoreUsage) {
+	c.inner.FetchAWSUsage(u)
+}
+
+func (c *CheckFirst) Unwrap() Store {
+	return c.inner
+}
+
+// Stats returns the store's counts
+func (c *CheckFirst) Stats() CheckFirstStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
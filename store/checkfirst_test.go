@@ -0,0 +1,51 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFirst(t *testing.T) {
+	ctx := context.Background()
+	inner := InMemory()
+	_, err := inner.Store(ctx, []byte("already here"))
+	require.NoError(t, err)
+
+	cf, err := NewCheckFirst(Traced(inner, "memory"))
+	require.NoError(t, err)
+	for _, obj := range []string{"already here", "new object", "new object"} {
+		id, err := cf.Store(ctx, []byte(obj))
+		require.NoError(t, err)
+		assert.Equal(t, inner.(Identifier).ObjectID([]byte(obj)), id)
+	}
+	assert.Equal(t, CheckFirstStats{
+		Uploaded:      1,
+		UploadedBytes: int64(len("new object")),
+		Present:       2,
+		PresentBytes:  int64(len("already here") + len("new object")),
+	}, cf.Stats())
+
+	got, err := Get(ctx, cf, inner.(Identifier).ObjectID([]byte("new object")))
+	require.NoError(t, err)
+	assert.Equal(t, "new object", string(got))
+
+	_, err = NewCheckFirst(bareStore{inner})
+	assert.Equal(t, ErrNoIdentifier, err)
+}
@@ -21,6 +21,8 @@ import (
 	"os"
 	"path"
 	"sync"
+
+	"github.com/nelhage/llama/store/internal/storeutil"
 )
 
 const debugCache = false
@@ -128,7 +130,7 @@ func (st *Cache) addToCache(id string, data []byte) {
 		}
 		file := st.pathFor(id)
 		os.Mkdir(path.Dir(file), 0755)
-		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		if err := storeutil.WriteAtomic(file, data); err != nil {
 			log.Printf("Error writing to cache! path=%s err=%q", file, err.Error())
 			return
 		}
@@ -0,0 +1,122 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package diskstore implements the object store in a local
+// directory. It stands in for S3 where one isn't available or
+// wanted: benchmarks, tests, and single-machine use.
+package diskstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/internal/storeutil"
+)
+
+// Store keeps objects under objects/, named by their hash like the
+// disk cache, and keyed data under keys/.
+type Store struct {
+	root string
+}
+
+func New(root string) (*Store, error) {
+	for _, dir := range []string{"objects", "keys"} {
+		if err := os.MkdirAll(path.Join(root, dir), 0755); err != nil {
+			return nil, fmt.Errorf("creating store: %w", err)
+		}
+	}
+	return &Store{root: root}, nil
+}
+
+func (s *Store) pathFor(id string) string {
+	return path.Join(s.root, "objects", id[:2], id[2:])
+}
+
+func (s *Store) ObjectID(obj []byte) string {
+	return storeutil.HashObject(obj)
+}
+
+func (s *Store) HasObject(ctx context.Context, id string) (bool, error) {
+	if len(id) < 3 {
+		return false, nil
+	}
+	_, err := os.Stat(s.pathFor(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
+	id := s.ObjectID(obj)
+	file := s.pathFor(id)
+	if _, err := os.Stat(file); err == nil {
+		return id, nil
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	if err := storeutil.WriteAtomic(file, obj); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *Store) getOne(id string) ([]byte, error) {
+	if len(id) < 3 {
+		return nil, &store.NotFoundError{ID: id}
+	}
+	data, err := ioutil.ReadFile(s.pathFor(id))
+	if os.IsNotExist(err) {
+		return nil, &store.NotFoundError{ID: id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if got := storeutil.HashObject(data); got != id {
+		return nil, fmt.Errorf("object store mismatch: got csum=%s expected %s", got, id)
+	}
+	return data, nil
+}
+
+func (s *Store) GetObjects(ctx context.Context, gets []store.GetRequest) {
+	for i := range gets {
+		gets[i].Data, gets[i].Err = s.getOne(gets[i].Id)
+	}
+}
+
+func (s *Store) PutKey(ctx context.Context, key string, data []byte) error {
+	file := path.Join(s.root, "keys", key)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return storeutil.WriteAtomic(file, data)
+}
+
+func (s *Store) GetKey(ctx context.Context, key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path.Join(s.root, "keys", key))
+	if os.IsNotExist(err) {
+		return nil, &store.NotFoundError{Key: key}
+	}
+	return data, err
+}
+
+// FetchAWSUsage reports nothing, since the store makes no AWS
+// requests.
+func (s *Store) FetchAWSUsage(u *protocol.StoreUsage) {}
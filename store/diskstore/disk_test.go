@@ -0,0 +1,68 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package diskstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "diskstore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	st, err := New(dir)
+	require.NoError(t, err)
+
+	id, err := st.Store(ctx, []byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, st.ObjectID([]byte("hello")), id)
+	again, err := st.Store(ctx, []byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, id, again)
+
+	ok, err := st.HasObject(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	missing := st.ObjectID([]byte("missing"))
+	gets := []store.GetRequest{{Id: id}, {Id: missing}}
+	st.GetObjects(ctx, gets)
+	require.NoError(t, gets[0].Err)
+	assert.Equal(t, "hello", string(gets[0].Data))
+	assert.True(t, errors.Is(gets[1].Err, store.ErrNotExists))
+
+	// Reopening the directory finds the same objects
+	st, err = New(dir)
+	require.NoError(t, err)
+	data, err := store.Get(ctx, st, id)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	require.NoError(t, st.PutKey(ctx, "traces/job", []byte("spans")))
+	data, err = st.GetKey(ctx, "traces/job")
+	require.NoError(t, err)
+	assert.Equal(t, "spans", string(data))
+	_, err = st.GetKey(ctx, "traces/other")
+	assert.Equal(t, &store.NotFoundError{Key: "traces/other"}, err)
+}
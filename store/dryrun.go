@@ -0,0 +1,115 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// PlannedObject is an object a DryRun store was asked to store
+type PlannedObject struct {
+	ID    string `json:"id"`
+	Bytes int    `json:"bytes"`
+	// Exists is set if the store already has the object, so
+	// storing it wouldn't upload anything
+	Exists bool `json:"exists"`
+}
+
+// ErrNoIdentifier is returned by NewDryRun for stores that can't
+// compute object IDs
+var ErrNoIdentifier = errors.New("store can't compute object IDs without storing objects")
+
+// DryRun is a store that records the objects it is asked to store,
+// and whether the store it wraps already has them, without storing
+// anything. Objects are looked up if the wrapped store is a
+// Checker, and otherwise assumed to be missing. Gets are passed
+// through.
+type DryRun struct {
+	inner Store
+	ids   Identifier
+
+	mu      sync.Mutex
+	objects []PlannedObject
+	seen    map[string]bool
+}
+
+func NewDryRun(inner Store) (*DryRun, error) {
+	ids, ok := inner.(Identifier)
+	if !ok {
+		return nil, ErrNoIdentifier
+	}
+	return &DryRun{inner: inner, ids: ids, seen: make(map[string]bool)}, nil
+}
+
+func (d *DryRun) ObjectID(obj []byte) string {
+	return d.ids.ObjectID(obj)
+}
+
+func (d *DryRun) Store(ctx context.Context, obj []byte) (string, error) {
+	id := d.ids.ObjectID(obj)
+	d.mu.Lock()
+	dup := d.seen[id]
+	d.seen[id] = true
+	d.mu.Unlock()
+	if dup {
+		return id, nil
+	}
+	planned := PlannedObject{ID: id, Bytes: len(obj)}
+	if ch, ok := d.inner.(Checker); ok {
+		exists, err := ch.HasObject(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		planned.Exists = exists
+	}
+	d.mu.Lock()
+	d.objects = append(d.objects, planned)
+	d.mu.Unlock()
+	return id, nil
+}
+
+func (d *DryRun) GetObjects(ctx context.Context, gets []GetRequest) {
+	d.inner.GetObjects(ctx, gets)
+}
+
+func (d *DryRun) FetchAWSUsage(u *protocol.StoreUsage) {
+	d.inner.FetchAWSUsage(u)
+}
+
+// Objects returns the objects the store was asked to store, each
+// once, in the order they were first stored.
+func (d *DryRun) Objects() []PlannedObject {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]PlannedObject(nil), d.objects...)
+}
+
+// Missing returns the number of objects the wrapped store is
+// missing, and their total size: what storing them would upload.
+func (d *DryRun) Missing() (int, int64) {
+	var n int
+	var bytes int64
+	for _, obj := range d.Objects() {
+		if !obj.Exists {
+			n++
+			bytes += int64(obj.Bytes)
+		}
+	}
+	return n, bytes
+}
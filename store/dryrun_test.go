@@ -0,0 +1,53 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	inner := InMemory()
+	have, err := inner.Store(ctx, []byte("already here"))
+	require.NoError(t, err)
+
+	dry, err := NewDryRun(Traced(inner, "memory"))
+	require.NoError(t, err)
+	for _, obj := range []string{"already here", "new object", "new object"} {
+		id, err := dry.Store(ctx, []byte(obj))
+		require.NoError(t, err)
+		assert.Equal(t, inner.(Identifier).ObjectID([]byte(obj)), id)
+	}
+	objs := dry.Objects()
+	require.Len(t, objs, 2)
+	assert.Equal(t, PlannedObject{ID: have, Bytes: 12, Exists: true}, objs[0])
+	assert.False(t, objs[1].Exists)
+
+	n, bytes := dry.Missing()
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(len("new object")), bytes)
+
+	// Nothing was stored.
+	_, err = Get(ctx, inner, objs[1].ID)
+	assert.Equal(t, &NotFoundError{ID: objs[1].ID}, err)
+
+	_, err = NewDryRun(bareStore{inner})
+	assert.Equal(t, ErrNoIdentifier, err)
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/tracing"
+)
+
+// DefaultCooldown is how long a Failover store skips a backend
+// after it fails
+const DefaultCooldown = 30 * time.Second
+
+// A Backend is one of the stores a Failover store reads from
+type Backend struct {
+	// Name identifies the store in logs, spans, and
+	// GetRequest.Source
+	Name  string
+	Store Store
+}
+
+// Failover is a store over an ordered list of replicas of the same
+// objects, such as a bucket and its replica in another region.
+// Writes go to the first, the primary. Reads and existence checks
+// go to the first backend that is up, and fail over to the next
+// if it fails in a way that suggests it is unavailable as a whole,
+// as judged by IsUnavailable. An object that a backend doesn't have
+// is not a failure: writes only go to the primary, and its replicas
+// can't have anything it doesn't.
+//
+// A backend that fails is skipped for Cooldown, so that during an
+// outage each read doesn't wait out its timeout first; the last
+// backend is always tried. Each GetRequest's Source names the
+// backend that served it.
+type Failover struct {
+	backends []Backend
+	ids      Identifier
+	checks   []Checker
+	// Cooldown defaults to DefaultCooldown
+	Cooldown time.Duration
+
+	now func() time.Time
+
+	mu sync.Mutex
+	// downUntil holds, for each backend, when to try it again
+	downUntil []time.Time
+}
+
+// NewFailover returns a Failover store over `backends`, the first
+// of which is the primary. Every backend must be, or wrap, a
+// Checker, and they must all name objects the same way, as the
+// primary's Identifier does.
+func NewFailover(backends []Backend) (*Failover, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("failover: no stores")
+	}
+	ids, ok := find(backends[0].Store, func(st Store) bool {
+		_, ok := st.(Identifier)
+		return ok
+	}).(Identifier)
+	if !ok {
+		return nil, ErrNoIdentifier
+	}
+	f := &Failover{
+		backends:  backends,
+		ids:       ids,
+		Cooldown:  DefaultCooldown,
+		now:       time.Now,
+		downUntil: make([]time.Time, len(backends)),
+	}
+	for _, b := range backends {
+		check, ok := find(b.Store, func(st Store) bool {
+			_, ok := st.(Checker)
+			return ok
+		}).(Checker)
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", b.Name, ErrNoChecker)
+		}
+		f.checks = append(f.checks, check)
+	}
+	return f, nil
+}
+
+// IsUnavailable reports whether `err` suggests that the store that
+// returned it is unavailable as a whole, rather than that one
+// request failed: a timeout, a failure to resolve or connect to
+// it, or a server error.
+func IsUnavailable(err error) bool {
+	for err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return true
+		}
+		switch e := err.(type) {
+		case *net.DNSError, *net.OpError:
+			return true
+		case net.Error:
+			if e.Timeout() {
+				return true
+			}
+		case interface{ StatusCode() int }:
+			if e.StatusCode() >= 500 {
+				return true
+			}
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ OrigErr() error }:
+			// AWS SDK errors wrap their causes this way
+			err = e.OrigErr()
+		default:
+			err = nil
+		}
+	}
+	return false
+}
+
+// skip reports whether backend `i` should be skipped, because it
+// failed recently and isn't the last resort
+func (f *Failover) skip(i int) bool {
+	if i == len(f.backends)-1 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now().Before(f.downUntil[i])
+}
+
+// failed records that backend `i` failed with `err`
+func (f *Failover) failed(i int, err error) {
+	if i == len(f.backends)-1 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	if now.Before(f.downUntil[i]) {
+		return
+	}
+	f.downUntil[i] = now.Add(f.Cooldown)
+	log.Printf("object store %s is unavailable (%s); reading from %s for %s",
+		f.backends[i].Name, err.Error(), f.backends[i+1].Name, f.Cooldown)
+}
+
+// failover reports whether a read from backend `i` that failed with
+// `err` should be retried on the next
+func (f *Failover) failover(ctx context.Context, i int, err error) bool {
+	return err != nil && i < len(f.backends)-1 && ctx.Err() == nil && IsUnavailable(err)
+}
+
+func (f *Failover) ObjectID(obj []byte) string {
+	return f.ids.ObjectID(obj)
+}
+
+// Store stores `obj` in the primary
+func (f *Failover) Store(ctx context.Context, obj []byte) (string, error) {
+	return f.backends[0].Store.Store(ctx, obj)
+}
+
+func (f *Failover) HasObject(ctx context.Context, id string) (ok bool, err error) {
+	for i := range f.backends {
+		if f.skip(i) {
+			continue
+		}
+		ok, err = f.checks[i].HasObject(ctx, id)
+		if !f.failover(ctx, i, err) {
+			return ok, err
+		}
+		f.failed(i, err)
+	}
+	return ok, err
+}
+
+func (f *Failover) GetObjects(ctx context.Context, gets []GetRequest) {
+	pending := make([]int, len(gets))
+	for i := range pending {
+		pending[i] = i
+	}
+	for i, b := range f.backends {
+		if len(pending) == 0 {
+			return
+		}
+		if f.skip(i) {
+			continue
+		}
+		if i == 0 {
+			pending = f.getFrom(ctx, i, gets, pending)
+			continue
+		}
+		tracing.Trace(ctx, "store.failover", func(ctx context.Context, span *tracing.SpanBuilder) error {
+			span.SetLabel("source", b.Name)
+			span.SetMetric("objects", float64(len(pending)))
+			pending = f.getFrom(ctx, i, gets, pending)
+			return nil
+		})
+	}
+}
+
+// getFrom fetches the gets at `pending` from backend `i`, and
+// returns those to retry on the next
+func (f *Failover) getFrom(ctx context.Context, i int, gets []GetRequest, pending []int) []int {
+	b := f.backends[i]
+	sub := make([]GetRequest, len(pending))
+	for j, idx := range pending {
+		sub[j] = GetRequest{Id: gets[idx].Id}
+	}
+	b.Store.GetObjects(ctx, sub)
+	var retry []int
+	var first error
+	for j, idx := range pending {
+		if f.failover(ctx, i, sub[j].Err) {
+			if first == nil {
+				first = sub[j].Err
+			}
+			retry = append(retry, idx)
+			continue
+		}
+		gets[idx] = sub[j]
+		gets[idx].Source = b.Name
+	}
+	if first != nil {
+		f.failed(i, first)
+	}
+	return retry
+}
+
+func (f *Failover) FetchAWSUsage(u *protocol.StoreUsage) {
+	for _, b := range f.backends {
+		b.Store.FetchAWSUsage(u)
+	}
+}
+
+// Unwrap returns the primary
+func (f *Failover) Unwrap() Store {
+	return f.backends[0].Store
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// downStore fails every request with `err`, if it is set
+type downStore struct {
+	inner Store
+	err   error
+	reads int
+}
+
+func (d *downStore) ObjectID(obj []byte) string {
+	return d.inner.(Identifier).ObjectID(obj)
+}
+
+func (d *downStore) Store(ctx context.Context, obj []byte) (string, error) {
+	return d.inner.Store(ctx, obj)
+}
+
+func (d *downStore) FetchAWSUsage(u *protocol.StoreUsage) {}
+
+func (d *downStore) HasObject(ctx context.Context, id string) (bool, error) {
+	d.reads++
+	if d.err != nil {
+		return false, d.err
+	}
+	return d.inner.(Checker).HasObject(ctx, id)
+}
+
+func (d *downStore) GetObjects(ctx context.Context, gets []GetRequest) {
+	d.reads++
+	if d.err != nil {
+		for i := range gets {
+			gets[i].Err = d.err
+		}
+		return
+	}
+	d.inner.GetObjects(ctx, gets)
+}
+
+type statusError int
+
+func (e statusError) Error() string   { return fmt.Sprintf("status %d", int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestIsUnavailable(t *testing.T) {
+	assert.True(t, IsUnavailable(context.DeadlineExceeded))
+	assert.True(t, IsUnavailable(&net.DNSError{Err: "no such host", Name: "s3.example"}))
+	assert.True(t, IsUnavailable(fmt.Errorf("get: %w", statusError(503))))
+	assert.False(t, IsUnavailable(statusError(403)))
+	assert.False(t, IsUnavailable(&NotFoundError{ID: "x"}))
+	assert.False(t, IsUnavailable(errors.New("decoding failed")))
+}
+
+func TestFailover(t *testing.T) {
+	ctx := context.Background()
+	primary := &downStore{inner: InMemory()}
+	replica := &downStore{inner: InMemory()}
+	id, err := primary.inner.Store(ctx, []byte("object"))
+	require.NoError(t, err)
+	_, err = replica.inner.Store(ctx, []byte("object"))
+	require.NoError(t, err)
+
+	f, err := NewFailover([]Backend{{"primary", primary}, {"replica", replica}})
+	require.NoError(t, err)
+	now := time.Unix(1000, 0)
+	f.now = func() time.Time { return now }
+
+	get := func() GetRequest {
+		gets := []GetRequest{{Id: id}, {Id: "missing"}}
+		f.GetObjects(ctx, gets)
+		require.NoError(t, gets[0].Err)
+		assert.Equal(t, "object", string(gets[0].Data))
+		assert.True(t, errors.Is(gets[1].Err, ErrNotExists), "a missing object doesn't fail over")
+		assert.Equal(t, gets[0].Source, gets[1].Source)
+		return gets[0]
+	}
+	assert.Equal(t, "primary", get().Source)
+	assert.Equal(t, 0, replica.reads)
+
+	primary.err = statusError(500)
+	assert.Equal(t, "replica", get().Source)
+	reads := primary.reads
+	ok, err := f.HasObject(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, reads, primary.reads, "the primary is skipped while it cools down")
+
+	primary.err = nil
+	assert.Equal(t, "replica", get().Source)
+	now = now.Add(DefaultCooldown)
+	assert.Equal(t, "primary", get().Source)
+
+	newID, err := f.Store(ctx, []byte("new"))
+	require.NoError(t, err)
+	has, _ := replica.inner.(Checker).HasObject(ctx, newID)
+	assert.False(t, has, "writes only go to the primary")
+
+	primary.err = statusError(403)
+	gets := []GetRequest{{Id: id}}
+	f.GetObjects(ctx, gets)
+	assert.Equal(t, statusError(403), gets[0].Err, "request errors don't fail over")
+
+	primary.err, replica.err = statusError(503), statusError(503)
+	gets = []GetRequest{{Id: id}}
+	f.GetObjects(ctx, gets)
+	assert.Equal(t, statusError(503), gets[0].Err)
+	assert.Equal(t, "replica", gets[0].Source)
+}
@@ -57,6 +57,14 @@ func (c *Cache) HasObject(id string) bool {
 	return ent.ok
 }
 
+// Forget drops any record of `id`, so that it will be uploaded
+// again
+func (c *Cache) Forget(id string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.seen, id)
+}
+
 func (c *Cache) StartUpload(id string) UploadHandle {
 	c.Lock()
 	defer c.Unlock()
@@ -17,37 +17,90 @@ package store
 import (
 	"context"
 	"encoding/hex"
+	"sync"
 
 	"github.com/nelhage/llama/protocol"
 	"golang.org/x/crypto/blake2b"
 )
 
 type inMemory struct {
+	mu      sync.RWMutex
 	objects map[string][]byte
+	keys    map[string][]byte
 }
 
-func (s *inMemory) Store(ctx context.Context, obj []byte) (string, error) {
+func (s *inMemory) ObjectID(obj []byte) string {
 	sha := blake2b.Sum256(obj)
-	id := hex.EncodeToString(sha[:])
-	s.objects[id] = append([]byte(nil), obj...)
+	return hex.EncodeToString(sha[:])
+}
+
+func (s *inMemory) HasObject(ctx context.Context, id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.objects[id]
+	return ok, nil
+}
+
+func (s *inMemory) Store(ctx context.Context, obj []byte) (string, error) {
+	id := s.ObjectID(obj)
+	data := append([]byte(nil), obj...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[id]; !ok {
+		s.objects[id] = data
+	}
 	return id, nil
 }
 
 func (s *inMemory) GetObjects(ctx context.Context, gets []GetRequest) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for i := range gets {
 		id := gets[i].Id
 		if got, ok := s.objects[id]; ok {
 			gets[i].Data = append([]byte(nil), got...)
 		} else {
-			gets[i].Err = ErrNotExists
+			gets[i].Err = &NotFoundError{ID: id}
 		}
 	}
 }
 
+func (s *inMemory) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, id)
+	return nil
+}
+
+func (s *inMemory) PutKey(ctx context.Context, key string, data []byte) error {
+	data = append([]byte(nil), data...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = data
+	return nil
+}
+
+func (s *inMemory) GetKey(ctx context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	got, ok := s.keys[key]
+	if !ok {
+		return nil, &NotFoundError{Key: key}
+	}
+	return append([]byte(nil), got...), nil
+}
+
 func (s *inMemory) FetchAWSUsage(u *protocol.StoreUsage) {}
 
+// InMemory returns a store that keeps objects in memory, for tests.
+// It is safe for concurrent use. Objects are immutable once stored:
+// since an object's ID is the hash of its contents, concurrent
+// Stores of the same contents all succeed with the same ID, and
+// readers see either the whole object or none of it. It is a
+// KeyedStore and a Deleter.
 func InMemory() Store {
 	return &inMemory{
 		objects: make(map[string][]byte),
+		keys:    make(map[string][]byte),
 	}
 }
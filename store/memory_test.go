@@ -0,0 +1,120 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemory_NotFound(t *testing.T) {
+	ctx := context.Background()
+	st := InMemory()
+	_, err := Get(ctx, st, "missing")
+	var nf *NotFoundError
+	require.True(t, errors.As(err, &nf), "err=%v", err)
+	assert.Equal(t, "missing", nf.ID)
+	assert.True(t, errors.Is(err, ErrNotExists))
+
+	_, err = st.(KeyedStore).GetKey(ctx, "k")
+	assert.Equal(t, &NotFoundError{Key: "k"}, err)
+}
+
+// TestInMemory_Concurrent hammers one store from many goroutines;
+// run it with -race.
+func TestInMemory_Concurrent(t *testing.T) {
+	ctx := context.Background()
+	st := InMemory()
+	const workers = 32
+	const rounds = 200
+	const distinct = 8
+
+	objects := make([][]byte, distinct)
+	ids := make([]string, distinct)
+	for i := range objects {
+		objects[i] = []byte(fmt.Sprintf("object %d", i))
+		ids[i] = st.(Identifier).ObjectID(objects[i])
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				i := (w + r) % distinct
+				// Stores of the same contents all succeed
+				// with the same ID
+				id, err := st.Store(ctx, objects[i])
+				if err != nil || id != ids[i] {
+					errs <- fmt.Errorf("Store(%d) = %q, %v", i, id, err)
+					return
+				}
+				// Readers see the whole object or none of
+				// it, since others may have deleted it
+				gets := []GetRequest{{Id: ids[i]}, {Id: ids[(i+1)%distinct]}}
+				st.GetObjects(ctx, gets)
+				for j, get := range gets {
+					want := objects[(i+j)%distinct]
+					if get.Err == nil && string(get.Data) != string(want) {
+						errs <- fmt.Errorf("Get(%d) = %q", i, get.Data)
+						return
+					}
+					if get.Err != nil && !errors.Is(get.Err, ErrNotExists) {
+						errs <- get.Err
+						return
+					}
+				}
+				if r%5 == 0 {
+					st.(Deleter).Delete(ctx, ids[(i+2)%distinct])
+				}
+				key := fmt.Sprintf("key-%d", i)
+				if err := st.(KeyedStore).PutKey(ctx, key, objects[i]); err != nil {
+					errs <- err
+					return
+				}
+				if data, err := st.(KeyedStore).GetKey(ctx, key); err != nil || string(data) != string(objects[i]) {
+					errs <- fmt.Errorf("GetKey(%q) = %q, %v", key, data, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Callers can't modify stored objects through the slices
+	// they stored or fetched
+	buf := []byte("mutable")
+	id, err := st.Store(ctx, buf)
+	require.NoError(t, err)
+	buf[0] = 'M'
+	data, err := Get(ctx, st, id)
+	require.NoError(t, err)
+	data[1] = 'U'
+	data, err = Get(ctx, st, id)
+	require.NoError(t, err)
+	assert.Equal(t, "mutable", string(data))
+}
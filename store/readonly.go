@@ -0,0 +1,88 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nelhage/llama/protocol"
+)
+
+// ErrReadOnly is returned by a ReadOnly store for writes it can't
+// satisfy
+var ErrReadOnly = errors.New("object store is read-only")
+
+// ReadOnly is a store that passes reads through to the store it
+// wraps and refuses to write to it. Storing an object the inner
+// store already has succeeds, if the inner store can tell that it
+// does, since nothing needs to be written; anything else returns
+// ErrReadOnly. It is a KeyedStore and a Deleter, so that callers
+// looking for those through Unwrap chains don't find the inner
+// store's.
+type ReadOnly struct {
+	inner Store
+}
+
+func NewReadOnly(inner Store) *ReadOnly {
+	return &ReadOnly{inner: inner}
+}
+
+func (r *ReadOnly) Store(ctx context.Context, obj []byte) (string, error) {
+	ids, isIdentifier := AsIdentifier(r.inner)
+	check, isChecker := AsChecker(r.inner)
+	if !isIdentifier || !isChecker {
+		return "", ErrReadOnly
+	}
+	id := ids.ObjectID(obj)
+	exists, err := check.HasObject(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrReadOnly
+	}
+	return id, nil
+}
+
+func (r *ReadOnly) GetObjects(ctx context.Context, gets []GetRequest) {
+	r.inner.GetObjects(ctx, gets)
+}
+
+func (r *ReadOnly) PutKey(ctx context.Context, key string, data []byte) error {
+	return ErrReadOnly
+}
+
+// GetKey reads `key` from the inner store. A store that isn't a
+// KeyedStore has nothing stored under any key.
+func (r *ReadOnly) GetKey(ctx context.Context, key string) ([]byte, error) {
+	ks, ok := AsKeyed(r.inner)
+	if !ok {
+		return nil, &NotFoundError{Key: key}
+	}
+	return ks.GetKey(ctx, key)
+}
+
+func (r *ReadOnly) Delete(ctx context.Context, id string) error {
+	return ErrReadOnly
+}
+
+func (r *ReadOnly) FetchAWSUsage(u *protocol.StoreUsage) {
+	r.inner.FetchAWSUsage(u)
+}
+
+func (r *ReadOnly) Unwrap() Store {
+	return r.inner
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	inner := InMemory()
+	id, err := inner.Store(ctx, []byte("already here"))
+	require.NoError(t, err)
+	require.NoError(t, inner.(KeyedStore).PutKey(ctx, "k", []byte("v")))
+
+	ro := NewReadOnly(inner)
+	got, err := ro.Store(ctx, []byte("already here"))
+	require.NoError(t, err)
+	assert.Equal(t, id, got)
+	_, err = ro.Store(ctx, []byte("new object"))
+	assert.Equal(t, ErrReadOnly, err)
+	has, _ := inner.(Checker).HasObject(ctx, inner.(Identifier).ObjectID([]byte("new object")))
+	assert.False(t, has)
+
+	data, err := Get(ctx, ro, id)
+	require.NoError(t, err)
+	assert.Equal(t, "already here", string(data))
+
+	ks, ok := AsKeyed(ro)
+	require.True(t, ok)
+	data, err = ks.GetKey(ctx, "k")
+	require.NoError(t, err)
+	assert.Equal(t, "v", string(data))
+	assert.Equal(t, ErrReadOnly, ks.PutKey(ctx, "k", []byte("w")))
+	assert.Equal(t, ErrReadOnly, ro.Delete(ctx, id))
+
+	// The inner store's Identifier and Checker may be found
+	// through Unwrap
+	got, err = NewReadOnly(&corruptStore{inner}).Store(ctx, []byte("already here"))
+	require.NoError(t, err)
+	assert.Equal(t, id, got)
+
+	_, err = NewReadOnly(bareStore{inner}).Store(ctx, []byte("already here"))
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = NewReadOnly(bareStore{inner}).GetKey(ctx, "k")
+	assert.True(t, errors.Is(err, ErrNotExists))
+}
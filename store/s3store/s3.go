@@ -18,7 +18,6 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/url"
 	"path"
@@ -32,6 +31,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/klauspost/compress/zstd"
+	"github.com/nelhage/llama/internal/bufpool"
 	"github.com/nelhage/llama/protocol"
 	"github.com/nelhage/llama/store"
 	"github.com/nelhage/llama/store/diskcache"
@@ -44,6 +44,9 @@ type Options struct {
 	DisableHeadCheck bool
 	DiskCachePath    string
 	DiskCacheBytes   uint64
+	// Concurrency bounds the number of objects GetObjects
+	// fetches at once. It defaults to DefaultConcurrency.
+	Concurrency int
 }
 
 type Store struct {
@@ -57,6 +60,9 @@ type Store struct {
 
 	metricsMu sync.Mutex
 	metrics   usageMetrics
+
+	// cache is updated atomically
+	cache store.CacheStats
 }
 
 type usageMetrics struct {
@@ -93,6 +99,27 @@ func (s *Store) FetchAWSUsage(u *protocol.StoreUsage) {
 	s.metrics = usageMetrics{}
 }
 
+// CacheStats reports how often the store's caches saved it a
+// request since it was created
+func (s *Store) CacheStats() store.CacheStats {
+	return store.CacheStats{
+		SeenHits:   atomic.LoadUint64(&s.cache.SeenHits),
+		SeenMisses: atomic.LoadUint64(&s.cache.SeenMisses),
+		DiskHits:   atomic.LoadUint64(&s.cache.DiskHits),
+		DiskMisses: atomic.LoadUint64(&s.cache.DiskMisses),
+	}
+}
+
+// hasSeen checks the cache of objects known to be stored
+func (s *Store) hasSeen(id string) bool {
+	if s.seen.HasObject(id) {
+		atomic.AddUint64(&s.cache.SeenHits, 1)
+		return true
+	}
+	atomic.AddUint64(&s.cache.SeenMisses, 1)
+	return false
+}
+
 func (s *Store) addUsage(add *usageMetrics) {
 	s.metricsMu.Lock()
 	defer s.metricsMu.Unlock()
@@ -133,13 +160,40 @@ func FromSessionAndOptions(s *session.Session, address string, opts Options) (*S
 	}, nil
 }
 
+func (s *Store) ObjectID(obj []byte) string {
+	return storeutil.HashObject(obj) + ":zstd"
+}
+
+func (s *Store) HasObject(ctx context.Context, id string) (bool, error) {
+	if s.hasSeen(id) {
+		return true, nil
+	}
+	var usage usageMetrics
+	defer s.addUsage(&usage)
+	usage.ReadRequests += 1
+	_, err := s.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &s.url.Host,
+		Key:    aws.String(path.Join(s.url.Path, id)),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 404 {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *Store) Invalidate(id string) {
+	s.seen.Forget(id)
+}
+
+// Store uploads `obj`. Generic tracing is left to store.Traced; we
+// only add S3-specific fields to the caller's span.
 func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
-	ctx, span := tracing.StartSpan(ctx, "s3.store")
-	defer span.End()
-	id := storeutil.HashObject(obj) + ":zstd"
+	id := s.ObjectID(obj)
 
-	span.AddField("object_id", id)
-	if s.seen.HasObject(id) {
+	if s.hasSeen(id) {
 		return id, nil
 	}
 
@@ -160,7 +214,7 @@ func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
 		})
 		if err == nil {
 			upload.Complete()
-			span.AddField("s3.exists", true)
+			tracing.AddField(ctx, "s3.exists", true)
 			return id, nil
 		}
 		if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 404 {
@@ -170,8 +224,10 @@ func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
 		}
 	}
 
-	compressed := encode.EncodeAll(obj, nil)
-	span.AddField("s3.write_bytes", len(compressed))
+	buf := bufpool.Get()
+	defer bufpool.Put(buf)
+	compressed := bufpool.Encode(buf, encode, obj)
+	tracing.SetMetric(ctx, "s3.write_bytes", float64(len(compressed)))
 
 	usage.WriteRequests += 1
 	_, err = s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
@@ -182,33 +238,89 @@ func (s *Store) Store(ctx context.Context, obj []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	s.metrics.XferIn += uint64(len(obj))
+	usage.XferIn += uint64(len(obj))
 	upload.Complete()
 	return id, nil
 }
 
-const getConcurrency = 32
+// PutKey stores `data`, compressed, under `key`, relative to the
+// store's prefix.
+func (s *Store) PutKey(ctx context.Context, key string, data []byte) error {
+	var usage usageMetrics
+	defer s.addUsage(&usage)
+
+	usage.WriteRequests += 1
+	usage.XferIn += uint64(len(data))
+	_, err := s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Body:   bytes.NewReader(encode.EncodeAll(data, nil)),
+		Bucket: &s.url.Host,
+		Key:    aws.String(path.Join(s.url.Path, key)),
+	})
+	return err
+}
 
-func (s *Store) getFromS3(ctx context.Context, id string, usage *usageMetrics) ([]byte, error) {
-	ctx, span := tracing.StartSpan(ctx, "s3.get_one")
-	defer span.End()
+func (s *Store) GetKey(ctx context.Context, key string) ([]byte, error) {
+	var usage usageMetrics
+	defer s.addUsage(&usage)
 
-	atomic.AddUint64(&usage.ReadRequests, 1)
+	usage.ReadRequests += 1
 	resp, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: &s.url.Host,
-		Key:    aws.String(path.Join(s.url.Path, id)),
+		Key:    aws.String(path.Join(s.url.Path, key)),
 	})
 	if err != nil {
+		if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 404 {
+			return nil, &store.NotFoundError{Key: key}
+		}
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
 		return nil, err
 	}
+	usage.XferOut += uint64(buf.Len())
+	data, err := decode.DecodeAll(buf.Bytes(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%q: decoding: %w", key, err)
+	}
+	return data, nil
+}
 
-	span.AddField("s3.read_bytes", len(body))
-	atomic.AddUint64(&usage.XferOut, uint64(len(body)))
+const DefaultConcurrency = 32
+
+// getFromS3 fetches the raw object `id` into `buf`
+func (s *Store) getFromS3(ctx context.Context, id string, buf *bytes.Buffer, usage *usageMetrics) (body []byte, err error) {
+	err = tracing.Trace(ctx, "s3.get_one", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		atomic.AddUint64(&usage.ReadRequests, 1)
+		resp, err := s.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: &s.url.Host,
+			Key:    aws.String(path.Join(s.url.Path, id)),
+		})
+		if reqerr, ok := err.(awserr.RequestFailure); ok && reqerr.StatusCode() == 404 {
+			s.seen.Forget(id)
+			return &store.NotFoundError{ID: id}
+		}
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength != nil {
+			buf.Grow(int(*resp.ContentLength) + bytes.MinRead)
+		}
+		_, err = buf.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		body = buf.Bytes()
+
+		span.SetMetric("s3.read_bytes", float64(len(body)))
+		atomic.AddUint64(&usage.XferOut, uint64(len(body)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	if s.disk != nil {
 		s.disk.Put(id, body)
@@ -216,6 +328,12 @@ func (s *Store) getFromS3(ctx context.Context, id string, usage *usageMetrics) (
 	return body, nil
 }
 
+// isCompressed reports whether the object `id` is stored with a
+// content coding.
+func isCompressed(id string) bool {
+	return strings.IndexRune(id, ':') > 0
+}
+
 func (s *Store) decompress(id string, body []byte) (string, []byte, error) {
 	expectHash := id
 	colon := strings.IndexRune(id, ':')
@@ -234,38 +352,59 @@ func (s *Store) decompress(id string, body []byte) (string, []byte, error) {
 	return expectHash, body, nil
 }
 
-func (s *Store) getOne(ctx context.Context, id string, usage *usageMetrics) ([]byte, error) {
+func (s *Store) getOne(ctx context.Context, id string, usage *usageMetrics) ([]byte, bool, error) {
 	var body []byte
 	if s.disk != nil {
 		body, _ = s.disk.Get(id)
+		if body != nil {
+			atomic.AddUint64(&s.cache.DiskHits, 1)
+		} else {
+			atomic.AddUint64(&s.cache.DiskMisses, 1)
+		}
 	}
-	if body == nil {
+	cached := body != nil
+	if !cached {
+		// decompress decodes into a fresh slice, so the raw
+		// object can be read into a pooled buffer. Objects
+		// stored uncompressed are returned as-is, and get a
+		// buffer of their own.
+		buf := new(bytes.Buffer)
+		if isCompressed(id) {
+			buf = bufpool.Get()
+			defer bufpool.Put(buf)
+		}
 		var err error
-		body, err = s.getFromS3(ctx, id, usage)
+		body, err = s.getFromS3(ctx, id, buf, usage)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 	}
 
 	hash, body, err := s.decompress(id, body)
 	if err != nil {
-		return nil, err
+		return nil, cached, err
 	}
 
 	gotHash := storeutil.HashObject(body)
 	if gotHash != hash {
-		return nil, fmt.Errorf("object store mismatch: got csum=%s expected %s", gotHash, id)
+		return nil, cached, fmt.Errorf("object store mismatch: got csum=%s expected %s", gotHash, id)
 	}
 	u := s.seen.StartUpload(id)
 	u.Complete()
 
-	return body, nil
+	return body, cached, nil
+}
+
+// Concurrency returns the number of objects GetObjects fetches at
+// once
+func (s *Store) Concurrency() int {
+	if s.opts.Concurrency > 0 {
+		return s.opts.Concurrency
+	}
+	return DefaultConcurrency
 }
 
 func (s *Store) GetObjects(ctx context.Context, gets []store.GetRequest) {
-	ctx, span := tracing.StartSpan(ctx, "s3.get_objects")
-	defer span.End()
-	span.AddField("objects", len(gets))
 	grp, ctx := errgroup.WithContext(ctx)
 	jobs := make(chan int)
 
@@ -279,10 +418,14 @@ func (s *Store) GetObjects(ctx context.Context, gets []store.GetRequest) {
 		}
 		return nil
 	})
-	for i := 0; i < getConcurrency; i++ {
+	workers := s.Concurrency()
+	if workers > len(gets) {
+		workers = len(gets)
+	}
+	for i := 0; i < workers; i++ {
 		grp.Go(func() error {
 			for idx := range jobs {
-				gets[idx].Data, gets[idx].Err = s.getOne(ctx, gets[idx].Id, &usage)
+				gets[idx].Data, gets[idx].Cached, gets[idx].Err = s.getOne(ctx, gets[idx].Id, &usage)
 			}
 			return nil
 		})
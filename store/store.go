@@ -17,6 +17,7 @@ package store
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/nelhage/llama/protocol"
 )
@@ -25,18 +26,204 @@ type GetRequest struct {
 	Id   string
 	Data []byte
 	Err  error
+	// Cached is set by stores with a local cache if the object
+	// was found there
+	Cached bool
+	// Source is set by stores that read from more than one store,
+	// such as Failover, to the name of the one that served the
+	// request
+	Source string
 }
 
 var ErrNotExists = errors.New("Requested object does not exist")
 
+// NotFoundError is the error stores return for missing objects and
+// keys. It matches ErrNotExists with errors.Is, so callers that
+// don't care which object was missing needn't unwrap it.
+type NotFoundError struct {
+	// ID is the missing object's ID, or Key the missing key
+	ID  string
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("key %q: %s", e.Key, ErrNotExists.Error())
+	}
+	return e.ID + ": " + ErrNotExists.Error()
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotExists
+}
+
+// ErrCorrupt is returned by GetVerified for objects whose contents
+// don't match their ID
+var ErrCorrupt = errors.New("object contents do not match its ID")
+
 type Store interface {
 	Store(ctx context.Context, obj []byte) (string, error)
 	GetObjects(ctx context.Context, gets []GetRequest)
 	FetchAWSUsage(u *protocol.StoreUsage)
 }
 
+// An Identifier can compute the ID an object will be stored under,
+// without storing it.
+type Identifier interface {
+	ObjectID(obj []byte) string
+}
+
+// A Checker can check whether an object exists without fetching it.
+type Checker interface {
+	HasObject(ctx context.Context, id string) (bool, error)
+}
+
+// A KeyedStore can also store data under keys of the caller's
+// choosing, outside of the content-addressed namespace. Data stored
+// under an existing key replaces it.
+type KeyedStore interface {
+	PutKey(ctx context.Context, key string, data []byte) error
+	// GetKey returns ErrNotExists if nothing is stored under
+	// `key`.
+	GetKey(ctx context.Context, key string) ([]byte, error)
+}
+
+// A Limiter bounds the number of objects a store transfers at
+// once. Callers issuing many requests in parallel should stay
+// within that bound.
+type Limiter interface {
+	Concurrency() int
+}
+
+// An Invalidator remembers which objects are known to be in the
+// store. Invalidate makes it forget an object that has gone
+// missing, so that storing it again uploads it.
+type Invalidator interface {
+	Invalidate(id string)
+}
+
+// A Deleter can remove objects. Deleting an object that isn't
+// stored is not an error.
+type Deleter interface {
+	Delete(ctx context.Context, id string) error
+}
+
+// CacheStats counts a store's use of its local caches: of the
+// objects it has seen stored, which lets it skip redundant uploads
+// and existence checks, and of object contents on disk.
+type CacheStats struct {
+	SeenHits   uint64
+	SeenMisses uint64
+	DiskHits   uint64
+	DiskMisses uint64
+}
+
+// A CacheReporter reports on its caches
+type CacheReporter interface {
+	CacheStats() CacheStats
+}
+
+// GetCacheStats returns the CacheStats of `st`, or of the store it
+// wraps, if it is a CacheReporter.
+func GetCacheStats(st Store) (CacheStats, bool) {
+	cr, ok := find(st, func(st Store) bool {
+		_, ok := st.(CacheReporter)
+		return ok
+	}).(CacheReporter)
+	if !ok {
+		return CacheStats{}, false
+	}
+	return cr.CacheStats(), true
+}
+
+// Invalidate forgets that `id` is in `st`, or in the store it
+// wraps, if that store remembers such things.
+func Invalidate(st Store, id string) {
+	if inv, ok := find(st, func(st Store) bool {
+		_, ok := st.(Invalidator)
+		return ok
+	}).(Invalidator); ok {
+		inv.Invalidate(id)
+	}
+}
+
+// find returns the first of `st` and the stores it wraps for which
+// `ok` returns true, or nil.
+func find(st Store, ok func(Store) bool) Store {
+	for {
+		if ok(st) {
+			return st
+		}
+		w, isWrapper := st.(interface{ Unwrap() Store })
+		if !isWrapper {
+			return nil
+		}
+		st = w.Unwrap()
+	}
+}
+
+// AsKeyed returns `st`, or the store it wraps, as a KeyedStore if
+// it is one.
+func AsKeyed(st Store) (KeyedStore, bool) {
+	ks, ok := find(st, func(st Store) bool {
+		_, ok := st.(KeyedStore)
+		return ok
+	}).(KeyedStore)
+	return ks, ok
+}
+
+// AsChecker returns `st`, or the store it wraps, as a Checker if it
+// is one.
+func AsChecker(st Store) (Checker, bool) {
+	ch, ok := find(st, func(st Store) bool {
+		_, ok := st.(Checker)
+		return ok
+	}).(Checker)
+	return ch, ok
+}
+
+// AsIdentifier returns `st`, or the store it wraps, as an Identifier
+// if it is one.
+func AsIdentifier(st Store) (Identifier, bool) {
+	ids, ok := find(st, func(st Store) bool {
+		_, ok := st.(Identifier)
+		return ok
+	}).(Identifier)
+	return ids, ok
+}
+
+// Concurrency returns the bound the Limiter `st`, or the store it
+// wraps, places on its transfers, or 0 if it has none.
+func Concurrency(st Store) int {
+	if l, ok := find(st, func(st Store) bool {
+		_, ok := st.(Limiter)
+		return ok
+	}).(Limiter); ok {
+		return l.Concurrency()
+	}
+	return 0
+}
+
 func Get(ctx context.Context, st Store, id string) ([]byte, error) {
 	gets := []GetRequest{{Id: id}}
 	st.GetObjects(ctx, gets)
 	return gets[0].Data, gets[0].Err
 }
+
+// GetVerified behaves like Get, and also checks the object's
+// contents against its ID, if `st`, or the store it wraps, is an
+// Identifier. It reports whether it was able to.
+func GetVerified(ctx context.Context, st Store, id string) (data []byte, verified bool, err error) {
+	data, err = Get(ctx, st, id)
+	if err != nil {
+		return nil, false, err
+	}
+	ids, ok := AsIdentifier(st)
+	if !ok {
+		return data, false, nil
+	}
+	if got := ids.ObjectID(data); got != id {
+		return nil, false, fmt.Errorf("%s: %w (got %s)", id, ErrCorrupt, got)
+	}
+	return data, true, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptStore returns the wrong contents for every object
+type corruptStore struct {
+	inner Store
+}
+
+func (c *corruptStore) Store(ctx context.Context, obj []byte) (string, error) {
+	return c.inner.Store(ctx, obj)
+}
+
+func (c *corruptStore) GetObjects(ctx context.Context, gets []GetRequest) {
+	c.inner.GetObjects(ctx, gets)
+	for i := range gets {
+		if gets[i].Err == nil {
+			gets[i].Data = append(gets[i].Data, '!')
+		}
+	}
+}
+
+func (c *corruptStore) FetchAWSUsage(u *protocol.StoreUsage) {}
+
+func (c *corruptStore) Unwrap() Store { return c.inner }
+
+func TestGetVerified(t *testing.T) {
+	ctx := context.Background()
+	st := Traced(InMemory(), "mem")
+	id, err := st.Store(ctx, []byte("hello"))
+	require.NoError(t, err)
+
+	data, verified, err := GetVerified(ctx, st, id)
+	require.NoError(t, err)
+	assert.True(t, verified)
+	assert.Equal(t, "hello", string(data))
+
+	_, _, err = GetVerified(ctx, st, "0000")
+	assert.True(t, errors.Is(err, ErrNotExists), "err=%v", err)
+
+	_, _, err = GetVerified(ctx, &corruptStore{inner: st}, id)
+	assert.True(t, errors.Is(err, ErrCorrupt), "err=%v", err)
+}
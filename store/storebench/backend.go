@@ -0,0 +1,121 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storebench
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/diskstore"
+	"github.com/nelhage/llama/store/storeurl"
+)
+
+// Options tune the backends Open creates
+type Options struct {
+	// S3Concurrency and DiskCacheBytes are passed on to S3
+	// backends as storeurl.Options.Concurrency and CacheBytes;
+	// the disk cache lives in a temporary directory.
+	S3Concurrency  int
+	DiskCacheBytes uint64
+	// HeadCheck makes S3 backends check for objects before
+	// uploading them, as the runtime's store does
+	HeadCheck bool
+	// Latency is added to each fake S3 request
+	Latency time.Duration
+	// Session is used to reach real S3 buckets
+	Session *session.Session
+}
+
+// Backends lists the backends Open accepts, besides s3:// URLs
+var Backends = []string{"mem", "disk", "disk:DIR", "fake-s3"}
+
+// Open creates the backend named by `backend`:
+//
+//	mem         store.InMemory
+//	disk        a diskstore in a temporary directory
+//	disk:DIR    a diskstore in DIR
+//	fake-s3     an s3store over a FakeS3
+//	s3://...    an s3store over a real bucket, via opts.Session
+//
+// The returned function releases the backend's resources.
+func Open(ctx context.Context, backend string, opts Options) (store.Store, func(), error) {
+	switch {
+	case backend == "mem":
+		return store.InMemory(), func() {}, nil
+	case backend == "disk":
+		dir, err := ioutil.TempDir("", "llama-storebench")
+		if err != nil {
+			return nil, nil, err
+		}
+		st, err := diskstore.New(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, nil, err
+		}
+		return st, func() { os.RemoveAll(dir) }, nil
+	case strings.HasPrefix(backend, "disk:"):
+		st, err := diskstore.New(strings.TrimPrefix(backend, "disk:"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return st, func() {}, nil
+	case backend == "fake-s3":
+		fake := NewFakeS3()
+		fake.Latency = opts.Latency
+		st, done, err := openS3(ctx, fake.Session(), "s3://bench/objects", opts)
+		if err != nil {
+			fake.Close()
+			return nil, nil, err
+		}
+		return st, func() { done(); fake.Close() }, nil
+	case strings.HasPrefix(backend, "s3://"):
+		if opts.Session == nil {
+			return nil, nil, fmt.Errorf("%s: no AWS session", backend)
+		}
+		return openS3(ctx, opts.Session, backend, opts)
+	}
+	return nil, nil, fmt.Errorf("unknown backend %q: want one of %s, or s3://BUCKET/PATH",
+		backend, strings.Join(Backends, ", "))
+}
+
+func openS3(ctx context.Context, sess *session.Session, url string, opts Options) (store.Store, func(), error) {
+	urlopts := storeurl.Options{
+		Session:          sess,
+		Concurrency:      opts.S3Concurrency,
+		DisableHeadCheck: !opts.HeadCheck,
+	}
+	done := func() {}
+	if opts.DiskCacheBytes > 0 {
+		dir, err := ioutil.TempDir("", "llama-storebench-cache")
+		if err != nil {
+			return nil, nil, err
+		}
+		urlopts.CacheDir = dir
+		urlopts.CacheBytes = opts.DiskCacheBytes
+		done = func() { os.RemoveAll(dir) }
+	}
+	st, err := storeurl.Open(ctx, url, urlopts)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return st, done, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storebench
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// FakeS3 serves the subset of the S3 API that s3store uses, from
+// memory, with path-style addressing.
+type FakeS3 struct {
+	// Latency is added to every request, to model the round trip
+	// to a real bucket.
+	Latency time.Duration
+
+	srv     *httptest.Server
+	mu      sync.Mutex
+	objects map[string][]byte
+
+	gets, puts, heads uint64
+}
+
+func NewFakeS3() *FakeS3 {
+	f := &FakeS3{objects: make(map[string][]byte)}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *FakeS3) Close() {
+	f.srv.Close()
+}
+
+// Session returns an AWS session whose S3 clients talk to the fake.
+func (f *FakeS3) Session() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Endpoint:         aws.String(f.srv.URL),
+		Region:           aws.String("us-west-2"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+	}))
+}
+
+// Requests returns the number of GET, PUT, and HEAD requests served
+func (f *FakeS3) Requests() (gets, puts, heads uint64) {
+	return atomic.LoadUint64(&f.gets), atomic.LoadUint64(&f.puts), atomic.LoadUint64(&f.heads)
+}
+
+func (f *FakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case "PUT":
+		atomic.AddUint64(&f.puts, 1)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.objects[key] = body
+		f.mu.Unlock()
+	case "GET", "HEAD":
+		if r.Method == "GET" {
+			atomic.AddUint64(&f.gets, 1)
+		} else {
+			atomic.AddUint64(&f.heads, 1)
+		}
+		f.mu.Lock()
+		body, ok := f.objects[key]
+		f.mu.Unlock()
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == "GET" {
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`))
+			}
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == "GET" {
+			w.Write(body)
+		}
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
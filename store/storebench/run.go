@@ -0,0 +1,214 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storebench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/store"
+)
+
+// Phase reports one pass of a workload over the store. An op is
+// one Store call, or one GetObjects call of up to Workload.Batch
+// objects.
+type Phase struct {
+	Name     string        `json:"phase"`
+	Ops      int           `json:"ops"`
+	Objects  int           `json:"objects"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	// P50 and P99 are percentiles of the ops' latencies
+	P50 time.Duration `json:"p50_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	// The requests the store reported making, for stores that
+	// count them
+	ReadRequests  uint64 `json:"read_requests"`
+	WriteRequests uint64 `json:"write_requests"`
+}
+
+// MBPerSec is the phase's throughput
+func (p *Phase) MBPerSec() float64 {
+	if p.Duration <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / 1e6 / p.Duration.Seconds()
+}
+
+type Result struct {
+	Backend  string   `json:"backend"`
+	Workload Workload `json:"workload"`
+	Phases   []Phase  `json:"phases"`
+}
+
+// Run runs a workload against `st`, in three phases: "store"
+// stores every object, "store_again" stores them all again, as a
+// rebuild of unchanged inputs would, and "get" fetches them all
+// back and checks them.
+func Run(ctx context.Context, backend string, st store.Store, w Workload) (*Result, error) {
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	objs := w.Generate()
+	res := &Result{Backend: backend, Workload: w}
+	var usage protocol.StoreUsage
+	// Discard usage from before the run
+	st.FetchAWSUsage(&usage)
+
+	ids := make([]string, len(objs))
+	for _, name := range []string{"store", "store_again"} {
+		phase, err := runPhase(ctx, name, st, &w, len(objs), func(i int) (int, int64, error) {
+			id, err := st.Store(ctx, objs[i])
+			ids[i] = id
+			return 1, int64(len(objs[i])), err
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Phases = append(res.Phases, *phase)
+	}
+
+	batch := w.batch()
+	nbatch := (len(objs) + batch - 1) / batch
+	phase, err := runPhase(ctx, "get", st, &w, nbatch, func(i int) (int, int64, error) {
+		lo, hi := i*batch, (i+1)*batch
+		if hi > len(objs) {
+			hi = len(objs)
+		}
+		gets := make([]store.GetRequest, hi-lo)
+		for j := range gets {
+			gets[j].Id = ids[lo+j]
+		}
+		st.GetObjects(ctx, gets)
+		var n int64
+		for j, get := range gets {
+			if get.Err != nil {
+				return 0, 0, fmt.Errorf("get %s: %w", get.Id, get.Err)
+			}
+			if !bytes.Equal(get.Data, objs[lo+j]) {
+				return 0, 0, fmt.Errorf("get %s: wrong data", get.Id)
+			}
+			n += int64(len(get.Data))
+		}
+		return len(gets), n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Phases = append(res.Phases, *phase)
+	return res, nil
+}
+
+// runPhase runs `op` for each of `n` ops, Workload.Concurrency at
+// a time. Each op reports the objects and bytes it moved.
+func runPhase(ctx context.Context, name string, st store.Store, w *Workload, n int,
+	op func(i int) (int, int64, error)) (*Phase, error) {
+	phase := Phase{Name: name, Ops: n}
+	latencies := make([]time.Duration, n)
+	var mu sync.Mutex
+	var firstErr error
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < w.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				t := time.Now()
+				objects, bytes, err := op(i)
+				latencies[i] = time.Since(t)
+				mu.Lock()
+				phase.Objects += objects
+				phase.Bytes += bytes
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", name, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	phase.Duration = time.Since(start)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	var usage protocol.StoreUsage
+	st.FetchAWSUsage(&usage)
+	phase.ReadRequests = usage.Read_Requests
+	phase.WriteRequests = usage.Write_Requests
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	phase.P50 = percentile(latencies, 50)
+	phase.P99 = percentile(latencies, 99)
+	return &phase, nil
+}
+
+// percentile returns the p'th percentile of sorted `ds`
+func percentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	return ds[(len(ds)-1)*p/100]
+}
+
+// WriteText writes results in the Go benchmark format, one line
+// per phase, named after the backend, phase, and workload. ns/op is
+// the phase's wall time over its ops, so it falls as concurrency
+// rises; p50-ns and p99-ns are latencies of individual ops.
+func WriteText(w io.Writer, results []*Result) error {
+	for _, res := range results {
+		for i := range res.Phases {
+			p := &res.Phases[i]
+			ops := p.Ops
+			if ops == 0 {
+				ops = 1
+			}
+			_, err := fmt.Fprintf(w, "BenchmarkStore/backend=%s/phase=%s/%s\t%d\t%d ns/op\t%.2f MB/s\t%d p50-ns\t%d p99-ns\t%.2f reads/op\t%.2f writes/op\n",
+				res.Backend, p.Name, res.Workload.Name(),
+				p.Ops, p.Duration.Nanoseconds()/int64(ops), p.MBPerSec(),
+				p.P50.Nanoseconds(), p.P99.Nanoseconds(),
+				float64(p.ReadRequests)/float64(ops), float64(p.WriteRequests)/float64(ops))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes each result as a line of JSON
+func WriteJSON(w io.Writer, results []*Result) error {
+	enc := json.NewEncoder(w)
+	for _, res := range results {
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storebench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/nelhage/llama/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testWorkload = Workload{
+	Objects:      40,
+	MinSize:      100,
+	MaxSize:      10000,
+	Dedup:        0.25,
+	Compressible: 0.5,
+	Concurrency:  4,
+	Batch:        8,
+	Seed:         2,
+}
+
+func unique(objs [][]byte) int {
+	seen := make(map[string]bool)
+	for _, o := range objs {
+		seen[string(o)] = true
+	}
+	return len(seen)
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	objs := testWorkload.Generate()
+	require.Len(t, objs, testWorkload.Objects)
+	assert.Equal(t, objs, testWorkload.Generate(), "workloads are deterministic")
+	distinct := unique(objs)
+	assert.Less(t, distinct, len(objs))
+
+	var results []*Result
+	for _, backend := range []string{"mem", "disk", "fake-s3"} {
+		st, done, err := Open(ctx, backend, Options{})
+		require.NoError(t, err, backend)
+		res, err := Run(ctx, backend, st, testWorkload)
+		done()
+		require.NoError(t, err, backend)
+		require.Len(t, res.Phases, 3)
+		assert.Equal(t, "store", res.Phases[0].Name)
+		assert.Equal(t, testWorkload.Objects, res.Phases[0].Objects)
+		assert.Equal(t, 5, res.Phases[2].Ops)
+		assert.Equal(t, testWorkload.Objects, res.Phases[2].Objects)
+		assert.Equal(t, res.Phases[0].Bytes, res.Phases[2].Bytes)
+		if backend == "fake-s3" {
+			assert.Equal(t, uint64(distinct), res.Phases[0].WriteRequests)
+			assert.Equal(t, uint64(0), res.Phases[1].WriteRequests)
+			assert.Equal(t, uint64(testWorkload.Objects), res.Phases[2].ReadRequests)
+		}
+		results = append(results, res)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteText(&buf, results))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 9)
+	line := regexp.MustCompile(`^BenchmarkStore/backend=[a-z0-9-]+/phase=[a-z_]+/objects=40/size=100-10000/dedup=0.25/compressible=0.5/concurrency=4/batch=8\t\d+\t\d+ ns/op\t[0-9.]+ MB/s\t\d+ p50-ns\t\d+ p99-ns\t[0-9.]+ reads/op\t[0-9.]+ writes/op$`)
+	for _, l := range lines {
+		assert.Regexp(t, line, l)
+	}
+}
+
+func TestOpen_Unknown(t *testing.T) {
+	_, _, err := Open(context.Background(), "gcs://bucket", Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fake-s3")
+}
+
+var benchBackends = []string{"mem", "disk", "fake-s3"}
+
+func benchObjects(n, size int) [][]byte {
+	w := Workload{Objects: n, MinSize: size, MaxSize: size, Compressible: 0.5, Seed: 1}
+	return w.Generate()
+}
+
+func BenchmarkStore(b *testing.B) {
+	ctx := context.Background()
+	for _, backend := range benchBackends {
+		for _, size := range []int{4 << 10, 1 << 20} {
+			b.Run(fmt.Sprintf("backend=%s/size=%s", backend, formatSize(size)), func(b *testing.B) {
+				st, done, err := Open(ctx, backend, Options{})
+				require.NoError(b, err)
+				defer done()
+				objs := benchObjects(16, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// Make every object distinct, so
+					// that none are deduplicated
+					obj := objs[i%len(objs)]
+					copy(obj, fmt.Sprintf("%016d", i))
+					if _, err := st.Store(ctx, obj); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkGetObjects(b *testing.B) {
+	ctx := context.Background()
+	const batch = 32
+	for _, backend := range benchBackends {
+		for _, size := range []int{4 << 10, 256 << 10} {
+			b.Run(fmt.Sprintf("backend=%s/size=%s/batch=%d", backend, formatSize(size), batch), func(b *testing.B) {
+				st, done, err := Open(ctx, backend, Options{})
+				require.NoError(b, err)
+				defer done()
+				gets := make([]store.GetRequest, batch)
+				for i, obj := range benchObjects(batch, size) {
+					gets[i].Id, err = st.Store(ctx, obj)
+					require.NoError(b, err)
+				}
+				b.SetBytes(int64(size * batch))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					st.GetObjects(ctx, gets)
+					for _, get := range gets {
+						if get.Err != nil {
+							b.Fatal(get.Err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
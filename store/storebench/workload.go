@@ -0,0 +1,130 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storebench measures object store backends against
+// synthetic workloads, so that backends and their tuning can be
+// compared, and tracked over time, with numbers.
+//
+// Results are printed in the Go benchmark format, which tools like
+// benchstat can compare across runs, or as JSON.
+package storebench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Workload describes a synthetic set of objects and how they are
+// moved through the store.
+type Workload struct {
+	// Objects is the number of objects stored
+	Objects int `json:"objects"`
+	// Object sizes are drawn log-uniformly between MinSize and
+	// MaxSize bytes
+	MinSize int `json:"min_size"`
+	MaxSize int `json:"max_size"`
+	// Dedup is the fraction of objects that repeat an earlier
+	// one, as rebuilding mostly-unchanged trees does
+	Dedup float64 `json:"dedup"`
+	// Compressible is the fraction of each object that is
+	// zeros, rather than random bytes
+	Compressible float64 `json:"compressible"`
+	// Concurrency is the number of Store or GetObjects calls
+	// in flight at once
+	Concurrency int `json:"concurrency"`
+	// Batch is the number of objects fetched per GetObjects call
+	Batch int   `json:"batch"`
+	Seed  int64 `json:"seed"`
+}
+
+// DefaultWorkload is a build-like mix of small and medium objects
+var DefaultWorkload = Workload{
+	Objects:      500,
+	MinSize:      1 << 10,
+	MaxSize:      1 << 20,
+	Dedup:        0.2,
+	Compressible: 0.5,
+	Concurrency:  8,
+	Batch:        32,
+	Seed:         1,
+}
+
+func (w *Workload) validate() error {
+	switch {
+	case w.Objects <= 0:
+		return fmt.Errorf("workload: objects must be positive")
+	case w.MinSize <= 0 || w.MaxSize < w.MinSize:
+		return fmt.Errorf("workload: need 0 < min size <= max size")
+	case w.Dedup < 0 || w.Dedup >= 1:
+		return fmt.Errorf("workload: dedup must be in [0, 1)")
+	case w.Compressible < 0 || w.Compressible > 1:
+		return fmt.Errorf("workload: compressible must be in [0, 1]")
+	}
+	return nil
+}
+
+func (w *Workload) concurrency() int {
+	if w.Concurrency > 0 {
+		return w.Concurrency
+	}
+	return 1
+}
+
+func (w *Workload) batch() int {
+	if w.Batch > 0 {
+		return w.Batch
+	}
+	return 1
+}
+
+// Generate returns the workload's objects. The same workload
+// always generates the same objects.
+func (w *Workload) Generate() [][]byte {
+	rng := rand.New(rand.NewSource(w.Seed))
+	objs := make([][]byte, w.Objects)
+	lo, hi := math.Log(float64(w.MinSize)), math.Log(float64(w.MaxSize))
+	for i := range objs {
+		if i > 0 && rng.Float64() < w.Dedup {
+			objs[i] = objs[rng.Intn(i)]
+			continue
+		}
+		size := int(math.Exp(lo + rng.Float64()*(hi-lo)))
+		if size < w.MinSize {
+			size = w.MinSize
+		}
+		obj := make([]byte, size)
+		random := size - int(float64(size)*w.Compressible)
+		rng.Read(obj[:random])
+		objs[i] = obj
+	}
+	return objs
+}
+
+// Name describes the workload as benchmark name components
+func (w *Workload) Name() string {
+	return fmt.Sprintf("objects=%d/size=%s-%s/dedup=%g/compressible=%g/concurrency=%d/batch=%d",
+		w.Objects, formatSize(w.MinSize), formatSize(w.MaxSize),
+		w.Dedup, w.Compressible, w.concurrency(), w.batch())
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dk", n>>10)
+	}
+	return fmt.Sprint(n)
+}
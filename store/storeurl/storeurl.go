@@ -0,0 +1,238 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storeurl opens object stores named by URL, so that
+// callers needn't know which backends exist or how to configure
+// them.
+package storeurl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/diskstore"
+	"github.com/nelhage/llama/store/s3store"
+)
+
+// DefaultCacheBytes bounds a disk cache whose size isn't given
+const DefaultCacheBytes = 100 * 1024 * 1024
+
+// Options configures the stores Open returns. Query parameters in
+// the URL override them:
+//
+//	cache=DIR        cache fetched objects in DIR
+//	cache_bytes=N    bound the cache to N bytes
+//	concurrency=N    fetch at most N objects at once
+//	region=REGION    reach S3 in REGION
+//	readonly=BOOL    refuse to write to the store
+type Options struct {
+	// Session is used to reach S3. If it is nil, Open creates
+	// one from the environment.
+	Session *session.Session
+	// Region overrides the session's region
+	Region string
+	// CacheDir, if set, is a directory to cache fetched objects
+	// in, of at most CacheBytes, or DefaultCacheBytes if that is
+	// zero. Only S3 stores cache; others ignore it, but
+	// reject a cache given in their URL.
+	CacheDir   string
+	CacheBytes uint64
+	// Concurrency bounds the number of objects an S3 store
+	// fetches at once
+	Concurrency int
+	// DisableHeadCheck skips checking whether an object is
+	// already stored before uploading it
+	DisableHeadCheck bool
+	// ReadOnly wraps the store in a store.ReadOnly
+	ReadOnly bool
+}
+
+type opener func(ctx context.Context, u *url.URL, opts *Options) (store.Store, error)
+
+var schemes = map[string]opener{
+	"s3":   openS3,
+	"file": openFile,
+	"mem":  openMem,
+}
+
+// Schemes returns the URL schemes Open supports
+func Schemes() []string {
+	var out []string
+	for s := range schemes {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Open opens the store at `rawurl`:
+//
+//	s3://BUCKET/PATH  objects under PATH in an S3 bucket
+//	file:///DIR       a diskstore in DIR
+//	mem://[NAME]      an in-memory store, for tests. Stores opened
+//	                  with the same NAME share their objects.
+//
+// Stores are wrapped with store.Traced, and then with any wrappers
+// the options call for.
+func Open(ctx context.Context, rawurl string, opts Options) (store.Store, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("parsing object store %q: %w", rawurl, err)
+	}
+	open, ok := schemes[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("object store %q: unsupported scheme %q: want one of %s",
+			rawurl, u.Scheme, strings.Join(Schemes(), ", "))
+	}
+	q := u.Query()
+	if q.Get("cache") != "" && u.Scheme != "s3" {
+		return nil, fmt.Errorf("object store %q: %s:// stores don't support caching", rawurl, u.Scheme)
+	}
+	if err := parseQuery(q, &opts); err != nil {
+		return nil, fmt.Errorf("object store %q: %w", rawurl, err)
+	}
+	u.RawQuery = ""
+	st, err := open(ctx, u, &opts)
+	if err != nil {
+		return nil, fmt.Errorf("object store %q: %w", rawurl, err)
+	}
+	st = store.Traced(st, u.Scheme)
+	if opts.ReadOnly {
+		st = store.NewReadOnly(st)
+	}
+	return st, nil
+}
+
+// OpenFailover opens the stores at `urls`, as Open does, and
+// returns a store.Failover that writes to the first and reads from
+// the others if it is unavailable. The stores must be replicas of
+// one another, such as an S3 bucket and its replica in another
+// region. Only the first caches objects on disk. With a single URL,
+// it is the same as Open.
+func OpenFailover(ctx context.Context, urls []string, opts Options) (store.Store, error) {
+	if len(urls) == 1 {
+		return Open(ctx, urls[0], opts)
+	}
+	var backends []store.Backend
+	for i, rawurl := range urls {
+		if i == 1 {
+			opts.CacheDir = ""
+		}
+		st, err := Open(ctx, rawurl, opts)
+		if err != nil {
+			return nil, err
+		}
+		name := rawurl
+		if u, err := url.Parse(rawurl); err == nil {
+			u.RawQuery = ""
+			name = u.String()
+		}
+		backends = append(backends, store.Backend{Name: name, Store: st})
+	}
+	return store.NewFailover(backends)
+}
+
+func parseQuery(q url.Values, opts *Options) error {
+	for key := range q {
+		val := q.Get(key)
+		var err error
+		switch key {
+		case "cache":
+			opts.CacheDir = val
+		case "cache_bytes":
+			opts.CacheBytes, err = strconv.ParseUint(val, 10, 64)
+		case "concurrency":
+			opts.Concurrency, err = strconv.Atoi(val)
+		case "region":
+			opts.Region = val
+		case "readonly":
+			opts.ReadOnly, err = strconv.ParseBool(val)
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("option %s=%q: %w", key, val, err)
+		}
+	}
+	return nil
+}
+
+func openS3(ctx context.Context, u *url.URL, opts *Options) (store.Store, error) {
+	sess := opts.Session
+	if sess == nil {
+		var err error
+		if sess, err = session.NewSession(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Region != "" {
+		sess = sess.Copy(aws.NewConfig().WithRegion(opts.Region))
+	}
+	s3opts := s3store.Options{
+		DisableHeadCheck: opts.DisableHeadCheck,
+		Concurrency:      opts.Concurrency,
+	}
+	if opts.CacheDir != "" {
+		s3opts.DiskCachePath = opts.CacheDir
+		s3opts.DiskCacheBytes = opts.CacheBytes
+		if s3opts.DiskCacheBytes == 0 {
+			s3opts.DiskCacheBytes = DefaultCacheBytes
+		}
+	}
+	return s3store.FromSessionAndOptions(sess, u.String(), s3opts)
+}
+
+func openFile(ctx context.Context, u *url.URL, opts *Options) (store.Store, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("file:// stores must be local, not on %q", u.Host)
+	}
+	dir := u.Path
+	if u.Opaque != "" {
+		dir = u.Opaque
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("no directory given")
+	}
+	return diskstore.New(dir)
+}
+
+var memStores struct {
+	sync.Mutex
+	byName map[string]store.Store
+}
+
+func openMem(ctx context.Context, u *url.URL, opts *Options) (store.Store, error) {
+	if u.Host == "" {
+		return store.InMemory(), nil
+	}
+	memStores.Lock()
+	defer memStores.Unlock()
+	if memStores.byName == nil {
+		memStores.byName = make(map[string]store.Store)
+	}
+	st, ok := memStores.byName[u.Host]
+	if !ok {
+		st = store.InMemory()
+		memStores.byName[u.Host] = st
+	}
+	return st, nil
+}
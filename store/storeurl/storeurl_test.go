@@ -0,0 +1,139 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storeurl_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nelhage/llama/store"
+	"github.com/nelhage/llama/store/storebench"
+	"github.com/nelhage/llama/store/storeurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func roundTrip(t *testing.T, st store.Store) string {
+	ctx := context.Background()
+	id, err := st.Store(ctx, []byte("hello"))
+	require.NoError(t, err)
+	got, err := store.Get(ctx, st, id)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+	return id
+}
+
+func TestOpen_Mem(t *testing.T) {
+	ctx := context.Background()
+	a, err := storeurl.Open(ctx, "mem://shared", storeurl.Options{})
+	require.NoError(t, err)
+	id := roundTrip(t, a)
+
+	b, err := storeurl.Open(ctx, "mem://shared", storeurl.Options{})
+	require.NoError(t, err)
+	_, err = store.Get(ctx, b, id)
+	assert.NoError(t, err, "same name shares objects")
+
+	c, err := storeurl.Open(ctx, "mem://", storeurl.Options{})
+	require.NoError(t, err)
+	_, err = store.Get(ctx, c, id)
+	assert.True(t, errors.Is(err, store.ErrNotExists))
+}
+
+func TestOpen_File(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "storeurl")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st, err := storeurl.Open(ctx, "file://"+dir, storeurl.Options{})
+	require.NoError(t, err)
+	id := roundTrip(t, st)
+	_, ok := store.AsKeyed(st)
+	assert.True(t, ok)
+
+	ro, err := storeurl.Open(ctx, "file://"+dir+"?readonly=true", storeurl.Options{})
+	require.NoError(t, err)
+	_, err = store.Get(ctx, ro, id)
+	assert.NoError(t, err)
+	_, err = ro.Store(ctx, []byte("new"))
+	assert.Equal(t, store.ErrReadOnly, err)
+
+	_, err = storeurl.Open(ctx, "file://"+dir+"?cache=/tmp", storeurl.Options{})
+	assert.Error(t, err)
+	_, err = storeurl.Open(ctx, "file://"+dir, storeurl.Options{CacheDir: "/tmp"})
+	assert.NoError(t, err, "caching is only an error if the URL asks for it")
+	_, err = storeurl.Open(ctx, "file://elsewhere/"+dir, storeurl.Options{})
+	assert.Error(t, err)
+}
+
+func TestOpen_S3(t *testing.T) {
+	fake := storebench.NewFakeS3()
+	defer fake.Close()
+	dir, err := ioutil.TempDir("", "storeurl-cache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	st, err := storeurl.Open(ctx, "s3://bucket/objects?cache="+dir+"&concurrency=4",
+		storeurl.Options{Session: fake.Session()})
+	require.NoError(t, err)
+	id := roundTrip(t, st)
+	_, err = store.Get(ctx, st, id)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, store.Concurrency(st))
+	stats, ok := store.GetCacheStats(st)
+	require.True(t, ok)
+	assert.NotZero(t, stats.DiskHits)
+}
+
+func TestOpen_Errors(t *testing.T) {
+	ctx := context.Background()
+	_, err := storeurl.Open(ctx, "gs://bucket", storeurl.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "want one of file, mem, s3")
+
+	_, err = storeurl.Open(ctx, "mem://?bogus=1", storeurl.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown option "bogus"`)
+
+	_, err = storeurl.Open(ctx, "mem://?readonly=maybe", storeurl.Options{})
+	assert.Error(t, err)
+}
+
+func TestOpenFailover(t *testing.T) {
+	ctx := context.Background()
+	st, err := storeurl.OpenFailover(ctx, []string{"mem://primary", "mem://replica?readonly=true"}, storeurl.Options{})
+	require.NoError(t, err)
+	f, ok := st.(*store.Failover)
+	require.True(t, ok)
+
+	id := roundTrip(t, f)
+	replica, err := storeurl.Open(ctx, "mem://replica", storeurl.Options{})
+	require.NoError(t, err)
+	_, err = store.Get(ctx, replica, id)
+	assert.True(t, errors.Is(err, store.ErrNotExists), "writes go to the primary")
+
+	gets := []store.GetRequest{{Id: id}}
+	f.GetObjects(ctx, gets)
+	assert.Equal(t, "mem://primary", gets[0].Source)
+
+	_, err = storeurl.OpenFailover(ctx, []string{"mem://a", "gs://b"}, storeurl.Options{})
+	assert.Error(t, err)
+}
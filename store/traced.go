@@ -0,0 +1,142 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/tracing"
+)
+
+// Traced wraps `inner` so that each of its operations is traced
+// the same way, whatever the backend. Every operation gets a span
+// with a `backend` label; GetObjects and Store also report object
+// IDs, bytes moved, and cache hits. Backends may add their own
+// fields to these spans with tracing.AddField and
+// tracing.SetMetric.
+//
+// The wrapper implements Identifier and Checker only if `inner`
+// does.
+func Traced(inner Store, backend string) Store {
+	t := &tracedStore{inner: inner, backend: backend}
+	ids, isIdentifier := inner.(Identifier)
+	_, isChecker := inner.(Checker)
+	switch {
+	case isIdentifier && isChecker:
+		return &struct {
+			*tracedStore
+			Identifier
+			tracedChecker
+		}{t, ids, tracedChecker{t}}
+	case isIdentifier:
+		return &struct {
+			*tracedStore
+			Identifier
+		}{t, ids}
+	case isChecker:
+		return &struct {
+			*tracedStore
+			tracedChecker
+		}{t, tracedChecker{t}}
+	default:
+		return t
+	}
+}
+
+type tracedStore struct {
+	inner   Store
+	backend string
+}
+
+func (t *tracedStore) Store(ctx context.Context, obj []byte) (id string, err error) {
+	err = tracing.Trace(ctx, "store.put", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		span.SetLabel("backend", t.backend)
+		span.SetMetric("bytes", float64(len(obj)))
+		id, err = t.inner.Store(ctx, obj)
+		if err == nil {
+			span.SetLabel("object_id", id)
+		}
+		return err
+	})
+	return id, err
+}
+
+func (t *tracedStore) GetObjects(ctx context.Context, gets []GetRequest) {
+	tracing.Trace(ctx, "store.get", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		span.SetLabel("backend", t.backend)
+		span.SetMetric("objects", float64(len(gets)))
+		if len(gets) == 1 {
+			span.SetLabel("object_id", gets[0].Id)
+		}
+
+		t.inner.GetObjects(ctx, gets)
+
+		var bytes, cached, errors int
+		var first error
+		for i := range gets {
+			bytes += len(gets[i].Data)
+			if gets[i].Cached {
+				cached++
+			}
+			if gets[i].Err != nil {
+				if first == nil {
+					first = gets[i].Err
+				}
+				errors++
+			}
+		}
+		span.SetMetric("bytes", float64(bytes))
+		span.SetMetric("cached", float64(cached))
+		if len(gets) == 1 {
+			span.AddField("cache_hit", cached == 1)
+		}
+		if errors == 0 {
+			return nil
+		}
+		span.SetMetric("errors", float64(errors))
+		if len(gets) == 1 {
+			return first
+		}
+		return fmt.Errorf("%d of %d objects failed: %w", errors, len(gets), first)
+	})
+}
+
+// Unwrap returns the wrapped store
+func (t *tracedStore) Unwrap() Store {
+	return t.inner
+}
+
+func (t *tracedStore) FetchAWSUsage(u *protocol.StoreUsage) {
+	t.inner.FetchAWSUsage(u)
+}
+
+type tracedChecker struct {
+	t *tracedStore
+}
+
+func (c tracedChecker) HasObject(ctx context.Context, id string) (ok bool, err error) {
+	err = tracing.Trace(ctx, "store.has", func(ctx context.Context, span *tracing.SpanBuilder) error {
+		span.SetLabel("backend", c.t.backend)
+		span.SetLabel("object_id", id)
+		ok, err = c.t.inner.(Checker).HasObject(ctx, id)
+		if err == nil {
+			span.AddField("exists", ok)
+		}
+		return err
+	})
+	return ok, err
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nelhage/llama/protocol"
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bareStore hides the optional interfaces of the store it wraps
+type bareStore struct{ inner Store }
+
+func (b bareStore) Store(ctx context.Context, obj []byte) (string, error) {
+	return b.inner.Store(ctx, obj)
+}
+func (b bareStore) GetObjects(ctx context.Context, gets []GetRequest) { b.inner.GetObjects(ctx, gets) }
+func (b bareStore) FetchAWSUsage(u *protocol.StoreUsage)              {}
+
+func TestTraced(t *testing.T) {
+	st := Traced(InMemory(), "memory")
+	_, ok := st.(Identifier)
+	assert.True(t, ok, "Identifier")
+	_, ok = st.(Checker)
+	assert.True(t, ok, "Checker")
+
+	bare := Traced(bareStore{InMemory()}, "bare")
+	_, ok = bare.(Identifier)
+	assert.False(t, ok, "Identifier")
+	_, ok = bare.(Checker)
+	assert.False(t, ok, "Checker")
+
+	var id string
+	spans, err := tracing.CollectSpans(context.Background(), func(ctx context.Context) error {
+		var err error
+		id, err = st.Store(ctx, []byte("hello"))
+		if err != nil {
+			return err
+		}
+		gets := []GetRequest{{Id: id}, {Id: "missing"}}
+		st.GetObjects(ctx, gets)
+		_, err = Get(ctx, st, id)
+		return err
+	})
+	require.NoError(t, err)
+	require.Len(t, spans, 3)
+
+	put, getMany, getOne := spans[0], spans[1], spans[2]
+	assert.Equal(t, "store.put", put.Name)
+	assert.Equal(t, map[string]interface{}{"backend": "memory", "object_id": id}, put.Fields)
+	assert.Equal(t, map[string]float64{"bytes": 5}, put.Metrics)
+
+	assert.Equal(t, "store.get", getMany.Name)
+	assert.Equal(t, map[string]interface{}{
+		"backend":          "memory",
+		tracing.ErrorField: "1 of 2 objects failed: missing: " + ErrNotExists.Error(),
+	}, getMany.Fields)
+	assert.Equal(t, map[string]float64{"objects": 2, "bytes": 5, "cached": 0, "errors": 1}, getMany.Metrics)
+
+	assert.Equal(t, map[string]interface{}{"backend": "memory", "object_id": id, "cache_hit": false}, getOne.Fields)
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/nelhage/llama/tracing"
+)
+
+// ErrNotKeyed is returned by PutTrace and GetTrace if the store
+// can't store data under keys
+var ErrNotKeyed = errors.New("store does not support keyed objects")
+
+// TraceKey returns the key the spans of job `jobID` are persisted
+// under
+func TraceKey(jobID string) string {
+	return "traces/" + jobID + ".json"
+}
+
+// PutTrace persists `spans` under TraceKey(jobID), as
+// newline-delimited JSON, the format of `llama -trace` files.
+func PutTrace(ctx context.Context, st Store, jobID string, spans []tracing.Span) error {
+	ks, ok := AsKeyed(st)
+	if !ok {
+		return ErrNotKeyed
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range spans {
+		if err := enc.Encode(&spans[i]); err != nil {
+			return err
+		}
+	}
+	return ks.PutKey(ctx, TraceKey(jobID), buf.Bytes())
+}
+
+// GetTrace fetches the spans persisted for job `jobID`
+func GetTrace(ctx context.Context, st Store, jobID string) ([]tracing.Span, error) {
+	ks, ok := AsKeyed(st)
+	if !ok {
+		return nil, ErrNotKeyed
+	}
+	data, err := ks.GetKey(ctx, TraceKey(jobID))
+	if err != nil {
+		return nil, err
+	}
+	var spans []tracing.Span
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var span tracing.Span
+		err := dec.Decode(&span)
+		if err == io.EOF {
+			return spans, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding trace: %w", err)
+		}
+		spans = append(spans, span)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nelhage/llama/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraces(t *testing.T) {
+	ctx := context.Background()
+	st := Traced(InMemory(), "memory")
+	start := time.Unix(1600000000, 0).UTC()
+	spans := []tracing.Span{
+		{TraceId: "t", SpanId: "a", Name: "root", Start: start, Duration: time.Second},
+		{TraceId: "t", SpanId: "b", ParentId: "a", Name: "child", Start: start, Duration: time.Millisecond,
+			Fields: map[string]interface{}{"k": "v"}},
+	}
+
+	_, err := GetTrace(ctx, st, "job-1")
+	assert.Equal(t, &NotFoundError{Key: TraceKey("job-1")}, err)
+
+	require.NoError(t, PutTrace(ctx, st, "job-1", spans))
+	got, err := GetTrace(ctx, st, "job-1")
+	require.NoError(t, err)
+	assert.Equal(t, spans, got)
+
+	err = PutTrace(ctx, bareStore{InMemory()}, "job-1", spans)
+	assert.Equal(t, ErrNotKeyed, err)
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/nelhage/llama/internal/humanize"
+)
+
+// DurationMetric is the pseudo-metric under which an Aggregator
+// records each span's duration, in milliseconds.
+const DurationMetric = "duration_ms"
+
+// maxSamples bounds the samples an Aggregator keeps per metric for
+// computing percentiles. Beyond it, samples are kept by reservoir
+// sampling, so percentiles become estimates; counts, sums, and
+// extremes stay exact.
+const maxSamples = 4096
+
+// MetricKey names an aggregated metric
+type MetricKey struct {
+	Span   string
+	Metric string
+}
+
+// MetricSummary summarizes the values recorded for a metric
+type MetricSummary struct {
+	Count    int
+	Sum      float64
+	Min, Max float64
+	P50, P95 float64
+}
+
+func (s MetricSummary) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+type metricStat struct {
+	count    int
+	sum      float64
+	min, max float64
+	samples  []float64
+}
+
+func (st *metricStat) add(v float64) {
+	if st.count == 0 || v < st.min {
+		st.min = v
+	}
+	if st.count == 0 || v > st.max {
+		st.max = v
+	}
+	st.count++
+	st.sum += v
+	if len(st.samples) < maxSamples {
+		st.samples = append(st.samples, v)
+	} else if i := rand.Intn(st.count); i < maxSamples {
+		st.samples[i] = v
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted `vs`
+func percentile(vs []float64, p float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(vs))))
+	if rank < 1 {
+		rank = 1
+	}
+	return vs[rank-1]
+}
+
+func (st *metricStat) summary() MetricSummary {
+	vs := append([]float64(nil), st.samples...)
+	sort.Float64s(vs)
+	return MetricSummary{
+		Count: st.count,
+		Sum:   st.sum,
+		Min:   st.min,
+		Max:   st.max,
+		P50:   percentile(vs, 50),
+		P95:   percentile(vs, 95),
+	}
+}
+
+// Aggregator is a Tracer that accumulates the metrics of the spans
+// submitted to it, keyed by span name and metric name, along with
+// each span's duration as DurationMetric.
+type Aggregator struct {
+	mu    sync.Mutex
+	stats map[MetricKey]*metricStat
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{stats: make(map[MetricKey]*metricStat)}
+}
+
+func (a *Aggregator) record(key MetricKey, v float64) {
+	st, ok := a.stats[key]
+	if !ok {
+		st = &metricStat{}
+		a.stats[key] = st
+	}
+	st.add(v)
+}
+
+func (a *Aggregator) Submit(span *Span) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.record(MetricKey{span.Name, DurationMetric}, float64(span.Duration.Nanoseconds())/1e6)
+	for k, v := range span.Metrics {
+		a.record(MetricKey{span.Name, k}, v)
+	}
+}
+
+// Snapshot summarizes the metrics recorded so far
+func (a *Aggregator) Snapshot() map[MetricKey]MetricSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[MetricKey]MetricSummary, len(a.stats))
+	for k, st := range a.stats {
+		out[k] = st.summary()
+	}
+	return out
+}
+
+func formatMetric(metric string, v float64) string {
+	switch {
+	case strings.HasSuffix(metric, "bytes"):
+		return humanize.Bytes(v)
+	case strings.HasSuffix(metric, "_ms"):
+		return fmt.Sprintf("%.1fms", v)
+	case v == math.Trunc(v):
+		return fmt.Sprintf("%.0f", v)
+	default:
+		return fmt.Sprintf("%.3g", v)
+	}
+}
+
+// WriteSummary writes a human-readable table of `snap`, sorted by
+// span and metric name.
+func WriteSummary(w io.Writer, snap map[MetricKey]MetricSummary) error {
+	keys := make([]MetricKey, 0, len(snap))
+	for k := range snap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Span != keys[j].Span {
+			return keys[i].Span < keys[j].Span
+		}
+		return keys[i].Metric < keys[j].Metric
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "span\tmetric\tcount\ttotal\tp50\tp95\tmax\t")
+	for _, k := range keys {
+		s := snap[k]
+		total := formatMetric(k.Metric, s.Sum)
+		if k.Metric == DurationMetric {
+			total = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t\n",
+			k.Span, k.Metric, s.Count, total,
+			formatMetric(k.Metric, s.P50),
+			formatMetric(k.Metric, s.P95),
+			formatMetric(k.Metric, s.Max),
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregator(t *testing.T) {
+	agg := NewAggregator()
+	for i := 1; i <= 20; i++ {
+		agg.Submit(&Span{
+			Name:     "s3.get_one",
+			Duration: time.Duration(i) * time.Millisecond,
+			Metrics:  map[string]float64{"s3.read_bytes": 1024},
+		})
+	}
+	agg.Submit(&Span{
+		Name:     "s3.store",
+		Duration: 5 * time.Millisecond,
+		Metrics:  map[string]float64{"s3.write_bytes": 3 << 20},
+	})
+
+	snap := agg.Snapshot()
+	assert.Len(t, snap, 4)
+	assert.Equal(t, MetricSummary{
+		Count: 20, Sum: 210, Min: 1, Max: 20, P50: 10, P95: 19,
+	}, snap[MetricKey{"s3.get_one", DurationMetric}])
+	assert.Equal(t, MetricSummary{
+		Count: 20, Sum: 20 * 1024, Min: 1024, Max: 1024, P50: 1024, P95: 1024,
+	}, snap[MetricKey{"s3.get_one", "s3.read_bytes"}])
+	assert.Equal(t, 10.5, snap[MetricKey{"s3.get_one", DurationMetric}].Mean())
+	assert.Equal(t, 1, snap[MetricKey{"s3.store", "s3.write_bytes"}].Count)
+
+	var buf bytes.Buffer
+	assert.NoError(t, WriteSummary(&buf, snap))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 5)
+	assert.Regexp(t, `s3.get_one\s+s3.read_bytes\s+20\s+20.0KiB\s+1.0KiB\s+1.0KiB\s+1.0KiB`, lines[2])
+	assert.Regexp(t, `s3.store\s+s3.write_bytes\s+1\s+3.0MiB`, lines[4])
+}
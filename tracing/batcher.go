@@ -0,0 +1,138 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batcher queues spans and hands them to `export` in batches, from
+// a goroutine of its own. It backs the exporters that send spans
+// over the network: Submit never blocks, and spans submitted while
+// the queue is full are dropped and counted.
+type batcher struct {
+	export   func([]Span) error
+	size     int
+	interval time.Duration
+
+	ch      chan Span
+	flush   chan chan struct{}
+	done    chan struct{}
+	close   sync.Once
+	dropped uint64
+
+	mu  sync.Mutex
+	err error
+}
+
+func newBatcher(queue, size int, interval time.Duration, export func([]Span) error) *batcher {
+	b := &batcher{
+		export:   export,
+		size:     size,
+		interval: interval,
+		ch:       make(chan Span, queue),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) Submit(span *Span) {
+	select {
+	case b.ch <- *span:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+// Dropped returns the number of spans discarded because the queue
+// was full
+func (b *batcher) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Flush blocks until every span submitted so far has been exported
+// or has failed to be.
+func (b *batcher) Flush() {
+	ack := make(chan struct{})
+	select {
+	case b.flush <- ack:
+		<-ack
+	case <-b.done:
+	}
+}
+
+// Close flushes queued spans and stops the exporter. It returns the
+// first export error, if any. Spans submitted after Close are
+// dropped.
+func (b *batcher) Close() error {
+	b.close.Do(func() {
+		b.Flush()
+		close(b.done)
+	})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func (b *batcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	batch := make([]Span, 0, b.size)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.export(batch); err != nil {
+			b.mu.Lock()
+			if b.err == nil {
+				b.err = err
+			}
+			b.mu.Unlock()
+		}
+		batch = batch[:0]
+	}
+	add := func(span Span) {
+		batch = append(batch, span)
+		if len(batch) >= b.size {
+			send()
+		}
+	}
+	for {
+		select {
+		case span := <-b.ch:
+			add(span)
+		case <-ticker.C:
+			send()
+		case ack := <-b.flush:
+		drain:
+			for {
+				select {
+				case span := <-b.ch:
+					add(span)
+				default:
+					break drain
+				}
+			}
+			send()
+			close(ack)
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChromeTracer collects spans in memory and, on Close, writes them
+// out in the Chrome trace-event format, for chrome://tracing or
+// Perfetto.
+type ChromeTracer struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	spans []Span
+}
+
+func NewChromeTracer(w io.Writer) *ChromeTracer {
+	return &ChromeTracer{w: w}
+}
+
+func (ct *ChromeTracer) Submit(span *Span) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.spans = append(ct.spans, *span)
+}
+
+// Close writes out the spans collected so far, and closes the
+// underlying writer if it is an io.Closer.
+func (ct *ChromeTracer) Close() error {
+	ct.mu.Lock()
+	err := WriteChromeTrace(ct.w, ct.spans)
+	ct.mu.Unlock()
+	if cl, ok := ct.w.(io.Closer); ok {
+		if cerr := cl.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type chromeEvent struct {
+	Name string                 `json:"name,omitempty"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+
+	// for sorting
+	depth int
+}
+
+type chromeFile struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// chromeLane is one track of the output. Its stack holds the spans
+// open at the point we have laid out up to; a span can only be
+// placed in a lane if it nests inside the top of the stack.
+type chromeLane struct {
+	tid   int
+	stack []*Span
+}
+
+func spanEnd(s *Span) time.Time {
+	return s.Start.Add(s.Duration)
+}
+
+// pop closes the spans that ended before `t`
+func (l *chromeLane) pop(t time.Time) {
+	for len(l.stack) > 0 && !spanEnd(l.stack[len(l.stack)-1]).After(t) {
+		l.stack = l.stack[:len(l.stack)-1]
+	}
+}
+
+func (l *chromeLane) fits(span, parent *Span) bool {
+	l.pop(span.Start)
+	if parent == nil {
+		return len(l.stack) == 0
+	}
+	if len(l.stack) == 0 {
+		return false
+	}
+	top := l.stack[len(l.stack)-1]
+	return top == parent && !spanEnd(span).After(spanEnd(parent))
+}
+
+// WriteChromeTrace writes `spans` as a Chrome trace-event JSON file.
+// Each span becomes a begin/end pair. Spans are laid out on tracks
+// so that each nests inside its parent where possible; a span that
+// overlaps its siblings, as concurrent operations do, gets a track
+// of its own. Fields and metrics become the events' args.
+func WriteChromeTrace(w io.Writer, spans []Span) error {
+	sorted := make([]*Span, len(spans))
+	byID := make(map[string]*Span, len(spans))
+	for i := range spans {
+		sorted[i] = &spans[i]
+		byID[spans[i].SpanId] = &spans[i]
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Start.Equal(sorted[j].Start) {
+			return sorted[i].Start.Before(sorted[j].Start)
+		}
+		return sorted[i].Duration > sorted[j].Duration
+	})
+	var start time.Time
+	if len(sorted) > 0 {
+		start = sorted[0].Start
+	}
+	ts := func(t time.Time) float64 {
+		return float64(t.Sub(start).Nanoseconds()) / 1e3
+	}
+
+	var lanes []*chromeLane
+	laneOf := make(map[*Span]*chromeLane, len(sorted))
+	out := chromeFile{DisplayTimeUnit: "ms"}
+	for _, span := range sorted {
+		parent := byID[span.ParentId]
+		var lane *chromeLane
+		if pl := laneOf[parent]; parent != nil && pl != nil && pl.fits(span, parent) {
+			lane = pl
+		} else {
+			for _, l := range lanes {
+				if l.fits(span, nil) {
+					lane = l
+					break
+				}
+			}
+		}
+		if lane == nil {
+			lane = &chromeLane{tid: len(lanes) + 1}
+			lanes = append(lanes, lane)
+			out.TraceEvents = append(out.TraceEvents, chromeEvent{
+				Name: "thread_name",
+				Ph:   "M",
+				Pid:  1,
+				Tid:  lane.tid,
+				Args: map[string]interface{}{"name": span.Name},
+				// Metadata sorts first
+				depth: -1,
+			})
+		}
+		lane.stack = append(lane.stack, span)
+		laneOf[span] = lane
+
+		args := make(map[string]interface{}, len(span.Fields)+len(span.Metrics)+1)
+		for k, v := range span.Fields {
+			args[k] = v
+		}
+		for k, v := range span.Metrics {
+			args[k] = v
+		}
+		args["span_id"] = span.SpanId
+		depth := len(lane.stack)
+		out.TraceEvents = append(out.TraceEvents,
+			chromeEvent{
+				Name: span.Name, Cat: "llama", Ph: "B", Pid: 1, Tid: lane.tid,
+				Ts: ts(span.Start), Args: args, depth: depth,
+			},
+			chromeEvent{
+				Name: span.Name, Cat: "llama", Ph: "E", Pid: 1, Tid: lane.tid,
+				Ts: ts(spanEnd(span)), depth: depth,
+			})
+	}
+
+	// Order events so that, at equal timestamps, ends come
+	// before begins, parents begin before their children, and
+	// children end before their parents.
+	sort.SliceStable(out.TraceEvents, func(i, j int) bool {
+		a, b := &out.TraceEvents[i], &out.TraceEvents[j]
+		if a.Ts != b.Ts {
+			return a.Ts < b.Ts
+		}
+		if a.Ph != b.Ph {
+			return chromePhaseOrder[a.Ph] < chromePhaseOrder[b.Ph]
+		}
+		if a.Ph == "E" {
+			return a.depth > b.depth
+		}
+		return a.depth < b.depth
+	})
+	return json.NewEncoder(w).Encode(&out)
+}
+
+var chromePhaseOrder = map[string]int{"M": 0, "E": 1, "B": 2}
@@ -0,0 +1,93 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteChromeTrace(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	span := func(id, parent string, start, dur int) Span {
+		return Span{
+			TraceId:  "t",
+			SpanId:   id,
+			ParentId: parent,
+			Name:     "span-" + id,
+			Start:    t0.Add(time.Duration(start) * time.Millisecond),
+			Duration: time.Duration(dur) * time.Millisecond,
+		}
+	}
+	root := span("root", "", 0, 100)
+	root.Fields = map[string]interface{}{"function": "llama"}
+	a := span("a", "root", 10, 40)
+	a.Metrics = map[string]float64{"bytes": 42}
+	b := span("b", "root", 20, 40)
+	aa := span("aa", "a", 15, 15)
+	other := span("other", "", 200, 10)
+
+	var buf bytes.Buffer
+	ct := NewChromeTracer(&buf)
+	for _, sp := range []Span{aa, a, b, root, other} {
+		ct.Submit(&sp)
+	}
+	require.NoError(t, ct.Close())
+
+	var out struct {
+		TraceEvents []struct {
+			Name string                 `json:"name"`
+			Ph   string                 `json:"ph"`
+			Ts   float64                `json:"ts"`
+			Tid  int                    `json:"tid"`
+			Args map[string]interface{} `json:"args"`
+		} `json:"traceEvents"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+
+	tids := make(map[string]int)
+	stacks := make(map[int][]string)
+	for _, ev := range out.TraceEvents {
+		switch ev.Ph {
+		case "B":
+			tids[ev.Name] = ev.Tid
+			stacks[ev.Tid] = append(stacks[ev.Tid], ev.Name)
+			if ev.Name == "span-a" {
+				assert.Equal(t, 42.0, ev.Args["bytes"])
+			}
+			if ev.Name == "span-root" {
+				assert.Equal(t, "llama", ev.Args["function"])
+				assert.Equal(t, 0.0, ev.Ts)
+			}
+		case "E":
+			st := stacks[ev.Tid]
+			require.NotEmpty(t, st, "unbalanced end of %s", ev.Name)
+			assert.Equal(t, st[len(st)-1], ev.Name, "improperly nested end")
+			stacks[ev.Tid] = st[:len(st)-1]
+		}
+	}
+	for tid, st := range stacks {
+		assert.Empty(t, st, "unclosed spans on track %d", tid)
+	}
+	assert.Equal(t, tids["span-root"], tids["span-a"])
+	assert.Equal(t, tids["span-a"], tids["span-aa"])
+	assert.NotEqual(t, tids["span-root"], tids["span-b"])
+	assert.Equal(t, tids["span-root"], tids["span-other"])
+}
@@ -17,8 +17,11 @@ package tracing
 import (
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	mathrand "math/rand"
+	"sync"
 	"time"
 )
 
@@ -33,6 +36,15 @@ func WithTracer(ctx context.Context, tr Tracer) context.Context {
 	return context.WithValue(ctx, tracerKey, tr)
 }
 
+// AddTracer returns a context whose spans are also submitted to
+// `tr`, in addition to any tracer `ctx` already has.
+func AddTracer(ctx context.Context, tr Tracer) context.Context {
+	if prev, ok := TracerFromContext(ctx); ok {
+		return WithTracer(ctx, Multi(prev, tr))
+	}
+	return WithTracer(ctx, tr)
+}
+
 func TracerFromContext(ctx context.Context) (Tracer, bool) {
 	v, ok := ctx.Value(tracerKey).(Tracer)
 	return v, ok
@@ -47,9 +59,24 @@ func SpanFromContext(ctx context.Context) (*Span, bool) {
 	return v, ok
 }
 
+// AddField records a field on the span active in `ctx`, if any.
+// Like SpanBuilder.AddField, it must not race with the span ending.
+func AddField(ctx context.Context, name string, v interface{}) {
+	if span, ok := SpanFromContext(ctx); ok {
+		span.addField(name, v)
+	}
+}
+
+// SetMetric records a metric on the span active in `ctx`, if any
+func SetMetric(ctx context.Context, name string, v float64) {
+	if span, ok := SpanFromContext(ctx); ok {
+		span.setMetric(name, v)
+	}
+}
+
 func PropagationFromContext(ctx context.Context) *Propagation {
 	span, ok := SpanFromContext(ctx)
-	if !ok {
+	if !ok || !span.sampling.isSampled() {
 		return nil
 	}
 	return &Propagation{
@@ -58,12 +85,22 @@ func PropagationFromContext(ctx context.Context) *Propagation {
 	}
 }
 
+// StartSpan starts a span, as a child of the span in `ctx` if
+// there is one. If `ctx` has neither a span nor a tracer, tracing
+// is disabled, and StartSpan returns `ctx` unchanged and a shared
+// no-op span without allocating.
 func StartSpan(ctx context.Context, name string) (context.Context, *SpanBuilder) {
 	parent, ok := SpanFromContext(ctx)
+	if !ok {
+		if _, ok := TracerFromContext(ctx); !ok {
+			return ctx, noopSpan
+		}
+	}
 	if ok {
-		return StartSpanInTrace(ctx, name, parent.TraceId, parent.SpanId)
+		return startSpan(ctx, name, parent.TraceId, parent.SpanId, parent.sampling)
 	} else {
-		return StartSpanInTrace(ctx, name, newId(), "")
+		sampled := samplerFromContext(ctx).sample(name)
+		return startSpan(ctx, name, newId(), "", newSampling(sampled))
 	}
 }
 
@@ -75,18 +112,24 @@ func StartPropagatedSpan(ctx context.Context, name string, p *Propagation) (cont
 	}
 }
 
+// StartSpanInTrace starts a span in an existing trace. The trace is
+// assumed to be sampled, since its parent was propagated to us.
 func StartSpanInTrace(ctx context.Context, name, trace, parent string) (context.Context, *SpanBuilder) {
-	sb := SpanBuilder{
-		span: Span{
-			SpanId:   newId(),
-			TraceId:  trace,
-			ParentId: parent,
-			Name:     name,
-			Start:    time.Now(),
-		},
+	return startSpan(ctx, name, trace, parent, alwaysSampled)
+}
+
+func startSpan(ctx context.Context, name, trace, parent string, sampling *sampling) (context.Context, *SpanBuilder) {
+	sb := builderPool.Get().(*SpanBuilder)
+	sb.span = Span{
+		SpanId:   newId(),
+		TraceId:  trace,
+		ParentId: parent,
+		Name:     name,
+		Start:    time.Now(),
+		sampling: sampling,
 	}
 	sb.tracer, _ = TracerFromContext(ctx)
-	return WithSpan(ctx, &sb.span), &sb
+	return WithSpan(ctx, &sb.span), sb
 }
 
 func SubmitAll(ctx context.Context, spans []Span) {
@@ -98,10 +141,26 @@ func SubmitAll(ctx context.Context, spans []Span) {
 	}
 }
 
-func newId() string {
+// Span IDs only need to be unique, so we draw them from a fast
+// PRNG, seeded from crypto/rand so that processes don't collide.
+var ids = struct {
+	sync.Mutex
+	rng *mathrand.Rand
+}{rng: mathrand.New(mathrand.NewSource(seed()))}
+
+func seed() int64 {
 	var buf [8]byte
 	if _, err := rand.Reader.Read(buf[:]); err != nil {
 		panic(fmt.Sprintf("rand: %s", err.Error()))
 	}
+	return int64(binary.LittleEndian.Uint64(buf[:]))
+}
+
+func newId() string {
+	var buf [8]byte
+	ids.Lock()
+	v := ids.rng.Uint64()
+	ids.Unlock()
+	binary.LittleEndian.PutUint64(buf[:], v)
 	return hex.EncodeToString(buf[:])
 }
@@ -0,0 +1,289 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for OTLPOptions
+const (
+	DefaultOTLPQueueSize = 2048
+	DefaultOTLPBatchSize = 512
+	DefaultOTLPInterval  = 5 * time.Second
+	DefaultOTLPTimeout   = 10 * time.Second
+)
+
+// OTLPOptions configures an OTLPTracer
+type OTLPOptions struct {
+	// Endpoint is the collector's base URL, such as
+	// http://localhost:4318; spans are POSTed to /v1/traces
+	// under it. If the URL already ends in /v1/traces, it is used
+	// as-is.
+	Endpoint string
+	// Service is reported as the service.name resource attribute
+	Service string
+	// Headers are added to each export request
+	Headers map[string]string
+
+	// Spans are queued and sent in batches of up to BatchSize,
+	// at least every Interval. Spans submitted while QueueSize
+	// spans are already waiting are dropped.
+	QueueSize int
+	BatchSize int
+	Interval  time.Duration
+
+	Client *http.Client
+}
+
+// OTLPTracer exports spans to an OpenTelemetry collector using
+// OTLP/HTTP with JSON encoding. Submit never blocks; Close flushes
+// whatever is still queued and returns the first export error.
+type OTLPTracer struct {
+	*batcher
+	opts OTLPOptions
+	url  string
+}
+
+// NewOTLPTracer starts an exporter for `opts`
+func NewOTLPTracer(opts OTLPOptions) *OTLPTracer {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultOTLPQueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultOTLPBatchSize
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultOTLPInterval
+	}
+	if opts.Service == "" {
+		opts.Service = "llama"
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: DefaultOTLPTimeout}
+	}
+	url := strings.TrimSuffix(opts.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	tr := &OTLPTracer{opts: opts, url: url}
+	tr.batcher = newBatcher(opts.QueueSize, opts.BatchSize, opts.Interval, tr.export)
+	return tr
+}
+
+// Close flushes queued spans and stops the exporter. It also
+// reports spans that were dropped because the queue was full.
+func (tr *OTLPTracer) Close() error {
+	if err := tr.batcher.Close(); err != nil {
+		return err
+	}
+	if n := tr.Dropped(); n > 0 {
+		return fmt.Errorf("otlp: dropped %d spans", n)
+	}
+	return nil
+}
+
+func (tr *OTLPTracer) export(spans []Span) error {
+	body, err := json.Marshal(otlpRequest(tr.opts.Service, spans))
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), "POST", tr.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tr.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := tr.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("otlp: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest. Only the
+// parts we produce are modeled.
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// otlpSpanKindInternal is SPAN_KIND_INTERNAL
+const otlpSpanKindInternal = 1
+
+func otlpRequest(service string, spans []Span) *otlpExport {
+	out := make([]otlpSpan, 0, len(spans))
+	for i := range spans {
+		out = append(out, otlpConvert(&spans[i]))
+	}
+	return &otlpExport{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{otlpAttribute("service.name", service)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/nelhage/llama/tracing"},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+// otlpTraceID widens our 64-bit trace IDs to the 128 bits OTLP
+// requires. The padding is deterministic, so spans submitted by
+// different processes in the same trace still agree.
+func otlpTraceID(id string) string {
+	if len(id) < 32 {
+		return strings.Repeat("0", 32-len(id)) + id
+	}
+	return id
+}
+
+func otlpConvert(span *Span) otlpSpan {
+	out := otlpSpan{
+		TraceID:           otlpTraceID(span.TraceId),
+		SpanID:            span.SpanId,
+		ParentSpanID:      span.ParentId,
+		Name:              span.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.Start.Add(span.Duration).UnixNano(), 10),
+	}
+	for _, k := range sortedKeys(span.Fields) {
+		if kv, ok := otlpField(k, span.Fields[k]); ok {
+			out.Attributes = append(out.Attributes, kv)
+		}
+	}
+	metrics := make([]string, 0, len(span.Metrics))
+	for k := range span.Metrics {
+		metrics = append(metrics, k)
+	}
+	sort.Strings(metrics)
+	for _, k := range metrics {
+		v := span.Metrics[k]
+		out.Attributes = append(out.Attributes, otlpKeyValue{Key: k, Value: otlpValue{DoubleValue: &v}})
+	}
+	return out
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func otlpAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func otlpInt(key string, v int64) otlpKeyValue {
+	s := strconv.FormatInt(v, 10)
+	return otlpKeyValue{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// otlpField converts a span field. Fields that have been through
+// JSON, as remote spans have, arrive as float64s; integral ones are
+// sent as ints.
+func otlpField(key string, v interface{}) (otlpKeyValue, bool) {
+	switch v := v.(type) {
+	case string:
+		return otlpAttribute(key, v), true
+	case bool:
+		return otlpKeyValue{Key: key, Value: otlpValue{BoolValue: &v}}, true
+	case int:
+		return otlpInt(key, int64(v)), true
+	case int32:
+		return otlpInt(key, int64(v)), true
+	case int64:
+		return otlpInt(key, v), true
+	case uint64:
+		return otlpInt(key, int64(v)), true
+	case float64:
+		if v == float64(int64(v)) {
+			return otlpInt(key, int64(v)), true
+		}
+		return otlpKeyValue{Key: key, Value: otlpValue{DoubleValue: &v}}, true
+	case float32:
+		f := float64(v)
+		return otlpKeyValue{Key: key, Value: otlpValue{DoubleValue: &f}}, true
+	case fmt.Stringer:
+		return otlpAttribute(key, v.String()), true
+	case nil:
+		return otlpKeyValue{}, false
+	default:
+		return otlpAttribute(key, fmt.Sprint(v)), true
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPTracer(t *testing.T) {
+	var mu sync.Mutex
+	var got []otlpSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+		body, _ := ioutil.ReadAll(r.Body)
+		var req otlpExport
+		if assert.NoError(t, json.Unmarshal(body, &req)) {
+			mu.Lock()
+			for _, rs := range req.ResourceSpans {
+				assert.Equal(t, "llama", *rs.Resource.Attributes[0].Value.StringValue)
+				for _, ss := range rs.ScopeSpans {
+					got = append(got, ss.Spans...)
+				}
+			}
+			mu.Unlock()
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	tr := NewOTLPTracer(OTLPOptions{
+		Endpoint:  srv.URL,
+		Headers:   map[string]string{"Authorization": "secret"},
+		BatchSize: 2,
+		Interval:  time.Hour,
+	})
+	ctx := WithTracer(context.Background(), tr)
+	ctx, root := StartSpan(ctx, "invoke")
+	root.SetLabel("function", "llama")
+	for i := 0; i < 2; i++ {
+		_, child := StartSpan(ctx, "s3.get")
+		child.SetMetric("bytes", 1.5)
+		child.AddField("objects", 3)
+		child.End()
+	}
+	rootSpan := root.End()
+	require.NoError(t, tr.Close())
+
+	require.Len(t, got, 3)
+	traceID := "0000000000000000" + rootSpan.TraceId
+	for _, sp := range got {
+		assert.Equal(t, traceID, sp.TraceID)
+		if sp.Name == "invoke" {
+			assert.Empty(t, sp.ParentSpanID)
+			assert.Equal(t, []otlpKeyValue{otlpAttribute("function", "llama")}, sp.Attributes)
+			continue
+		}
+		assert.Equal(t, rootSpan.SpanId, sp.ParentSpanID)
+		bytes := 1.5
+		assert.Equal(t, []otlpKeyValue{
+			otlpInt("objects", 3),
+			{Key: "bytes", Value: otlpValue{DoubleValue: &bytes}},
+		}, sp.Attributes)
+	}
+}
+
+func TestOTLPTracer_Drop(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+
+	tr := NewOTLPTracer(OTLPOptions{
+		Endpoint:  srv.URL,
+		QueueSize: 1,
+		BatchSize: 1,
+		Interval:  time.Hour,
+	})
+	for i := 0; i < 10; i++ {
+		tr.Submit(&Span{Name: "span"})
+	}
+	close(block)
+	assert.Error(t, tr.Close())
+	assert.NotZero(t, tr.Dropped())
+}
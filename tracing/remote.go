@@ -0,0 +1,91 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// TrimSpans drops spans until the JSON encoding of `spans` fits in
+// about `maxBytes`. The span `root` is always kept; of the others,
+// the ones that started earliest are dropped first. Spans whose
+// parent was dropped are re-parented to their nearest surviving
+// ancestor, so the trace stays connected. TrimSpans returns the
+// surviving spans, in their original order, and the number
+// dropped.
+func TrimSpans(spans []Span, root string, maxBytes int) ([]Span, int) {
+	sizes := make([]int, len(spans))
+	total := 0
+	for i := range spans {
+		b, _ := json.Marshal(&spans[i])
+		sizes[i] = len(b) + 1
+		total += sizes[i]
+	}
+	if total <= maxBytes {
+		return spans, 0
+	}
+
+	order := make([]int, 0, len(spans))
+	for i := range spans {
+		if spans[i].SpanId != root {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return spans[order[i]].Start.Before(spans[order[j]].Start)
+	})
+	dropped := make(map[string]bool)
+	for _, i := range order {
+		if total <= maxBytes {
+			break
+		}
+		dropped[spans[i].SpanId] = true
+		total -= sizes[i]
+	}
+
+	parents := make(map[string]string, len(spans))
+	for i := range spans {
+		parents[spans[i].SpanId] = spans[i].ParentId
+	}
+	out := make([]Span, 0, len(spans)-len(dropped))
+	for _, span := range spans {
+		if dropped[span.SpanId] {
+			continue
+		}
+		for dropped[span.ParentId] {
+			span.ParentId = parents[span.ParentId]
+		}
+		out = append(out, span)
+	}
+	return out, len(dropped)
+}
+
+// Reparent moves `spans`, received from another process, into
+// trace `trace` under the span `parent`. Spans whose parent isn't
+// among `spans` become children of `parent`; the rest keep their
+// structure.
+func Reparent(spans []Span, trace, parent string) {
+	ids := make(map[string]bool, len(spans))
+	for i := range spans {
+		ids[spans[i].SpanId] = true
+	}
+	for i := range spans {
+		spans[i].TraceId = trace
+		if !ids[spans[i].ParentId] {
+			spans[i].ParentId = parent
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimSpans(t *testing.T) {
+	t0 := time.Unix(1600000000, 0)
+	// root -> a -> a1, a2; root -> b
+	spans := []Span{
+		{SpanId: "a1", ParentId: "a", Start: t0.Add(2 * time.Second)},
+		{SpanId: "a2", ParentId: "a", Start: t0.Add(3 * time.Second)},
+		{SpanId: "a", ParentId: "root", Start: t0.Add(1 * time.Second)},
+		{SpanId: "b", ParentId: "root", Start: t0.Add(4 * time.Second)},
+		{SpanId: "root", ParentId: "remote", Start: t0},
+	}
+	all, _ := json.Marshal(spans)
+
+	out, dropped := TrimSpans(spans, "root", len(all)+len(spans))
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, spans, out)
+
+	budget := 0
+	for _, i := range []int{1, 3, 4} {
+		b, _ := json.Marshal(&spans[i])
+		budget += len(b) + 1
+	}
+	out, dropped = TrimSpans(spans, "root", budget)
+	assert.Equal(t, 2, dropped)
+	var got []string
+	for _, sp := range out {
+		got = append(got, fmt.Sprintf("%s<-%s", sp.SpanId, sp.ParentId))
+	}
+	assert.Equal(t, []string{"a2<-root", "b<-root", "root<-remote"}, got)
+
+	out, dropped = TrimSpans(spans, "root", 0)
+	assert.Equal(t, 4, dropped)
+	assert.Len(t, out, 1)
+	assert.Equal(t, "root", out[0].SpanId)
+}
+
+func TestReparent(t *testing.T) {
+	spans := []Span{
+		{TraceId: "theirs", SpanId: "child", ParentId: "top"},
+		{TraceId: "theirs", SpanId: "top", ParentId: "unknown"},
+		{TraceId: "theirs", SpanId: "orphan", ParentId: "dropped"},
+	}
+	Reparent(spans, "ours", "invoke")
+	for _, sp := range spans {
+		assert.Equal(t, "ours", sp.TraceId)
+	}
+	assert.Equal(t, "top", spans[0].ParentId)
+	assert.Equal(t, "invoke", spans[1].ParentId)
+	assert.Equal(t, "invoke", spans[2].ParentId)
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrorField is the field that marks a span as failed. Setting it
+// on a span of an unsampled trace upgrades the trace to sampled, so
+// that failures are recorded even at low sample rates. Spans of the
+// trace that had already ended are not recovered, but the span that
+// failed and its ancestors are.
+const ErrorField = "error"
+
+// Sampler makes the head-based sampling decision for each trace
+// started in a context: the decision is made when a root span is
+// started, and inherited by its descendants (including those in
+// other processes, via Propagation). Spans of unsampled traces
+// record no fields and are never submitted.
+type Sampler struct {
+	// Rate is the fraction of traces to sample, from 0 to 1
+	Rate float64
+	// Always lists the names of root spans that are sampled
+	// regardless of Rate
+	Always []string
+}
+
+type samplerKey struct{}
+
+// WithSampler sets the sampler for traces started in `ctx`. Without
+// one, every trace is sampled.
+func WithSampler(ctx context.Context, s *Sampler) context.Context {
+	return context.WithValue(ctx, samplerKey{}, s)
+}
+
+func samplerFromContext(ctx context.Context) *Sampler {
+	s, _ := ctx.Value(samplerKey{}).(*Sampler)
+	return s
+}
+
+// ParseSampler parses a sampling configuration of the form
+// `RATE[,NAME...]`. RATE may be a fraction (0.25), a percentage
+// (25%), or 1-in-N (1/4); the names are root spans that are always
+// sampled.
+func ParseSampler(spec string) (*Sampler, error) {
+	parts := strings.Split(spec, ",")
+	rate, err := parseRate(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("sample rate %q: %w", parts[0], err)
+	}
+	s := &Sampler{Rate: rate}
+	for _, name := range parts[1:] {
+		if name = strings.TrimSpace(name); name != "" {
+			s.Always = append(s.Always, name)
+		}
+	}
+	return s, nil
+}
+
+func parseRate(s string) (float64, error) {
+	var rate float64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "1/"):
+		var n float64
+		n, err = strconv.ParseFloat(s[2:], 64)
+		if err == nil && n <= 0 {
+			return 0, fmt.Errorf("N must be positive")
+		}
+		rate = 1 / n
+	case strings.HasSuffix(s, "%"):
+		rate, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		rate /= 100
+	default:
+		rate, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+func (s *Sampler) sample(name string) bool {
+	if s == nil {
+		return true
+	}
+	for _, n := range s.Always {
+		if n == name {
+			return true
+		}
+	}
+	return s.Rate >= 1 || rand.Float64() < s.Rate
+}
+
+// sampling is a trace's sampling decision, shared by all of its
+// spans in this process
+type sampling struct {
+	sampled int32
+}
+
+var alwaysSampled = &sampling{sampled: 1}
+
+func newSampling(sampled bool) *sampling {
+	if sampled {
+		return alwaysSampled
+	}
+	return &sampling{}
+}
+
+func (s *sampling) isSampled() bool {
+	return s == nil || atomic.LoadInt32(&s.sampled) != 0
+}
+
+func (s *sampling) upgrade() {
+	atomic.StoreInt32(&s.sampled, 1)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSampler(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Sampler
+	}{
+		{"0.25", Sampler{Rate: 0.25}},
+		{"25%", Sampler{Rate: 0.25}},
+		{"1/4", Sampler{Rate: 0.25}},
+		{"0,llama.Invoke, llamacc", Sampler{Rate: 0, Always: []string{"llama.Invoke", "llamacc"}}},
+	} {
+		s, err := ParseSampler(tc.in)
+		if assert.NoError(t, err, tc.in) {
+			assert.Equal(t, tc.want, *s, tc.in)
+		}
+	}
+	for _, bad := range []string{"", "2", "-1%", "1/0", "fast"} {
+		_, err := ParseSampler(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func sampledSpans(t *testing.T, s *Sampler, fn func(ctx context.Context)) []Span {
+	ctx := WithSampler(context.Background(), s)
+	spans, err := CollectSpans(ctx, func(ctx context.Context) error {
+		fn(ctx)
+		return nil
+	})
+	require.NoError(t, err)
+	return spans
+}
+
+func TestSampler(t *testing.T) {
+	never := &Sampler{Rate: 0, Always: []string{"important"}}
+
+	spans := sampledSpans(t, never, func(ctx context.Context) {
+		ctx, root := StartSpan(ctx, "root")
+		assert.False(t, root.WillSubmit())
+		assert.Nil(t, PropagationFromContext(ctx))
+		_, child := StartSpan(ctx, "child")
+		child.AddField("k", "v")
+		child.SetMetric("bytes", 1)
+		child.End()
+		assert.Nil(t, child.End().Fields)
+		root.End()
+	})
+	assert.Empty(t, spans)
+
+	spans = sampledSpans(t, never, func(ctx context.Context) {
+		ctx, root := StartSpan(ctx, "important")
+		_, child := StartSpan(ctx, "child")
+		child.End()
+		root.End()
+	})
+	assert.Len(t, spans, 2)
+
+	spans = sampledSpans(t, &Sampler{Rate: 1}, func(ctx context.Context) {
+		_, root := StartSpan(ctx, "root")
+		root.End()
+	})
+	assert.Len(t, spans, 1)
+}
+
+func TestSampler_UpgradeOnError(t *testing.T) {
+	spans := sampledSpans(t, &Sampler{Rate: 0}, func(ctx context.Context) {
+		ctx, root := StartSpan(ctx, "root")
+		_, ok := StartSpan(ctx, "ok")
+		ok.End()
+		_, failed := StartSpan(ctx, "failed")
+		failed.AddField("attempt", 1)
+		failed.AddField(ErrorField, "boom")
+		failed.End()
+		root.AddField("status", "failed")
+		root.End()
+	})
+	require.Len(t, spans, 2)
+	assert.Equal(t, "failed", spans[0].Name)
+	assert.Equal(t, map[string]interface{}{ErrorField: "boom"}, spans[0].Fields)
+	assert.Equal(t, "root", spans[1].Name)
+	assert.Equal(t, map[string]interface{}{"status": "failed"}, spans[1].Fields)
+}
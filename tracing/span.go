@@ -25,6 +25,11 @@ type Span struct {
 	Start    time.Time              `json:"start"`
 	Duration time.Duration          `json:"duration"`
 	Fields   map[string]interface{} `json:"fields"`
+	// Metrics holds numeric measurements recorded with
+	// SpanBuilder.SetMetric, as distinct from descriptive Fields.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+
+	sampling *sampling
 }
 
 type Propagation struct {
@@ -14,31 +14,139 @@
 
 package tracing
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
 
 type Tracer interface {
 	Submit(span *Span)
 }
 
+// Multi returns a Tracer that submits each span to all of `trs`
+func Multi(trs ...Tracer) Tracer {
+	if len(trs) == 1 {
+		return trs[0]
+	}
+	return multiTracer(trs)
+}
+
+type multiTracer []Tracer
+
+func (m multiTracer) Submit(span *Span) {
+	for _, tr := range m {
+		tr.Submit(span)
+	}
+}
+
 type SpanBuilder struct {
 	tracer Tracer
 	span   Span
+	noop   bool
+}
+
+// noopSpan is returned by StartSpan when tracing is disabled. All
+// of its methods do nothing.
+var noopSpan = &SpanBuilder{noop: true}
+
+// builderPool recycles the spans Trace manages. Spans from
+// StartSpan can't be recycled, since callers may hold on to them.
+var builderPool = sync.Pool{New: func() interface{} { return new(SpanBuilder) }}
+
+func (s *Span) addField(name string, v interface{}) {
+	if !s.sampling.isSampled() {
+		if name != ErrorField {
+			return
+		}
+		s.sampling.upgrade()
+	}
+	if s.Fields == nil {
+		s.Fields = make(map[string]interface{})
+	}
+	s.Fields[name] = v
 }
 
-func (sp *SpanBuilder) ensureFields() {
-	if sp.span.Fields == nil {
-		sp.span.Fields = make(map[string]interface{})
+func (s *Span) setMetric(name string, v float64) {
+	if !s.sampling.isSampled() {
+		return
+	}
+	if s.Metrics == nil {
+		s.Metrics = make(map[string]float64)
 	}
+	s.Metrics[name] = v
 }
 
 func (sp *SpanBuilder) AddField(name string, v interface{}) {
-	sp.ensureFields()
-	sp.span.Fields[name] = v
+	if sp.noop {
+		return
+	}
+	sp.span.addField(name, v)
+}
+
+// SetLabel records a descriptive string field on the span
+func (sp *SpanBuilder) SetLabel(name, value string) {
+	if sp.noop {
+		return
+	}
+	sp.span.addField(name, value)
+}
+
+// SetMetric records a numeric measurement on the span. Exporters
+// that distinguish the two report metrics separately from fields.
+func (sp *SpanBuilder) SetMetric(name string, v float64) {
+	if sp.noop {
+		return
+	}
+	sp.span.setMetric(name, v)
+}
+
+// SetError marks the span as failed with `err`
+func (sp *SpanBuilder) SetError(err error) {
+	sp.AddField(ErrorField, err.Error())
+}
+
+// Trace runs `fn` in a new span, which it ends when `fn` returns.
+// If `fn` returns an error, the span is marked failed with it; if
+// `fn` panics, the span records the panic before it is re-raised.
+//
+// The span is recycled once it has been submitted, so neither it
+// nor the context passed to `fn` may be used to record fields or
+// start spans after `fn` returns.
+func Trace(ctx context.Context, name string, fn func(ctx context.Context, span *SpanBuilder) error) (err error) {
+	ctx, span := StartSpan(ctx, name)
+	defer func() {
+		if v := recover(); v != nil {
+			span.AddField(ErrorField, fmt.Sprintf("panic: %v", v))
+			span.End()
+			panic(v)
+		}
+		if err != nil {
+			span.SetError(err)
+		}
+		span.End()
+		span.release()
+	}()
+	return fn(ctx, span)
+}
+
+func (sp *SpanBuilder) release() {
+	if sp.noop {
+		return
+	}
+	// Tracers copy the spans submitted to them, but the copies
+	// share our maps, so we drop them rather than clearing them.
+	*sp = SpanBuilder{}
+	builderPool.Put(sp)
 }
 
 func (sp *SpanBuilder) End() *Span {
+	if sp.noop {
+		return &sp.span
+	}
 	sp.span.Duration = time.Since(sp.span.Start)
-	if sp.tracer != nil {
+	if sp.tracer != nil && sp.span.sampling.isSampled() {
 		sp.tracer.Submit(&sp.span)
 	}
 	return &sp.span
@@ -52,11 +160,16 @@ func (sp *SpanBuilder) Id() string {
 	return sp.span.SpanId
 }
 
+// WillSubmit reports whether the span will be submitted to a tracer
+// if it ends now
 func (sp *SpanBuilder) WillSubmit() bool {
-	return sp.tracer != nil
+	return sp.tracer != nil && sp.span.sampling.isSampled()
 }
 
 func (sp *SpanBuilder) Propagation() *Propagation {
+	if sp.noop {
+		return nil
+	}
 	return &Propagation{
 		TraceId:  sp.span.TraceId,
 		ParentId: sp.span.SpanId,
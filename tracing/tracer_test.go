@@ -0,0 +1,106 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	boom := errors.New("boom")
+	spans, err := CollectSpans(context.Background(), func(ctx context.Context) error {
+		return Trace(ctx, "outer", func(ctx context.Context, span *SpanBuilder) error {
+			span.SetLabel("k", "v")
+			assert.NoError(t, Trace(ctx, "ok", func(ctx context.Context, span *SpanBuilder) error {
+				return nil
+			}))
+			return Trace(ctx, "failed", func(ctx context.Context, span *SpanBuilder) error {
+				return boom
+			})
+		})
+	})
+	assert.Equal(t, boom, err)
+	require.Len(t, spans, 3)
+	assert.Equal(t, "ok", spans[0].Name)
+	assert.Nil(t, spans[0].Fields)
+	assert.Equal(t, "failed", spans[1].Name)
+	assert.Equal(t, map[string]interface{}{ErrorField: "boom"}, spans[1].Fields)
+	assert.Equal(t, spans[2].SpanId, spans[1].ParentId)
+	assert.Equal(t, map[string]interface{}{"k": "v", ErrorField: "boom"}, spans[2].Fields)
+}
+
+func TestTrace_Panic(t *testing.T) {
+	mt := NewMemoryTracer(context.Background())
+	ctx := WithTracer(context.Background(), mt)
+	assert.PanicsWithValue(t, "oops", func() {
+		Trace(ctx, "panics", func(ctx context.Context, span *SpanBuilder) error {
+			panic("oops")
+		})
+	})
+	spans := mt.Close()
+	require.Len(t, spans, 1)
+	assert.Equal(t, map[string]interface{}{ErrorField: "panic: oops"}, spans[0].Fields)
+}
+
+func TestStartSpanDisabled(t *testing.T) {
+	ctx := context.Background()
+	allocs := testing.AllocsPerRun(100, func() {
+		ctx, span := StartSpan(ctx, "noop")
+		span.AddField("k", 1)
+		span.SetMetric("m", 1)
+		prop := PropagationFromContext(ctx)
+		if prop != nil || span.Propagation() != nil {
+			t.Fatal("disabled span propagated")
+		}
+		span.End()
+	})
+	assert.Zero(t, allocs)
+
+	err := Trace(ctx, "noop", func(ctx context.Context, span *SpanBuilder) error {
+		return errors.New("boom")
+	})
+	assert.EqualError(t, err, "boom")
+	assert.False(t, noopSpan.WillSubmit())
+}
+
+type discardTracer struct{}
+
+func (discardTracer) Submit(*Span) {}
+
+func BenchmarkStartSpanDisabled(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, span := StartSpan(ctx, "bench")
+		span.AddField("i", i)
+		span.End()
+	}
+}
+
+func BenchmarkStartSpanEnabled(b *testing.B) {
+	ctx := WithTracer(context.Background(), discardTracer{})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Trace(ctx, "bench", func(ctx context.Context, span *SpanBuilder) error {
+			span.SetMetric("i", float64(i))
+			return nil
+		})
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/xray"
+	"github.com/aws/aws-sdk-go/service/xray/xrayiface"
+)
+
+// Defaults for XRayOptions
+const (
+	DefaultXRayQueueSize = 2048
+	DefaultXRayBatchSize = 50
+	DefaultXRayInterval  = time.Second
+	// DefaultXRayDaemonAddress is where the X-Ray daemon listens
+	// unless AWS_XRAY_DAEMON_ADDRESS says otherwise
+	DefaultXRayDaemonAddress = "127.0.0.1:2000"
+)
+
+// XRayHeader is a parsed X-Amzn-Trace-Id header, as Lambda passes
+// to functions in _X_AMZN_TRACE_ID.
+type XRayHeader struct {
+	Root    string
+	Parent  string
+	Sampled bool
+}
+
+// ParseXRayHeader parses a header of the form
+// `Root=1-...;Parent=...;Sampled=1`. It reports false if there is
+// no Root.
+func ParseXRayHeader(s string) (XRayHeader, bool) {
+	var h XRayHeader
+	for _, part := range strings.Split(s, ";") {
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			continue
+		}
+		v := part[eq+1:]
+		switch strings.TrimSpace(part[:eq]) {
+		case "Root":
+			h.Root = v
+		case "Parent":
+			h.Parent = v
+		case "Sampled":
+			h.Sampled = v == "1"
+		}
+	}
+	return h, h.Root != ""
+}
+
+// XRaySender delivers segment documents to X-Ray
+type XRaySender interface {
+	Send(docs [][]byte) error
+}
+
+// XRayOptions configures an XRayTracer
+type XRayOptions struct {
+	// Name names the segments for root spans; it is what X-Ray
+	// shows in its service map.
+	Name   string
+	Sender XRaySender
+
+	QueueSize int
+	BatchSize int
+	Interval  time.Duration
+}
+
+// XRayTracer exports spans to AWS X-Ray. Root spans become
+// segments, and other spans become subsegments of their parents.
+// String, boolean, and numeric fields become annotations, and
+// metrics become metadata.
+type XRayTracer struct {
+	*batcher
+	opts XRayOptions
+
+	mu sync.Mutex
+	// traceIDs maps our trace IDs to X-Ray ones
+	traceIDs map[string]string
+}
+
+// NewXRayTracer starts an exporter for `opts`
+func NewXRayTracer(opts XRayOptions) *XRayTracer {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultXRayQueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultXRayBatchSize
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultXRayInterval
+	}
+	if opts.Name == "" {
+		opts.Name = "llama"
+	}
+	tr := &XRayTracer{opts: opts, traceIDs: make(map[string]string)}
+	tr.batcher = newBatcher(opts.QueueSize, opts.BatchSize, opts.Interval, tr.export)
+	return tr
+}
+
+// Attach returns a Tracer that submits spans into the X-Ray trace
+// named by `h`, such as the one Lambda started for an invocation.
+// Spans whose parent is `parent`, which lives outside of X-Ray,
+// become subsegments of h.Parent instead.
+func (tr *XRayTracer) Attach(h XRayHeader, parent string) Tracer {
+	return &xrayAttached{tr: tr, header: h, parent: parent}
+}
+
+type xrayAttached struct {
+	tr     *XRayTracer
+	header XRayHeader
+	parent string
+}
+
+func (a *xrayAttached) Submit(span *Span) {
+	sp := *span
+	sp.TraceId = a.header.Root
+	if sp.ParentId == a.parent {
+		sp.ParentId = a.header.Parent
+	}
+	a.tr.Submit(&sp)
+}
+
+// maxTraceIDs bounds the trace ID map of a long-lived tracer
+const maxTraceIDs = 4096
+
+// traceID returns the X-Ray trace ID for `span`. X-Ray trace IDs
+// embed the trace's start time, which we take from the first span
+// of each trace that we see.
+func (tr *XRayTracer) traceID(span *Span) string {
+	if strings.HasPrefix(span.TraceId, "1-") {
+		return span.TraceId
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if id, ok := tr.traceIDs[span.TraceId]; ok {
+		return id
+	}
+	if len(tr.traceIDs) >= maxTraceIDs {
+		tr.traceIDs = make(map[string]string)
+	}
+	id := fmt.Sprintf("1-%08x-%024s", span.Start.Unix(), span.TraceId)
+	tr.traceIDs[span.TraceId] = id
+	return id
+}
+
+type xraySegment struct {
+	Name        string                            `json:"name"`
+	ID          string                            `json:"id"`
+	TraceID     string                            `json:"trace_id"`
+	ParentID    string                            `json:"parent_id,omitempty"`
+	Type        string                            `json:"type,omitempty"`
+	StartTime   float64                           `json:"start_time"`
+	EndTime     float64                           `json:"end_time"`
+	Annotations map[string]interface{}            `json:"annotations,omitempty"`
+	Metadata    map[string]map[string]interface{} `json:"metadata,omitempty"`
+}
+
+func xrayTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// xrayKey rewrites `k` to the characters X-Ray allows in annotation
+// keys
+func xrayKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, k)
+}
+
+func (tr *XRayTracer) convert(span *Span) *xraySegment {
+	seg := &xraySegment{
+		Name:      span.Name,
+		ID:        span.SpanId,
+		TraceID:   tr.traceID(span),
+		ParentID:  span.ParentId,
+		StartTime: xrayTime(span.Start),
+		EndTime:   xrayTime(span.Start.Add(span.Duration)),
+	}
+	if span.ParentId == "" {
+		seg.Name = tr.opts.Name
+		seg.Annotations = map[string]interface{}{"operation": span.Name}
+	} else {
+		seg.Type = "subsegment"
+	}
+	for k, v := range span.Fields {
+		switch v.(type) {
+		case string, bool, int, int64, float64:
+			if seg.Annotations == nil {
+				seg.Annotations = make(map[string]interface{})
+			}
+			seg.Annotations[xrayKey(k)] = v
+		}
+	}
+	if len(span.Metrics) > 0 {
+		md := make(map[string]interface{}, len(span.Metrics))
+		for k, v := range span.Metrics {
+			md[k] = v
+		}
+		seg.Metadata = map[string]map[string]interface{}{"default": md}
+	}
+	return seg
+}
+
+func (tr *XRayTracer) export(spans []Span) error {
+	docs := make([][]byte, 0, len(spans))
+	for i := range spans {
+		doc, err := json.Marshal(tr.convert(&spans[i]))
+		if err != nil {
+			return fmt.Errorf("xray: %w", err)
+		}
+		docs = append(docs, doc)
+	}
+	return tr.opts.Sender.Send(docs)
+}
+
+// NewXRayDaemonSender returns a sender that sends segments over UDP
+// to the X-Ray daemon at `addr`, which may be in the format of
+// AWS_XRAY_DAEMON_ADDRESS. If `addr` is empty, it is read from the
+// environment.
+func NewXRayDaemonSender(addr string) XRaySender {
+	if addr == "" {
+		addr = os.Getenv("AWS_XRAY_DAEMON_ADDRESS")
+	}
+	// The variable may name separate TCP and UDP addresses, as
+	// "tcp:HOST:PORT udp:HOST:PORT"
+	for _, part := range strings.Fields(addr) {
+		if strings.HasPrefix(part, "udp:") {
+			addr = strings.TrimPrefix(part, "udp:")
+		}
+	}
+	if addr == "" {
+		addr = DefaultXRayDaemonAddress
+	}
+	return &xrayDaemon{addr: addr}
+}
+
+type xrayDaemon struct {
+	addr string
+	conn net.Conn
+}
+
+const xrayDaemonHeader = "{\"format\": \"json\", \"version\": 1}\n"
+
+func (d *xrayDaemon) Send(docs [][]byte) error {
+	if d.conn == nil {
+		conn, err := net.Dial("udp", d.addr)
+		if err != nil {
+			return fmt.Errorf("xray: %w", err)
+		}
+		d.conn = conn
+	}
+	for _, doc := range docs {
+		if _, err := d.conn.Write(append([]byte(xrayDaemonHeader), doc...)); err != nil {
+			return fmt.Errorf("xray: %w", err)
+		}
+	}
+	return nil
+}
+
+// NewXRayAPISender returns a sender that uses the PutTraceSegments
+// API
+func NewXRayAPISender(api xrayiface.XRayAPI) XRaySender {
+	return &xrayAPI{api: api}
+}
+
+type xrayAPI struct {
+	api xrayiface.XRayAPI
+}
+
+func (x *xrayAPI) Send(docs [][]byte) error {
+	var in xray.PutTraceSegmentsInput
+	for _, doc := range docs {
+		in.TraceSegmentDocuments = append(in.TraceSegmentDocuments, aws.String(string(doc)))
+	}
+	out, err := x.api.PutTraceSegments(&in)
+	if err != nil {
+		return fmt.Errorf("xray: %w", err)
+	}
+	if len(out.UnprocessedTraceSegments) > 0 {
+		u := out.UnprocessedTraceSegments[0]
+		return fmt.Errorf("xray: %d segments unprocessed: %s: %s",
+			len(out.UnprocessedTraceSegments), aws.StringValue(u.ErrorCode), aws.StringValue(u.Message))
+	}
+	return nil
+}
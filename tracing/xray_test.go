@@ -0,0 +1,114 @@
+// Copyright 2020 Nelson Elhage
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type xraySink struct {
+	mu   sync.Mutex
+	segs []xraySegment
+}
+
+func (s *xraySink) Send(docs [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, doc := range docs {
+		var seg xraySegment
+		if err := json.Unmarshal(doc, &seg); err != nil {
+			return err
+		}
+		s.segs = append(s.segs, seg)
+	}
+	return nil
+}
+
+func TestParseXRayHeader(t *testing.T) {
+	h, ok := ParseXRayHeader("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	assert.True(t, ok)
+	assert.Equal(t, XRayHeader{
+		Root:    "1-5759e988-bd862e3fe1be46a994272793",
+		Parent:  "53995c3f42cd8ad8",
+		Sampled: true,
+	}, h)
+
+	_, ok = ParseXRayHeader("Parent=53995c3f42cd8ad8")
+	assert.False(t, ok)
+}
+
+func TestXRayTracer(t *testing.T) {
+	var sink xraySink
+	tr := NewXRayTracer(XRayOptions{Sender: &sink, Interval: time.Hour})
+
+	ctx := WithTracer(context.Background(), tr)
+	ctx, root := StartSpan(ctx, "invoke")
+	root.SetLabel("function", "llama")
+	_, child := StartSpan(ctx, "s3.get")
+	child.AddField("s3.exists", true)
+	child.SetMetric("read_bytes", 1024)
+	child.End()
+	rootSpan := root.End()
+	require.NoError(t, tr.Close())
+
+	require.Len(t, sink.segs, 2)
+	sub, seg := sink.segs[0], sink.segs[1]
+
+	assert.Equal(t, "llama", seg.Name)
+	assert.Empty(t, seg.Type)
+	assert.Empty(t, seg.ParentID)
+	assert.Equal(t, map[string]interface{}{"operation": "invoke", "function": "llama"}, seg.Annotations)
+	assert.Regexp(t, "^1-[0-9a-f]{8}-0{8}"+rootSpan.TraceId+"$", seg.TraceID)
+
+	assert.Equal(t, "s3.get", sub.Name)
+	assert.Equal(t, "subsegment", sub.Type)
+	assert.Equal(t, rootSpan.SpanId, sub.ParentID)
+	assert.Equal(t, seg.TraceID, sub.TraceID)
+	assert.Equal(t, map[string]interface{}{"s3_exists": true}, sub.Annotations)
+	assert.Equal(t, map[string]map[string]interface{}{"default": {"read_bytes": 1024.0}}, sub.Metadata)
+	assert.True(t, sub.EndTime >= sub.StartTime)
+}
+
+func TestXRayTracer_Attach(t *testing.T) {
+	var sink xraySink
+	tr := NewXRayTracer(XRayOptions{Sender: &sink, Interval: time.Hour})
+	h := XRayHeader{
+		Root:    "1-5759e988-bd862e3fe1be46a994272793",
+		Parent:  "53995c3f42cd8ad8",
+		Sampled: true,
+	}
+
+	ctx := WithTracer(context.Background(), tr.Attach(h, "0123456789abcdef"))
+	ctx, root := StartSpanInTrace(ctx, "runtime.Execute", "fedcba9876543210", "0123456789abcdef")
+	_, child := StartSpan(ctx, "exec")
+	child.End()
+	rootSpan := root.End()
+	require.NoError(t, tr.Close())
+
+	require.Len(t, sink.segs, 2)
+	for _, seg := range sink.segs {
+		assert.Equal(t, h.Root, seg.TraceID)
+		assert.Equal(t, "subsegment", seg.Type)
+	}
+	assert.Equal(t, rootSpan.SpanId, sink.segs[0].ParentID)
+	assert.Equal(t, h.Parent, sink.segs[1].ParentID)
+}